@@ -0,0 +1,29 @@
+package main
+
+// TypeANY is the QTYPE asking for every record type at a name
+const TypeANY uint16 = 255
+
+// AmplificationConfig limits how much larger than its query a UDP response
+// may get. ANY answers are the classic amplification vector, so a UDP ANY
+// query whose response would be more than MaxANYRatio times the size of the
+// query is answered with an empty truncated response, forcing the client to
+// retry over TCP where its address is verified. 0 disables the limit.
+type AmplificationConfig struct {
+	MaxANYRatio float64 `json:"maxANYRatio"`
+}
+
+// forceTCP reports whether a UDP response must be replaced with a truncated
+// one to make the client retry over TCP.
+func forceTCP(queryResourceRecords []DNSResourceRecord, querySize int, responseSize int) bool {
+	ratio := currentConfig().Amplification.MaxANYRatio
+	if ratio <= 0 || querySize == 0 {
+		return false
+	}
+
+	for _, queryResourceRecord := range queryResourceRecords {
+		if queryResourceRecord.Type == TypeANY && float64(responseSize) > ratio*float64(querySize) {
+			return true
+		}
+	}
+	return false
+}
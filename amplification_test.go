@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLargeANYResponsesMoveToTCP(t *testing.T) {
+	entries := []NameModel{{Name: "small.example.com", Address: "192.0.2.1"}}
+	for i := 1; i <= 8; i++ {
+		entries = append(entries, NameModel{Name: "big.example.com", Address: fmt.Sprintf("192.0.2.%d", i)})
+	}
+	cfg := DefaultConfig()
+	cfg.Amplification.MaxANYRatio = 3
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	useConfig(t, cfg, entries...)
+
+	tests := []struct {
+		name      string
+		queryType uint16
+		udp       bool
+		truncated bool
+	}{
+		{"big.example.com", TypeANY, true, true},
+		{"big.example.com", TypeANY, false, false},
+		{"big.example.com", TypeA, true, false},
+		{"small.example.com", TypeANY, true, false},
+	}
+	for _, test := range tests {
+		response := serve(t, newWriter("192.0.2.1", test.udp), buildQuery(1, 0, test.name, test.queryType))
+		truncated := response.Header.Flags&FlagTruncated != 0
+		if truncated != test.truncated {
+			t.Errorf("%s type %d with UDP %v: TC %v, want %v", test.name, test.queryType, test.udp, truncated, test.truncated)
+		}
+		if truncated && len(response.Answers) != 0 {
+			t.Errorf("%s type %d: the forced TCP retry still carries %d answers", test.name, test.queryType, len(response.Answers))
+		}
+		if !truncated && len(response.Answers) == 0 {
+			t.Errorf("%s type %d with UDP %v got no answers", test.name, test.queryType, test.udp)
+		}
+	}
+}
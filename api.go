@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const redactedValue = "REDACTED"
+
+// requireAPIToken wraps a handler so it only runs for requests carrying the
+// configured API token as "Authorization: Bearer <token>".
+func requireAPIToken(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if currentConfig().APIToken == "" {
+			http.Error(w, "API token not configured", http.StatusForbidden)
+			return
+		}
+
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(currentConfig().APIToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// httpHandlers routes the HTTP API.
+func httpHandlers() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// Changes need the API token and a method a cross-site link or image
+	// can't send
+	mux.HandleFunc("/add-entry", requireAPIToken(allowMethods(handleAddEntry, http.MethodPost)))
+	mux.HandleFunc("/entries", handleListEntries)
+	mux.HandleFunc("/entry", handleGetEntry)
+	mux.HandleFunc("/toggle-entry", requireAPIToken(allowMethods(handleToggleEntry, http.MethodPost)))
+	mux.HandleFunc("/delete-entry", requireAPIToken(allowMethods(handleDeleteEntry, http.MethodPost, http.MethodDelete)))
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/config", requireAPIToken(handleConfig))
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/stats", handleStats)
+	mux.HandleFunc("/export", handleExport)
+	mux.HandleFunc("/query-debug", handleQueryDebug)
+	return mux
+}
+
+// allowMethods wraps a handler so it only runs for the given methods,
+// answering others with 405 Method Not Allowed.
+func allowMethods(handler http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(methods, r.Method) {
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// redactedConfig returns a copy of the config that is safe to show, with
+// secrets replaced.
+func redactedConfig(cfg Config) Config {
+	if cfg.APIToken != "" {
+		cfg.APIToken = redactedValue
+	}
+	if cfg.Redis.Password != "" {
+		cfg.Redis.Password = redactedValue
+	}
+	if cfg.Cookies.Secret != "" {
+		cfg.Cookies.Secret = redactedValue
+	}
+	cfg.TSIGKeys = slices.Clone(cfg.TSIGKeys)
+	for i := range cfg.TSIGKeys {
+		cfg.TSIGKeys[i].Secret = redactedValue
+	}
+	return cfg
+}
+
+// handleConfig returns the effective running config, after the config file
+// and command-line flags were merged, as JSON.
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(redactedConfig(*currentConfig()))
+}
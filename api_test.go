@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestConfigEndpointShowsEffectiveConfig(t *testing.T) {
+	cfg, err := ParseConfig([]string{"-config", writeConfigFile(t, `{"defaultTTL": 60}`), "-ttl", "120"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.APIToken = testToken
+	cfg.TSIGKeys = []TSIGKeyConfig{testKey}
+	loaded := useConfig(t, cfg)
+
+	if w := apiRequest(t, http.MethodGet, "/config", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("/config without the token: status %d, want 401", w.Code)
+	}
+
+	w := apiRequest(t, http.MethodGet, "/config", "", testToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	body := w.Body.String()
+	var shown Config
+	err = json.Unmarshal([]byte(body), &shown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shown.DefaultTTL != 120 {
+		t.Errorf("/config shows defaultTTL %d, want the flag's 120", shown.DefaultTTL)
+	}
+	if strings.Contains(body, testToken) || strings.Contains(body, testKey.Secret) {
+		t.Errorf("/config leaks a secret: %s", body)
+	}
+	if shown.APIToken != redactedValue || shown.TSIGKeys[0].Secret != redactedValue {
+		t.Errorf("secrets shown as %q and %q, want %s", shown.APIToken, shown.TSIGKeys[0].Secret, redactedValue)
+	}
+	if loaded.TSIGKeys[0].Secret != testKey.Secret {
+		t.Error("redacting changed the running config")
+	}
+}
+
+func TestDisabledHTTPServerDoesntListen(t *testing.T) {
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := probe.Addr().String()
+	probe.Close()
+
+	cfg := DefaultConfig()
+	cfg.HTTPAddress = address
+	cfg.DisableHTTP = true
+	listener, err := startHTTPServer(useConfig(t, cfg))
+	if err != nil || listener != nil {
+		t.Fatalf("startHTTPServer = %v, %v, want no listener", listener, err)
+	}
+	conn, err := net.Dial("tcp", address)
+	if err == nil {
+		conn.Close()
+		t.Fatal("something listens on the HTTP address while the server is disabled")
+	}
+
+	cfg.DisableHTTP = false
+	listener, err = startHTTPServer(useConfig(t, cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	response, err := http.Get("http://" + address + "/healthz")
+	if err != nil {
+		t.Fatal("the enabled HTTP server isn't reachable:", err)
+	}
+	response.Body.Close()
+}
+
+func TestHTTPServerBindsToLoopbackByDefault(t *testing.T) {
+	host, _, err := net.SplitHostPort(DefaultConfig().HTTPAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !net.ParseIP(host).IsLoopback() {
+		t.Errorf("default httpAddress %s isn't a loopback address", DefaultConfig().HTTPAddress)
+	}
+}
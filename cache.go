@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
+)
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+	class uint16
+}
+
+type cacheEntry struct {
+	answers     []DNSResourceRecord
+	authorities []DNSResourceRecord
+	rcode       uint16
+	stored      time.Time
+	expires     time.Time
+}
+
+// answerCache holds forwarded answers until their TTL runs out. It holds at
+// most forwarding.cacheEntries answers; when full, expired entries are dropped first and
+// otherwise an arbitrary one.
+type answerCache struct {
+	sync.Mutex
+	entries map[cacheKey]*cacheEntry
+
+	// hits and misses count Get calls, for /stats and /metrics
+	hits   uint64
+	misses uint64
+}
+
+var forwardCache = &answerCache{entries: make(map[cacheKey]*cacheEntry)}
+
+func newCacheKey(question DNSResourceRecord) cacheKey {
+	return cacheKey{
+		name:  strings.ToLower(strings.TrimSuffix(question.DomainName, ".")),
+		qtype: question.Type,
+		class: question.Class,
+	}
+}
+
+// agedRecords copies records with their TTLs reduced by the time spent in
+// the cache.
+func agedRecords(records []DNSResourceRecord, elapsed uint32) []DNSResourceRecord {
+	aged := make([]DNSResourceRecord, len(records))
+	for i, record := range records {
+		aged[i] = record
+		aged[i].TimeToLive = record.TimeToLive - min(elapsed, record.TimeToLive)
+	}
+	return aged
+}
+
+// Get returns a cached answer, with TTLs aged to the current time.
+func (c *answerCache) Get(key cacheKey, now time.Time) ([]DNSResourceRecord, []DNSResourceRecord, uint16, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || !now.Before(entry.expires) {
+		c.misses++
+		return nil, nil, 0, false
+	}
+	c.hits++
+
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	return agedRecords(entry.answers, elapsed), agedRecords(entry.authorities, elapsed), entry.rcode, true
+}
+
+// Counters returns the cache hits and misses so far and the number of
+// answers cached.
+func (c *answerCache) Counters() (uint64, uint64, int) {
+	c.Lock()
+	defer c.Unlock()
+	return c.hits, c.misses, len(c.entries)
+}
+
+// staleTTL is the TTL of stale answers, as recommended by RFC 8767 section 4
+const staleTTL uint32 = 30
+
+// GetStale returns an expired answer that is at most maxStale past its TTL,
+// with every TTL set to staleTTL.
+func (c *answerCache) GetStale(key cacheKey, now time.Time, maxStale time.Duration) ([]DNSResourceRecord, []DNSResourceRecord, uint16, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || !now.Before(entry.expires.Add(maxStale)) {
+		return nil, nil, 0, false
+	}
+
+	answers := agedRecords(entry.answers, 0)
+	authorities := agedRecords(entry.authorities, 0)
+	for _, records := range [][]DNSResourceRecord{answers, authorities} {
+		for i := range records {
+			records[i].TimeToLive = staleTTL
+		}
+	}
+	return answers, authorities, entry.rcode, true
+}
+
+// Store caches an answer for its TTL: the lowest answer TTL, or for negative
+// answers the SOA's negative caching TTL (RFC 2308 section 5). Answers
+// without a usable TTL aren't cached.
+func (c *answerCache) Store(key cacheKey, answers []DNSResourceRecord, authorities []DNSResourceRecord, rcode uint16, now time.Time) {
+	ttl, ok := cacheTTL(answers, authorities, rcode)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	maxEntries := valueOrDefaultInt(currentConfig().Forwarding.CacheEntries, 10000)
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= maxEntries {
+		c.evict(now)
+	}
+
+	c.entries[key] = &cacheEntry{
+		answers:     answers,
+		authorities: authorities,
+		rcode:       rcode,
+		stored:      now,
+		expires:     now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// evict makes room for one entry. Callers hold the lock.
+func (c *answerCache) evict(now time.Time) {
+	evicted := false
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+			evicted = true
+		}
+	}
+	if evicted {
+		return
+	}
+	for key := range c.entries {
+		delete(c.entries, key)
+		return
+	}
+}
+
+func cacheTTL(answers []DNSResourceRecord, authorities []DNSResourceRecord, rcode uint16) (uint32, bool) {
+	if rcode != RcodeNoError && rcode != RcodeNameError {
+		return 0, false
+	}
+
+	if len(answers) > 0 {
+		ttl := answers[0].TimeToLive
+		for _, answer := range answers[1:] {
+			ttl = min(ttl, answer.TimeToLive)
+		}
+		return clampTTL(ttl), true
+	}
+
+	for _, authority := range authorities {
+		if authority.Type == TypeSOA && len(authority.ResourceData) >= 4 {
+			minimum := binary.BigEndian.Uint32(authority.ResourceData[len(authority.ResourceData)-4:])
+			return clampTTL(min(authority.TimeToLive, minimum)), true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCache() *answerCache {
+	return &answerCache{entries: make(map[cacheKey]*cacheEntry)}
+}
+
+func addressRecord(name string, ttl uint32) DNSResourceRecord {
+	return DNSResourceRecord{DomainName: name, Type: TypeA, Class: ClassINET, TimeToLive: ttl, ResourceData: []byte{192, 0, 2, 1}, ResourceDataLength: 4}
+}
+
+func TestCacheAgesAndExpiresAnswers(t *testing.T) {
+	useConfig(t, DefaultConfig())
+	cache := newTestCache()
+	key := newCacheKey(DNSResourceRecord{DomainName: "WWW.example.com.", Type: TypeA, Class: ClassINET})
+	now := time.Now()
+
+	cache.Store(key, []DNSResourceRecord{addressRecord("www.example.com", 300), addressRecord("www.example.com", 60)}, nil, RcodeNoError, now)
+
+	answers, _, _, ok := cache.Get(newCacheKey(DNSResourceRecord{DomainName: "www.example.com", Type: TypeA, Class: ClassINET}), now.Add(20*time.Second))
+	if !ok {
+		t.Fatal("a cached answer wasn't found under another spelling of its name")
+	}
+	if answers[0].TimeToLive != 280 || answers[1].TimeToLive != 40 {
+		t.Errorf("aged TTLs = %d and %d, want 280 and 40", answers[0].TimeToLive, answers[1].TimeToLive)
+	}
+
+	_, _, _, ok = cache.Get(key, now.Add(60*time.Second))
+	if ok {
+		t.Error("an answer was served past its lowest TTL")
+	}
+	answers, _, _, ok = cache.GetStale(key, now.Add(90*time.Second), time.Minute)
+	if !ok || answers[0].TimeToLive != staleTTL {
+		t.Error("an expired answer within the stale window wasn't served stale")
+	}
+
+	hits, misses, entries := cache.Counters()
+	if hits != 1 || misses != 1 || entries != 1 {
+		t.Errorf("counters = %d hits, %d misses, %d entries; want 1, 1, 1", hits, misses, entries)
+	}
+}
+
+func TestCacheNegativeAnswers(t *testing.T) {
+	useConfig(t, DefaultConfig())
+	cache := newTestCache()
+	key := newCacheKey(DNSResourceRecord{DomainName: "missing.example.com", Type: TypeA, Class: ClassINET})
+	zone := ZoneConfig{Name: "example.com", Minimum: 120}
+	soa := zone.SOARecord()
+	soa.TimeToLive = 600
+
+	cache.Store(key, nil, []DNSResourceRecord{soa}, RcodeNameError, time.Now())
+	_, _, rcode, ok := cache.Get(key, time.Now().Add(119*time.Second))
+	if !ok || rcode != RcodeNameError {
+		t.Fatal("an NXDOMAIN wasn't cached for the SOA minimum")
+	}
+	_, _, _, ok = cache.Get(key, time.Now().Add(121*time.Second))
+	if ok {
+		t.Error("an NXDOMAIN outlived the SOA minimum")
+	}
+
+	cache.Store(newCacheKey(DNSResourceRecord{DomainName: "fail.example.com", Type: TypeA, Class: ClassINET}), nil, nil, RcodeServerFailure, time.Now())
+	if _, _, entries := cache.Counters(); entries != 1 {
+		t.Error("a SERVFAIL was cached")
+	}
+}
+
+func TestCacheStaysWithinCacheEntries(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Forwarding.CacheEntries = 3
+	useConfig(t, cfg)
+	cache := newTestCache()
+
+	for _, name := range []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com", "e.example.com"} {
+		cache.Store(newCacheKey(DNSResourceRecord{DomainName: name, Type: TypeA, Class: ClassINET}), []DNSResourceRecord{addressRecord(name, 60)}, nil, RcodeNoError, time.Now())
+	}
+	if _, _, entries := cache.Counters(); entries != 3 {
+		t.Errorf("the cache holds %d answers, want its cap of 3", entries)
+	}
+}
+
+func TestCacheCountersAreExposed(t *testing.T) {
+	useConfig(t, DefaultConfig())
+	previous := forwardCache
+	forwardCache = newTestCache()
+	t.Cleanup(func() { forwardCache = previous })
+
+	key := newCacheKey(DNSResourceRecord{DomainName: "www.example.com", Type: TypeA, Class: ClassINET})
+	forwardCache.Get(key, time.Now())
+	forwardCache.Store(key, []DNSResourceRecord{addressRecord("www.example.com", 60)}, nil, RcodeNoError, time.Now())
+	forwardCache.Get(key, time.Now())
+	forwardCache.Get(key, time.Now())
+
+	w := apiRequest(t, http.MethodGet, "/stats", "", "")
+	var stats Stats
+	err := json.NewDecoder(w.Body).Decode(&stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.CacheHits != 2 || stats.CacheMisses != 1 || stats.CacheEntries != 1 {
+		t.Errorf("/stats reports %d hits, %d misses, %d entries; want 2, 1, 1", stats.CacheHits, stats.CacheMisses, stats.CacheEntries)
+	}
+
+	metrics := apiRequest(t, http.MethodGet, "/metrics", "", "").Body.String()
+	for _, line := range []string{"lightdns_cache_hits_total 2", "lightdns_cache_misses_total 1", "lightdns_cache_entries 1"} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("/metrics is missing %q", line)
+		}
+	}
+}
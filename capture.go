@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CapturedExchange is one line of a capture file: a query as it arrived and
+// the response that was sent for it, both hex encoded.
+type CapturedExchange struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Transport string    `json:"transport"`
+	Query     string    `json:"query"`
+	Response  string    `json:"response"`
+}
+
+// exchangeCapture appends exchanges to the capture file, one JSON object per
+// line.
+type exchangeCapture struct {
+	sync.Mutex
+	file *os.File
+}
+
+var capture *exchangeCapture
+
+// OpenCapture opens the capture file for appending.
+func OpenCapture(path string) (*exchangeCapture, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &exchangeCapture{file: file}, nil
+}
+
+// captureExchange records a query and its response when capturing is on.
+func captureExchange(requestBytes []byte, responseBytes []byte, responseWriter DNSResponseWriter) {
+	if capture == nil {
+		return
+	}
+
+	transport := "tcp"
+	if responseWriter.IsUDP() {
+		transport = "udp"
+	}
+
+	line, err := json.Marshal(CapturedExchange{
+		Time:      time.Now().UTC(),
+		Client:    fmt.Sprint(responseWriter.RemoteAddr()),
+		Transport: transport,
+		Query:     hex.EncodeToString(requestBytes),
+		Response:  hex.EncodeToString(responseBytes),
+	})
+	if err != nil {
+		return
+	}
+
+	capture.Lock()
+	defer capture.Unlock()
+
+	_, err = capture.file.Write(append(line, '\n'))
+	if err != nil {
+		logError("Error writing capture file:", err)
+	}
+}
+
+// parseCaptureLine reads one line of a replay file: a capture file line, or
+// a bare hex query as copied out of a packet capture.
+func parseCaptureLine(line string) (CapturedExchange, []byte, error) {
+	var exchange CapturedExchange
+	if strings.HasPrefix(line, "{") {
+		err := json.Unmarshal([]byte(line), &exchange)
+		if err != nil {
+			return exchange, nil, err
+		}
+	} else {
+		exchange = CapturedExchange{Transport: "udp", Query: strings.Join(strings.Fields(line), "")}
+	}
+
+	queryBytes, err := hex.DecodeString(exchange.Query)
+	return exchange, queryBytes, err
+}
+
+// runReplay implements the -replay command-line mode: every query in the
+// file is answered by the loaded store and config, and the response is
+// printed and compared against the recorded one, if any. It returns the
+// process exit code, 1 when a response differs from the recording.
+func runReplay(path string, output io.Writer) int {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(output, "Error opening replay file:", err)
+		return 2
+	}
+	defer file.Close()
+
+	status := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		exchange, queryBytes, err := parseCaptureLine(line)
+		if err != nil {
+			fmt.Fprintf(output, "line %d: invalid capture: %v\n", lineNumber, err)
+			status = 1
+			continue
+		}
+
+		// Replay from the recorded client so views and ACLs match
+		host, _, _ := net.SplitHostPort(exchange.Client)
+		clientIP := net.ParseIP(host)
+		if clientIP == nil {
+			clientIP = net.IPv4(127, 0, 0, 1)
+		}
+		responseWriter := &capturingResponseWriter{remoteAddr: &net.UDPAddr{IP: clientIP}, udp: exchange.Transport != "tcp"}
+		if !responseWriter.udp {
+			responseWriter.remoteAddr = &net.TCPAddr{IP: clientIP}
+		}
+		handleDNSClient(context.Background(), queryBytes, responseWriter)
+
+		summary := "no response"
+		response, err := parseResponse(responseWriter.response)
+		if err == nil {
+			summary = fmt.Sprintf("%s %d answers %d authorities %d additionals", rcodeName(response.Header.Flags),
+				len(response.Answers), len(response.Authorities), len(response.Additionals))
+		}
+
+		result := "replayed"
+		if exchange.Response != "" {
+			recorded, _ := hex.DecodeString(exchange.Response)
+			if bytes.Equal(recorded, responseWriter.response) {
+				result = "matches"
+			} else {
+				result = "DIFFERS"
+				status = 1
+			}
+		}
+
+		fmt.Fprintf(output, "line %d: %s: %s\n\t%s\n", lineNumber, result, summary, hex.EncodeToString(responseWriter.response))
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		fmt.Fprintln(output, "Error reading replay file:", err)
+		return 2
+	}
+	return status
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// digQuery is "dig www.example.com A" as captured on the wire: RD and AD
+// set, with an EDNS OPT record carrying a client cookie.
+const digQuery = "3f1c 0120 0001 0000 0000 0001" +
+	" 03777777 076578616d706c65 03636f6d 00 0001 0001" +
+	" 00 0029 04d0 00000000 000c 000a 0008 0102030405060708"
+
+// useCapture records the exchanges of one test to a temp capture file.
+func useCapture(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	opened, err := OpenCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	capture = opened
+	t.Cleanup(func() {
+		capture = nil
+		opened.file.Close()
+	})
+	return path
+}
+
+// writeReplayFile saves replay lines to a temp file.
+func writeReplayFile(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "replay.txt")
+	err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func replayConfig(t *testing.T, address string) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	useConfig(t, cfg, NameModel{Name: "www.example.com", Address: address})
+}
+
+func TestReplayCapturedDigQuery(t *testing.T) {
+	replayConfig(t, "192.0.2.10")
+
+	var output strings.Builder
+	status := runReplay(writeReplayFile(t, "# dig www.example.com", digQuery), &output)
+	if status != 0 {
+		t.Fatalf("replay exited %d:\n%s", status, output.String())
+	}
+	if !strings.Contains(output.String(), "line 2: replayed: NOERROR 1 answers 0 authorities 1 additionals") {
+		t.Errorf("replay printed\n%s", output.String())
+	}
+
+	output.Reset()
+	status = runReplay(writeReplayFile(t, "not hex"), &output)
+	if status != 1 || !strings.Contains(output.String(), "line 1: invalid capture") {
+		t.Errorf("replaying garbage exited %d:\n%s", status, output.String())
+	}
+}
+
+func TestRecordedExchangesReplay(t *testing.T) {
+	replayConfig(t, "192.0.2.10")
+	path := useCapture(t)
+
+	serve(t, newWriter("192.0.2.1", true), buildQuery(1, FlagRecursionDesired, "www.example.com", TypeA))
+	serve(t, newWriter("198.51.100.7", false), buildQuery(2, FlagRecursionDesired, "missing.example.com", TypeA))
+
+	recorded, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(recorded)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"transport":"udp"`) || !strings.Contains(lines[1], `"client":"198.51.100.7:5300","transport":"tcp"`) {
+		t.Fatalf("the capture file holds\n%s", recorded)
+	}
+
+	// Replaying must not record into the file it reads
+	capture = nil
+
+	// The same data gives the same responses
+	var output strings.Builder
+	if status := runReplay(path, &output); status != 0 || strings.Count(output.String(), ": matches: ") != 2 {
+		t.Errorf("replaying the capture exited %d:\n%s", status, output.String())
+	}
+
+	// Changed data shows up as a difference
+	replayConfig(t, "192.0.2.99")
+	output.Reset()
+	if status := runReplay(path, &output); status != 1 || !strings.Contains(output.String(), "line 1: DIFFERS") {
+		t.Errorf("replaying against changed data exited %d:\n%s", status, output.String())
+	}
+}
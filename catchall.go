@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+)
+
+const TypeAAAA uint16 = 28 // an IPv6 host address
+
+// CatchAllConfig sets fixed answers for names that aren't otherwise matched,
+// e.g. for captive portals. Types limits the catch-all to some query types;
+// by default it answers A and AAAA queries for which an address is set.
+type CatchAllConfig struct {
+	Address     string   `json:"address"`
+	IPv6Address string   `json:"ipv6Address"`
+	Types       []string `json:"types"`
+}
+
+// catchAllAnswer returns the catch-all record for a query, if one applies.
+func catchAllAnswer(queryResourceRecord DNSResourceRecord) (DNSResourceRecord, bool) {
+	return fixedAnswer(currentConfig().CatchAll, queryResourceRecord)
+}
+
+// enabled reports whether any fixed address is set.
+func (catchAll CatchAllConfig) enabled() bool {
+	return catchAll.Address != "" || catchAll.IPv6Address != ""
+}
+
+// fixedAnswer returns the fixed address record the settings give a query, if
+// one applies.
+func fixedAnswer(catchAll CatchAllConfig, queryResourceRecord DNSResourceRecord) (DNSResourceRecord, bool) {
+	if queryResourceRecord.Class != ClassINET {
+		return DNSResourceRecord{}, false
+	}
+
+	var resourceData net.IP
+	switch queryResourceRecord.Type {
+	case TypeA:
+		resourceData = net.ParseIP(catchAll.Address).To4()
+	case TypeAAAA:
+		resourceData = net.ParseIP(catchAll.IPv6Address)
+		if resourceData.To4() != nil {
+			resourceData = nil
+		}
+	}
+	if resourceData == nil {
+		return DNSResourceRecord{}, false
+	}
+
+	if len(catchAll.Types) > 0 {
+		typeName := "A"
+		if queryResourceRecord.Type == TypeAAAA {
+			typeName = "AAAA"
+		}
+		if !slices.ContainsFunc(catchAll.Types, func(t string) bool { return strings.EqualFold(t, typeName) }) {
+			return DNSResourceRecord{}, false
+		}
+	}
+
+	return DNSResourceRecord{
+		DomainName:         queryResourceRecord.DomainName,
+		Type:               queryResourceRecord.Type,
+		Class:              ClassINET,
+		TimeToLive:         findZone(queryResourceRecord.DomainName).TTL(),
+		ResourceData:       resourceData,
+		ResourceDataLength: uint16(len(resourceData)),
+	}, true
+}
@@ -0,0 +1,84 @@
+package main
+
+import "testing"
+
+func TestCatchAllAnswersUnknownNames(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	cfg.CatchAll = CatchAllConfig{Address: "10.0.0.1", IPv6Address: "fd00::1", Types: []string{"A"}}
+	useConfig(t, cfg, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+
+	tests := []struct {
+		name      string
+		queryType uint16
+		rcode     uint16
+		address   string
+	}{
+		{"unknown.example.net", TypeA, RcodeNoError, "10.0.0.1"},
+		{"missing.example.com", TypeA, RcodeNoError, "10.0.0.1"},
+		{"www.example.com", TypeA, RcodeNoError, "192.0.2.10"},
+		// AAAA isn't in Types
+		{"missing.example.com", TypeAAAA, RcodeNameError, ""},
+	}
+	for _, test := range tests {
+		response := query(t, test.name, test.queryType)
+		if responseCode(response) != test.rcode || answerAddress(response) != test.address {
+			t.Errorf("%s type %d: rcode %d answering %q, want %d answering %q", test.name, test.queryType, responseCode(response), answerAddress(response), test.rcode, test.address)
+		}
+	}
+	if response := query(t, "unknown.example.net", TypeA); response.Answers[0].DomainName != "unknown.example.net" {
+		t.Errorf("the catch-all answer is owned by %s, want the queried name", response.Answers[0].DomainName)
+	}
+}
+
+func TestNXDomainRedirect(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{
+		{Name: "example.com", NXDomainRedirect: CatchAllConfig{Address: "192.0.2.250"}},
+		{Name: "example.org"},
+	}
+	useConfig(t, cfg, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+
+	tests := []struct {
+		name      string
+		queryType uint16
+		rcode     uint16
+		address   string
+	}{
+		{"missing.example.com", TypeA, RcodeNoError, "192.0.2.250"},
+		{"www.example.com", TypeA, RcodeNoError, "192.0.2.10"},
+		// Other types of a redirected name get an empty answer
+		{"missing.example.com", TypeMX, RcodeNoError, ""},
+		// Zones without a redirect keep NXDOMAIN
+		{"missing.example.org", TypeA, RcodeNameError, ""},
+	}
+	for _, test := range tests {
+		response := query(t, test.name, test.queryType)
+		if responseCode(response) != test.rcode || answerAddress(response) != test.address {
+			t.Errorf("%s type %d: rcode %d answering %q, want %d answering %q", test.name, test.queryType, responseCode(response), answerAddress(response), test.rcode, test.address)
+		}
+	}
+}
+
+func TestCatchAllComesBeforeForwarding(t *testing.T) {
+	upstream := startUpstream(t, func(requestBytes []byte) []byte {
+		return upstreamResponse(requestBytes, RcodeServerFailure)
+	})
+	cfg := DefaultConfig()
+	cfg.CatchAll = CatchAllConfig{Address: "10.0.0.1", Types: []string{"A"}}
+	useForwarding(t, cfg, upstream.address)
+
+	response := query(t, "unknown.example.net", TypeA)
+	if responseCode(response) != RcodeNoError || answerAddress(response) != "10.0.0.1" {
+		t.Errorf("rcode %d answering %q, want the catch-all address", responseCode(response), answerAddress(response))
+	}
+	if queries := upstream.queries.Load(); queries != 0 {
+		t.Errorf("the upstream was queried %d times for a name the catch-all answers", queries)
+	}
+
+	// Types the catch-all doesn't cover are still forwarded
+	response = query(t, "unknown.example.net", TypeAAAA)
+	if responseCode(response) != RcodeServerFailure || upstream.queries.Load() != 1 {
+		t.Errorf("rcode %d after %d upstream queries, want the forwarded SERVFAIL", responseCode(response), upstream.queries.Load())
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// buildQuery encodes a single question query message.
+func buildQuery(transactionID uint16, flags uint16, name string, queryType uint16) []byte {
+	var queryBuffer bytes.Buffer
+
+	Write(&queryBuffer, DNSHeader{TransactionID: transactionID, Flags: flags, NumQuestions: 1})
+	writeDomainName(&queryBuffer, name)
+	Write(&queryBuffer, queryType)
+	Write(&queryBuffer, ClassINET)
+
+	return queryBuffer.Bytes()
+}
+
+// Client sends queries to a DNS server and decodes the responses. Queries go
+// over UDP and are retried over TCP when the answer comes back truncated,
+// unless UseTCP asks for TCP from the start.
+type Client struct {
+	Timeout time.Duration
+	UseTCP  bool
+}
+
+// Exchange sends a query message to a server and returns the decoded
+// response, checking that it carries the query's transaction ID. It gives
+// up with the context's error once the context is done.
+func (client Client) Exchange(ctx context.Context, queryBytes []byte, server string) (DNSResponse, error) {
+	if len(queryBytes) < 12 {
+		return DNSResponse{}, fmt.Errorf("query is too short")
+	}
+	transactionID := binary.BigEndian.Uint16(queryBytes)
+
+	response, err := client.exchangeOver(ctx, server, queryBytes, client.UseTCP, transactionID)
+	if err == nil && !client.UseTCP && response.Header.Flags&FlagTruncated != 0 {
+		response, err = client.exchangeOver(ctx, server, queryBytes, true, transactionID)
+	}
+	return response, err
+}
+
+func (client Client) exchangeOver(ctx context.Context, server string, queryBytes []byte, useTCP bool, transactionID uint16) (DNSResponse, error) {
+	responseBytes, err := exchange(ctx, server, queryBytes, useTCP, client.timeout())
+	if ctx.Err() != nil {
+		return DNSResponse{}, ctx.Err()
+	}
+	if err != nil {
+		return DNSResponse{}, err
+	}
+
+	response, err := parseResponse(responseBytes)
+	if err != nil {
+		return DNSResponse{}, fmt.Errorf("error decoding response: %v", err)
+	}
+	if response.Header.TransactionID != transactionID {
+		return DNSResponse{}, fmt.Errorf("response ID doesn't match the query")
+	}
+	return response, nil
+}
+
+func (client Client) timeout() time.Duration {
+	if client.Timeout <= 0 {
+		return 2 * time.Second
+	}
+	return client.Timeout
+}
+
+// exchange sends a query to a server over UDP or TCP and returns the raw
+// response. Client builds on it for decoding and the TCP retry. The
+// exchange stops at the timeout or the context's deadline, whichever comes
+// first, or as soon as the context is cancelled.
+func exchange(ctx context.Context, server string, queryBytes []byte, useTCP bool, timeout time.Duration) ([]byte, error) {
+	network := "udp"
+	if useTCP {
+		network = "tcp"
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+
+	// Cancelling the context unblocks the pending read or write
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if useTCP {
+		_, err = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(queryBytes))), queryBytes...))
+		if err != nil {
+			return nil, err
+		}
+
+		var lengthBytes [2]byte
+		_, err = io.ReadFull(conn, lengthBytes[:])
+		if err != nil {
+			return nil, err
+		}
+		responseBytes := make([]byte, binary.BigEndian.Uint16(lengthBytes[:]))
+		_, err = io.ReadFull(conn, responseBytes)
+		return responseBytes, err
+	}
+
+	_, err = conn.Write(queryBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	responseBytes := make([]byte, 65535)
+	n, err := conn.Read(responseBytes)
+	return responseBytes[:n], err
+}
+
+// formatWireResourceData renders rdata for display. Types without a
+// dedicated form use the generic \# syntax of RFC 3597.
+func formatWireResourceData(resourceRecord DNSResourceRecord) string {
+	resourceData := resourceRecord.ResourceData
+
+	switch resourceRecord.Type {
+	case TypeA, TypeAAAA:
+		if len(resourceData) == net.IPv4len || len(resourceData) == net.IPv6len {
+			return net.IP(resourceData).String()
+		}
+	case TypeCNAME, TypeDNAME, TypeNS, TypePTR:
+		name, err := readDomainName(bytes.NewBuffer(resourceData))
+		if err == nil {
+			return absoluteName(name)
+		}
+	case TypeSOA:
+		soaBuffer := bytes.NewBuffer(resourceData)
+		primaryNS, err := readDomainName(soaBuffer)
+		mailbox, mailboxErr := readDomainName(soaBuffer)
+		if err == nil && mailboxErr == nil && soaBuffer.Len() == 20 {
+			fields := []string{absoluteName(primaryNS), absoluteName(mailbox)}
+			for i := 0; i < 5; i++ {
+				fields = append(fields, strconv.FormatUint(uint64(binary.BigEndian.Uint32(soaBuffer.Next(4))), 10))
+			}
+			return strings.Join(fields, " ")
+		}
+	case TypeTXT:
+		value, err := decodeTXT(resourceData)
+		if err == nil {
+			return quoteCharacterString(value)
+		}
+	case TypeLOC:
+		if len(resourceData) == 16 {
+			return formatLOC(resourceData)
+		}
+	}
+
+	return fmt.Sprintf("\\# %d %s", len(resourceData), hex.EncodeToString(resourceData))
+}
+
+var rcodeNames = map[uint16]string{
+	RcodeNoError:        "NOERROR",
+	RcodeFormatError:    "FORMERR",
+	RcodeServerFailure:  "SERVFAIL",
+	RcodeNameError:      "NXDOMAIN",
+	RcodeNotImplemented: "NOTIMP",
+	RcodeRefused:        "REFUSED",
+	RcodeYXDomain:       "YXDOMAIN",
+	RcodeYXRRSet:        "YXRRSET",
+	RcodeNXRRSet:        "NXRRSET",
+	RcodeNotAuth:        "NOTAUTH",
+	RcodeNotZone:        "NOTZONE",
+}
+
+// rcodeName returns the mnemonic of the rcode in the header flags.
+func rcodeName(headerFlags uint16) string {
+	rcode := headerFlags & 0x0f
+	name, ok := rcodeNames[rcode]
+	if !ok {
+		return fmt.Sprintf("RCODE%d", rcode)
+	}
+	return name
+}
+
+// flagNames lists the header flags that are set, dig style.
+func flagNames(headerFlags uint16) []string {
+	var names []string
+	for _, flagBit := range []struct {
+		bit  uint16
+		name string
+	}{{FlagResponse, "qr"}, {FlagAuthoritative, "aa"}, {FlagTruncated, "tc"}, {FlagRecursionDesired, "rd"}, {FlagRecursionAvailable, "ra"}, {FlagAuthenticData, "ad"}, {FlagCheckingDisabled, "cd"}} {
+		if headerFlags&flagBit.bit != 0 {
+			names = append(names, flagBit.name)
+		}
+	}
+	return names
+}
+
+// runQuery implements "lightdns query <name> [type]": it sends one query to
+// a running server and prints the response.
+func runQuery(args []string, output io.Writer) int {
+	flags := flag.NewFlagSet("lightdns query", flag.ContinueOnError)
+	server := flags.String("server", "127.0.0.1:1053", "address of the DNS server to query")
+	useTCP := flags.Bool("tcp", false, "query over TCP instead of UDP")
+	timeout := flags.Duration("timeout", 2*time.Second, "time to wait for the response")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		fmt.Fprintln(flags.Output(), "usage: lightdns query [-server addr] [-tcp] <name> [type]")
+		return 2
+	}
+
+	name, err := CanonicalName(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(output, "Invalid name:", err)
+		return 2
+	}
+
+	queryType := TypeA
+	if flags.NArg() == 2 {
+		code, ok := typeCode(flags.Arg(1))
+		if !ok {
+			fmt.Fprintln(output, "Unknown query type", flags.Arg(1))
+			return 2
+		}
+		queryType = code
+	}
+
+	client := Client{Timeout: *timeout, UseTCP: *useTCP}
+	response, err := client.Exchange(context.Background(), buildQuery(uint16(rand.Uint32()), FlagRecursionDesired, name, queryType), *server)
+	if err != nil {
+		fmt.Fprintln(output, "Error querying", *server, ":", err)
+		return 1
+	}
+
+	fmt.Fprintf(output, "status: %s, flags: %s\n", rcodeName(response.Header.Flags), strings.Join(flagNames(response.Header.Flags), " "))
+
+	for _, section := range []struct {
+		name    string
+		records []DNSResourceRecord
+	}{{"ANSWER", response.Answers}, {"AUTHORITY", response.Authorities}, {"ADDITIONAL", response.Additionals}} {
+		if len(section.records) == 0 {
+			continue
+		}
+		fmt.Fprintf(output, "\n;; %s SECTION:\n", section.name)
+		for _, resourceRecord := range section.records {
+			if resourceRecord.Type == TypeOPT {
+				continue
+			}
+			fmt.Fprintf(output, "%s\t%d\tIN\t%s\t%s\n", absoluteName(resourceRecord.DomainName), resourceRecord.TimeToLive,
+				typeName(resourceRecord.Type), formatWireResourceData(resourceRecord))
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer serves entries on UDP and TCP listeners at a free loopback
+// address and returns the address.
+func startServer(t *testing.T, entries ...NameModel) string {
+	t.Helper()
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := probe.Addr().String()
+	probe.Close()
+
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	useConfig(t, cfg, entries...)
+	err = StartListeners([]ListenerConfig{{Network: "udp", Address: address}, {Network: "tcp", Address: address}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return address
+}
+
+func TestQueryCommand(t *testing.T) {
+	address := startServer(t,
+		NameModel{Name: "www.example.com", Address: "192.0.2.10", TTL: 60},
+		NameModel{Name: "www.example.com", Type: "TXT", TXT: "hello world"},
+	)
+
+	tests := []struct {
+		args   []string
+		status int
+		output []string
+	}{
+		{[]string{"-server", address, "www.example.com"}, 0,
+			[]string{"status: NOERROR, flags: qr aa rd", ";; ANSWER SECTION:\nwww.example.com.\t60\tIN\tA\t192.0.2.10\n"}},
+		{[]string{"-server", address, "-tcp", "WWW.Example.com.", "txt"}, 0,
+			[]string{"status: NOERROR", "www.example.com.\t", "\tIN\tTXT\t\"hello world\"\n"}},
+		{[]string{"-server", address, "missing.example.com", "A"}, 0,
+			[]string{"status: NXDOMAIN", ";; AUTHORITY SECTION:\nexample.com.\t", "\tIN\tSOA\t"}},
+		{[]string{"-server", address, "www.example.com", "BOGUS"}, 2,
+			[]string{"Unknown query type BOGUS"}},
+		{[]string{"-server", address}, 2, nil},
+	}
+	for _, test := range tests {
+		var output strings.Builder
+		status := runQuery(test.args, &output)
+		if status != test.status {
+			t.Errorf("query %v exited %d, want %d: %s", test.args, status, test.status, output.String())
+			continue
+		}
+		for _, want := range test.output {
+			if !strings.Contains(output.String(), want) {
+				t.Errorf("query %v printed\n%s\nwant it to contain %q", test.args, output.String(), want)
+			}
+		}
+	}
+}
+
+func TestClientExchangeOverUDP(t *testing.T) {
+	address := startServer(t, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+
+	response, err := Client{}.Exchange(context.Background(), buildQuery(77, 0, "www.example.com", TypeA), address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Header.TransactionID != 77 || len(response.Answers) != 1 || answerAddress(response) != "192.0.2.10" {
+		t.Errorf("response %+v, want ID 77 and the A record", response)
+	}
+}
+
+func TestClientRetriesTruncatedAnswersOverTCP(t *testing.T) {
+	var entries []NameModel
+	for i := 0; i < 20; i++ {
+		entries = append(entries, NameModel{Name: "big.example.com", Type: "TXT", TXT: fmt.Sprintf("record %02d %s", i, strings.Repeat("x", 40))})
+	}
+	address := startServer(t, entries...)
+	request := buildQuery(78, 0, "big.example.com", TypeTXT)
+
+	responseBytes, err := exchange(context.Background(), address, request, false, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint16(responseBytes[2:])&FlagTruncated == 0 {
+		t.Fatal("the UDP answer isn't truncated, so the retry isn't exercised")
+	}
+
+	response, err := Client{}.Exchange(context.Background(), request, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Header.Flags&FlagTruncated != 0 || len(response.Answers) != len(entries) {
+		t.Errorf("got %d answers with flags %#x, want all %d from the TCP retry", len(response.Answers), response.Header.Flags, len(entries))
+	}
+}
+
+func TestClientRejectsMismatchedResponses(t *testing.T) {
+	upstream := startUpstream(t, func(requestBytes []byte) []byte {
+		response := upstreamResponse(requestBytes, RcodeNoError)
+		binary.BigEndian.PutUint16(response, binary.BigEndian.Uint16(response)+1)
+		return response
+	})
+
+	_, err := Client{Timeout: time.Second}.Exchange(context.Background(), buildQuery(79, 0, "www.example.com", TypeA), upstream.address)
+	if err == nil || !strings.Contains(err.Error(), "ID") {
+		t.Errorf("Exchange = %v, want a transaction ID mismatch", err)
+	}
+
+	_, err = Client{}.Exchange(context.Background(), []byte{0, 1}, upstream.address)
+	if err == nil {
+		t.Error("Exchange sent a query shorter than a header")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+)
+
+// nameCompression remembers where names were written in a message, so later
+// occurrences of a name or any of its suffixes can be written as a pointer
+// (RFC 1035 section 4.1.4). Matching is case-sensitive so names keep the case
+// they were asked with.
+type nameCompression map[string]int
+
+// maxCompressionOffset is the largest offset a 14-bit pointer can hold
+const maxCompressionOffset = 0x3fff
+
+// writeCompressedName writes a name, replacing its longest suffix already in
+// the message with a pointer. The buffer must hold the message from its first
+// byte so buffer offsets are message offsets.
+func writeCompressedName(responseBuffer *bytes.Buffer, domainName string, compression nameCompression) error {
+	labels := splitLabels(domainName)
+
+	for i, label := range labels {
+		suffix := strings.Join(labels[i:], ".")
+		if offset, ok := compression[suffix]; ok {
+			return Write(responseBuffer, uint16(0xc000|offset))
+		}
+		if responseBuffer.Len() <= maxCompressionOffset {
+			compression[suffix] = responseBuffer.Len()
+		}
+
+		responseBuffer.WriteByte(byte(len(label)))
+		responseBuffer.WriteString(label)
+	}
+
+	return responseBuffer.WriteByte(0)
+}
+
+// writeCompressedResourceData writes the rdata of a record, compressing the
+// names inside it for the types RFC 3597 section 4 allows: CNAME, NS, PTR, MX
+// and SOA. Other rdata, and rdata that doesn't decode, is copied as is.
+func writeCompressedResourceData(responseBuffer *bytes.Buffer, resourceRecord DNSResourceRecord, compression nameCompression) {
+	resourceData := resourceRecord.ResourceData
+	nameCount, prefixLength, suffixLength := 0, 0, 0
+
+	switch resourceRecord.Type {
+	case TypeCNAME, TypeNS, TypePTR:
+		nameCount = 1
+	case TypeMX:
+		nameCount, prefixLength = 1, 2
+	case TypeSOA:
+		nameCount, suffixLength = 2, 20
+	}
+	if nameCount == 0 || len(resourceData) < prefixLength {
+		responseBuffer.Write(resourceData)
+		return
+	}
+
+	rdataBuffer := bytes.NewBuffer(resourceData[prefixLength:])
+	names := make([]string, nameCount)
+	for i := range names {
+		name, err := readDomainName(rdataBuffer)
+		if err != nil {
+			responseBuffer.Write(resourceData)
+			return
+		}
+		names[i] = name
+	}
+	if rdataBuffer.Len() != suffixLength {
+		responseBuffer.Write(resourceData)
+		return
+	}
+
+	responseBuffer.Write(resourceData[:prefixLength])
+	for _, name := range names {
+		writeCompressedName(responseBuffer, name, compression)
+	}
+	responseBuffer.Write(rdataBuffer.Bytes())
+}
+
+// patchLength fills in a uint16 length field at offset, covering everything
+// written after it.
+func patchLength(responseBuffer *bytes.Buffer, offset int) {
+	message := responseBuffer.Bytes()
+	binary.BigEndian.PutUint16(message[offset:], uint16(len(message)-offset-2))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// answerToWWW writes a response to a www.example.com question holding one
+// answer and returns it with the number of bytes the answer took.
+func answerToWWW(answer DNSResourceRecord) ([]byte, int) {
+	var responseBuffer bytes.Buffer
+	Write(&responseBuffer, DNSHeader{TransactionID: 1, Flags: FlagResponse, NumQuestions: 1, NumAnswers: 1})
+	compression := make(nameCompression)
+	writeCompressedName(&responseBuffer, "www.example.com", compression)
+	Write(&responseBuffer, answer.Type)
+	Write(&responseBuffer, ClassINET)
+
+	answerOffset := responseBuffer.Len()
+	writeResourceRecord(&responseBuffer, answer, compression)
+	return responseBuffer.Bytes(), responseBuffer.Len() - answerOffset
+}
+
+func TestCNAMETargetCompressedAgainstQuestion(t *testing.T) {
+	var target bytes.Buffer
+	writeDomainName(&target, "web.example.com")
+	answer := DNSResourceRecord{
+		DomainName:         "www.example.com",
+		Type:               TypeCNAME,
+		Class:              ClassINET,
+		TimeToLive:         60,
+		ResourceData:       target.Bytes(),
+		ResourceDataLength: uint16(target.Len()),
+	}
+
+	message, answerLength := answerToWWW(answer)
+
+	// A pointer owner, type, class, TTL and length, then "web" and a
+	// pointer to example.com
+	if answerLength != 2+10+4+2 {
+		t.Errorf("the answer took %d bytes, want its owner and target compressed", answerLength)
+	}
+
+	response, err := parseResponse(message)
+	if err != nil {
+		t.Fatal("error decoding the response:", err)
+	}
+	if len(response.Answers) != 1 {
+		t.Fatalf("decoded %d answers, want 1", len(response.Answers))
+	}
+	got := response.Answers[0]
+	if !bytes.Equal(got.ResourceData, target.Bytes()) || int(got.ResourceDataLength) != target.Len() {
+		t.Errorf("decoded rdata %x, want the expanded target %x", got.ResourceData, target.Bytes())
+	}
+	if name := formatWireResourceData(got); name != "web.example.com." {
+		t.Errorf("CNAME target = %q, want web.example.com.", name)
+	}
+}
+
+func TestRdataNamesRoundTrip(t *testing.T) {
+	var ns, mx, soa, ptr bytes.Buffer
+	writeDomainName(&ns, "ns1.example.com")
+	Write(&mx, uint16(10))
+	writeDomainName(&mx, "mail.example.com")
+	writeDomainName(&soa, "ns1.example.com")
+	writeDomainName(&soa, "hostmaster.example.com")
+	soa.Write([]byte{0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0, 4, 0, 0, 0, 5})
+	writeDomainName(&ptr, "host.example.com")
+
+	tests := []struct {
+		recordType uint16
+		rdata      []byte
+	}{
+		{TypeNS, ns.Bytes()},
+		{TypeMX, mx.Bytes()},
+		{TypeSOA, soa.Bytes()},
+		{TypePTR, ptr.Bytes()},
+	}
+	for _, test := range tests {
+		answer := DNSResourceRecord{
+			DomainName:         "www.example.com",
+			Type:               test.recordType,
+			Class:              ClassINET,
+			TimeToLive:         60,
+			ResourceData:       test.rdata,
+			ResourceDataLength: uint16(len(test.rdata)),
+		}
+
+		message, answerLength := answerToWWW(answer)
+		if answerLength >= 2+10+len(test.rdata) {
+			t.Errorf("%s rdata wasn't compressed", typeName(test.recordType))
+		}
+
+		response, err := parseResponse(message)
+		if err != nil {
+			t.Fatalf("%s: error decoding the response: %v", typeName(test.recordType), err)
+		}
+		if !bytes.Equal(response.Answers[0].ResourceData, test.rdata) {
+			t.Errorf("%s rdata decoded as %x, want %x", typeName(test.recordType), response.Answers[0].ResourceData, test.rdata)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// Config holds every server setting. It is read from a JSON config file at
+// startup, and individual fields can be overridden with command-line flags.
+type Config struct {
+	StoreFile   string `json:"storeFile"`
+	DNSAddress  string `json:"dnsAddress"`
+	HTTPAddress string `json:"httpAddress"`
+	DefaultTTL  uint32 `json:"defaultTTL"`
+
+	// DisableHTTP turns off the HTTP API entirely, leaving only DNS
+	DisableHTTP bool `json:"disableHTTP"`
+
+	// MinTTL and MaxTTL bound the TTL of every record served; 0 disables
+	// the bound
+	MinTTL uint32 `json:"minTTL"`
+	MaxTTL uint32 `json:"maxTTL"`
+
+	// TTLJitterPercent spreads the expiry of cached copies of a record by
+	// serving its TTL up to this many percent above or below the stored
+	// value; 0 disables jitter
+	TTLJitterPercent uint32 `json:"ttlJitterPercent"`
+
+	// StoreBackend selects where entries live: "file", "memory", "sqlite",
+	// "redis" or "static", the store compiled into the binary
+	StoreBackend string      `json:"storeBackend"`
+	SQLiteFile   string      `json:"sqliteFile"`
+	Redis        RedisConfig `json:"redis"`
+
+	// Listeners lists every DNS listening address; when empty the server
+	// listens on DNSAddress over both UDP and TCP
+	Listeners []ListenerConfig `json:"listeners"`
+
+	// MinimalResponses adds the zone SOA to NODATA answers instead of
+	// returning a completely empty response
+	MinimalResponses bool `json:"minimalResponses"`
+
+	// PackResponses fills truncated UDP responses with as many complete
+	// records as fit, keeping the answer section intact over additionals
+	PackResponses bool `json:"packResponses"`
+
+	// MaxAnswers caps the answer records of a UDP response, setting TC so
+	// the client retries over TCP for the full set; 0 disables the cap
+	MaxAnswers int `json:"maxAnswers"`
+
+	// RRsetOrder orders the records of multi-record answers: "fixed" (store
+	// order, the default), "cyclic" rotating on every response or "random".
+	// Weighted records always use their weighted draw.
+	RRsetOrder string `json:"rrsetOrder"`
+
+	// DualStackHints adds a name's AAAA records to the additional section
+	// of A answers, and its A records to AAAA answers
+	DualStackHints bool `json:"dualStackHints"`
+
+	// FailOnDuplicates makes loading a store with duplicate entries an error
+	// instead of a warning
+	FailOnDuplicates bool `json:"failOnDuplicates"`
+
+	// MaxRecords caps the number of entries in the store, 0 for no limit.
+	// Zones can set their own cap with the zone's maxRecords.
+	MaxRecords int `json:"maxRecords"`
+
+	// LogLevel is the minimum level logged: error, warn, info or debug.
+	// Per-query lines are only logged at debug
+	LogLevel string `json:"logLevel"`
+
+	// SlowQueryMillis logs a warning for requests taking longer than this
+	// many milliseconds to answer; 0 disables slow-query logging
+	SlowQueryMillis int `json:"slowQueryMillis"`
+
+	// QueryTimeoutMillis is the deadline for answering one query, including
+	// forwarding it; queries past it get SERVFAIL
+	QueryTimeoutMillis int `json:"queryTimeoutMillis"`
+
+	// TCPReadTimeoutMillis is how long a TCP connection may take to deliver
+	// its next query, and TCPWriteTimeoutMillis how long writing a response
+	// may take; the connection is closed when either expires
+	TCPReadTimeoutMillis  int `json:"tcpReadTimeoutMillis"`
+	TCPWriteTimeoutMillis int `json:"tcpWriteTimeoutMillis"`
+
+	// TCPMaxMessageSize is the largest query accepted over TCP; connections
+	// announcing a larger one are closed
+	TCPMaxMessageSize int `json:"tcpMaxMessageSize"`
+
+	// UDPReadBufferSize is the largest query read over UDP. EDNS clients
+	// may send queries above 512 bytes; larger datagrams are cut short
+	UDPReadBufferSize int `json:"udpReadBufferSize"`
+
+	// UDPSocketReceiveBuffer and UDPSocketSendBuffer size the UDP sockets'
+	// kernel buffers (SO_RCVBUF and SO_SNDBUF), so bursts of queries aren't
+	// dropped before they are read. The kernel may grant less, e.g. Linux
+	// caps them at net.core.rmem_max and wmem_max; 0 keeps the OS default.
+	UDPSocketReceiveBuffer int `json:"udpSocketReceiveBuffer"`
+	UDPSocketSendBuffer    int `json:"udpSocketSendBuffer"`
+
+	// ReusePort opens ReusePortSockets UDP sockets on each UDP listener's
+	// address with SO_REUSEPORT, defaulting to one per CPU, so the kernel
+	// spreads queries across them and their read loops. Linux only.
+	ReusePort        bool `json:"reusePort"`
+	ReusePortSockets int  `json:"reusePortSockets"`
+
+	// UDPQueueHighWaterMark is the number of UDP queries waiting to be
+	// answered above which new ones get an immediate SERVFAIL instead of
+	// queueing behind them; 0 never sheds
+	UDPQueueHighWaterMark int `json:"udpQueueHighWaterMark"`
+
+	// DistinctNamesWindowSeconds is the window over which distinct query
+	// names are counted for /metrics; 0 counts since startup
+	DistinctNamesWindowSeconds int `json:"distinctNamesWindowSeconds"`
+
+	// APIToken is the bearer token required by protected HTTP endpoints
+	// such as /config; those endpoints are disabled while it is empty
+	APIToken string `json:"apiToken"`
+
+	CORS CORSConfig `json:"cors"`
+
+	// CaptureFile records every query and its response to the named file,
+	// one JSON object per line, for replaying with -replay
+	CaptureFile string `json:"captureFile"`
+
+	// TSIGKeys are the shared keys that may sign dynamic updates and zone
+	// transfer requests
+	TSIGKeys []TSIGKeyConfig `json:"tsigKeys"`
+
+	// SerialFile keeps the zone serials across restarts, so a serial
+	// bumped by a change never goes backwards
+	SerialFile string `json:"serialFile"`
+
+	Zones        []ZoneConfig        `json:"zones"`
+	ReverseZones []ReverseZoneConfig `json:"reverseZones"`
+
+	WaterTorture  WaterTortureConfig  `json:"waterTorture"`
+	CatchAll      CatchAllConfig      `json:"catchAll"`
+	Forwarding    ForwardingConfig    `json:"forwarding"`
+	Cookies       CookieConfig        `json:"cookies"`
+	Amplification AmplificationConfig `json:"amplification"`
+	RRL           RRLConfig           `json:"rrl"`
+
+	// BlocklistFile lists names to block and AllowlistFile names that are
+	// never blocked, see LoadDomainList for the format
+	BlocklistFile string `json:"blocklistFile"`
+	AllowlistFile string `json:"allowlistFile"`
+
+	Views  []ViewConfig `json:"views"`
+	GeoIP  GeoIPConfig  `json:"geoip"`
+	DNSSEC DNSSECConfig `json:"dnssec"`
+
+	// ValidateFile is only set from the command line: the named store file
+	// is checked and the process exits instead of starting the server
+	ValidateFile string `json:"-"`
+
+	// ExportOrigin is only set from the command line: the store is written
+	// to stdout as a zone file for this origin and the process exits
+	ExportOrigin string `json:"-"`
+
+	// GenerateStatic is only set from the command line: the store file is
+	// compiled into a Go source file of this name and the process exits
+	GenerateStatic string `json:"-"`
+
+	// ReplayFile is only set from the command line: the queries in the
+	// named capture file are answered and compared, then the process exits
+	ReplayFile string `json:"-"`
+
+	// ConfigFile is the path the config was loaded from
+	ConfigFile string `json:"-"`
+
+	// ShowVersion prints the build information and exits
+	ShowVersion bool `json:"-"`
+
+	// What the settings above load, set by main and LoadRuntime: the store
+	// backend, geoLookup which is nil without a GeoIP database, the domain
+	// lists where queries matching the allowlist are never blocked, and the
+	// TSIG keys by canonical name
+	store        Store
+	views        []View
+	geoLookup    GeoLookup
+	blocklist    *DomainList
+	allowlist    *DomainList
+	reverseZones []reverseZone
+	tsigKeys     map[string]tsigKey
+}
+
+const defaultConfigFile = "./lightdns.json"
+
+// configSnapshot is the running config with everything loaded from it. A
+// published Config is never modified: a reload builds a new one and swaps
+// it in, so readers never lock, and a query that reads it once sees one
+// consistent config however long it takes to answer.
+var configSnapshot atomic.Pointer[Config]
+
+func init() {
+	cfg := DefaultConfig()
+	cfg.store = &FileStore{Path: cfg.StoreFile}
+	configSnapshot.Store(&cfg)
+}
+
+// currentConfig returns the running config, which callers must not modify.
+func currentConfig() *Config {
+	return configSnapshot.Load()
+}
+
+// LoadRuntime loads everything the settings refer to, other than the store,
+// into the config: views, GeoIP, the domain lists, zones and TSIG keys.
+func LoadRuntime(cfg *Config) error {
+	var err error
+
+	cfg.views, err = LoadViews(cfg.Views)
+	if err != nil {
+		return fmt.Errorf("error loading views: %w", err)
+	}
+	cfg.geoLookup, err = LoadGeoIP(&cfg.GeoIP)
+	if err != nil {
+		return fmt.Errorf("error loading GeoIP: %w", err)
+	}
+	cfg.blocklist, err = LoadDomainList(cfg.BlocklistFile, "blocklist")
+	if err != nil {
+		return fmt.Errorf("error loading blocklist: %w", err)
+	}
+	cfg.allowlist, err = LoadDomainList(cfg.AllowlistFile, "allowlist")
+	if err != nil {
+		return fmt.Errorf("error loading allowlist: %w", err)
+	}
+	err = LoadZones(cfg.Zones)
+	if err != nil {
+		return fmt.Errorf("error loading zones: %w", err)
+	}
+	cfg.reverseZones, err = LoadReverseZones(cfg.ReverseZones)
+	if err != nil {
+		return fmt.Errorf("error loading reverse zones: %w", err)
+	}
+	cfg.tsigKeys, err = LoadTSIGKeys(cfg.TSIGKeys)
+	if err != nil {
+		return fmt.Errorf("error loading TSIG keys: %w", err)
+	}
+
+	return nil
+}
+
+func DefaultConfig() Config {
+	return Config{
+		StoreFile:   "./names.json",
+		DNSAddress:  ":1053",
+		HTTPAddress: "127.0.0.1:8080",
+		DefaultTTL:  31337,
+
+		SerialFile: "./serials.json",
+
+		SQLiteFile: "./names.db",
+		Redis:      RedisConfig{Address: "localhost:6379"},
+
+		LogLevel: "info",
+
+		SlowQueryMillis:        50,
+		QueryTimeoutMillis:     5000,
+		TCPReadTimeoutMillis:   10000,
+		TCPWriteTimeoutMillis:  10000,
+		TCPMaxMessageSize:      4096,
+		UDPReadBufferSize:      4096,
+		UDPSocketReceiveBuffer: 4 << 20,
+		UDPSocketSendBuffer:    1 << 20,
+
+		DistinctNamesWindowSeconds: 300,
+	}
+}
+
+// LoadConfig reads a config file on top of the defaults. A missing file is not
+// an error and leaves the defaults in place.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, fmt.Errorf("error reading config file: %v", err)
+	}
+
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+
+	return cfg, nil
+}
+
+// ParseConfig builds the effective config from command-line arguments: the
+// file named by -config is loaded first, then any flags that were explicitly
+// set override the matching fields.
+func ParseConfig(args []string) (Config, error) {
+	flags := flag.NewFlagSet("lightdns", flag.ContinueOnError)
+
+	configFile := flags.String("config", defaultConfigFile, "path to the JSON config file")
+	storeFile := flags.String("store", "", "path to the names.json store file")
+	dnsAddress := flags.String("dns-addr", "", "UDP address for the DNS server")
+	httpAddress := flags.String("http-addr", "", "TCP address for the HTTP API")
+	disableHTTP := flags.Bool("disable-http", false, "don't start the HTTP API")
+	logLevel := flags.String("log-level", "", "minimum level to log: error, warn, info or debug")
+	defaultTTL := flags.Uint("ttl", 0, "TTL in seconds for served records")
+	validateFile := flags.String("validate", "", "validate a store file and exit")
+	exportOrigin := flags.String("export", "", "print the store as a BIND zone file for this origin (\".\" for all) and exit")
+	generateStatic := flags.String("generate-static", "", "compile the store file into this Go source file for -tags static builds and exit")
+	replayFile := flags.String("replay", "", "answer the queries in a capture file, compare the responses and exit")
+	showVersion := flags.Bool("version", false, "print the version and exit")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg, err := LoadConfig(*configFile)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ConfigFile = *configFile
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "store":
+			cfg.StoreFile = *storeFile
+		case "dns-addr":
+			cfg.DNSAddress = *dnsAddress
+		case "http-addr":
+			cfg.HTTPAddress = *httpAddress
+		case "disable-http":
+			cfg.DisableHTTP = *disableHTTP
+		case "log-level":
+			cfg.LogLevel = *logLevel
+		case "ttl":
+			cfg.DefaultTTL = uint32(*defaultTTL)
+		case "validate":
+			cfg.ValidateFile = *validateFile
+		case "export":
+			cfg.ExportOrigin = *exportOrigin
+		case "generate-static":
+			cfg.GenerateStatic = *generateStatic
+		case "replay":
+			cfg.ReplayFile = *replayFile
+		case "version":
+			cfg.ShowVersion = *showVersion
+		}
+	})
+
+	return cfg, nil
+}
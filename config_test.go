@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseConfigLayersFileAndFlags(t *testing.T) {
+	path := writeConfigFile(t, `{"storeFile": "/srv/names.json", "dnsAddress": ":53", "defaultTTL": 60}`)
+
+	cfg, err := ParseConfig([]string{"-config", path, "-dns-addr", ":5353"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.StoreFile != "/srv/names.json" || cfg.DefaultTTL != 60 {
+		t.Errorf("file settings weren't applied: store %q, TTL %d", cfg.StoreFile, cfg.DefaultTTL)
+	}
+	if cfg.DNSAddress != ":5353" {
+		t.Errorf("DNSAddress = %q, want the flag's :5353", cfg.DNSAddress)
+	}
+	if cfg.HTTPAddress != DefaultConfig().HTTPAddress {
+		t.Errorf("HTTPAddress = %q, want the default", cfg.HTTPAddress)
+	}
+}
+
+func TestLoadConfigMissingAndInvalidFiles(t *testing.T) {
+	cfg, err := LoadConfig(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil || cfg.DNSAddress != DefaultConfig().DNSAddress {
+		t.Errorf("a missing config file gave %+v, %v; want the defaults", cfg, err)
+	}
+
+	_, err = LoadConfig(writeConfigFile(t, `{"dnsAddress": `))
+	if err == nil {
+		t.Error("an invalid config file was accepted")
+	}
+}
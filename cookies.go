@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	EDNSOptionCookie uint16 = 10 // RFC 7873
+
+	// RcodeBadCookie is an extended rcode: the low four bits go in the
+	// header and the rest in the OPT record
+	RcodeBadCookie uint16 = 23
+
+	clientCookieSizeBytes = 8
+	serverCookieSizeBytes = 16
+	serverCookieVersion   = 1
+
+	// Server cookies older than this, or from further in the future than
+	// serverCookieMaxSkew, are treated as invalid (RFC 9018 section 4.3)
+	serverCookieLifetime = time.Hour
+	serverCookieMaxSkew  = 5 * time.Minute
+)
+
+// CookieConfig enables DNS cookies. Secret is a hex encoded key for server
+// cookies, generated at startup when empty; servers sharing an anycast
+// address need the same one. In Strict mode UDP queries without a valid
+// server cookie get BADCOOKIE and a fresh cookie instead of an answer, and
+// UDP queries without any cookie an empty truncated response.
+type CookieConfig struct {
+	Enabled bool   `json:"enabled"`
+	Secret  string `json:"secret"`
+	Strict  bool   `json:"strict"`
+}
+
+// DNSCookie is the COOKIE option of a query. Server is empty on a client's
+// first query.
+type DNSCookie struct {
+	Client []byte
+	Server []byte
+}
+
+var cookieSecret []byte
+
+// LoadCookieSecret decodes the configured cookie secret, or generates one.
+func LoadCookieSecret(cfg CookieConfig) ([]byte, error) {
+	if cfg.Secret == "" {
+		secret := make([]byte, 16)
+		_, err := rand.Read(secret)
+		return secret, err
+	}
+
+	secret, err := hex.DecodeString(cfg.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cookie secret: %v", err)
+	}
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("cookie secret must be at least 16 bytes")
+	}
+	return secret, nil
+}
+
+// parseCookie decodes the data of a COOKIE option: an 8 byte client cookie
+// optionally followed by an 8 to 32 byte server cookie.
+func parseCookie(optionData []byte) (*DNSCookie, error) {
+	if len(optionData) != clientCookieSizeBytes && (len(optionData) < clientCookieSizeBytes+8 || len(optionData) > clientCookieSizeBytes+32) {
+		return nil, fmt.Errorf("cookie option has invalid length %d", len(optionData))
+	}
+
+	return &DNSCookie{
+		Client: append([]byte(nil), optionData[:clientCookieSizeBytes]...),
+		Server: append([]byte(nil), optionData[clientCookieSizeBytes:]...),
+	}, nil
+}
+
+// encode builds the full option, code and length included, for the response.
+func (cookie DNSCookie) encode() []byte {
+	option := binary.BigEndian.AppendUint16(nil, EDNSOptionCookie)
+	option = binary.BigEndian.AppendUint16(option, uint16(len(cookie.Client)+len(cookie.Server)))
+	option = append(option, cookie.Client...)
+	return append(option, cookie.Server...)
+}
+
+// serverCookie builds a server cookie in the RFC 9018 layout: version,
+// three reserved bytes, a timestamp and a hash binding them to the client
+// cookie and address. The hash is a truncated HMAC-SHA256 rather than
+// SipHash, which is fine as only this server needs to verify it.
+func serverCookie(clientCookie []byte, clientAddress net.IP, timestamp uint32) []byte {
+	cookie := []byte{serverCookieVersion, 0, 0, 0}
+	cookie = binary.BigEndian.AppendUint32(cookie, timestamp)
+
+	mac := hmac.New(sha256.New, cookieSecret)
+	mac.Write(clientCookie)
+	mac.Write(cookie)
+	mac.Write(clientAddress)
+	return mac.Sum(cookie)[:serverCookieSizeBytes]
+}
+
+// validServerCookie checks the server cookie a client sent back against the
+// one we would have given it.
+func validServerCookie(cookie DNSCookie, clientAddress net.IP, now time.Time) bool {
+	if len(cookie.Server) != serverCookieSizeBytes || cookie.Server[0] != serverCookieVersion {
+		return false
+	}
+
+	issued := time.Unix(int64(binary.BigEndian.Uint32(cookie.Server[4:8])), 0)
+	if now.Sub(issued) > serverCookieLifetime || issued.Sub(now) > serverCookieMaxSkew {
+		return false
+	}
+
+	expected := serverCookie(cookie.Client, clientAddress, uint32(issued.Unix()))
+	return hmac.Equal(cookie.Server, expected)
+}
+
+// requiresCookie reports whether a query without a cookie must be sent to
+// TCP instead of answered. Only strict mode requires cookies, and only over
+// UDP as a TCP connection already proves the client address.
+func requiresCookie(edns *EDNSOptions, isUDP bool) bool {
+	cookies := currentConfig().Cookies
+	return cookies.Enabled && cookies.Strict && isUDP && (edns == nil || edns.Cookie == nil)
+}
+
+// checkCookie validates the cookie of a query and replaces its server part
+// with a fresh one for the response. It reports whether the query must be
+// answered with BADCOOKIE. Queries without a cookie are left to
+// requiresCookie, and TCP queries are never rejected as the connection
+// already proves the client address.
+func checkCookie(cookie *DNSCookie, clientAddress net.IP, isUDP bool) bool {
+	if !currentConfig().Cookies.Enabled || cookie == nil {
+		return false
+	}
+
+	now := time.Now()
+	valid := validServerCookie(*cookie, clientAddress, now)
+	cookie.Server = serverCookie(cookie.Client, clientAddress, uint32(now.Unix()))
+
+	return !valid && currentConfig().Cookies.Strict && isUDP
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func cookieConfig(t *testing.T, strict bool) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Cookies = CookieConfig{Enabled: true, Strict: strict}
+	useConfig(t, cfg, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+
+	previous := cookieSecret
+	cookieSecret = bytes.Repeat([]byte{7}, 16)
+	t.Cleanup(func() { cookieSecret = previous })
+}
+
+var clientCookie = []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+func TestStrictCookiesSendCookielessUDPToTCP(t *testing.T) {
+	cookieConfig(t, true)
+
+	for _, request := range [][]byte{
+		buildQuery(1, 0, "www.example.com", TypeA),
+		withOPT(buildQuery(1, 0, "www.example.com", TypeA), 0),
+	} {
+		response := serve(t, newWriter("192.0.2.1", true), request)
+		if response.Header.Flags&FlagTruncated == 0 || len(response.Answers) != 0 {
+			t.Errorf("cookieless UDP query got %d answers, TC %v; want an empty truncated response", len(response.Answers), response.Header.Flags&FlagTruncated != 0)
+		}
+	}
+
+	response := serve(t, newWriter("192.0.2.1", false), buildQuery(1, 0, "www.example.com", TypeA))
+	if len(response.Answers) != 1 {
+		t.Errorf("cookieless TCP query got %d answers, want 1", len(response.Answers))
+	}
+}
+
+func TestStrictCookiesRejectMissingServerCookie(t *testing.T) {
+	cookieConfig(t, true)
+
+	request := withOPT(buildQuery(1, 0, "www.example.com", TypeA), 0, DNSCookie{Client: clientCookie}.encode())
+	response := serve(t, newWriter("192.0.2.1", true), request)
+	edns := responseOPTOf(response)
+	if edns == nil || edns.Cookie == nil || len(edns.Cookie.Server) != serverCookieSizeBytes {
+		t.Fatal("the response carries no server cookie")
+	}
+	rcode := responseCode(response) | uint16(response.Additionals[0].TimeToLive>>24)<<4
+	if rcode != RcodeBadCookie || len(response.Answers) != 0 {
+		t.Fatalf("rcode = %d with %d answers, want BADCOOKIE and none", rcode, len(response.Answers))
+	}
+
+	request = withOPT(buildQuery(2, 0, "www.example.com", TypeA), 0, edns.Cookie.encode())
+	response = serve(t, newWriter("192.0.2.1", true), request)
+	if responseCode(response) != RcodeNoError || len(response.Answers) != 1 {
+		t.Errorf("query with a valid server cookie got rcode %d and %d answers", responseCode(response), len(response.Answers))
+	}
+
+	response = serve(t, newWriter("192.0.2.99", true), request)
+	if len(response.Answers) != 0 {
+		t.Error("a server cookie issued to another address was accepted")
+	}
+}
+
+func TestLaxCookiesAnswerEveryone(t *testing.T) {
+	cookieConfig(t, false)
+
+	response := serve(t, newWriter("192.0.2.1", true), buildQuery(1, 0, "www.example.com", TypeA))
+	if len(response.Answers) != 1 || response.Header.Flags&FlagTruncated != 0 {
+		t.Errorf("cookieless query got %d answers, want a full answer", len(response.Answers))
+	}
+
+	request := withOPT(buildQuery(1, 0, "www.example.com", TypeA), 0, DNSCookie{Client: clientCookie}.encode())
+	response = serve(t, newWriter("192.0.2.1", true), request)
+	edns := responseOPTOf(response)
+	if len(response.Answers) != 1 || edns == nil || edns.Cookie == nil || !bytes.Equal(edns.Cookie.Client, clientCookie) {
+		t.Error("a query with a client cookie didn't get an answer and the cookie back")
+	}
+}
+
+func TestMalformedCookieIsFormErr(t *testing.T) {
+	cookieConfig(t, false)
+
+	malformed := DNSCookie{Client: clientCookie[:5]}.encode()
+	response := serve(t, newWriter("192.0.2.1", true), withOPT(buildQuery(1, 0, "www.example.com", TypeA), 0, malformed))
+	if responseCode(response) != RcodeFormatError {
+		t.Errorf("rcode = %d, want FORMERR", responseCode(response))
+	}
+}
+
+func TestServerCookieLifetime(t *testing.T) {
+	cookieConfig(t, true)
+	address := net.ParseIP("192.0.2.1")
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		issued time.Time
+		valid  bool
+	}{
+		{"just issued", now, true},
+		{"within its lifetime", now.Add(-serverCookieLifetime + time.Minute), true},
+		{"expired", now.Add(-serverCookieLifetime - time.Minute), false},
+		{"from the far future", now.Add(serverCookieMaxSkew + time.Minute), false},
+	}
+	for _, test := range tests {
+		cookie := DNSCookie{Client: clientCookie, Server: serverCookie(clientCookie, address, uint32(test.issued.Unix()))}
+		if valid := validServerCookie(cookie, address, now); valid != test.valid {
+			t.Errorf("%s: valid = %v, want %v", test.name, valid, test.valid)
+		}
+	}
+
+	// A returning client's cookie is accepted and refreshed
+	old := DNSCookie{Client: clientCookie, Server: serverCookie(clientCookie, address, uint32(now.Add(-30*time.Minute).Unix()))}
+	response := serve(t, newWriter("192.0.2.1", true), withOPT(buildQuery(1, 0, "www.example.com", TypeA), 0, old.encode()))
+	edns := responseOPTOf(response)
+	if len(response.Answers) != 1 || edns == nil || edns.Cookie == nil {
+		t.Fatal("a returning client wasn't answered with a cookie")
+	}
+	if bytes.Equal(edns.Cookie.Server, old.Server) || !validServerCookie(*edns.Cookie, address, now) {
+		t.Error("the returning client didn't get a fresh server cookie")
+	}
+}
+
+func TestLoadCookieSecret(t *testing.T) {
+	secret, err := LoadCookieSecret(CookieConfig{})
+	if err != nil || len(secret) != 16 {
+		t.Errorf("generated secret = %x, %v; want 16 random bytes", secret, err)
+	}
+	secret, err = LoadCookieSecret(CookieConfig{Secret: "000102030405060708090a0b0c0d0e0f"})
+	if err != nil || len(secret) != 16 || secret[15] != 15 {
+		t.Errorf("configured secret = %x, %v", secret, err)
+	}
+	for _, bad := range []string{"not hex", "0001020304"} {
+		_, err = LoadCookieSecret(CookieConfig{Secret: bad})
+		if err == nil {
+			t.Errorf("the secret %q was accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// CORSConfig lets browser dashboards on other origins call the HTTP API.
+// Cross-origin requests are refused unless their origin is listed in
+// AllowedOrigins, where "*" allows every origin. Methods and headers default
+// to what the API uses.
+type CORSConfig struct {
+	AllowedOrigins []string `json:"allowedOrigins"`
+	AllowedMethods []string `json:"allowedMethods"`
+	AllowedHeaders []string `json:"allowedHeaders"`
+	MaxAgeSeconds  int      `json:"maxAgeSeconds"`
+}
+
+// originAllowed reports whether the origin may call the API.
+func (cors CORSConfig) originAllowed(origin string) bool {
+	return slices.Contains(cors.AllowedOrigins, "*") || slices.ContainsFunc(cors.AllowedOrigins, func(allowed string) bool {
+		return strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin)
+	})
+}
+
+// withCORS adds the CORS headers for allowed origins and answers preflight
+// requests itself. Preflights from other origins are rejected so they never
+// reach a handler, since some handlers act on any method.
+func withCORS(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cors := currentConfig().CORS
+
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		if origin == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if !cors.originAllowed(origin) {
+			if preflight {
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if !preflight {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		methods := cors.AllowedMethods
+		if len(methods) == 0 {
+			methods = []string{http.MethodGet, http.MethodPost, http.MethodDelete}
+		}
+		headers := cors.AllowedHeaders
+		if len(headers) == 0 {
+			headers = []string{"Authorization", "Content-Type"}
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(valueOrDefaultInt(cors.MaxAgeSeconds, 600)))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// corsRequest sends a request from a browser on origin through the CORS
+// handling, as a preflight for the method when preflightMethod is set.
+func corsRequest(method string, target string, origin string, preflightMethod string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("Origin", origin)
+	if preflightMethod != "" {
+		r.Header.Set("Access-Control-Request-Method", preflightMethod)
+	}
+	w := httptest.NewRecorder()
+	withCORS(httpHandlers()).ServeHTTP(w, r)
+	return w
+}
+
+func TestCORSPreflight(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CORS = CORSConfig{AllowedOrigins: []string{"https://dashboard.example.com/"}}
+	useConfig(t, cfg)
+
+	w := corsRequest(http.MethodOptions, "/add-entry", "https://dashboard.example.com", http.MethodPost)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("preflight status %d, want 204", w.Code)
+	}
+	headers := map[string]string{
+		"Access-Control-Allow-Origin":  "https://dashboard.example.com",
+		"Access-Control-Allow-Methods": "GET, POST, DELETE",
+		"Access-Control-Allow-Headers": "Authorization, Content-Type",
+		"Access-Control-Max-Age":       "600",
+		"Vary":                         "Origin",
+	}
+	for header, want := range headers {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+
+	w = corsRequest(http.MethodOptions, "/add-entry", "https://evil.example.net", http.MethodPost)
+	if w.Code != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("preflight from another origin: status %d, allowed origin %q, want 403 and none", w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+	}
+}
+
+func TestCORSConfiguredMethodsAndHeaders(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CORS = CORSConfig{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{http.MethodGet},
+		AllowedHeaders: []string{"X-Requested-With"},
+		MaxAgeSeconds:  60,
+	}
+	useConfig(t, cfg)
+
+	w := corsRequest(http.MethodOptions, "/entries", "https://anywhere.example.org", http.MethodGet)
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://anywhere.example.org" {
+		t.Errorf("wildcard origins allowed %q", w.Header().Get("Access-Control-Allow-Origin"))
+	}
+	if w.Header().Get("Access-Control-Allow-Methods") != "GET" || w.Header().Get("Access-Control-Allow-Headers") != "X-Requested-With" || w.Header().Get("Access-Control-Max-Age") != "60" {
+		t.Errorf("preflight headers = %v, want the configured ones", w.Header())
+	}
+}
+
+func TestCORSIsOffByDefault(t *testing.T) {
+	useConfig(t, DefaultConfig())
+
+	w := corsRequest(http.MethodOptions, "/entries", "https://dashboard.example.com", http.MethodGet)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("preflight status %d, want 403 without allowed origins", w.Code)
+	}
+
+	w = corsRequest(http.MethodGet, "/entries", "https://dashboard.example.com", "")
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("a cross-origin response allows %q", w.Header().Get("Access-Control-Allow-Origin"))
+	}
+
+	// Same-origin and non-browser requests aren't affected
+	r := httptest.NewRequest(http.MethodGet, "/entries", nil)
+	w = httptest.NewRecorder()
+	withCORS(httpHandlers()).ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Vary") != "" {
+		t.Errorf("request without an origin: status %d, Vary %q", w.Code, w.Header().Get("Vary"))
+	}
+}
+
+func TestCORSAllowedOriginOnActualRequest(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CORS = CORSConfig{AllowedOrigins: []string{"https://dashboard.example.com"}}
+	useConfig(t, cfg)
+
+	w := corsRequest(http.MethodGet, "/entries", "https://DASHBOARD.example.com", "")
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "https://DASHBOARD.example.com" {
+		t.Errorf("status %d, allowed origin %q, want the request served with its origin allowed", w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type debugHeader struct {
+	ID             uint16   `json:"id"`
+	Opcode         uint16   `json:"opcode"`
+	Rcode          string   `json:"rcode"`
+	Flags          []string `json:"flags"`
+	NumQuestions   uint16   `json:"numQuestions"`
+	NumAnswers     uint16   `json:"numAnswers"`
+	NumAuthorities uint16   `json:"numAuthorities"`
+	NumAdditionals uint16   `json:"numAdditionals"`
+}
+
+type debugRecord struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class uint16 `json:"class"`
+	TTL   uint32 `json:"ttl,omitempty"`
+	Data  string `json:"data,omitempty"`
+}
+
+type debugMessage struct {
+	Header      debugHeader   `json:"header"`
+	Questions   []debugRecord `json:"questions"`
+	Answers     []debugRecord `json:"answers"`
+	Authorities []debugRecord `json:"authorities"`
+	Additionals []debugRecord `json:"additionals"`
+}
+
+// debugView converts a decoded message into its JSON form.
+func debugView(message DNSResponse) debugMessage {
+	view := debugMessage{
+		Header: debugHeader{
+			ID:             message.Header.TransactionID,
+			Opcode:         (message.Header.Flags >> 11) & 0x0f,
+			Rcode:          rcodeName(message.Header.Flags),
+			Flags:          flagNames(message.Header.Flags),
+			NumQuestions:   message.Header.NumQuestions,
+			NumAnswers:     message.Header.NumAnswers,
+			NumAuthorities: message.Header.NumAuthorities,
+			NumAdditionals: message.Header.NumAdditionals,
+		},
+		Questions:   []debugRecord{},
+		Answers:     []debugRecord{},
+		Authorities: []debugRecord{},
+		Additionals: []debugRecord{},
+	}
+
+	for _, question := range message.Questions {
+		view.Questions = append(view.Questions, debugRecord{Name: absoluteName(question.DomainName), Type: typeName(question.Type), Class: question.Class})
+	}
+	for _, section := range []struct {
+		records []DNSResourceRecord
+		view    *[]debugRecord
+	}{{message.Answers, &view.Answers}, {message.Authorities, &view.Authorities}, {message.Additionals, &view.Additionals}} {
+		for _, resourceRecord := range section.records {
+			*section.view = append(*section.view, debugRecord{
+				Name:  absoluteName(resourceRecord.DomainName),
+				Type:  typeName(resourceRecord.Type),
+				Class: resourceRecord.Class,
+				TTL:   resourceRecord.TimeToLive,
+				Data:  formatWireResourceData(resourceRecord),
+			})
+		}
+	}
+
+	return view
+}
+
+// capturingResponseWriter keeps the response instead of sending it. Unless
+// udp is set it behaves like a TCP connection, so the response is never
+// truncated.
+type capturingResponseWriter struct {
+	remoteAddr net.Addr
+	udp        bool
+	response   []byte
+}
+
+func (w *capturingResponseWriter) WriteResponse(responseBytes []byte) error {
+	w.response = append([]byte(nil), responseBytes...)
+	return nil
+}
+
+func (w *capturingResponseWriter) RemoteAddr() net.Addr { return w.remoteAddr }
+func (w *capturingResponseWriter) IsUDP() bool          { return w.udp }
+
+// handleQueryDebug decodes the base64 wire-format query in the 'query'
+// parameter and returns it as JSON, along with the response the server gives
+// it. Standard and URL-safe base64 are accepted, with or without padding.
+func handleQueryDebug(w http.ResponseWriter, r *http.Request) {
+	encoded := r.URL.Query().Get("query")
+	if encoded == "" {
+		http.Error(w, "The 'query' parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	encoded = strings.NewReplacer("+", "-", "/", "_").Replace(strings.TrimRight(encoded, "="))
+	queryBytes, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid base64 query: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	query, err := parseResponse(queryBytes)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid DNS message: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Answer as if the query came from the HTTP client
+	remoteAddr, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	responseWriter := &capturingResponseWriter{remoteAddr: remoteAddr}
+	handleDNSClient(r.Context(), queryBytes, responseWriter)
+
+	result := struct {
+		Query    debugMessage  `json:"query"`
+		Response *debugMessage `json:"response,omitempty"`
+		Error    string        `json:"error,omitempty"`
+	}{Query: debugView(query)}
+
+	response, err := parseResponse(responseWriter.response)
+	if err != nil {
+		result.Error = fmt.Sprintf("error decoding response: %v", err)
+	} else {
+		view := debugView(response)
+		result.Response = &view
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(result)
+}
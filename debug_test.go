@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestQueryDebug(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	useConfig(t, cfg, NameModel{Name: "www.example.com", Address: "192.0.2.10", TTL: 60})
+
+	request := buildQuery(0xbeef, FlagRecursionDesired, "www.example.com", TypeA)
+	w := apiRequest(t, http.MethodGet, "/query-debug?query="+base64.RawURLEncoding.EncodeToString(request), "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("/query-debug: status %d: %s", w.Code, w.Body)
+	}
+
+	var result struct {
+		Query    debugMessage  `json:"query"`
+		Response *debugMessage `json:"response"`
+	}
+	err := json.NewDecoder(w.Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := result.Query.Header
+	if header.ID != 0xbeef || header.Rcode != "NOERROR" || len(header.Flags) != 1 || header.Flags[0] != "rd" || header.NumQuestions != 1 {
+		t.Errorf("decoded query header %+v", header)
+	}
+	if len(result.Query.Questions) != 1 || result.Query.Questions[0] != (debugRecord{Name: "www.example.com.", Type: "A", Class: ClassINET}) {
+		t.Errorf("decoded questions %+v", result.Query.Questions)
+	}
+	if result.Response == nil || len(result.Response.Answers) != 1 ||
+		result.Response.Answers[0] != (debugRecord{Name: "www.example.com.", Type: "A", Class: ClassINET, TTL: 60, Data: "192.0.2.10"}) {
+		t.Errorf("decoded response %+v", result.Response)
+	}
+
+	// Standard base64 with padding is accepted too
+	w = apiRequest(t, http.MethodGet, "/query-debug?query="+url.QueryEscape(base64.StdEncoding.EncodeToString(request)), "", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("/query-debug with standard base64: status %d: %s", w.Code, w.Body)
+	}
+
+	for _, bad := range []string{"", "not*base64", "AAAA"} {
+		w = apiRequest(t, http.MethodGet, "/query-debug?query="+bad, "", "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("/query-debug?query=%s: status %d, want 400", bad, w.Code)
+		}
+	}
+}
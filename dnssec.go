@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	TypeRRSIG  uint16 = 46 // signature over an RRset, RFC 4034
+	TypeDNSKEY uint16 = 48 // zone public key, RFC 4034
+
+	FlagAuthenticData    uint16 = 1 << 5
+	FlagCheckingDisabled uint16 = 1 << 4
+
+	DNSSECAlgorithmECDSAP256SHA256 uint8  = 13 // RFC 6605
+	DNSKEYProtocol                 uint8  = 3
+	DNSKEYFlagZone                 uint16 = 1 << 8
+	DNSKEYFlagSecureEntryPoint     uint16 = 1 // set on key signing keys
+)
+
+// DNSSECConfig configures online signing of the local zone.
+type DNSSECConfig struct {
+	Enabled               bool   `json:"enabled"`
+	Zone                  string `json:"zone"`
+	KSKFile               string `json:"kskFile"`
+	ZSKFile               string `json:"zskFile"`
+	SignatureValidityDays uint32 `json:"signatureValidityDays"`
+}
+
+// ZoneKey is a DNSSEC signing key. Keys use ECDSA P-256 with SHA-256.
+type ZoneKey struct {
+	Flags      uint16
+	PrivateKey *ecdsa.PrivateKey
+}
+
+// ZoneSigner signs the answers served for one zone. The KSK signs the DNSKEY
+// RRset at the apex and the ZSK signs everything else.
+type ZoneSigner struct {
+	Zone     string
+	KSK      ZoneKey
+	ZSK      ZoneKey
+	Validity time.Duration
+}
+
+var zoneSigner *ZoneSigner
+
+func NewZoneSigner(dnssecConfig DNSSECConfig) (*ZoneSigner, error) {
+	zone, err := CanonicalName(dnssecConfig.Zone)
+	if err != nil || zone == "" {
+		return nil, fmt.Errorf("invalid DNSSEC zone %q", dnssecConfig.Zone)
+	}
+
+	ksk, err := loadZoneKey(dnssecConfig.KSKFile, DNSKEYFlagZone|DNSKEYFlagSecureEntryPoint)
+	if err != nil {
+		return nil, fmt.Errorf("error loading KSK: %v", err)
+	}
+
+	zsk, err := loadZoneKey(dnssecConfig.ZSKFile, DNSKEYFlagZone)
+	if err != nil {
+		return nil, fmt.Errorf("error loading ZSK: %v", err)
+	}
+
+	validityDays := dnssecConfig.SignatureValidityDays
+	if validityDays == 0 {
+		validityDays = 7
+	}
+
+	return &ZoneSigner{
+		Zone:     zone,
+		KSK:      ksk,
+		ZSK:      zsk,
+		Validity: time.Duration(validityDays) * 24 * time.Hour,
+	}, nil
+}
+
+// loadZoneKey reads a PEM encoded EC private key. If the file doesn't exist a
+// new key is generated and written there; an empty path keeps the generated
+// key in memory only.
+func loadZoneKey(path string, flags uint16) (ZoneKey, error) {
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			privateKey, err := parseZoneKeyPEM(data)
+			return ZoneKey{Flags: flags, PrivateKey: privateKey}, err
+		}
+		if !os.IsNotExist(err) {
+			return ZoneKey{}, err
+		}
+	}
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return ZoneKey{}, err
+	}
+
+	if path != "" {
+		der, err := x509.MarshalECPrivateKey(privateKey)
+		if err != nil {
+			return ZoneKey{}, err
+		}
+		err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+		if err != nil {
+			return ZoneKey{}, err
+		}
+		logInfo("Generated new DNSSEC key", path)
+	}
+
+	return ZoneKey{Flags: flags, PrivateKey: privateKey}, nil
+}
+
+func parseZoneKeyPEM(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	if block.Type == "EC PRIVATE KEY" {
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok || privateKey.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("DNSSEC keys must be ECDSA P-256")
+	}
+
+	return privateKey, nil
+}
+
+// DNSKEYData returns the DNSKEY rdata: flags, protocol, algorithm and the
+// public key as the concatenated X and Y coordinates (RFC 6605 section 4).
+func (key ZoneKey) DNSKEYData() []byte {
+	publicKey, _ := key.PrivateKey.PublicKey.ECDH()
+	point := publicKey.Bytes() // uncompressed form, 0x04 || X || Y
+
+	data := binary.BigEndian.AppendUint16(nil, key.Flags)
+	data = append(data, DNSKEYProtocol, DNSSECAlgorithmECDSAP256SHA256)
+	return append(data, point[1:]...)
+}
+
+// KeyTag computes the key tag of the DNSKEY as in RFC 4034 appendix B.
+func (key ZoneKey) KeyTag() uint16 {
+	var accumulator uint32
+	for i, b := range key.DNSKEYData() {
+		if i&1 == 0 {
+			accumulator += uint32(b) << 8
+		} else {
+			accumulator += uint32(b)
+		}
+	}
+	accumulator += accumulator >> 16 & 0xFFFF
+	return uint16(accumulator & 0xFFFF)
+}
+
+// InZone reports whether a name is the zone apex or below it.
+func (signer *ZoneSigner) InZone(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	return name == signer.Zone || strings.HasSuffix(name, "."+signer.Zone)
+}
+
+// DNSKEYRecords returns the DNSKEY RRset served at the zone apex.
+func (signer *ZoneSigner) DNSKEYRecords() []DNSResourceRecord {
+	var records []DNSResourceRecord
+	for _, key := range []ZoneKey{signer.KSK, signer.ZSK} {
+		data := key.DNSKEYData()
+		records = append(records, DNSResourceRecord{
+			DomainName:         signer.Zone,
+			Type:               TypeDNSKEY,
+			Class:              ClassINET,
+			TimeToLive:         findZone(signer.Zone).TTL(),
+			ResourceData:       data,
+			ResourceDataLength: uint16(len(data)),
+		})
+	}
+	return records
+}
+
+// Sign returns the records with an RRSIG appended after each in-zone RRset.
+// Records are grouped into RRsets by owner name, type and class.
+func (signer *ZoneSigner) Sign(records []DNSResourceRecord) ([]DNSResourceRecord, bool) {
+	var rrsets [][]DNSResourceRecord
+	index := make(map[string]int)
+
+	for _, record := range records {
+		key := fmt.Sprintf("%s/%d/%d", strings.ToLower(record.DomainName), record.Type, record.Class)
+		i, ok := index[key]
+		if !ok {
+			i = len(rrsets)
+			index[key] = i
+			rrsets = append(rrsets, nil)
+		}
+		rrsets[i] = append(rrsets[i], record)
+	}
+
+	signed := false
+	signedRecords := make([]DNSResourceRecord, 0, len(records)+len(rrsets))
+
+	for _, rrset := range rrsets {
+		signedRecords = append(signedRecords, rrset...)
+
+		if !signer.InZone(rrset[0].DomainName) || rrset[0].Type == TypeRRSIG || rrset[0].Type == TypeOPT {
+			continue
+		}
+
+		key := signer.ZSK
+		if rrset[0].Type == TypeDNSKEY {
+			key = signer.KSK
+		}
+
+		rrsig, err := signer.signRRset(key, rrset)
+		if err != nil {
+			logError("Error signing RRset for", rrset[0].DomainName, ":", err)
+			continue
+		}
+
+		signedRecords = append(signedRecords, rrsig)
+		signed = true
+	}
+
+	return signedRecords, signed
+}
+
+// signRRset builds the RRSIG for an RRset following RFC 4034 section 3.1.8.1:
+// the signature covers the RRSIG rdata (minus the signature) followed by each
+// record in canonical form and canonical order.
+func (signer *ZoneSigner) signRRset(key ZoneKey, rrset []DNSResourceRecord) (DNSResourceRecord, error) {
+	owner := strings.ToLower(strings.TrimSuffix(rrset[0].DomainName, "."))
+	labels := 0
+	if owner != "" {
+		labels = len(strings.Split(owner, "."))
+	}
+
+	now := time.Now()
+	originalTTL := rrset[0].TimeToLive
+
+	var rrsigData bytes.Buffer
+	Write(&rrsigData, rrset[0].Type)
+	rrsigData.WriteByte(DNSSECAlgorithmECDSAP256SHA256)
+	rrsigData.WriteByte(byte(labels))
+	Write(&rrsigData, originalTTL)
+	Write(&rrsigData, uint32(now.Add(signer.Validity).Unix()))
+	Write(&rrsigData, uint32(now.Add(-time.Hour).Unix()))
+	Write(&rrsigData, key.KeyTag())
+	writeDomainName(&rrsigData, signer.Zone)
+
+	resourceDatas := make([][]byte, 0, len(rrset))
+	for _, record := range rrset {
+		resourceDatas = append(resourceDatas, record.ResourceData)
+	}
+	sort.Slice(resourceDatas, func(i, j int) bool { return bytes.Compare(resourceDatas[i], resourceDatas[j]) < 0 })
+
+	var signedData bytes.Buffer
+	signedData.Write(rrsigData.Bytes())
+	for _, resourceData := range resourceDatas {
+		writeDomainName(&signedData, owner)
+		Write(&signedData, rrset[0].Type)
+		Write(&signedData, rrset[0].Class)
+		Write(&signedData, originalTTL)
+		Write(&signedData, uint16(len(resourceData)))
+		signedData.Write(resourceData)
+	}
+
+	digest := sha256.Sum256(signedData.Bytes())
+	r, s, err := ecdsa.Sign(rand.Reader, key.PrivateKey, digest[:])
+	if err != nil {
+		return DNSResourceRecord{}, err
+	}
+
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	data := append(rrsigData.Bytes(), signature...)
+
+	return DNSResourceRecord{
+		DomainName:         rrset[0].DomainName,
+		Type:               TypeRRSIG,
+		Class:              rrset[0].Class,
+		TimeToLive:         originalTTL,
+		ResourceData:       data,
+		ResourceDataLength: uint16(len(data)),
+	}, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+	"sort"
+	"testing"
+)
+
+// useZoneSigner signs example.com with in-memory keys for one test.
+func useZoneSigner(t *testing.T) *ZoneSigner {
+	t.Helper()
+	signer, err := NewZoneSigner(DNSSECConfig{Enabled: true, Zone: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := zoneSigner
+	zoneSigner = signer
+	t.Cleanup(func() { zoneSigner = previous })
+	return signer
+}
+
+// verifyRRSIG checks an RRSIG over an RRset with key, rebuilding the
+// signed data as in RFC 4034 section 3.1.8.1.
+func verifyRRSIG(t *testing.T, key ZoneKey, rrsig DNSResourceRecord, rrset []DNSResourceRecord) bool {
+	t.Helper()
+	data := rrsig.ResourceData
+	if len(data) < 18+64 || binary.BigEndian.Uint16(data) != rrset[0].Type || binary.BigEndian.Uint16(data[16:]) != key.KeyTag() {
+		return false
+	}
+	rrsigData, signature := data[:len(data)-64], data[len(data)-64:]
+	originalTTL := binary.BigEndian.Uint32(data[4:])
+
+	resourceDatas := make([][]byte, 0, len(rrset))
+	for _, record := range rrset {
+		resourceDatas = append(resourceDatas, record.ResourceData)
+	}
+	sort.Slice(resourceDatas, func(i, j int) bool { return bytes.Compare(resourceDatas[i], resourceDatas[j]) < 0 })
+
+	signed := bytes.NewBuffer(append([]byte(nil), rrsigData...))
+	for _, resourceData := range resourceDatas {
+		writeDomainName(signed, canonicalTarget(rrset[0].DomainName))
+		Write(signed, rrset[0].Type)
+		Write(signed, rrset[0].Class)
+		Write(signed, originalTTL)
+		Write(signed, uint16(len(resourceData)))
+		signed.Write(resourceData)
+	}
+
+	digest := sha256.Sum256(signed.Bytes())
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	return ecdsa.Verify(&key.PrivateKey.PublicKey, digest[:], r, s)
+}
+
+func TestSignedAnswers(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	useConfig(t, cfg,
+		NameModel{Name: "www.example.com", Address: "192.0.2.10"},
+		NameModel{Name: "www.example.com", Address: "192.0.2.11"},
+	)
+	signer := useZoneSigner(t)
+
+	request := withOPT(buildQuery(1, FlagRecursionDesired, "www.example.com", TypeA), EDNSFlagDNSSECOK)
+	response := serve(t, newWriter("192.0.2.1", true), request)
+	if response.Header.Flags&FlagAuthenticData == 0 {
+		t.Error("a signed answer doesn't set AD")
+	}
+	var rrset, rrsigs []DNSResourceRecord
+	for _, answer := range response.Answers {
+		switch answer.Type {
+		case TypeA:
+			rrset = append(rrset, answer)
+		case TypeRRSIG:
+			rrsigs = append(rrsigs, answer)
+		}
+	}
+	if len(rrset) != 2 || len(rrsigs) != 1 {
+		t.Fatalf("got %d A records and %d RRSIGs, want 2 and 1", len(rrset), len(rrsigs))
+	}
+	if !verifyRRSIG(t, signer.ZSK, rrsigs[0], rrset) {
+		t.Error("the RRSIG over the A RRset doesn't verify with the ZSK")
+	}
+
+	request = withOPT(buildQuery(2, 0, "example.com", TypeDNSKEY), EDNSFlagDNSSECOK)
+	response = serve(t, newWriter("192.0.2.1", false), request)
+	var dnskeys []DNSResourceRecord
+	for _, answer := range response.Answers {
+		if answer.Type == TypeDNSKEY {
+			dnskeys = append(dnskeys, answer)
+		}
+	}
+	if len(dnskeys) != 2 || len(response.Answers) != 3 {
+		t.Fatalf("DNSKEY answer has %d records, want both keys and an RRSIG", len(response.Answers))
+	}
+	if !verifyRRSIG(t, signer.KSK, response.Answers[2], dnskeys) {
+		t.Error("the DNSKEY RRset isn't signed by the KSK")
+	}
+
+	response = query(t, "www.example.com", TypeA)
+	if len(response.Answers) != 2 || response.Header.Flags&FlagAuthenticData != 0 {
+		t.Error("a query without DO got signatures or AD")
+	}
+}
+
+func TestADAndCDBits(t *testing.T) {
+	useConfig(t, DefaultConfig(), NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+
+	// Nothing is validated here, so AD from the client is never echoed
+	// back while CD is
+	request := withOPT(buildQuery(1, FlagRecursionDesired|FlagAuthenticData|FlagCheckingDisabled, "www.example.com", TypeA), EDNSFlagDNSSECOK)
+	response := serve(t, newWriter("192.0.2.1", true), request)
+	if len(response.Answers) != 1 {
+		t.Fatalf("got %d answers, want 1", len(response.Answers))
+	}
+	if response.Header.Flags&FlagAuthenticData != 0 {
+		t.Error("an unsigned answer sets AD")
+	}
+	if response.Header.Flags&FlagCheckingDisabled == 0 {
+		t.Error("CD isn't echoed")
+	}
+
+	response = query(t, "www.example.com", TypeA)
+	if response.Header.Flags&(FlagAuthenticData|FlagCheckingDisabled) != 0 {
+		t.Errorf("flags %#x, want AD and CD clear for a plain query", response.Header.Flags)
+	}
+
+	// A signed answer keeps CD as asked
+	useZoneSigner(t)
+	request = withOPT(buildQuery(2, FlagCheckingDisabled, "www.example.com", TypeA), EDNSFlagDNSSECOK)
+	response = serve(t, newWriter("192.0.2.1", true), request)
+	if response.Header.Flags&(FlagAuthenticData|FlagCheckingDisabled) != FlagAuthenticData|FlagCheckingDisabled {
+		t.Errorf("flags %#x, want AD and CD set on a signed answer", response.Header.Flags)
+	}
+}
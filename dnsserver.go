@@ -2,11 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 )
 
 type DNSHeader struct {
@@ -29,42 +33,292 @@ type DNSResourceRecord struct {
 
 const (
 	TypeA                  uint16 = 1 // a host address
+	TypeCNAME              uint16 = 5 // the canonical name for an alias
 	ClassINET              uint16 = 1 // the Internet
 	FlagResponse           uint16 = 1 << 15
+	FlagAuthoritative      uint16 = 1 << 10
+	FlagRecursionDesired   uint16 = 1 << 8
+	FlagRecursionAvailable uint16 = 1 << 7
 	UDPMaxMessageSizeBytes uint   = 512 // RFC1035
 )
 
-func dbLookup(queryResourceRecord DNSResourceRecord) ([]DNSResourceRecord, []DNSResourceRecord, []DNSResourceRecord) {
+// Response codes, carried in the low four bits of the header flags
+const (
+	RcodeNoError        uint16 = 0
+	RcodeFormatError    uint16 = 1
+	RcodeServerFailure  uint16 = 2
+	RcodeNameError      uint16 = 3 // NXDOMAIN
+	RcodeNotImplemented uint16 = 4
+	RcodeRefused        uint16 = 5
+)
+
+// dbLookup answers a question from the store. The address the query came
+// from selects which view's records are used, and geoIP the GeoIP store,
+// which may be a trusted resolver's client subnet instead. Misses inside a
+// configured zone are answered with NXDOMAIN, or NODATA when the name exists
+// with other record types, and names outside every zone and the store are
+// REFUSED. Records owned by the queried name carry it in the case the client
+// sent, as some clients compare names strictly.
+func dbLookup(ctx context.Context, queryResourceRecord DNSResourceRecord, sourceIP net.IP, geoIP net.IP) ([]DNSResourceRecord, []DNSResourceRecord, []DNSResourceRecord, uint16) {
+	answerResourceRecords, authorityResourceRecords, additionalResourceRecords, rcode := lookupRecords(ctx, queryResourceRecord, sourceIP, geoIP)
+
+	queryName := strings.TrimSuffix(queryResourceRecord.DomainName, ".")
+	for _, section := range [][]DNSResourceRecord{answerResourceRecords, authorityResourceRecords, additionalResourceRecords} {
+		for i := range section {
+			if strings.EqualFold(section[i].DomainName, queryName) {
+				section[i].DomainName = queryName
+			}
+		}
+	}
+
+	return answerResourceRecords, authorityResourceRecords, additionalResourceRecords, rcode
+}
+
+// lookupRecords does the work of dbLookup, with owner names as stored.
+func lookupRecords(ctx context.Context, queryResourceRecord DNSResourceRecord, sourceIP net.IP, geoIP net.IP) ([]DNSResourceRecord, []DNSResourceRecord, []DNSResourceRecord, uint16) {
 	var answerResourceRecords = make([]DNSResourceRecord, 0)
 	var authorityResourceRecords = make([]DNSResourceRecord, 0)
 	var additionalResourceRecords = make([]DNSResourceRecord, 0)
 
-	names, err := GetNames()
+	// A store that can't be read or decoded is the server's failure, not
+	// the client's, whatever kind of error it was
+	models, err := modelsForClient(ctx, sourceIP, geoIP)
+	if err != nil {
+		return answerResourceRecords, authorityResourceRecords, additionalResourceRecords, RcodeServerFailure
+	}
+	names := To(models)
+
+	if queryResourceRecord.Class != ClassINET {
+		return answerResourceRecords, authorityResourceRecords, additionalResourceRecords, RcodeNoError
+	}
+
+	// Stored names are canonical, so compare against the canonical form of the query
+	queryName, err := CanonicalName(queryResourceRecord.DomainName)
 	if err != nil {
-		return answerResourceRecords, authorityResourceRecords, additionalResourceRecords
+		queryName = strings.ToLower(strings.TrimSuffix(queryResourceRecord.DomainName, "."))
 	}
 
-	if queryResourceRecord.Type != TypeA || queryResourceRecord.Class != ClassINET {
-		return answerResourceRecords, authorityResourceRecords, additionalResourceRecords
+	// Names below a DNAME owner are redirected to the DNAME target, so the
+	// synthesized answer takes precedence over anything else stored for them
+	if queryResourceRecord.Type != TypeDNAME && findDNAME(queryName, names) != nil {
+		return synthesizeDNAME(ctx, queryResourceRecord, queryName, names, sourceIP, geoIP)
 	}
 
+	zone := findZone(queryName)
+
+	queryAny := queryResourceRecord.Type == TypeANY
+
+	// The apex of a zone always has its SOA and NS records, so it's never
+	// NXDOMAIN
+	atApex := zone != nil && queryName == canonicalTarget(zone.Name)
+	if atApex && (queryResourceRecord.Type == TypeSOA || queryAny) {
+		answerResourceRecords = append(answerResourceRecords, zone.SOARecord())
+	}
+	if atApex && (queryResourceRecord.Type == TypeNS || queryAny) {
+		answerResourceRecords = append(answerResourceRecords, zone.NSRecords()...)
+	}
+
+	// The DNSKEY RRset of a signed zone is served from the loaded keys
+	if zoneSigner != nil && queryResourceRecord.Type == TypeDNSKEY && queryName == zoneSigner.Zone {
+		answerResourceRecords = append(answerResourceRecords, zoneSigner.DNSKEYRecords()...)
+	}
+
+	// The apex and DNSKEY records above aren't stored with a weight, so
+	// they draw as weight 0 alongside the stored records
+	answerWeights := make([]uint32, len(answerResourceRecords))
+	weighted := false
+
 	for _, name := range names {
-		if strings.Contains(queryResourceRecord.DomainName, name.Name) {
-			fmt.Println(queryResourceRecord.DomainName, "resolved to", name.Address)
+		if (name.Type == queryResourceRecord.Type || queryAny) && nameMatches(queryName, name.Name) {
+			answerWeights = append(answerWeights, name.Weight)
+			weighted = weighted || name.Weight > 0
+
+			logDebug(queryResourceRecord.DomainName, "resolved to", name.Name, "type", name.Type)
 			answerResourceRecords = append(answerResourceRecords, DNSResourceRecord{
 				DomainName:         name.Name,
-				Type:               TypeA,
+				Type:               name.Type,
 				Class:              ClassINET,
-				TimeToLive:         31337,
-				ResourceData:       name.Address[12:16],
-				ResourceDataLength: 4,
+				TimeToLive:         name.ttlIn(zone),
+				ResourceData:       name.ResourceData,
+				ResourceDataLength: uint16(len(name.ResourceData)),
 			})
 		}
 	}
 
-	return answerResourceRecords, authorityResourceRecords, additionalResourceRecords
+	uniformRRsetTTLs(answerResourceRecords)
+
+	if weighted {
+		answerResourceRecords = weightedOrder(answerResourceRecords, answerWeights)
+	} else if !queryAny {
+		answerResourceRecords = orderRRset(answerResourceRecords, cacheKey{name: queryName, qtype: queryResourceRecord.Type, class: ClassINET}, currentConfig().RRsetOrder)
+	}
+
+	if queryResourceRecord.Type == TypeURI || queryResourceRecord.Type == TypeNAPTR {
+		sortByPriority(answerResourceRecords)
+	}
+
+	// Dual-stack hosts get the addresses of the other family as a hint
+	if currentConfig().DualStackHints && len(answerResourceRecords) > 0 && (queryResourceRecord.Type == TypeA || queryResourceRecord.Type == TypeAAAA) {
+		hintType := TypeAAAA
+		if queryResourceRecord.Type == TypeAAAA {
+			hintType = TypeA
+		}
+		for _, name := range names {
+			if name.Type == hintType && nameMatches(queryName, name.Name) {
+				additionalResourceRecords = append(additionalResourceRecords, DNSResourceRecord{
+					DomainName:         name.Name,
+					Type:               name.Type,
+					Class:              ClassINET,
+					TimeToLive:         name.ttlIn(zone),
+					ResourceData:       name.ResourceData,
+					ResourceDataLength: uint16(len(name.ResourceData)),
+				})
+			}
+		}
+		uniformRRsetTTLs(additionalResourceRecords)
+	}
+
+	// Addresses in a reverse zone without a stored PTR get a templated one
+	if queryResourceRecord.Type == TypePTR && len(answerResourceRecords) == 0 {
+		if ptrResourceRecord, ok := synthesizePTR(queryName); ok {
+			answerResourceRecords = append(answerResourceRecords, ptrResourceRecord)
+		}
+	}
+
+	var rcode = RcodeNoError
+
+	// Without forwarding the server only speaks for its own zones and data:
+	// a name outside them gets REFUSED since we can't say it doesn't exist.
+	// That includes the root and the parents of stored names, like "com",
+	// which would otherwise get an empty answer.
+	if len(answerResourceRecords) == 0 && zone == nil && !nameHasRecords(queryName, names) {
+		rcode = RcodeRefused
+	}
+
+	if len(answerResourceRecords) == 0 && zone != nil {
+		if !atApex && !nameExists(queryName, names) {
+			// During a random-subdomain flood misses are refused outright.
+			// Misses in a forwarding zone are counted once the upstream has
+			// answered NXDOMAIN too, in handleDNSClient.
+			zoneName := canonicalTarget(zone.Name)
+			if zone.Forward && forwardingEnabled() {
+				if waterTorture.Mitigating(zoneName, time.Now()) {
+					return answerResourceRecords, authorityResourceRecords, additionalResourceRecords, RcodeRefused
+				}
+			} else if waterTorture.ObserveNXDomain(zoneName, time.Now()) {
+				return answerResourceRecords, authorityResourceRecords, additionalResourceRecords, RcodeRefused
+			}
+			if zone.NXDomainRedirect.enabled() {
+				if redirectResourceRecord, ok := fixedAnswer(zone.NXDomainRedirect, queryResourceRecord); ok {
+					answerResourceRecords = append(answerResourceRecords, redirectResourceRecord)
+				} else {
+					authorityResourceRecords = append(authorityResourceRecords, zone.SOARecord())
+				}
+				return answerResourceRecords, authorityResourceRecords, additionalResourceRecords, RcodeNoError
+			}
+			rcode = RcodeNameError
+			authorityResourceRecords = append(authorityResourceRecords, zone.SOARecord())
+		} else if currentConfig().MinimalResponses {
+			// NODATA: the name exists but has no records of this type
+			authorityResourceRecords = append(authorityResourceRecords, zone.SOARecord())
+		}
+	}
+
+	return answerResourceRecords, authorityResourceRecords, additionalResourceRecords, rcode
+}
+
+// nameHasRecords reports whether the store holds records answering the name
+// itself, of any type.
+func nameHasRecords(queryName string, names []Name) bool {
+	for _, name := range names {
+		if nameMatches(queryName, name.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// nameMatches reports whether a stored name answers the query name: only
+// records owned by the name itself do, never those of a parent or of a
+// name that merely contains it.
+func nameMatches(queryName string, storedName string) bool {
+	return strings.EqualFold(queryName, storedName)
+}
+
+// findDNAME returns the DNAME whose owner is a proper ancestor of the name.
+func findDNAME(queryName string, names []Name) *Name {
+	for i, name := range names {
+		if name.Type == TypeDNAME && strings.HasSuffix(queryName, "."+name.Name) {
+			return &names[i]
+		}
+	}
+	return nil
+}
+
+// synthesizeDNAME follows DNAME redirections for a query per RFC 6672: each hop
+// returns the DNAME itself plus a CNAME from the queried name to the rewritten
+// name, and the final name is then looked up as usual. Chains are capped and
+// loops are detected so a misconfigured store can't recurse forever.
+func synthesizeDNAME(ctx context.Context, queryResourceRecord DNSResourceRecord, queryName string, names []Name, sourceIP net.IP, geoIP net.IP) ([]DNSResourceRecord, []DNSResourceRecord, []DNSResourceRecord, uint16) {
+	var answerResourceRecords []DNSResourceRecord
+	visited := map[string]bool{queryName: true}
+	currentName := queryName
+
+	for hops := 0; ; hops++ {
+		dname := findDNAME(currentName, names)
+		if dname == nil {
+			break
+		}
+
+		if hops == maxDNAMEChain {
+			logWarn("DNAME chain too long for", queryName)
+			return answerResourceRecords, nil, nil, RcodeNoError
+		}
+
+		targetName := strings.TrimSuffix(currentName, dname.Name) + dname.Target
+		if len(targetName) > 253 {
+			logWarn("DNAME substitution for", currentName, "exceeds the maximum name length")
+			return answerResourceRecords, nil, nil, RcodeNoError
+		}
+
+		var cnameBuffer bytes.Buffer
+		writeDomainName(&cnameBuffer, targetName)
+
+		answerResourceRecords = append(answerResourceRecords, DNSResourceRecord{
+			DomainName:         dname.Name,
+			Type:               TypeDNAME,
+			Class:              ClassINET,
+			TimeToLive:         dname.ttlIn(findZone(dname.Name)),
+			ResourceData:       dname.ResourceData,
+			ResourceDataLength: uint16(len(dname.ResourceData)),
+		}, DNSResourceRecord{
+			DomainName:         currentName,
+			Type:               TypeCNAME,
+			Class:              ClassINET,
+			TimeToLive:         dname.ttlIn(findZone(dname.Name)),
+			ResourceData:       cnameBuffer.Bytes(),
+			ResourceDataLength: uint16(cnameBuffer.Len()),
+		})
+
+		if visited[targetName] {
+			logWarn("DNAME loop detected for", queryName)
+			return answerResourceRecords, nil, nil, RcodeNoError
+		}
+		visited[targetName] = true
+		currentName = targetName
+	}
+
+	targetAnswers, targetAuthorities, targetAdditionals, rcode := dbLookup(ctx, DNSResourceRecord{
+		DomainName: currentName,
+		Type:       queryResourceRecord.Type,
+		Class:      queryResourceRecord.Class,
+	}, sourceIP, geoIP)
+
+	return append(answerResourceRecords, targetAnswers...), targetAuthorities, targetAdditionals, rcode
 }
 
+// readDomainName reads an uncompressed name from a query. A name running
+// past the end of the message is malformed.
 func readDomainName(requestBuffer *bytes.Buffer) (string, error) {
 	var domainName string
 
@@ -72,6 +326,9 @@ func readDomainName(requestBuffer *bytes.Buffer) (string, error) {
 
 	for ; b != 0 && err == nil; b, err = requestBuffer.ReadByte() {
 		labelLength := int(b)
+		if labelLength > requestBuffer.Len() {
+			return domainName, fmt.Errorf("%w: label truncated", ErrMalformed)
+		}
 		labelBytes := requestBuffer.Next(labelLength)
 		labelName := string(labelBytes)
 
@@ -81,12 +338,57 @@ func readDomainName(requestBuffer *bytes.Buffer) (string, error) {
 			domainName += "." + labelName
 		}
 	}
+	if err != nil {
+		return domainName, fmt.Errorf("%w: name truncated", ErrMalformed)
+	}
+
+	return domainName, nil
+}
+
+// splitLabels splits a name into its labels. The root name and trailing dots
+// produce empty labels, which are represented on the wire by the terminating
+// zero byte alone.
+func splitLabels(domainName string) []string {
+	labels := make([]string, 0, strings.Count(domainName, ".")+1)
+	for _, label := range strings.Split(domainName, ".") {
+		if len(label) > 0 {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// writeResourceRecord is the one place records are written to a message. The
+// rdata length is always computed from the rdata as written, so a record with
+// a stale ResourceDataLength can't produce a malformed message. Names are
+// compressed against those already in the message.
+func writeResourceRecord(responseBuffer *bytes.Buffer, resourceRecord DNSResourceRecord, compression nameCompression) error {
+	if len(resourceRecord.ResourceData) > 0xffff {
+		return fmt.Errorf("rdata of %s record for %s is too long", typeName(resourceRecord.Type), resourceRecord.DomainName)
+	}
+	if int(resourceRecord.ResourceDataLength) != len(resourceRecord.ResourceData) {
+		logWarn("Fixing ResourceDataLength", resourceRecord.ResourceDataLength, "of", typeName(resourceRecord.Type), "record for", resourceRecord.DomainName, "to", len(resourceRecord.ResourceData))
+	}
 
-	return domainName, err
+	err := writeCompressedName(responseBuffer, resourceRecord.DomainName, compression)
+	if err != nil {
+		return err
+	}
+
+	Write(responseBuffer, resourceRecord.Type)
+	Write(responseBuffer, resourceRecord.Class)
+	Write(responseBuffer, resourceRecord.TimeToLive)
+
+	lengthOffset := responseBuffer.Len()
+	Write(responseBuffer, uint16(0))
+	writeCompressedResourceData(responseBuffer, resourceRecord, compression)
+	patchLength(responseBuffer, lengthOffset)
+
+	return nil
 }
 
 func writeDomainName(responseBuffer *bytes.Buffer, domainName string) error {
-	labels := strings.Split(domainName, ".")
+	labels := splitLabels(domainName)
 
 	for _, label := range labels {
 		labelLength := len(label)
@@ -101,49 +403,312 @@ func writeDomainName(responseBuffer *bytes.Buffer, domainName string) error {
 	return err
 }
 
-func handleDNSClient(requestBytes []byte, serverConn *net.UDPConn, clientAddr *net.UDPAddr) {
+// handleDNSClient answers a single DNS query message. Messages carrying more
+// than one question are answered with FORMERR.
+func handleDNSClient(ctx context.Context, requestBytes []byte, responseWriter DNSResponseWriter) {
+	// Settings read here come from this snapshot. The lookup, forwarding,
+	// TTL and rate limiting helpers load the current config themselves, so
+	// a reload while the query waits on an upstream can reach them.
+	cfg := currentConfig()
+
 	var requestBuffer = bytes.NewBuffer(requestBytes)
 	var queryHeader DNSHeader
 	var queryResourceRecords []DNSResourceRecord
 
+	// Time the whole request, including the lookup and the response write
+	startTime := time.Now()
+	defer func() {
+		logSlowQuery(queryResourceRecords, responseWriter.RemoteAddr(), time.Since(startTime))
+	}()
+
 	err := binary.Read(requestBuffer, binary.BigEndian, &queryHeader) // network byte order is big endian
 
+	// Without a header there is no transaction ID to answer with
 	if err != nil {
-		fmt.Println("Error decoding header: ", err.Error())
+		logDebug("Error decoding header: ", err.Error())
+		return
+	}
+
+	switch (queryHeader.Flags >> 11) & 0x0f {
+	case OpcodeUpdate:
+		handleUpdate(ctx, queryHeader, requestBytes, responseWriter)
+		return
+	case OpcodeNotify:
+		handleNotify(queryHeader, requestBytes, responseWriter)
+		return
+	}
+	if isTransferQuery(queryHeader, requestBytes) {
+		handleTransfer(ctx, queryHeader, requestBytes, responseWriter)
+		return
 	}
 
 	queryResourceRecords = make([]DNSResourceRecord, queryHeader.NumQuestions)
 
+	// A question that can't be decoded is answered with FORMERR, echoing
+	// the questions before it
+	var questionErr error
 	for idx, _ := range queryResourceRecords {
 		queryResourceRecords[idx].DomainName, err = readDomainName(requestBuffer)
+		if err == nil && requestBuffer.Len() < 4 {
+			err = fmt.Errorf("%w: question truncated", ErrMalformed)
+		}
 
 		if err != nil {
-			fmt.Println("Error decoding label: ", err.Error())
+			logDebug("Error decoding question: ", err.Error())
+			questionErr = err
+			queryResourceRecords = queryResourceRecords[:idx]
+			break
 		}
 
 		queryResourceRecords[idx].Type = binary.BigEndian.Uint16(requestBuffer.Next(2))
 		queryResourceRecords[idx].Class = binary.BigEndian.Uint16(requestBuffer.Next(2))
 	}
 
+	// Look for an EDNS0 OPT record among the remaining sections
+	var queryEDNS *EDNSOptions
+	numRecords := int(queryHeader.NumAnswers) + int(queryHeader.NumAuthorities) + int(queryHeader.NumAdditionals)
+
+	for i := 0; i < numRecords; i++ {
+		resourceRecord, err := readResourceRecord(requestBuffer)
+		if err != nil {
+			logDebug("Error decoding resource record: ", err.Error())
+			break
+		}
+		if resourceRecord.Type == TypeOPT {
+			edns := parseEDNS(resourceRecord)
+			queryEDNS = &edns
+		}
+	}
+
 	var answerResourceRecords = make([]DNSResourceRecord, 0)
 	var authorityResourceRecords = make([]DNSResourceRecord, 0)
 	var additionalResourceRecords = make([]DNSResourceRecord, 0)
 
-	for _, queryResourceRecord := range queryResourceRecords {
-		newAnswerRR, newAuthorityRR, newAdditionalRR := dbLookup(queryResourceRecord)
+	var responseRcode = RcodeNoError
+	if questionErr != nil {
+		responseRcode = rcodeForError(questionErr)
+	}
+	var responseFlags = FlagResponse
+	var responseSource = SourceLocal
+
+	// RD is copied from the query (RFC 1035 section 4.1.1). Without
+	// forwarding the server answers from local data only and refuses names
+	// it has no data for, so RA is only set when forwarding is on. CD is
+	// copied too (RFC 4035 section 3.1.6); AD, Z and any other bits the
+	// query carried are never reflected, AD only being set below for
+	// answers we signed ourselves.
+	responseFlags |= queryHeader.Flags & (FlagRecursionDesired | FlagCheckingDisabled)
+	if forwardingEnabled() {
+		responseFlags |= FlagRecursionAvailable
+	}
 
-		answerResourceRecords = append(answerResourceRecords, newAnswerRR...)
-		authorityResourceRecords = append(authorityResourceRecords, newAuthorityRR...)
-		additionalResourceRecords = append(additionalResourceRecords, newAdditionalRR...)
+	// Like most servers, only a single question per message is supported. A
+	// query with more gets FORMERR, echoing just the first question and
+	// answering none of them.
+	if len(queryResourceRecords) > 1 {
+		responseRcode = RcodeFormatError
+		queryResourceRecords = queryResourceRecords[:1]
 	}
 
+	// A malformed cookie is a FORMERR (RFC 7873 section 5.2.2). With strict
+	// cookies a UDP query with a cookie but no valid server cookie only gets
+	// a fresh cookie, and one without any cookie only an empty truncated
+	// response sending it to TCP, so spoofed queries can't be used for
+	// amplification.
+	if queryEDNS != nil && responseRcode == RcodeNoError {
+		if queryEDNS.InvalidCookie {
+			responseRcode = RcodeFormatError
+		} else if checkCookie(queryEDNS.Cookie, clientIP(responseWriter.RemoteAddr()), responseWriter.IsUDP()) {
+			responseRcode = RcodeBadCookie & 0xF
+			queryEDNS.ExtendedRcode = uint8(RcodeBadCookie >> 4)
+		}
+	}
+	cookieMissing := responseRcode == RcodeNoError && requiresCookie(queryEDNS, responseWriter.IsUDP())
+
+	// Views are selected by the address the query came from, which the
+	// sender can't choose. GeoIP tailors answers to the client subnet a
+	// resolver passed along, but only for trusted resolvers; anyone else's
+	// subnet is ignored and echoed with scope 0, as it didn't matter.
+	sourceIP := clientIP(responseWriter.RemoteAddr())
+	geoIP := sourceIP
+	if queryEDNS != nil && queryEDNS.ClientSubnet != nil {
+		queryEDNS.ClientSubnet.ScopePrefix = 0
+		if cfg.GeoIP.TrustsResolver(sourceIP) {
+			geoIP = queryEDNS.ClientSubnet.Address
+			queryEDNS.ClientSubnet.ScopePrefix = clientSubnetScope(*queryEDNS.ClientSubnet)
+		}
+	}
+
+	if cookieMissing {
+		logDebug("Sending", responseWriter.RemoteAddr(), "to TCP for a UDP query without a cookie")
+		responseFlags |= FlagTruncated
+	} else if responseRcode == RcodeNoError {
+		for _, queryResourceRecord := range queryResourceRecords {
+			recordQuery(queryResourceRecord)
+
+			// Only the Internet class is served. Other classes, CH included
+			// since there are no CHAOS records, get NOTIMP rather than an
+			// empty answer that looks like the name has no records.
+			if queryResourceRecord.Class != ClassINET {
+				responseRcode = RcodeNotImplemented
+				continue
+			}
+
+			// Blocked names get NXDOMAIN; a name blocked only for some types
+			// gets an empty answer so its other types still resolve. The
+			// allowlist rescues names from false positives in the blocklist.
+			queryName, _ := CanonicalName(queryResourceRecord.DomainName)
+			allowed, _ := cfg.allowlist.Matches(queryName, queryResourceRecord.Type)
+			if blocked, wholeName := cfg.blocklist.Matches(queryName, queryResourceRecord.Type); blocked && !allowed {
+				logDebug("Blocked query for", queryResourceRecord.DomainName, "type", queryResourceRecord.Type)
+				if wholeName {
+					responseRcode = RcodeNameError
+				}
+				responseSource = SourceBlocklist
+				continue
+			}
+
+			// Zone ACLs apply to the address the query came from, never to
+			// the client subnet, which the sender chooses freely
+			zone := cfg.findZone(queryName)
+			if zone != nil && !zone.AllowsClient(clientIP(responseWriter.RemoteAddr())) {
+				responseRcode = RcodeRefused
+				continue
+			}
+
+			newAnswerRR, newAuthorityRR, newAdditionalRR, rcode := dbLookup(ctx, queryResourceRecord, sourceIP, geoIP)
+
+			// Misses refused during a random-subdomain flood are answered
+			// as they are, never forwarded or given the catch-all answer
+			mitigated := zone != nil && rcode == RcodeRefused && waterTorture.Mitigating(canonicalTarget(zone.Name), time.Now())
+			if mitigated {
+				responseSource = SourceMitigated
+			}
+
+			// Names the store doesn't know get the catch-all answer if one is
+			// set, which takes precedence over forwarding
+			if !mitigated && (rcode == RcodeNameError || rcode == RcodeRefused) {
+				catchAllRR, ok := catchAllAnswer(queryResourceRecord)
+				if ok {
+					newAnswerRR = []DNSResourceRecord{catchAllRR}
+					newAuthorityRR = nil
+					rcode = RcodeNoError
+					responseSource = SourceCatchAll
+				}
+			}
+
+			// Names without local data or a catch-all answer are forwarded,
+			// or served from the cache, as are misses in zones that forward.
+			// The upstream's NXDOMAINs count toward the zone's flood
+			// threshold.
+			forwarded := false
+			if !mitigated && (rcode == RcodeRefused || (rcode == RcodeNameError && zone != nil && zone.Forward)) && forwardingEnabled() {
+				newAnswerRR, newAuthorityRR, rcode, responseSource = resolveForwarded(ctx, queryResourceRecord, queryHeader.Flags&FlagRecursionDesired != 0)
+				newAdditionalRR = nil
+				forwarded = true
+				if zone != nil && rcode == RcodeNameError {
+					waterTorture.ObserveNXDomain(canonicalTarget(zone.Name), time.Now())
+				}
+			}
+
+			responseRcode = rcode
+			if zone != nil && rcode != RcodeRefused && !forwarded {
+				responseFlags |= FlagAuthoritative
+			}
+
+			answerResourceRecords = append(answerResourceRecords, newAnswerRR...)
+			authorityResourceRecords = append(authorityResourceRecords, newAuthorityRR...)
+			additionalResourceRecords = append(additionalResourceRecords, newAdditionalRR...)
+		}
+	}
+
+	responseFlags |= responseRcode
+
+	// Overlapping lookups, such as a CNAME chain and a direct match, can
+	// add the same record twice
+	answerResourceRecords = dedupRecords(answerResourceRecords)
+	authorityResourceRecords = dedupRecords(authorityResourceRecords)
+	additionalResourceRecords = dedupRecords(additionalResourceRecords)
+
+	// Finalize the TTLs before signing so the signatures cover the served values
+	clampTTLs(answerResourceRecords)
+	clampTTLs(authorityResourceRecords)
+	clampTTLs(additionalResourceRecords)
+
+	// Cap huge answer sets before signing so no RRSIG is left without its
+	// records; the TCP retry gets all of them
+	if responseWriter.IsUDP() {
+		var capped bool
+		answerResourceRecords, capped = capAnswers(answerResourceRecords)
+		if capped {
+			responseFlags |= FlagTruncated
+		}
+	}
+
+	// Sign the answers when the client asked for DNSSEC records with the DO
+	// bit. Unsigned answers, forwarded ones included since upstream data
+	// isn't validated here, leave AD clear.
+	if zoneSigner != nil && queryEDNS != nil && queryEDNS.DNSSECOK {
+		var signed bool
+		var authoritySigned bool
+		answerResourceRecords, signed = zoneSigner.Sign(answerResourceRecords)
+		authorityResourceRecords, authoritySigned = zoneSigner.Sign(authorityResourceRecords)
+		if signed || authoritySigned {
+			responseFlags |= FlagAuthenticData
+		}
+	}
+
+	// Fit UDP responses into the client's limit, reserving room for the
+	// header, the question and our OPT record
+	var responseOPTRecords []DNSResourceRecord
+	if queryEDNS != nil {
+		responseOPTRecords = append(responseOPTRecords, responseOPT(*queryEDNS))
+	}
+
+	if responseWriter.IsUDP() {
+		switch responseRateLimit.Check(clientIP(responseWriter.RemoteAddr()), rrlSignature(queryResourceRecords, responseRcode, len(answerResourceRecords)), time.Now()) {
+		case rrlDrop:
+			logDebug("Rate limit dropped the response to", responseWriter.RemoteAddr())
+			return
+		case rrlSlip:
+			logDebug("Rate limit slipped the response to", responseWriter.RemoteAddr())
+			answerResourceRecords, authorityResourceRecords, additionalResourceRecords = nil, nil, nil
+			responseFlags |= FlagTruncated
+		}
+
+		responseSize := DNSHeaderSizeBytes + questionsSize(queryResourceRecords)
+		for _, section := range [][]DNSResourceRecord{answerResourceRecords, authorityResourceRecords, additionalResourceRecords, responseOPTRecords} {
+			for _, resourceRecord := range section {
+				responseSize += resourceRecordSize(resourceRecord)
+			}
+		}
+		if forceTCP(queryResourceRecords, len(requestBytes), responseSize) {
+			logDebug("Forcing", responseWriter.RemoteAddr(), "to retry its", responseSize, "byte ANY response over TCP")
+			answerResourceRecords, authorityResourceRecords, additionalResourceRecords = nil, nil, nil
+			responseFlags |= FlagTruncated
+		}
+
+		budget := udpResponseLimit(queryEDNS) - DNSHeaderSizeBytes - questionsSize(queryResourceRecords)
+		for _, optResourceRecord := range responseOPTRecords {
+			budget -= resourceRecordSize(optResourceRecord)
+		}
+
+		var truncated bool
+		answerResourceRecords, authorityResourceRecords, additionalResourceRecords, truncated = fitResponse(answerResourceRecords, authorityResourceRecords, additionalResourceRecords, budget)
+		if truncated {
+			responseFlags |= FlagTruncated
+		}
+	}
+
+	additionalResourceRecords = append(additionalResourceRecords, responseOPTRecords...)
+
 	var responseBuffer = new(bytes.Buffer)
 	var responseHeader DNSHeader
 
 	responseHeader = DNSHeader{
 		TransactionID:  queryHeader.TransactionID,
-		Flags:          FlagResponse,
-		NumQuestions:   queryHeader.NumQuestions,
+		Flags:          responseFlags,
+		NumQuestions:   uint16(len(queryResourceRecords)),
 		NumAnswers:     uint16(len(answerResourceRecords)),
 		NumAuthorities: uint16(len(authorityResourceRecords)),
 		NumAdditionals: uint16(len(additionalResourceRecords)),
@@ -152,111 +717,243 @@ func handleDNSClient(requestBytes []byte, serverConn *net.UDPConn, clientAddr *n
 	err = Write(responseBuffer, &responseHeader)
 
 	if err != nil {
-		fmt.Println("Error writing to buffer: ", err.Error())
+		logError("Error writing to buffer: ", err.Error())
 	}
 
+	compression := make(nameCompression)
+
 	for _, queryResourceRecord := range queryResourceRecords {
-		err = writeDomainName(responseBuffer, queryResourceRecord.DomainName)
+		err = writeCompressedName(responseBuffer, queryResourceRecord.DomainName, compression)
 
 		if err != nil {
-			fmt.Println("Error writing to buffer: ", err.Error())
+			logError("Error writing to buffer: ", err.Error())
 		}
 
 		Write(responseBuffer, queryResourceRecord.Type)
 		Write(responseBuffer, queryResourceRecord.Class)
 	}
 
-	for _, answerResourceRecord := range answerResourceRecords {
-		err = writeDomainName(responseBuffer, answerResourceRecord.DomainName)
+	questionSectionEnd := responseBuffer.Len()
 
-		if err != nil {
-			fmt.Println("Error writing to buffer: ", err.Error())
-		}
+	for _, section := range [][]DNSResourceRecord{answerResourceRecords, authorityResourceRecords, additionalResourceRecords} {
+		for _, resourceRecord := range section {
+			err = writeResourceRecord(responseBuffer, resourceRecord, compression)
 
-		Write(responseBuffer, answerResourceRecord.Type)
-		Write(responseBuffer, answerResourceRecord.Class)
-		Write(responseBuffer, answerResourceRecord.TimeToLive)
-		Write(responseBuffer, answerResourceRecord.ResourceDataLength)
-		Write(responseBuffer, answerResourceRecord.ResourceData)
+			if err != nil {
+				logError("Error writing to buffer: ", err.Error())
+			}
+		}
 	}
 
-	for _, authorityResourceRecord := range authorityResourceRecords {
-		err = writeDomainName(responseBuffer, authorityResourceRecord.DomainName)
+	responseBytes := responseBuffer.Bytes()
 
-		if err != nil {
-			fmt.Println("Error writing to buffer: ", err.Error())
+	uncompressedSize := DNSHeaderSizeBytes + questionsSize(queryResourceRecords)
+	for _, section := range [][]DNSResourceRecord{answerResourceRecords, authorityResourceRecords, additionalResourceRecords} {
+		for _, resourceRecord := range section {
+			uncompressedSize += resourceRecordSize(resourceRecord)
 		}
+	}
+	recordResponseSize(len(responseBytes), uncompressedSize)
 
-		Write(responseBuffer, authorityResourceRecord.Type)
-		Write(responseBuffer, authorityResourceRecord.Class)
-		Write(responseBuffer, authorityResourceRecord.TimeToLive)
-		Write(responseBuffer, authorityResourceRecord.ResourceDataLength)
-		Write(responseBuffer, authorityResourceRecord.ResourceData)
+	// Never send a datagram larger than the negotiated size, even if the
+	// records were mis-sized above
+	if responseWriter.IsUDP() && len(responseBytes) > udpResponseLimit(queryEDNS) {
+		logDebug("Clamping", len(responseBytes), "byte UDP response to", responseWriter.RemoteAddr(), "to fit", udpResponseLimit(queryEDNS), "bytes")
+		responseBytes = clampUDPResponse(responseBytes, questionSectionEnd)
 	}
 
-	for _, additionalResourceRecord := range additionalResourceRecords {
-		err = writeDomainName(responseBuffer, additionalResourceRecord.DomainName)
+	logQuery(queryResourceRecords, responseWriter.RemoteAddr(), responseFlags, responseSource)
 
-		if err != nil {
-			fmt.Println("Error writing to buffer: ", err.Error())
-		}
+	captureExchange(requestBytes, responseBytes, responseWriter)
 
-		Write(responseBuffer, additionalResourceRecord.Type)
-		Write(responseBuffer, additionalResourceRecord.Class)
-		Write(responseBuffer, additionalResourceRecord.TimeToLive)
-		Write(responseBuffer, additionalResourceRecord.ResourceDataLength)
-		Write(responseBuffer, additionalResourceRecord.ResourceData)
+	err = responseWriter.WriteResponse(responseBytes)
+	if err != nil {
+		logWarn("Error sending response to", responseWriter.RemoteAddr(), ":", err)
 	}
+}
 
-	serverConn.WriteToUDP(responseBuffer.Bytes(), clientAddr)
+// Where the answer to a query came from, for the query log
+const (
+	SourceLocal     = "local"    // the store, zones or synthesized records
+	SourceCache     = "cache"    // a cached forwarded answer
+	SourceUpstream  = "upstream" // forwarded to an upstream resolver
+	SourceStale     = "stale"    // an expired cached answer, upstreams being down
+	SourceFallback  = "fallback" // the fixed answer, upstreams being down
+	SourceBlocklist = "blocklist"
+	SourceCatchAll  = "catch-all"
+	SourceMitigated = "mitigated" // refused during a random-subdomain flood
+)
+
+// logQuery writes one key=value line per answered query at debug level, so
+// the log can be searched by rcode and by where answers came from.
+func logQuery(queryResourceRecords []DNSResourceRecord, clientAddr net.Addr, responseFlags uint16, source string) {
+	queryName, queryType := ".", "NONE"
+	if len(queryResourceRecords) > 0 {
+		queryName, queryType = absoluteName(queryResourceRecords[0].DomainName), typeName(queryResourceRecords[0].Type)
+	}
+
+	logDebug(fmt.Sprintf("query name=%s type=%s client=%s rcode=%s source=%s", queryName, queryType, clientAddr, rcodeName(responseFlags), source))
+}
+
+// logSlowQuery warns about requests that took longer than the configured
+// threshold to answer.
+func logSlowQuery(queryResourceRecords []DNSResourceRecord, clientAddr net.Addr, elapsed time.Duration) {
+	threshold := time.Duration(currentConfig().SlowQueryMillis) * time.Millisecond
+	if threshold <= 0 || elapsed < threshold {
+		return
+	}
+
+	queryName, queryType := "", uint16(0)
+	if len(queryResourceRecords) > 0 {
+		queryName, queryType = queryResourceRecords[0].DomainName, queryResourceRecords[0].Type
+	}
+
+	logWarn("Slow query", queryName, "type", queryType, "from", clientAddr, "took", elapsed)
 }
 
 func main() {
-	// Initialize in-memory database with hardcoded A records or load from file
-	err := LoadFromFile()
+	var err error
+
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		os.Exit(runQuery(os.Args[2:], os.Stdout))
+	}
+
+	cfg, err := ParseConfig(os.Args[1:])
 	if err != nil {
-		fmt.Println("Error loading from file:", err)
+		logError("Error loading config:", err)
+		os.Exit(2)
 	}
 
-	// DNS server setup
-	serverAddr, err := net.ResolveUDPAddr("udp", ":1053")
+	err = SetLogLevel(cfg.LogLevel)
 	if err != nil {
-		fmt.Println("Error resolving UDP address for DNS server:", err)
+		logError("Error loading config:", err)
+		os.Exit(2)
+	}
+
+	if cfg.ShowVersion {
+		fmt.Println(versionString())
 		return
 	}
 
-	serverConn, err := net.ListenUDP("udp", serverAddr)
+	if cfg.ValidateFile != "" {
+		os.Exit(runValidate(cfg.ValidateFile))
+	}
+
+	if cfg.GenerateStatic != "" {
+		os.Exit(runGenerateStatic(cfg.StoreFile, cfg.GenerateStatic))
+	}
+
+	cfg.store, err = NewStore(cfg)
 	if err != nil {
-		fmt.Println("Error listening for DNS server:", err)
+		logError("Error setting up store:", err)
+		os.Exit(1)
+	}
+
+	if cfg.ExportOrigin != "" {
+		models, err := cfg.store.All(context.Background())
+		if err == nil {
+			err = ExportZoneFile(os.Stdout, models, exportOrigin(cfg.ExportOrigin))
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error exporting zone file:", err)
+			os.Exit(1)
+		}
 		return
 	}
 
-	fmt.Println("DNS server is running on :1053")
+	err = LoadRuntime(&cfg)
+	if err != nil {
+		logError(err)
+		os.Exit(1)
+	}
+	err = loadSerials(cfg.SerialFile)
+	if err != nil {
+		logError("Error loading zone serials:", err)
+		os.Exit(1)
+	}
+	configSnapshot.Store(&cfg)
 
-	// HTTP server setup
-	http.HandleFunc("/add-entry", handleAddEntry)
+	// Initialize in-memory database with hardcoded A records or load from file
+	err = LoadFromFile(&cfg)
+	if err != nil {
+		logError("Error loading from file:", err)
+	}
+	serverReady.Store(err == nil)
 
-	go func() {
-		fmt.Println("HTTP server is running on :8080")
-		err := http.ListenAndServe(":8080", nil)
+	if cfg.Cookies.Enabled {
+		cookieSecret, err = LoadCookieSecret(cfg.Cookies)
 		if err != nil {
-			fmt.Println("Error starting HTTP server:", err)
+			logError("Error setting up DNS cookies:", err)
+			os.Exit(1)
 		}
-	}()
-
-	defer serverConn.Close()
+	}
 
-	// DNS server main loop
-	for {
-		requestBytes := make([]byte, UDPMaxMessageSizeBytes)
+	if cfg.DNSSEC.Enabled {
+		zoneSigner, err = NewZoneSigner(cfg.DNSSEC)
+		if err != nil {
+			logError("Error setting up DNSSEC:", err)
+			os.Exit(1)
+		}
+		logInfo("DNSSEC signing enabled for", zoneSigner.Zone, "KSK tag", zoneSigner.KSK.KeyTag(), "ZSK tag", zoneSigner.ZSK.KeyTag())
+	}
 
-		_, clientAddr, err := serverConn.ReadFromUDP(requestBytes)
+	if cfg.ReplayFile != "" {
+		os.Exit(runReplay(cfg.ReplayFile, os.Stdout))
+	}
 
+	if cfg.CaptureFile != "" {
+		capture, err = OpenCapture(cfg.CaptureFile)
 		if err != nil {
-			fmt.Println("Error receiving for DNS server:", err)
-		} else {
-			fmt.Println("Received DNS request from ", clientAddr)
-			go handleDNSClient(requestBytes, serverConn, clientAddr)
+			logError("Error opening capture file:", err)
+			os.Exit(1)
 		}
+		logInfo("Capturing queries to", cfg.CaptureFile)
 	}
+
+	watchReloadSignal(os.Args[1:])
+	watchShutdownSignal()
+
+	// DNS server setup
+	err = StartListeners(listenerConfigs())
+	if err != nil {
+		logError("Error starting DNS server:", err)
+		os.Exit(1)
+	}
+
+	// Secondaries may have missed changes made while the server was down
+	notifySerialChanges(nil, cfg.Zones)
+
+	// HTTP server setup, unless only the DNS service should run
+	_, err = startHTTPServer(&cfg)
+	if err != nil {
+		logError("Error starting HTTP server:", err)
+		os.Exit(1)
+	}
+
+	// The listeners and HTTP server run in their own goroutines until
+	// shutdown, which cancels the queries in flight and lets them answer
+	<-serverContext.Done()
+	waitForQueries()
+}
+
+// startHTTPServer listens on HTTPAddress and serves the HTTP API from its
+// own goroutine. It returns a nil listener when DisableHTTP is set.
+func startHTTPServer(cfg *Config) (net.Listener, error) {
+	if cfg.DisableHTTP {
+		logInfo("HTTP server disabled")
+		return nil, nil
+	}
+
+	listener, err := net.Listen("tcp", cfg.HTTPAddress)
+	if err != nil {
+		return nil, err
+	}
+	logInfo("HTTP server is running on", listener.Addr())
+	go func() {
+		err := http.Serve(listener, withCORS(httpHandlers()))
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			logError("Error serving HTTP:", err)
+		}
+	}()
+	return listener, nil
 }
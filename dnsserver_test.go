@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTwoQuestionsAreFormatErrors(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	useConfig(t, cfg,
+		NameModel{Name: "a.example.com", Address: "192.0.2.1"},
+		NameModel{Name: "b.example.com", Address: "192.0.2.2"},
+	)
+
+	request := buildQuery(1, FlagRecursionDesired, "a.example.com", TypeA)
+	request = append(request, buildQuery(0, 0, "b.example.com", TypeA)[DNSHeaderSizeBytes:]...)
+	binary.BigEndian.PutUint16(request[4:], 2)
+
+	response := serve(t, newWriter("192.0.2.1", true), request)
+	if responseCode(response) != RcodeFormatError {
+		t.Errorf("rcode = %d, want FORMERR", responseCode(response))
+	}
+	if len(response.Questions) != 1 || response.Questions[0].DomainName != "a.example.com" {
+		t.Errorf("echoed questions %+v, want only the first", response.Questions)
+	}
+	if len(response.Answers) != 0 {
+		t.Errorf("got %d answers, want none", len(response.Answers))
+	}
+}
+
+func TestNODATAWithAndWithoutMinimalResponses(t *testing.T) {
+	for _, minimal := range []bool{false, true} {
+		cfg := DefaultConfig()
+		cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+		cfg.MinimalResponses = minimal
+		useConfig(t, cfg, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+
+		response := query(t, "www.example.com", TypeAAAA)
+		if responseCode(response) != RcodeNoError || len(response.Answers) != 0 {
+			t.Errorf("minimal %v: NODATA got rcode %d with %d answers", minimal, responseCode(response), len(response.Answers))
+		}
+		hasSOA := len(response.Authorities) == 1 && response.Authorities[0].Type == TypeSOA
+		if hasSOA != minimal {
+			t.Errorf("minimal %v: NODATA authority = %+v", minimal, response.Authorities)
+		}
+
+		response = query(t, "missing.example.com", TypeA)
+		if responseCode(response) != RcodeNameError || len(response.Authorities) != 1 || response.Authorities[0].Type != TypeSOA {
+			t.Errorf("minimal %v: NXDOMAIN got rcode %d with authority %+v", minimal, responseCode(response), response.Authorities)
+		}
+	}
+}
+
+func TestOnlyExactNamesMatch(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	useConfig(t, cfg, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+
+	for _, name := range []string{"ww.example.com", "w.example.com", "sub.www.example.com", "example.com"} {
+		response := query(t, name, TypeA)
+		if len(response.Answers) != 0 {
+			t.Errorf("query for %s was answered with the records of www.example.com", name)
+		}
+	}
+	if response := query(t, "WWW.Example.COM", TypeA); len(response.Answers) != 1 {
+		t.Error("names don't match case insensitively")
+	}
+}
+
+func TestAnswersEchoTheQueryCase(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	cfg.MinimalResponses = true
+	useConfig(t, cfg,
+		NameModel{Name: "www.example.com", Address: "192.0.2.10"},
+		NameModel{Name: "old.example.com", Type: "DNAME", Target: "example.com"},
+	)
+
+	response := query(t, "WwW.ExAmPlE.cOm", TypeA)
+	if len(response.Answers) != 1 || response.Answers[0].DomainName != "WwW.ExAmPlE.cOm" {
+		t.Errorf("answers %+v, want one owned by the name as queried", response.Answers)
+	}
+
+	// Only the queried name is rewritten, not the names it leads to
+	response = query(t, "WWW.OLD.example.com", TypeA)
+	if len(response.Answers) != 3 || response.Answers[0].DomainName != "old.example.com" ||
+		response.Answers[1].DomainName != "WWW.OLD.example.com" || response.Answers[2].DomainName != "www.example.com" {
+		t.Errorf("answers %+v, want the synthesized CNAME in the query case and the rest as stored", response.Answers)
+	}
+
+	// The apex SOA of a NODATA answer echoes an apex query's case
+	response = query(t, "EXAMPLE.com", TypeAAAA)
+	if len(response.Authorities) != 1 || response.Authorities[0].DomainName != "EXAMPLE.com" {
+		t.Errorf("authority %+v, want the SOA owned by the name as queried", response.Authorities)
+	}
+}
+
+// slowWriter delays every response it writes.
+type slowWriter struct {
+	*recordingResponseWriter
+	delay time.Duration
+}
+
+func (w slowWriter) WriteResponse(responseBytes []byte) error {
+	time.Sleep(w.delay)
+	return w.recordingResponseWriter.WriteResponse(responseBytes)
+}
+
+func TestSlowQueriesAreLogged(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	cfg.SlowQueryMillis = 20
+	useConfig(t, cfg, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+	logs := captureLog(t)
+
+	handleDNSClient(context.Background(), buildQuery(1, 0, "www.example.com", TypeA), newWriter("192.0.2.1", true))
+	if strings.Contains(logs.String(), "Slow query") {
+		t.Fatalf("a fast query was logged as slow: %s", logs)
+	}
+
+	handleDNSClient(context.Background(), buildQuery(1, 0, "www.example.com", TypeA), slowWriter{newWriter("192.0.2.1", true), 30 * time.Millisecond})
+	if !strings.Contains(logs.String(), "Slow query www.example.com type 1 ") {
+		t.Errorf("a query delayed past the threshold wasn't logged with its name and type: %q", logs)
+	}
+}
+
+func TestOutOfZoneQueriesAreRefused(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	useConfig(t, cfg,
+		NameModel{Name: "www.example.com", Address: "192.0.2.10"},
+		NameModel{Name: "host.example.org", Address: "192.0.2.20"},
+	)
+
+	tests := []struct {
+		name  string
+		rcode uint16
+	}{
+		{"missing.example.com", RcodeNameError},
+		{"www.example.net", RcodeRefused},
+		{"example.org", RcodeRefused},
+		{"org", RcodeRefused},
+		// Stored names outside every zone are still answered
+		{"host.example.org", RcodeNoError},
+	}
+	for _, test := range tests {
+		response := query(t, test.name, TypeA)
+		if responseCode(response) != test.rcode {
+			t.Errorf("%s: rcode %d, want %d", test.name, responseCode(response), test.rcode)
+		}
+		if test.rcode == RcodeRefused && (len(response.Answers) != 0 || len(response.Authorities) != 0) {
+			t.Errorf("%s: a refused query carried records", test.name)
+		}
+	}
+}
+
+func TestRecursionDesiredWithoutRecursion(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	useConfig(t, cfg, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+
+	response := query(t, "www.example.com", TypeA)
+	if len(response.Answers) != 1 {
+		t.Errorf("got %d local answers, want 1", len(response.Answers))
+	}
+	if response.Header.Flags&FlagRecursionAvailable != 0 {
+		t.Error("RA is set without forwarding")
+	}
+	if response.Header.Flags&FlagRecursionDesired == 0 {
+		t.Error("RD isn't echoed")
+	}
+
+	response = query(t, "www.example.net", TypeA)
+	if responseCode(response) != RcodeRefused || response.Header.Flags&FlagRecursionAvailable != 0 {
+		t.Errorf("a name needing recursion got rcode %d and flags %#x, want REFUSED without RA", responseCode(response), response.Header.Flags)
+	}
+}
+
+func TestRecursionAvailableWithForwarding(t *testing.T) {
+	upstream := startUpstream(t, func(requestBytes []byte) []byte {
+		return upstreamResponse(requestBytes, RcodeNoError, addressRecord("www.example.net", 60))
+	})
+	useForwarding(t, DefaultConfig(), upstream.address)
+
+	response := query(t, "www.example.net", TypeA)
+	if len(response.Answers) != 1 || response.Header.Flags&FlagRecursionAvailable == 0 {
+		t.Errorf("a forwarded answer has %d records and flags %#x, want 1 record with RA", len(response.Answers), response.Header.Flags)
+	}
+
+	// Without RD nothing is forwarded
+	response = serve(t, newWriter("192.0.2.1", true), buildQuery(2, 0, "other.example.net", TypeA))
+	if responseCode(response) != RcodeRefused || upstream.queries.Load() != 1 {
+		t.Errorf("a query without RD got rcode %d after %d upstream queries, want REFUSED after 1", responseCode(response), upstream.queries.Load())
+	}
+}
+
+func TestDualStackHints(t *testing.T) {
+	entries := []NameModel{
+		{Name: "www.example.com", Address: "192.0.2.10"},
+		{Name: "www.example.com", Type: "AAAA", Address: "2001:db8::10"},
+		{Name: "v4.example.com", Address: "192.0.2.20"},
+	}
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	useConfig(t, cfg, entries...)
+
+	if response := query(t, "www.example.com", TypeA); len(response.Additionals) != 0 {
+		t.Errorf("got %d additionals with hints off, want none", len(response.Additionals))
+	}
+
+	cfg.DualStackHints = true
+	useConfig(t, cfg, entries...)
+
+	tests := []struct {
+		name      string
+		queryType uint16
+		answer    string
+		hint      string
+	}{
+		{"www.example.com", TypeA, "192.0.2.10", "2001:db8::10"},
+		{"www.example.com", TypeAAAA, "2001:db8::10", "192.0.2.10"},
+		{"v4.example.com", TypeA, "192.0.2.20", ""},
+	}
+	for _, test := range tests {
+		response := query(t, test.name, test.queryType)
+		if answerAddress(response) != test.answer {
+			t.Errorf("%s type %d answered %+v, want %s", test.name, test.queryType, response.Answers, test.answer)
+		}
+		var hints []string
+		for _, additional := range response.Additionals {
+			hints = append(hints, net.IP(additional.ResourceData).String())
+		}
+		if strings.Join(hints, ",") != test.hint {
+			t.Errorf("%s type %d got hints %v, want %q", test.name, test.queryType, hints, test.hint)
+		}
+	}
+}
+
+func TestQueryLogShowsRcodeAndSource(t *testing.T) {
+	upstream := startUpstream(t, upstreamAddress(300))
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	loaded := useForwarding(t, cfg, upstream.address)
+	err := loaded.store.(*MemoryStore).Seed([]NameModel{{Name: "www.example.com", Address: "192.0.2.10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := logLevel.Load()
+	logLevel.Store(LogLevelDebug)
+	t.Cleanup(func() { logLevel.Store(previous) })
+	logged := captureLog(t)
+
+	query(t, "www.example.com", TypeA)
+	query(t, "missing.example.com", TypeA)
+	query(t, "www.example.net", TypeA)
+	query(t, "www.example.net", TypeA)
+
+	for _, line := range []string{
+		"query name=www.example.com. type=A client=192.0.2.1:5300 rcode=NOERROR source=local",
+		"query name=missing.example.com. type=A client=192.0.2.1:5300 rcode=NXDOMAIN source=local",
+		"query name=www.example.net. type=A client=192.0.2.1:5300 rcode=NOERROR source=upstream",
+		"query name=www.example.net. type=A client=192.0.2.1:5300 rcode=NOERROR source=cache",
+	} {
+		if !strings.Contains(logged.String(), line+"\n") {
+			t.Errorf("the log is missing %q:\n%s", line, logged)
+		}
+	}
+}
+
+func TestWrittenRdataLengthMatchesRdata(t *testing.T) {
+	logged := captureLog(t)
+	for _, claimed := range []uint16{0, 2, 200} {
+		var buffer bytes.Buffer
+		record := DNSResourceRecord{DomainName: "www.example.com", Type: TypeA, Class: ClassINET, TimeToLive: 60, ResourceData: []byte{192, 0, 2, 10}, ResourceDataLength: claimed}
+		err := writeResourceRecord(&buffer, record, make(nameCompression))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		written := buffer.Bytes()
+		if length := binary.BigEndian.Uint16(written[len(written)-6:]); length != 4 {
+			t.Errorf("claimed length %d was written as %d, want the 4 bytes of rdata", claimed, length)
+		}
+	}
+	if !strings.Contains(logged.String(), "Fixing ResourceDataLength") {
+		t.Error("the mismatched lengths weren't logged")
+	}
+
+	var buffer bytes.Buffer
+	err := writeResourceRecord(&buffer, DNSResourceRecord{DomainName: "www.example.com", Type: TypeTXT, Class: ClassINET, ResourceData: make([]byte, 0x10000)}, make(nameCompression))
+	if err == nil {
+		t.Error("a record with 64KiB of rdata was written")
+	}
+}
+
+func TestUnsupportedClassesAreNotImplemented(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	useConfig(t, cfg, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+
+	for _, class := range []uint16{3, 4, 42} {
+		request := buildQuery(1, 0, "www.example.com", TypeA)
+		binary.BigEndian.PutUint16(request[len(request)-2:], class)
+
+		response := serve(t, newWriter("192.0.2.1", true), request)
+		if responseCode(response) != RcodeNotImplemented || len(response.Answers) != 0 {
+			t.Errorf("class %d: rcode %d with %d answers, want NOTIMP", class, responseCode(response), len(response.Answers))
+		}
+		if len(response.Questions) != 1 || response.Questions[0].Class != class {
+			t.Errorf("class %d: echoed questions %+v", class, response.Questions)
+		}
+	}
+
+	if response := query(t, "www.example.com", TypeA); answerAddress(response) != "192.0.2.10" {
+		t.Errorf("an IN query got %+v", response.Answers)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// DomainList is a list of names used by the blocklist and the allowlist.
+// Each name covers itself and its subdomains, either for every query type or
+// only for the listed types.
+type DomainList struct {
+	// entries maps a canonical name to the listed types, nil for all types
+	entries map[string][]uint16
+}
+
+// LoadDomainList reads a domain list file. Each line holds a domain,
+// optionally followed by the query types it applies to, e.g.
+// "ads.example.com" or "example.com AAAA". Blank lines and lines starting
+// with # are ignored. The kind names the list in messages.
+func LoadDomainList(path string, kind string) (*DomainList, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %v", kind, err)
+	}
+	defer file.Close()
+
+	loaded := &DomainList{entries: make(map[string][]uint16)}
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		name, err := CanonicalName(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid name %q: %v", kind, lineNumber, fields[0], err)
+		}
+
+		var blockedTypes []uint16
+		for _, field := range fields[1:] {
+			code, ok := typeCode(field)
+			if !ok {
+				return nil, fmt.Errorf("%s line %d: unknown query type %q", kind, lineNumber, field)
+			}
+			blockedTypes = append(blockedTypes, code)
+		}
+
+		// Listing a name for all types wins over type restricted lines for it
+		existing, seen := loaded.entries[name]
+		switch {
+		case seen && existing == nil:
+		case blockedTypes == nil:
+			loaded.entries[name] = nil
+		default:
+			loaded.entries[name] = append(existing, blockedTypes...)
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", kind, err)
+	}
+
+	logInfo("Loaded", len(loaded.entries), kind, "entries from", path)
+	return loaded, nil
+}
+
+// Matches reports whether a query matches the list, and if so whether the
+// whole name is listed rather than just this query type. The closest listed
+// ancestor of the name decides.
+func (l *DomainList) Matches(name string, queryType uint16) (bool, bool) {
+	if l == nil {
+		return false, false
+	}
+
+	for {
+		listedTypes, ok := l.entries[name]
+		if ok {
+			if listedTypes == nil {
+				return true, true
+			}
+			return slices.Contains(listedTypes, queryType), false
+		}
+
+		_, parent, found := strings.Cut(name, ".")
+		if !found {
+			return false, false
+		}
+		name = parent
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeDomainList saves a domain list file in a temp directory.
+func writeDomainList(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "domains.txt")
+	err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBlocklistQueryTypes(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	cfg.BlocklistFile = writeDomainList(t,
+		"# blocked names",
+		"ads.example.com",
+		"v4only.example.com AAAA",
+	)
+	useConfig(t, cfg,
+		NameModel{Name: "tracker.ads.example.com", Address: "192.0.2.66"},
+		NameModel{Name: "www.v4only.example.com", Address: "192.0.2.10"},
+		NameModel{Name: "www.v4only.example.com", Type: "AAAA", Address: "2001:db8::10"},
+	)
+
+	tests := []struct {
+		name      string
+		queryType uint16
+		rcode     uint16
+		answers   int
+	}{
+		{"tracker.ads.example.com", TypeA, RcodeNameError, 0},
+		{"tracker.ads.example.com", TypeAAAA, RcodeNameError, 0},
+		{"www.v4only.example.com", TypeA, RcodeNoError, 1},
+		{"www.v4only.example.com", TypeAAAA, RcodeNoError, 0},
+	}
+	for _, test := range tests {
+		response := query(t, test.name, test.queryType)
+		if responseCode(response) != test.rcode || len(response.Answers) != test.answers {
+			t.Errorf("%s type %d: rcode %d with %d answers, want %d with %d",
+				test.name, test.queryType, responseCode(response), len(response.Answers), test.rcode, test.answers)
+		}
+	}
+}
+
+func TestLoadDomainList(t *testing.T) {
+	list, err := LoadDomainList(writeDomainList(t, "example.com AAAA", "example.com", "example.org MX TXT", ""), "blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A line for all types wins over a type restricted one
+	if matched, wholeName := list.Matches("www.example.com", TypeA); !matched || !wholeName {
+		t.Errorf("www.example.com A matched %v whole name %v, want the whole name", matched, wholeName)
+	}
+	if matched, _ := list.Matches("example.org", TypeTXT); !matched {
+		t.Error("example.org TXT isn't matched")
+	}
+	if matched, _ := list.Matches("example.org", TypeA); matched {
+		t.Error("example.org A is matched, only MX and TXT are listed")
+	}
+	if matched, _ := list.Matches("example.net", TypeA); matched {
+		t.Error("an unlisted name is matched")
+	}
+
+	_, err = LoadDomainList(writeDomainList(t, "example.com BOGUS"), "blocklist")
+	if err == nil {
+		t.Error("an unknown query type was accepted")
+	}
+	list, err = LoadDomainList("", "blocklist")
+	if err != nil || list != nil {
+		t.Errorf("LoadDomainList without a file = %v, %v; want no list", list, err)
+	}
+}
+
+func TestAllowlistOverridesBlocklist(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	cfg.BlocklistFile = writeDomainList(t, "example.com")
+	cfg.AllowlistFile = writeDomainList(t, "cdn.example.com")
+	useConfig(t, cfg,
+		NameModel{Name: "ads.example.com", Address: "192.0.2.66"},
+		NameModel{Name: "img.cdn.example.com", Address: "192.0.2.10"},
+	)
+
+	if response := query(t, "ads.example.com", TypeA); responseCode(response) != RcodeNameError {
+		t.Errorf("ads.example.com: rcode %d, want NXDOMAIN from the blocklist", responseCode(response))
+	}
+	if got := answerAddress(query(t, "img.cdn.example.com", TypeA)); got != "192.0.2.10" {
+		t.Errorf("img.cdn.example.com answered %q, want the allowlisted name served", got)
+	}
+}
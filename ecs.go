@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+const (
+	EDNSOptionClientSubnet uint16 = 8 // RFC 7871
+
+	ClientSubnetFamilyIPv4 uint16 = 1
+	ClientSubnetFamilyIPv6 uint16 = 2
+)
+
+// ClientSubnet is the EDNS Client Subnet option a resolver sends on behalf
+// of its client. Only the first SourcePrefix bits of Address are meaningful.
+type ClientSubnet struct {
+	Family       uint16
+	SourcePrefix uint8
+	ScopePrefix  uint8
+	Address      net.IP
+}
+
+// parseClientSubnet decodes the data of an ECS option.
+func parseClientSubnet(optionData []byte) (*ClientSubnet, error) {
+	if len(optionData) < 4 {
+		return nil, fmt.Errorf("client subnet option too short")
+	}
+
+	clientSubnet := &ClientSubnet{
+		Family:       binary.BigEndian.Uint16(optionData[0:2]),
+		SourcePrefix: optionData[2],
+		ScopePrefix:  optionData[3],
+	}
+
+	var addressLength int
+	switch clientSubnet.Family {
+	case ClientSubnetFamilyIPv4:
+		addressLength = net.IPv4len
+	case ClientSubnetFamilyIPv6:
+		addressLength = net.IPv6len
+	default:
+		return nil, fmt.Errorf("unknown client subnet family %d", clientSubnet.Family)
+	}
+
+	if int(clientSubnet.SourcePrefix) > addressLength*8 {
+		return nil, fmt.Errorf("client subnet prefix /%d too long", clientSubnet.SourcePrefix)
+	}
+
+	// The address is sent without trailing bytes beyond the prefix
+	address := optionData[4:]
+	if len(address) != (int(clientSubnet.SourcePrefix)+7)/8 {
+		return nil, fmt.Errorf("client subnet address length doesn't match /%d", clientSubnet.SourcePrefix)
+	}
+
+	clientSubnet.Address = make(net.IP, addressLength)
+	copy(clientSubnet.Address, address)
+	clientSubnet.Address = clientSubnet.Address.Mask(net.CIDRMask(int(clientSubnet.SourcePrefix), addressLength*8))
+
+	return clientSubnet, nil
+}
+
+// encode builds the full option, code and length included, for the response.
+func (clientSubnet ClientSubnet) encode() []byte {
+	address := clientSubnet.Address
+	if clientSubnet.Family == ClientSubnetFamilyIPv4 {
+		address = address.To4()
+	}
+	address = address[:(int(clientSubnet.SourcePrefix)+7)/8]
+
+	option := binary.BigEndian.AppendUint16(nil, EDNSOptionClientSubnet)
+	option = binary.BigEndian.AppendUint16(option, uint16(4+len(address)))
+	option = binary.BigEndian.AppendUint16(option, clientSubnet.Family)
+	option = append(option, clientSubnet.SourcePrefix, clientSubnet.ScopePrefix)
+	return append(option, address...)
+}
+
+// clientSubnetScope returns the scope prefix length to send back: how much of
+// the client address the answer depended on. Only GeoIP looks at the client
+// subnet, views going by the resolver's address, so answers are the same for
+// every subnet without it; with it the whole source prefix is assumed to
+// matter.
+func clientSubnetScope(clientSubnet ClientSubnet) uint8 {
+	if currentConfig().geoLookup == nil {
+		return 0
+	}
+	return clientSubnet.SourcePrefix
+}
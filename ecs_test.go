@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// clientSubnetOption encodes an ECS option for an IPv4 subnet.
+func clientSubnetOption(address string, prefix uint8) []byte {
+	return ClientSubnet{Family: ClientSubnetFamilyIPv4, SourcePrefix: prefix, Address: net.ParseIP(address)}.encode()
+}
+
+func TestParseClientSubnet(t *testing.T) {
+	option := clientSubnetOption("203.0.113.77", 24)
+	clientSubnet, err := parseClientSubnet(option[4:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientSubnet.SourcePrefix != 24 || !clientSubnet.Address.Equal(net.ParseIP("203.0.113.0")) {
+		t.Errorf("parsed %+v, want 203.0.113.0/24", clientSubnet)
+	}
+
+	bad := map[string][]byte{
+		"too short":        {0, 1, 24},
+		"unknown family":   {0, 3, 24, 0, 203, 0, 113},
+		"prefix too long":  {0, 1, 33, 0, 203, 0, 113, 0, 0},
+		"address too long": {0, 1, 16, 0, 203, 0, 113},
+	}
+	for name, optionData := range bad {
+		_, err := parseClientSubnet(optionData)
+		if err == nil {
+			t.Errorf("an option with a %s was accepted", name)
+		}
+	}
+}
+
+// clientSubnetOf returns the ECS option echoed in a response.
+func clientSubnetOf(t *testing.T, response DNSResponse) *ClientSubnet {
+	t.Helper()
+	edns := responseOPTOf(response)
+	if edns == nil || edns.ClientSubnet == nil {
+		t.Fatal("the response doesn't echo the client subnet")
+	}
+	return edns.ClientSubnet
+}
+
+func TestClientSubnetOnlyFeedsGeoIP(t *testing.T) {
+	loaded := geoConfig(t, "198.51.100.0/24")
+	loaded.views, _ = LoadViews([]ViewConfig{{
+		Name:      "internal",
+		Networks:  []string{"10.0.0.0/8"},
+		StoreFile: writeStoreFile(t, NameModel{Name: "www.example.com", Address: "10.0.0.10"}),
+	}})
+
+	tests := []struct {
+		name     string
+		resolver string
+		subnet   string
+		want     string
+		scope    uint8
+	}{
+		{"trusted resolver", "198.51.100.53", "203.0.113.0", "198.51.100.10", 24},
+		{"untrusted resolver", "192.0.2.53", "203.0.113.0", "192.0.2.10", 0},
+		// Views go by the resolver's own address, never the subnet
+		{"subnet inside a view", "198.51.100.53", "10.1.2.0", "192.0.2.10", 24},
+	}
+	for _, test := range tests {
+		request := withOPT(buildQuery(1, 0, "www.example.com", TypeA), 0, clientSubnetOption(test.subnet, 24))
+		response := serve(t, newWriter(test.resolver, true), request)
+		if got := answerAddress(response); got != test.want {
+			t.Errorf("%s: answered %q, want %s", test.name, got, test.want)
+		}
+		if scope := clientSubnetOf(t, response).ScopePrefix; scope != test.scope {
+			t.Errorf("%s: scope /%d, want /%d", test.name, scope, test.scope)
+		}
+	}
+}
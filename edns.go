@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	TypeOPT uint16 = 41 // EDNS0 pseudo-record, RFC 6891
+
+	EDNSFlagDNSSECOK uint32 = 1 << 15 // DO bit in the OPT TTL field
+	EDNSUDPSizeBytes uint16 = 4096    // payload size advertised in responses
+)
+
+// EDNSOptions are the EDNS0 parameters a client sent in its OPT record.
+type EDNSOptions struct {
+	UDPSize  uint16
+	DNSSECOK bool
+
+	// ClientSubnet is set when the query carried a valid ECS option
+	ClientSubnet *ClientSubnet
+
+	// Cookie is set when the query carried a COOKIE option, and
+	// InvalidCookie when that option was malformed
+	Cookie        *DNSCookie
+	InvalidCookie bool
+
+	// ExtendedRcode holds the upper eight bits of a response rcode
+	ExtendedRcode uint8
+}
+
+// readResourceRecord decodes a full resource record, including its rdata.
+func readResourceRecord(requestBuffer *bytes.Buffer) (DNSResourceRecord, error) {
+	var resourceRecord DNSResourceRecord
+	var err error
+
+	resourceRecord.DomainName, err = readDomainName(requestBuffer)
+	if err != nil {
+		return resourceRecord, err
+	}
+
+	if requestBuffer.Len() < 10 {
+		return resourceRecord, fmt.Errorf("%w: resource record truncated", ErrMalformed)
+	}
+
+	resourceRecord.Type = binary.BigEndian.Uint16(requestBuffer.Next(2))
+	resourceRecord.Class = binary.BigEndian.Uint16(requestBuffer.Next(2))
+	resourceRecord.TimeToLive = binary.BigEndian.Uint32(requestBuffer.Next(4))
+	resourceRecord.ResourceDataLength = binary.BigEndian.Uint16(requestBuffer.Next(2))
+
+	if requestBuffer.Len() < int(resourceRecord.ResourceDataLength) {
+		return resourceRecord, fmt.Errorf("%w: resource record data truncated", ErrMalformed)
+	}
+
+	resourceRecord.ResourceData = append([]byte(nil), requestBuffer.Next(int(resourceRecord.ResourceDataLength))...)
+
+	return resourceRecord, nil
+}
+
+// parseEDNS reads the EDNS0 parameters out of an OPT record. The requestor's
+// UDP payload size lives in the class field, the flags in the TTL field and
+// the options in the rdata.
+func parseEDNS(optResourceRecord DNSResourceRecord) EDNSOptions {
+	edns := EDNSOptions{
+		UDPSize:  optResourceRecord.Class,
+		DNSSECOK: optResourceRecord.TimeToLive&EDNSFlagDNSSECOK != 0,
+	}
+
+	options := optResourceRecord.ResourceData
+	for len(options) >= 4 {
+		optionCode := binary.BigEndian.Uint16(options[0:2])
+		optionLength := int(binary.BigEndian.Uint16(options[2:4]))
+		if len(options) < 4+optionLength {
+			logDebug("Error decoding EDNS option: option truncated")
+			break
+		}
+		optionData := options[4 : 4+optionLength]
+		options = options[4+optionLength:]
+
+		switch optionCode {
+		case EDNSOptionClientSubnet:
+			clientSubnet, err := parseClientSubnet(optionData)
+			if err != nil {
+				logDebug("Ignoring client subnet option:", err)
+				continue
+			}
+			edns.ClientSubnet = clientSubnet
+		case EDNSOptionCookie:
+			cookie, err := parseCookie(optionData)
+			if err != nil {
+				logDebug("Error decoding cookie option:", err)
+				edns.InvalidCookie = true
+				continue
+			}
+			edns.Cookie = cookie
+		}
+	}
+
+	return edns
+}
+
+// responseOPT builds the OPT record sent back to an EDNS-capable client,
+// echoing the DO bit as RFC 3225 requires, the client subnet with its scope
+// as RFC 7871 requires and the cookie as RFC 7873 requires.
+func responseOPT(queryEDNS EDNSOptions) DNSResourceRecord {
+	flags := uint32(queryEDNS.ExtendedRcode) << 24
+	if queryEDNS.DNSSECOK {
+		flags |= EDNSFlagDNSSECOK
+	}
+
+	resourceData := []byte{}
+	if queryEDNS.ClientSubnet != nil {
+		resourceData = append(resourceData, queryEDNS.ClientSubnet.encode()...)
+	}
+	if queryEDNS.Cookie != nil && len(queryEDNS.Cookie.Server) > 0 {
+		resourceData = append(resourceData, queryEDNS.Cookie.encode()...)
+	}
+
+	return DNSResourceRecord{
+		DomainName:         "",
+		Type:               TypeOPT,
+		Class:              EDNSUDPSizeBytes,
+		TimeToLive:         flags,
+		ResourceData:       resourceData,
+		ResourceDataLength: uint16(len(resourceData)),
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	_ "embed"
+	"os"
+	"sync/atomic"
+)
+
+// embeddedStore is a small demo zone served when the server is started
+// without a store file or config file, so it answers something out of the box.
+//
+//go:embed default_names.json
+var embeddedStore []byte
+
+// embeddedStoreFor is the path of the missing store file the embedded store
+// stands in for, set when the store is loaded; "" when it isn't in use.
+var embeddedStoreFor atomic.Value
+
+// shouldUseEmbeddedStore reports whether neither the store file nor the
+// config file exist.
+func shouldUseEmbeddedStore(cfg *Config) bool {
+	_, storeErr := os.Stat(cfg.StoreFile)
+	_, configErr := os.Stat(cfg.ConfigFile)
+	return os.IsNotExist(storeErr) && os.IsNotExist(configErr)
+}
+
+// readStoreFile reads a store file, returning the embedded store instead of
+// the missing main store file when it is in use.
+func readStoreFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if standIn, _ := embeddedStoreFor.Load().(string); os.IsNotExist(err) && standIn != "" && path == standIn {
+		return embeddedStore, nil
+	}
+	return data, err
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestEmbeddedStoreWithoutFiles(t *testing.T) {
+	t.Cleanup(func() { embeddedStoreFor.Store("") })
+	dir := t.TempDir()
+
+	cfg := DefaultConfig()
+	cfg.StoreFile = filepath.Join(dir, "names.json")
+	cfg.ConfigFile = filepath.Join(dir, "config.json")
+	loaded := useConfig(t, cfg)
+	err := LoadFromFile(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response := query(t, "www.lightdns.example", TypeA); answerAddress(response) != "127.0.0.1" {
+		t.Errorf("the embedded zone didn't answer: %+v", response.Answers)
+	}
+
+	// With a config file present a missing store is just empty
+	loaded = useConfig(t, cfg)
+	loaded.ConfigFile = writeConfigFile(t, `{}`)
+	err = LoadFromFile(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response := query(t, "www.lightdns.example", TypeA); len(response.Answers) != 0 {
+		t.Error("the embedded zone was served although a config file exists")
+	}
+}
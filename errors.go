@@ -0,0 +1,32 @@
+package main
+
+import "errors"
+
+// Error kinds returned by the store and the message parsers. Errors are
+// wrapped with one of these so callers can tell them apart with errors.Is.
+var (
+	// ErrNotFound means the name or entry asked for doesn't exist
+	ErrNotFound = errors.New("not found")
+	// ErrMalformed means a message or store file couldn't be decoded
+	ErrMalformed = errors.New("malformed")
+	// ErrIO means reading or writing the store failed
+	ErrIO = errors.New("i/o error")
+	// ErrLimitExceeded means a change would take the store or a zone past
+	// its configured record limit
+	ErrLimitExceeded = errors.New("record limit exceeded")
+)
+
+// rcodeForError maps an error to the rcode answering the query it failed:
+// NXDOMAIN for missing names, FORMERR for undecodable messages, REFUSED for
+// changes over a record limit and SERVFAIL for everything else.
+func rcodeForError(err error) uint16 {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return RcodeNameError
+	case errors.Is(err, ErrMalformed):
+		return RcodeFormatError
+	case errors.Is(err, ErrLimitExceeded):
+		return RcodeRefused
+	}
+	return RcodeServerFailure
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestErrorKinds(t *testing.T) {
+	useConfig(t, DefaultConfig(), NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+
+	unreadable := filepath.Join(t.TempDir(), "names.json")
+	err := os.Mkdir(unreadable, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, missingErr := lookupExisting(context.Background(), currentConfig().store, "missing.example.com", "")
+	_, malformedStoreErr := GetNameModelsFrom(writeRawStoreFile(t, `[{"name": `))
+	_, unreadableErr := GetNameModelsFrom(unreadable)
+	_, truncatedErr := parseResponse(buildQuery(1, 0, "www.example.com", TypeA)[:20])
+	_, headerErr := parseResponse([]byte{0, 1, 2})
+	_, _, loopErr := readMessageName([]byte{0xc0, 0x00}, 0)
+
+	tests := []struct {
+		name  string
+		err   error
+		kind  error
+		rcode uint16
+	}{
+		{"missing entry", missingErr, ErrNotFound, RcodeNameError},
+		{"store file with bad JSON", malformedStoreErr, ErrMalformed, RcodeFormatError},
+		{"unreadable store file", unreadableErr, ErrIO, RcodeServerFailure},
+		{"truncated question", truncatedErr, ErrMalformed, RcodeFormatError},
+		{"truncated header", headerErr, ErrMalformed, RcodeFormatError},
+		{"compression loop", loopErr, ErrMalformed, RcodeFormatError},
+	}
+	for _, test := range tests {
+		if !errors.Is(test.err, test.kind) {
+			t.Errorf("%s: error %v, want %v", test.name, test.err, test.kind)
+		}
+		if rcode := rcodeForError(test.err); rcode != test.rcode {
+			t.Errorf("%s: rcode %d, want %d", test.name, rcode, test.rcode)
+		}
+	}
+}
+
+func TestErrorKindsSurviveWrapping(t *testing.T) {
+	wrapped := fmt.Errorf("reloading: %w", fmt.Errorf("%w: record limit of 10 for zone example.com", ErrLimitExceeded))
+	if rcode := rcodeForError(wrapped); rcode != RcodeRefused {
+		t.Errorf("rcode for a wrapped limit error = %d, want REFUSED", rcode)
+	}
+	if rcode := rcodeForError(errors.New("connection reset")); rcode != RcodeServerFailure {
+		t.Errorf("rcode for an unclassified error = %d, want SERVFAIL", rcode)
+	}
+}
+
+func TestMissingStoreFileIsEmpty(t *testing.T) {
+	models, err := GetNameModelsFrom(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil || len(models) != 0 {
+		t.Errorf("GetNameModelsFrom of a missing file = %v, %v; want an empty store", models, err)
+	}
+}
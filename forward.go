@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// ForwardingConfig turns the server into a forwarder for names it has no
+// data for. Queries for them are sent to the upstream resolvers, picked by
+// Strategy, and the answers are cached. An upstream that fails is skipped for
+// FailureHoldSeconds.
+//
+// OnFailure picks the answer when no upstream responds: "servfail" (the
+// default), "stale" to serve expired cache entries up to MaxStaleSeconds
+// past their TTL (RFC 8767), or "fallback" for the fixed Fallback addresses.
+// Both fall back to SERVFAIL when they have nothing to answer with.
+//
+// RandomizeCase turns on DNS 0x20: the letters of each forwarded name get a
+// random case, and responses that don't echo it exactly are dropped as
+// likely spoofed.
+type ForwardingConfig struct {
+	Upstreams          []string       `json:"upstreams"`
+	Strategy           string         `json:"strategy"`
+	TimeoutMillis      int            `json:"timeoutMillis"`
+	FailureHoldSeconds int            `json:"failureHoldSeconds"`
+	CacheEntries       int            `json:"cacheEntries"`
+	OnFailure          string         `json:"onFailure"`
+	MaxStaleSeconds    int            `json:"maxStaleSeconds"`
+	Fallback           CatchAllConfig `json:"fallback"`
+	RandomizeCase      bool           `json:"randomizeCase"`
+}
+
+func forwardingEnabled() bool {
+	return len(currentConfig().Forwarding.Upstreams) > 0
+}
+
+// forwardGroup coalesces concurrent forwards of the same question.
+var forwardGroup singleflight.Group
+
+// forwardGroupKey names the shared upstream exchange of a question.
+func forwardGroupKey(key cacheKey) string {
+	return fmt.Sprintf("%s/%d/%d", key.name, key.qtype, key.class)
+}
+
+// forwardQuery asks the upstreams in turn until one answers, giving up when
+// the context is done. Upstreams aren't blamed for a cancelled exchange.
+func forwardQuery(ctx context.Context, question DNSResourceRecord) (DNSResponse, error) {
+	forwarding := currentConfig().Forwarding
+	timeout := time.Duration(valueOrDefaultInt(forwarding.TimeoutMillis, 2000)) * time.Millisecond
+	holdoff := time.Duration(valueOrDefaultInt(forwarding.FailureHoldSeconds, 30)) * time.Second
+
+	var lastErr error
+	for _, upstream := range upstreamHealth.Order(forwarding.Upstreams, forwarding.Strategy, time.Now()) {
+		started := time.Now()
+		response, err := exchangeWithUpstream(ctx, upstream, question, timeout)
+		if err == nil {
+			upstreamHealth.RecordSuccess(upstream, time.Since(started))
+			return response, nil
+		}
+		if ctx.Err() != nil {
+			return DNSResponse{}, ctx.Err()
+		}
+		logWarn("Error forwarding", question.DomainName, "to", upstream, ":", err)
+		upstreamHealth.RecordFailure(upstream, time.Now(), holdoff)
+		lastErr = err
+	}
+
+	return DNSResponse{}, lastErr
+}
+
+// exchangeWithUpstream sends a question to one upstream. The Client retries
+// truncated answers over TCP.
+func exchangeWithUpstream(ctx context.Context, upstream string, question DNSResourceRecord, timeout time.Duration) (DNSResponse, error) {
+	queryName := strings.TrimSuffix(question.DomainName, ".")
+	sentName := queryName
+	if currentConfig().Forwarding.RandomizeCase {
+		sentName = randomizeCase(queryName)
+	}
+
+	client := Client{Timeout: timeout}
+	response, err := client.Exchange(ctx, buildQuery(uint16(rand.Uint32()), FlagRecursionDesired, sentName, question.Type), upstream)
+	if err != nil {
+		return DNSResponse{}, err
+	}
+
+	// Only accept the answer to the question we asked, in the case we asked
+	// it with when the case was randomized
+	if len(response.Questions) != 1 ||
+		!strings.EqualFold(response.Questions[0].DomainName, sentName) ||
+		response.Questions[0].Type != question.Type {
+		return DNSResponse{}, fmt.Errorf("response doesn't match the query")
+	}
+	if currentConfig().Forwarding.RandomizeCase && response.Questions[0].DomainName != sentName {
+		return DNSResponse{}, fmt.Errorf("response doesn't echo the query name's case")
+	}
+
+	// Clients see their own spelling of the name, not the randomized one
+	if sentName != queryName {
+		for _, section := range [][]DNSResourceRecord{response.Questions, response.Answers, response.Authorities, response.Additionals} {
+			for i := range section {
+				if section[i].DomainName == sentName {
+					section[i].DomainName = queryName
+				}
+			}
+		}
+	}
+
+	return response, nil
+}
+
+// randomizeCase flips the case of each letter in a name at random (DNS
+// 0x20). Upstreams echo the question name as sent, so an off-path spoofer
+// also has to guess one bit per letter.
+func randomizeCase(name string) string {
+	randomized := []byte(name)
+	var bits uint64
+	var remaining int
+	for i, c := range randomized {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+			continue
+		}
+		if remaining == 0 {
+			bits, remaining = rand.Uint64(), 64
+		}
+		if bits&1 == 1 {
+			randomized[i] = c ^ 0x20
+		}
+		bits >>= 1
+		remaining--
+	}
+	return string(randomized)
+}
+
+// resolveForwarded answers a question from the cache, or forwards it when
+// the client asked for recursion. Upstream failures are SERVFAIL, as are
+// queries whose context is done before the upstream answers.
+func resolveForwarded(ctx context.Context, question DNSResourceRecord, recursionDesired bool) ([]DNSResourceRecord, []DNSResourceRecord, uint16, string) {
+	key := newCacheKey(question)
+	now := time.Now()
+
+	answers, authorities, rcode, ok := forwardCache.Get(key, now)
+	if ok {
+		return answers, authorities, rcode, SourceCache
+	}
+
+	if !recursionDesired {
+		return nil, nil, RcodeRefused, SourceLocal
+	}
+
+	// Identical concurrent queries wait for one shared upstream exchange. It
+	// isn't bound to any one query's context, only to the server's, so a
+	// query giving up doesn't fail the others waiting on it.
+	results := forwardGroup.DoChan(forwardGroupKey(key), func() (any, error) {
+		response, err := forwardQuery(serverContext, question)
+		if err == nil {
+			forwardCache.Store(key, response.Answers, response.Authorities, response.Header.Flags&0x0f, now)
+		}
+		return response, err
+	})
+
+	var result singleflight.Result
+	select {
+	case result = <-results:
+	case <-ctx.Done():
+	}
+	if ctx.Err() != nil {
+		logDebug("Gave up forwarding", question.DomainName, ":", ctx.Err())
+		return nil, nil, RcodeServerFailure, SourceUpstream
+	}
+	if result.Err != nil {
+		return forwardFailureAnswer(question, key, now)
+	}
+
+	// Every waiter gets its own copy, as the records are modified later on
+	response := result.Val.(DNSResponse)
+	return slices.Clone(response.Answers), slices.Clone(response.Authorities), response.Header.Flags & 0x0f, SourceUpstream
+}
+
+// forwardFailureAnswer answers a question no upstream responded to, as
+// configured by OnFailure.
+func forwardFailureAnswer(question DNSResourceRecord, key cacheKey, now time.Time) ([]DNSResourceRecord, []DNSResourceRecord, uint16, string) {
+	switch strings.ToLower(currentConfig().Forwarding.OnFailure) {
+	case "stale":
+		maxStale := time.Duration(valueOrDefaultInt(currentConfig().Forwarding.MaxStaleSeconds, 86400)) * time.Second
+		answers, authorities, rcode, ok := forwardCache.GetStale(key, now, maxStale)
+		if ok {
+			logDebug("Serving stale answer for", question.DomainName)
+			return answers, authorities, rcode, SourceStale
+		}
+	case "fallback":
+		fallback, ok := fixedAnswer(currentConfig().Forwarding.Fallback, question)
+		if ok {
+			return []DNSResourceRecord{fallback}, nil, RcodeNoError, SourceFallback
+		}
+	}
+
+	return nil, nil, RcodeServerFailure, SourceUpstream
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubUpstream is a UDP resolver for forwarding tests.
+type stubUpstream struct {
+	address string
+	queries atomic.Int32
+}
+
+// startUpstream serves respond's answer to every query it receives; a nil
+// answer leaves the query unanswered.
+func startUpstream(t *testing.T, respond func(requestBytes []byte) []byte) *stubUpstream {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	upstream := &stubUpstream{address: conn.LocalAddr().String()}
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			upstream.queries.Add(1)
+			if responseBytes := respond(append([]byte(nil), buffer[:n]...)); responseBytes != nil {
+				conn.WriteTo(responseBytes, addr)
+			}
+		}
+	}()
+	return upstream
+}
+
+// upstreamResponse answers a query with the rcode and records, echoing its
+// question as sent.
+func upstreamResponse(requestBytes []byte, rcode uint16, answers ...DNSResourceRecord) []byte {
+	_, questionEnd, _ := readMessageName(requestBytes, DNSHeaderSizeBytes)
+	questionEnd += 4
+
+	response := bytes.NewBuffer(append([]byte(nil), requestBytes[:questionEnd]...))
+	flags := binary.BigEndian.Uint16(requestBytes[2:])&FlagRecursionDesired | FlagResponse | FlagRecursionAvailable | rcode
+	binary.BigEndian.PutUint16(response.Bytes()[2:], flags)
+	binary.BigEndian.PutUint16(response.Bytes()[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(response.Bytes()[10:], 0)
+	compression := make(nameCompression)
+	for _, answer := range answers {
+		writeResourceRecord(response, answer, compression)
+	}
+	return response.Bytes()
+}
+
+// useForwarding publishes cfg forwarding to the upstreams, with an empty
+// cache and fresh upstream health.
+func useForwarding(t *testing.T, cfg Config, upstreams ...string) *Config {
+	t.Helper()
+	cfg.Forwarding.Upstreams = upstreams
+	if cfg.Forwarding.TimeoutMillis == 0 {
+		cfg.Forwarding.TimeoutMillis = 500
+	}
+
+	previousCache, previousHealth := forwardCache, upstreamHealth
+	forwardCache = newTestCache()
+	upstreamHealth = &upstreamPool{states: make(map[string]*upstreamState)}
+	t.Cleanup(func() { forwardCache, upstreamHealth = previousCache, previousHealth })
+
+	return useConfig(t, cfg)
+}
+
+func TestForwardingTimesOutWithSERVFAIL(t *testing.T) {
+	silent := startUpstream(t, func([]byte) []byte { return nil })
+	cfg := DefaultConfig()
+	cfg.Forwarding.TimeoutMillis = 100
+	useForwarding(t, cfg, silent.address)
+
+	started := time.Now()
+	response := query(t, "www.example.net", TypeA)
+	if responseCode(response) != RcodeServerFailure {
+		t.Errorf("rcode = %d, want SERVFAIL from a silent upstream", responseCode(response))
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("the query took %v with a 100ms upstream timeout", elapsed)
+	}
+}
+
+// upstreamAddress answers every query with one A record.
+func upstreamAddress(ttl uint32) func(requestBytes []byte) []byte {
+	return func(requestBytes []byte) []byte {
+		name, _, _ := readMessageName(requestBytes, DNSHeaderSizeBytes)
+		return upstreamResponse(requestBytes, RcodeNoError, DNSResourceRecord{
+			DomainName: name, Type: TypeA, Class: ClassINET, TimeToLive: ttl,
+			ResourceData: net.IPv4(192, 0, 2, 40).To4(), ResourceDataLength: 4,
+		})
+	}
+}
+
+func TestForwardedAnswersAreCached(t *testing.T) {
+	upstream := startUpstream(t, upstreamAddress(300))
+	useForwarding(t, DefaultConfig(), upstream.address)
+
+	response := query(t, "www.example.net", TypeA)
+	if len(response.Answers) != 1 || response.Answers[0].TimeToLive != 300 {
+		t.Fatalf("forwarded answers %+v, want one with TTL 300", response.Answers)
+	}
+
+	// Pretend the answer was cached a minute ago
+	ageCache(time.Minute)
+
+	response = query(t, "WWW.example.net", TypeA)
+	if len(response.Answers) != 1 || response.Answers[0].TimeToLive != 240 {
+		t.Errorf("cached answers %+v, want one aged to TTL 240", response.Answers)
+	}
+	if queries := upstream.queries.Load(); queries != 1 {
+		t.Errorf("the upstream was queried %d times, want once", queries)
+	}
+
+	// Once the TTL runs out the question is forwarded again
+	ageCache(5 * time.Minute)
+	query(t, "www.example.net", TypeA)
+	if queries := upstream.queries.Load(); queries != 2 {
+		t.Errorf("the upstream was queried %d times after expiry, want twice", queries)
+	}
+}
+
+func TestConcurrentForwardsShareOneUpstreamQuery(t *testing.T) {
+	answer := upstreamAddress(300)
+	slow := startUpstream(t, func(requestBytes []byte) []byte {
+		time.Sleep(200 * time.Millisecond)
+		return answer(requestBytes)
+	})
+	cfg := DefaultConfig()
+	cfg.Forwarding.TimeoutMillis = 2000
+	useForwarding(t, cfg, slow.address)
+
+	const clients = 20
+	var wg sync.WaitGroup
+	answered := make(chan int, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := newWriter("192.0.2.1", true)
+			handleDNSClient(context.Background(), buildQuery(uint16(i), FlagRecursionDesired, "www.example.net", TypeA), w)
+			response, err := parseResponse(w.responses[0])
+			if err == nil && response.Header.TransactionID == uint16(i) && len(response.Answers) == 1 {
+				answered <- i
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(answered)
+
+	if len(answered) != clients {
+		t.Errorf("%d of %d clients got the answer", len(answered), clients)
+	}
+	if queries := slow.queries.Load(); queries != 1 {
+		t.Errorf("the upstream got %d queries, want 1", queries)
+	}
+}
+
+// ageCache moves every cached answer back in time by age.
+func ageCache(age time.Duration) {
+	forwardCache.Lock()
+	defer forwardCache.Unlock()
+	for _, entry := range forwardCache.entries {
+		entry.stored = entry.stored.Add(-age)
+		entry.expires = entry.expires.Add(-age)
+	}
+}
+
+func TestUpstreamFailureAnswers(t *testing.T) {
+	var down atomic.Bool
+	answer := upstreamAddress(60)
+	upstream := startUpstream(t, func(requestBytes []byte) []byte {
+		if down.Load() {
+			return requestBytes[:4]
+		}
+		return answer(requestBytes)
+	})
+
+	cfg := DefaultConfig()
+	cfg.Forwarding.OnFailure = "stale"
+	cfg.Forwarding.MaxStaleSeconds = 600
+	cfg.Forwarding.FailureHoldSeconds = 1
+	useForwarding(t, cfg, upstream.address)
+
+	query(t, "www.example.net", TypeA)
+	down.Store(true)
+
+	// Expired but within the stale window
+	ageCache(5 * time.Minute)
+	response := query(t, "www.example.net", TypeA)
+	if answerAddress(response) != "192.0.2.40" || response.Answers[0].TimeToLive != staleTTL {
+		t.Errorf("answers %+v while the upstream is down, want the stale answer with TTL %d", response.Answers, staleTTL)
+	}
+
+	// Past the stale window
+	ageCache(10 * time.Minute)
+	if response := query(t, "www.example.net", TypeA); responseCode(response) != RcodeServerFailure {
+		t.Errorf("rcode %d past the stale window, want SERVFAIL", responseCode(response))
+	}
+
+	cfg.Forwarding.OnFailure = "fallback"
+	cfg.Forwarding.Fallback = CatchAllConfig{Address: "192.0.2.254"}
+	useForwarding(t, cfg, upstream.address)
+	if response := query(t, "other.example.net", TypeA); answerAddress(response) != "192.0.2.254" {
+		t.Errorf("answers %+v while the upstream is down, want the fallback address", response.Answers)
+	}
+
+	cfg.Forwarding.OnFailure = ""
+	useForwarding(t, cfg, upstream.address)
+	if response := query(t, "other.example.net", TypeA); responseCode(response) != RcodeServerFailure {
+		t.Errorf("rcode %d by default while the upstream is down, want SERVFAIL", responseCode(response))
+	}
+}
+
+// awaitForward waits out the shared upstream exchange of a question, if one
+// is in flight. It outlives the queries that gave up on it, and must not
+// outlive the test whose cache and upstreams it uses.
+func awaitForward(name string, qtype uint16) {
+	key := newCacheKey(DNSResourceRecord{DomainName: name, Type: qtype, Class: ClassINET})
+	forwardGroup.Do(forwardGroupKey(key), func() (any, error) { return nil, nil })
+}
+
+// heldUpstream answers once the returned release func is called, until
+// then holding every query it receives. Queries are signalled on forwarded.
+func heldUpstream(t *testing.T, forwarded chan<- struct{}) (*stubUpstream, func()) {
+	t.Helper()
+	release := make(chan struct{})
+	var once sync.Once
+	upstream := startUpstream(t, func(requestBytes []byte) []byte {
+		if forwarded != nil {
+			forwarded <- struct{}{}
+		}
+		<-release
+		return upstreamAddress(60)(requestBytes)
+	})
+	return upstream, func() { once.Do(func() { close(release) }) }
+}
+
+func TestCancellingMidForwardAnswersSERVFAIL(t *testing.T) {
+	forwarded := make(chan struct{}, 1)
+	held, release := heldUpstream(t, forwarded)
+	cfg := DefaultConfig()
+	cfg.Forwarding.TimeoutMillis = 5000
+	useForwarding(t, cfg, held.address)
+	t.Cleanup(func() {
+		release()
+		awaitForward("cancelled.example.net", TypeA)
+	})
+
+	// The shared upstream exchange outlives the query, so the name is
+	// one no other test forwards
+	ctx, cancel := context.WithCancel(context.Background())
+	w := newWriter("192.0.2.1", true)
+	done := make(chan struct{})
+	started := time.Now()
+	go func() {
+		handleDNSClient(ctx, buildQuery(1, FlagRecursionDesired, "cancelled.example.net", TypeA), w)
+		close(done)
+	}()
+
+	select {
+	case <-forwarded:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the query was never forwarded")
+	}
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("cancelling the context didn't stop the forward")
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("the cancelled query took %v with a 5s upstream timeout", elapsed)
+	}
+	if len(w.responses) != 1 {
+		t.Fatalf("sent %d responses, want 1", len(w.responses))
+	}
+	response, err := parseResponse(w.responses[0])
+	if err != nil || responseCode(response) != RcodeServerFailure {
+		t.Errorf("rcode = %d (%v), want SERVFAIL", responseCode(response), err)
+	}
+}
+
+func TestQueryTimeoutBoundsForwarding(t *testing.T) {
+	held, release := heldUpstream(t, nil)
+	cfg := DefaultConfig()
+	cfg.Forwarding.TimeoutMillis = 5000
+	cfg.QueryTimeoutMillis = 100
+	useForwarding(t, cfg, held.address)
+	t.Cleanup(func() {
+		release()
+		awaitForward("slow.example.net", TypeA)
+	})
+
+	w := newWriter("192.0.2.1", true)
+	started := time.Now()
+	serveQuery(buildQuery(2, FlagRecursionDesired, "slow.example.net", TypeA), w)
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("the query took %v with a 100ms query timeout", elapsed)
+	}
+	if len(w.responses) != 1 {
+		t.Fatalf("sent %d responses, want 1", len(w.responses))
+	}
+	response, _ := parseResponse(w.responses[0])
+	if responseCode(response) != RcodeServerFailure {
+		t.Errorf("rcode = %d, want SERVFAIL", responseCode(response))
+	}
+}
+
+func TestRandomizedCaseMustBeEchoed(t *testing.T) {
+	// Letters in the question name are lowercased before answering, as an
+	// off-path spoofer guessing the name would send it
+	spoofer := startUpstream(t, func(requestBytes []byte) []byte {
+		_, questionEnd, _ := readMessageName(requestBytes, DNSHeaderSizeBytes)
+		copy(requestBytes[DNSHeaderSizeBytes:], bytes.ToLower(requestBytes[DNSHeaderSizeBytes:questionEnd]))
+		return upstreamAddress(300)(requestBytes)
+	})
+	cfg := DefaultConfig()
+	cfg.Forwarding.RandomizeCase = true
+	useForwarding(t, cfg, spoofer.address)
+
+	name := "abcdefghijklmnopqrstuvwxyz.example.net"
+	question := DNSResourceRecord{DomainName: name, Type: TypeA, Class: ClassINET}
+	_, err := exchangeWithUpstream(context.Background(), spoofer.address, question, time.Second)
+	if err == nil {
+		t.Error("a response with the name's case lost was accepted")
+	}
+	if response := query(t, name, TypeA); responseCode(response) != RcodeServerFailure {
+		t.Errorf("rcode %d, want SERVFAIL when the only response is spoofed", responseCode(response))
+	}
+
+	// An upstream echoing the name as sent is answered in the client's case
+	honest := startUpstream(t, upstreamAddress(300))
+	useForwarding(t, cfg, honest.address)
+	response := query(t, "Echoed.Example.net", TypeA)
+	if len(response.Answers) != 1 || response.Answers[0].DomainName != "Echoed.Example.net" {
+		t.Errorf("answers %+v, want one owned by the name as queried", response.Answers)
+	}
+}
+
+func TestRandomizeCase(t *testing.T) {
+	name := "www-1.abcdefghijklmnopqrstuvwxyz.example.net"
+	randomized := randomizeCase(name)
+	if !strings.EqualFold(randomized, name) || randomized[3:6] != "-1." {
+		t.Fatalf("randomizeCase(%q) = %q, want only the letters' case changed", name, randomized)
+	}
+	if randomized == name && randomizeCase(name) == name {
+		t.Errorf("randomizeCase(%q) never changes the case", name)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// GeoIPConfig selects a store file by the client's country, using a MaxMind
+// GeoLite2/GeoIP2 country database. Countries are ISO 3166-1 alpha-2 codes.
+// The client subnet (ECS) of queries from resolvers in TrustedResolvers is
+// located instead of the resolver's own address; other senders' subnets
+// are ignored, as anyone can put any subnet in a query.
+type GeoIPConfig struct {
+	Database         string            `json:"database"`
+	Countries        map[string]string `json:"countries"`
+	TrustedResolvers []string          `json:"trustedResolvers"`
+
+	trustedNetworks []*net.IPNet
+}
+
+// TrustsResolver reports whether the client subnet sent by the resolver at
+// the address is used for GeoIP.
+func (geoConfig GeoIPConfig) TrustsResolver(resolverIP net.IP) bool {
+	for _, network := range geoConfig.trustedNetworks {
+		if network.Contains(resolverIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// GeoLookup resolves the ISO country code of an address.
+type GeoLookup interface {
+	Country(ip net.IP) (string, error)
+}
+
+type maxMindLookup struct {
+	reader *geoip2.Reader
+}
+
+func (lookup maxMindLookup) Country(ip net.IP) (string, error) {
+	record, err := lookup.reader.Country(ip)
+	if err != nil {
+		return "", err
+	}
+	return record.Country.IsoCode, nil
+}
+
+// LoadGeoIP opens the configured database once at startup and parses the
+// trusted resolver networks.
+func LoadGeoIP(geoConfig *GeoIPConfig) (GeoLookup, error) {
+	geoConfig.trustedNetworks = nil
+	for _, network := range geoConfig.TrustedResolvers {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GeoIP trusted resolver network %q", network)
+		}
+		geoConfig.trustedNetworks = append(geoConfig.trustedNetworks, ipNet)
+	}
+
+	if geoConfig.Database == "" {
+		return nil, nil
+	}
+
+	reader, err := geoip2.Open(geoConfig.Database)
+	if err != nil {
+		return nil, fmt.Errorf("error opening GeoIP database: %v", err)
+	}
+
+	return maxMindLookup{reader: reader}, nil
+}
+
+// storeFileForCountry returns the country specific store file for the client,
+// or an empty string when there is none.
+func storeFileForCountry(clientIP net.IP) string {
+	cfg := currentConfig()
+	if cfg.geoLookup == nil || clientIP == nil {
+		return ""
+	}
+
+	country, err := cfg.geoLookup.Country(clientIP)
+	if err != nil {
+		logWarn("Error looking up country for", clientIP, ":", err)
+		return ""
+	}
+
+	return cfg.GeoIP.Countries[strings.ToUpper(country)]
+}
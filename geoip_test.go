@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+// countryLookup locates addresses from a fixed table.
+type countryLookup map[string]string
+
+func (lookup countryLookup) Country(ip net.IP) (string, error) {
+	country, ok := lookup[ip.String()]
+	if !ok {
+		return "", fmt.Errorf("%s not found", ip)
+	}
+	return country, nil
+}
+
+// geoConfig serves www and mail from the default store, with www and a
+// name only Germany has overridden for clients in Germany.
+func geoConfig(t *testing.T, trustedResolvers ...string) *Config {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	cfg.GeoIP = GeoIPConfig{
+		Countries: map[string]string{"DE": writeStoreFile(t,
+			NameModel{Name: "www.example.com", Address: "198.51.100.10"},
+			NameModel{Name: "de.example.com", Address: "198.51.100.20"},
+		)},
+		TrustedResolvers: trustedResolvers,
+	}
+	loaded := useConfig(t, cfg,
+		NameModel{Name: "www.example.com", Address: "192.0.2.10"},
+		NameModel{Name: "mail.example.com", Address: "192.0.2.25"},
+	)
+	loaded.geoLookup = countryLookup{"203.0.113.1": "de", "203.0.113.2": "US", "203.0.113.0": "de"}
+	return loaded
+}
+
+func TestGeoIPFallsBackPerName(t *testing.T) {
+	geoConfig(t)
+
+	tests := []struct {
+		client string
+		name   string
+		want   string
+	}{
+		{"203.0.113.1", "www.example.com", "198.51.100.10"},
+		{"203.0.113.1", "de.example.com", "198.51.100.20"},
+		{"203.0.113.1", "mail.example.com", "192.0.2.25"},
+		{"203.0.113.2", "www.example.com", "192.0.2.10"},
+		{"192.0.2.99", "www.example.com", "192.0.2.10"},
+	}
+	for _, test := range tests {
+		response := serve(t, newWriter(test.client, true), buildQuery(1, 0, test.name, TypeA))
+		if got := answerAddress(response); got != test.want {
+			t.Errorf("%s from %s got %q, want %s", test.name, test.client, got, test.want)
+		}
+	}
+}
@@ -1,3 +1,23 @@
 module testDNS
 
 go 1.21.5
+
+require (
+	github.com/alicebob/miniredis/v2 v2.31.1
+	github.com/mattn/go-sqlite3 v1.14.52
+	github.com/oschwald/geoip2-golang v1.13.0
+	github.com/redis/go-redis/v9 v9.18.0
+	golang.org/x/net v0.35.0
+	golang.org/x/sync v0.11.0
+	golang.org/x/sys v0.30.0
+)
+
+require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/oschwald/maxminddb-golang v1.13.0 // indirect
+	github.com/yuin/gopher-lua v1.1.0 // indirect
+	go.uber.org/atomic v1.11.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
+)
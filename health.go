@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// serverReady reports whether initialization has completed and the store was
+// loaded successfully. It is cleared again if a load fails.
+var serverReady atomic.Bool
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if !serverReady.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "ok")
+}
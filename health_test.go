@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHealthzFollowsReadiness(t *testing.T) {
+	previous := serverReady.Load()
+	t.Cleanup(func() { serverReady.Store(previous) })
+
+	serverReady.Store(false)
+	w := apiRequest(t, http.MethodGet, "/healthz", "", "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("/healthz before the store loaded = %d, want 503", w.Code)
+	}
+
+	serverReady.Store(true)
+	w = apiRequest(t, http.MethodGet, "/healthz", "", "")
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("/healthz once ready = %d %q, want 200 ok", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"hash/maphash"
+	"math"
+	"math/bits"
+)
+
+// hyperLogLogPrecision is the number of hash bits used to pick a register;
+// 2^12 registers give about 1.6% standard error in 4 KiB of memory.
+const hyperLogLogPrecision = 12
+
+var hyperLogLogSeed = maphash.MakeSeed()
+
+// HyperLogLog estimates the number of distinct strings added to it using a
+// fixed amount of memory, however many strings are seen.
+type HyperLogLog struct {
+	registers [1 << hyperLogLogPrecision]uint8
+}
+
+func (h *HyperLogLog) Add(value string) {
+	hash := maphash.String(hyperLogLogSeed, value)
+
+	index := hash >> (64 - hyperLogLogPrecision)
+	// The guard bit keeps the rank within the remaining 52 bits
+	rank := uint8(bits.LeadingZeros64(hash<<hyperLogLogPrecision|1<<(hyperLogLogPrecision-1))) + 1
+
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+// Merge folds another estimator into this one, so the result counts the
+// union of both.
+func (h *HyperLogLog) Merge(other *HyperLogLog) {
+	for i, rank := range other.registers {
+		if rank > h.registers[i] {
+			h.registers[i] = rank
+		}
+	}
+}
+
+// Estimate returns the approximate number of distinct values added.
+func (h *HyperLogLog) Estimate() uint64 {
+	registerCount := float64(len(h.registers))
+
+	var sum float64
+	var zeroRegisters int
+	for _, rank := range h.registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeroRegisters++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/registerCount)
+	estimate := alpha * registerCount * registerCount / sum
+
+	// Linear counting is more accurate while many registers are still empty
+	if estimate <= 2.5*registerCount && zeroRegisters > 0 {
+		estimate = registerCount * math.Log(registerCount/float64(zeroRegisters))
+	}
+
+	return uint64(estimate + 0.5)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	for _, distinct := range []int{1000, 100000} {
+		var h HyperLogLog
+		for i := 0; i < distinct; i++ {
+			name := fmt.Sprintf("%x.example.com", i)
+			h.Add(name)
+			h.Add(name)
+		}
+		estimate := float64(h.Estimate())
+		if math.Abs(estimate-float64(distinct))/float64(distinct) > 0.06 {
+			t.Errorf("estimated %.0f distinct names, want about %d", estimate, distinct)
+		}
+	}
+}
+
+func TestDistinctNamesWindow(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DistinctNamesWindowSeconds = 60
+	useConfig(t, cfg)
+
+	counter := distinctNameCounter{current: &HyperLogLog{}, previous: &HyperLogLog{}}
+	for i := 0; i < 100; i++ {
+		counter.Add(fmt.Sprintf("host%d.example.com", i))
+	}
+
+	// One window later the names still count, from the previous window
+	counter.windowStarted = counter.windowStarted.Add(-61 * time.Second)
+	if estimate := counter.Estimate(); estimate < 95 || estimate > 105 {
+		t.Errorf("a window later the estimate is %d, want about 100", estimate)
+	}
+
+	// After two windows of silence they're gone
+	counter.windowStarted = counter.windowStarted.Add(-121 * time.Second)
+	if estimate := counter.Estimate(); estimate != 0 {
+		t.Errorf("two windows later the estimate is %d, want 0", estimate)
+	}
+
+	query(t, "www.example.com", TypeA)
+	metrics := apiRequest(t, http.MethodGet, "/metrics", "", "").Body.String()
+	if !strings.Contains(metrics, "\nlightdns_distinct_query_names ") {
+		t.Error("/metrics doesn't report the distinct query names")
+	}
+}
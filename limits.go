@@ -0,0 +1,27 @@
+package main
+
+import "fmt"
+
+// checkRecordLimits checks a complete list of entries, as it would be after
+// a load or a change, against the store's and the zones' record limits.
+// Changes are checked before they are applied, so a change going over a
+// limit is rejected as a whole.
+func checkRecordLimits(cfg *Config, models []NameModel) error {
+	if cfg.MaxRecords > 0 && len(models) > cfg.MaxRecords {
+		return fmt.Errorf("%w: %d entries, the store is limited to %d", ErrLimitExceeded, len(models), cfg.MaxRecords)
+	}
+
+	zoneCounts := make(map[*ZoneConfig]int)
+	for _, model := range models {
+		zone := cfg.findZone(canonicalTarget(model.Name))
+		if zone == nil || zone.MaxRecords == 0 {
+			continue
+		}
+		zoneCounts[zone]++
+		if zoneCounts[zone] > zone.MaxRecords {
+			return fmt.Errorf("%w: zone %s is limited to %d entries", ErrLimitExceeded, zone.Name, zone.MaxRecords)
+		}
+	}
+
+	return nil
+}
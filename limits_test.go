@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestAddEntryStopsAtZoneLimit(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.APIToken = testToken
+	cfg.Zones = []ZoneConfig{{Name: "example.com", MaxRecords: 2}}
+	loaded := useConfig(t, cfg,
+		NameModel{Name: "www.example.com", Address: "192.0.2.10"},
+		NameModel{Name: "www.example.org", Address: "192.0.2.20"},
+	)
+
+	if w := apiRequest(t, http.MethodPost, "/add-entry?name=mail.example.com&ip=192.0.2.11", "", testToken); w.Code != http.StatusOK {
+		t.Fatalf("adding up to the limit: status %d: %s", w.Code, w.Body)
+	}
+	w := apiRequest(t, http.MethodPost, "/add-entry?name=ftp.example.com&ip=192.0.2.12", "", testToken)
+	if w.Code != http.StatusInsufficientStorage {
+		t.Errorf("adding past the limit: status %d, want 507: %s", w.Code, w.Body)
+	}
+	if len(storedEntries(t, loaded, "ftp.example.com")) != 0 {
+		t.Error("the entry past the limit was stored")
+	}
+
+	// Other zones and names outside every zone aren't limited
+	if w := apiRequest(t, http.MethodPost, "/add-entry?name=mail.example.org&ip=192.0.2.21", "", testToken); w.Code != http.StatusOK {
+		t.Errorf("adding outside the limited zone: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestLoaderRejectsStoreOverLimit(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxRecords = 3
+	cfg.StoreFile = writeStoreFile(t,
+		NameModel{Name: "a.example.com", Address: "192.0.2.1"},
+		NameModel{Name: "b.example.com", Address: "192.0.2.2"},
+		NameModel{Name: "c.example.com", Address: "192.0.2.3"},
+		NameModel{Name: "d.example.com", Address: "192.0.2.4"},
+	)
+	memoryStore := &MemoryStore{}
+	cfg.store = memoryStore
+
+	err := LoadFromFile(&cfg)
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("LoadFromFile = %v, want ErrLimitExceeded", err)
+	}
+	models, _ := memoryStore.All(context.Background())
+	if len(models) != 0 {
+		t.Errorf("the store was seeded with %d of the entries, want none", len(models))
+	}
+
+	cfg.MaxRecords = 4
+	err = LoadFromFile(&cfg)
+	if err != nil {
+		t.Errorf("LoadFromFile at the limit = %v", err)
+	}
+}
+
+func TestUpdateOverLimitIsRejectedAsWhole(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com", MaxRecords: 2, AllowUpdate: []string{"198.51.100.0/24"}}}
+	useConfig(t, cfg, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+	ctx := context.Background()
+
+	two := updateMessage(nil, addRecord("a.example.com", "192.0.2.1", 60), addRecord("b.example.com", "192.0.2.2", 60))
+	if rcode := applyUpdate(ctx, two, updateClient, ""); rcode != RcodeRefused {
+		t.Errorf("update past the limit: rcode %d, want REFUSED", rcode)
+	}
+	if response := query(t, "a.example.com", TypeA); len(response.Answers) != 0 {
+		t.Error("part of an update past the limit was applied")
+	}
+
+	one := updateMessage(nil, addRecord("a.example.com", "192.0.2.1", 60))
+	if rcode := applyUpdate(ctx, one, updateClient, ""); rcode != RcodeNoError {
+		t.Errorf("update up to the limit: rcode %d, want NOERROR", rcode)
+	}
+}
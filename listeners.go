@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// ListenerConfig is one address the DNS server listens on. Network is one of
+// udp, udp4, udp6, tcp, tcp4 or tcp6; plain udp/tcp bind dual-stack where the
+// platform supports it.
+type ListenerConfig struct {
+	Network string `json:"network"`
+	Address string `json:"address"`
+}
+
+// DNSResponseWriter sends a response back over the transport the query came
+// in on.
+type DNSResponseWriter interface {
+	WriteResponse(responseBytes []byte) error
+	RemoteAddr() net.Addr
+	// UDP responses are subject to the client's payload size limit
+	IsUDP() bool
+}
+
+type udpResponseWriter struct {
+	conn       *net.UDPConn
+	clientAddr *net.UDPAddr
+}
+
+func (w udpResponseWriter) WriteResponse(responseBytes []byte) error {
+	_, err := w.conn.WriteToUDP(responseBytes, w.clientAddr)
+	return err
+}
+
+func (w udpResponseWriter) RemoteAddr() net.Addr { return w.clientAddr }
+func (w udpResponseWriter) IsUDP() bool          { return true }
+
+type tcpResponseWriter struct {
+	conn net.Conn
+}
+
+// WriteResponse prefixes the message with its two byte length (RFC 1035
+// section 4.2.2). A failed or timed out write closes the connection, since
+// the client can no longer tell where the next message starts.
+func (w tcpResponseWriter) WriteResponse(responseBytes []byte) error {
+	setDeadline(w.conn.SetWriteDeadline, currentConfig().TCPWriteTimeoutMillis)
+
+	message := binary.BigEndian.AppendUint16(nil, uint16(len(responseBytes)))
+	_, err := w.conn.Write(append(message, responseBytes...))
+	if err != nil {
+		w.conn.Close()
+	}
+	return err
+}
+
+func (w tcpResponseWriter) RemoteAddr() net.Addr { return w.conn.RemoteAddr() }
+func (w tcpResponseWriter) IsUDP() bool          { return false }
+
+// clientIP extracts the IP address of a UDP or TCP peer.
+func clientIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// listenerConfigs returns the configured listeners, falling back to UDP and
+// TCP listeners on DNSAddress. TCP is needed for truncated answers and zone
+// transfers.
+func listenerConfigs() []ListenerConfig {
+	if len(currentConfig().Listeners) > 0 {
+		return currentConfig().Listeners
+	}
+	address := currentConfig().DNSAddress
+	return []ListenerConfig{{Network: "udp", Address: address}, {Network: "tcp", Address: address}}
+}
+
+// StartListeners opens every configured listener and serves each in its own
+// goroutine. Either all listeners start or an error is returned.
+func StartListeners(listeners []ListenerConfig) error {
+	var servers []func()
+
+	for _, listener := range listeners {
+		switch network := strings.ToLower(listener.Network); network {
+		case "udp", "udp4", "udp6":
+			serverConns, err := listenUDP(network, listener.Address)
+			if err != nil {
+				return err
+			}
+
+			for _, serverConn := range serverConns {
+				serverConn := serverConn
+				setUDPSocketBuffers(serverConn)
+				servers = append(servers, func() { serveUDP(serverConn) })
+			}
+		case "tcp", "tcp4", "tcp6":
+			tcpListener, err := net.Listen(network, listener.Address)
+			if err != nil {
+				return fmt.Errorf("error listening on %s %s: %v", network, listener.Address, err)
+			}
+
+			servers = append(servers, func() { serveTCP(tcpListener) })
+		default:
+			return fmt.Errorf("unknown listener network %q", listener.Network)
+		}
+
+		logInfo("DNS server is running on", listener.Network, listener.Address)
+	}
+
+	for _, server := range servers {
+		go server()
+	}
+
+	return nil
+}
+
+// listenUDP opens the sockets of a UDP listener: one, or with reusePort
+// reusePortSockets sockets sharing the address, each served by its own
+// read loop.
+func listenUDP(network string, address string) ([]*net.UDPConn, error) {
+	if !currentConfig().ReusePort {
+		serverAddr, err := net.ResolveUDPAddr(network, address)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving %s address %s: %v", network, address, err)
+		}
+
+		serverConn, err := net.ListenUDP(network, serverAddr)
+		if err != nil {
+			return nil, fmt.Errorf("error listening on %s %s: %v", network, address, err)
+		}
+		return []*net.UDPConn{serverConn}, nil
+	}
+
+	listenConfig := net.ListenConfig{Control: reusePortControl}
+	socketCount := valueOrDefaultInt(currentConfig().ReusePortSockets, runtime.NumCPU())
+
+	serverConns := make([]*net.UDPConn, 0, socketCount)
+	for len(serverConns) < socketCount {
+		packetConn, err := listenConfig.ListenPacket(context.Background(), network, address)
+		if err != nil {
+			for _, serverConn := range serverConns {
+				serverConn.Close()
+			}
+			return nil, fmt.Errorf("error listening on %s %s: %v", network, address, err)
+		}
+		serverConns = append(serverConns, packetConn.(*net.UDPConn))
+	}
+
+	logInfo("Opened", socketCount, "SO_REUSEPORT sockets on", network, address)
+	return serverConns, nil
+}
+
+// setUDPSocketBuffers applies the configured socket buffer sizes and logs
+// the sizes the kernel actually granted.
+func setUDPSocketBuffers(conn *net.UDPConn) {
+	if currentConfig().UDPSocketReceiveBuffer > 0 {
+		err := conn.SetReadBuffer(currentConfig().UDPSocketReceiveBuffer)
+		if err != nil {
+			logWarn("Error setting UDP receive buffer on", conn.LocalAddr(), ":", err)
+		}
+	}
+	if currentConfig().UDPSocketSendBuffer > 0 {
+		err := conn.SetWriteBuffer(currentConfig().UDPSocketSendBuffer)
+		if err != nil {
+			logWarn("Error setting UDP send buffer on", conn.LocalAddr(), ":", err)
+		}
+	}
+
+	receiveSize, sendSize, err := socketBufferSizes(conn)
+	if err != nil {
+		logDebug("Error reading UDP socket buffer sizes:", err)
+		return
+	}
+	logInfo("UDP socket buffers on", conn.LocalAddr(), ":", receiveSize, "bytes receive,", sendSize, "bytes send")
+}
+
+func serveUDP(serverConn *net.UDPConn) {
+	defer serverConn.Close()
+
+	var readBuffer []byte
+	for {
+		cfg := currentConfig()
+		bufferSize := min(max(cfg.UDPReadBufferSize, int(UDPMaxMessageSizeBytes)), 65535)
+		highWaterMark := cfg.UDPQueueHighWaterMark
+		if len(readBuffer) != bufferSize {
+			readBuffer = make([]byte, bufferSize)
+		}
+
+		n, clientAddr, err := serverConn.ReadFromUDP(readBuffer)
+
+		if err != nil {
+			logError("Error receiving for DNS server:", err)
+		} else {
+			logDebug("Received DNS request from ", clientAddr)
+			// The read buffer is reused, so the handler gets its own copy
+			requestBytes := append([]byte(nil), readBuffer[:n]...)
+			responseWriter := udpResponseWriter{conn: serverConn, clientAddr: clientAddr}
+
+			// Past the high-water mark, fail fast rather than queue
+			if shouldShed(highWaterMark) {
+				shedQueriesTotal.Add(1)
+				if responseBytes := shedResponse(requestBytes); responseBytes != nil {
+					responseWriter.WriteResponse(responseBytes)
+				}
+				continue
+			}
+
+			udpQueriesQueued.Add(1)
+			go func() {
+				defer udpQueriesQueued.Add(-1)
+				serveQuery(requestBytes, responseWriter)
+			}()
+		}
+	}
+}
+
+func serveTCP(listener net.Listener) {
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logError("Error accepting TCP connection:", err)
+			continue
+		}
+
+		go handleTCPConnection(conn)
+	}
+}
+
+// setDeadline applies a timeout in milliseconds through one of the
+// net.Conn deadline setters; 0 clears the deadline.
+func setDeadline(setter func(time.Time) error, timeoutMillis int) {
+	if timeoutMillis <= 0 {
+		setter(time.Time{})
+		return
+	}
+	setter(time.Now().Add(time.Duration(timeoutMillis) * time.Millisecond))
+}
+
+// handleTCPConnection answers length-prefixed queries on a connection until
+// the client closes it or stalls past the read timeout.
+func handleTCPConnection(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		// The read deadline covers waiting for and reading one whole query
+		cfg := currentConfig()
+		readTimeoutMillis := cfg.TCPReadTimeoutMillis
+		maxMessageSize := cfg.TCPMaxMessageSize
+		setDeadline(conn.SetReadDeadline, readTimeoutMillis)
+
+		var lengthBytes [2]byte
+		_, err := io.ReadFull(conn, lengthBytes[:])
+		if err != nil {
+			if err != io.EOF {
+				logDebug("Error reading TCP message length:", err)
+			}
+			return
+		}
+
+		// The length prefix is up to the client, so refuse to allocate or
+		// wait for more than a query can reasonably need
+		messageSize := int(binary.BigEndian.Uint16(lengthBytes[:]))
+		if messageSize < DNSHeaderSizeBytes || messageSize > maxMessageSize {
+			logWarn("Closing TCP connection from", conn.RemoteAddr(), ": message length", messageSize, "outside", DNSHeaderSizeBytes, "to", maxMessageSize, "bytes")
+			return
+		}
+
+		requestBytes := make([]byte, messageSize)
+		_, err = io.ReadFull(conn, requestBytes)
+		if err != nil {
+			logWarn("Error reading TCP message:", err)
+			return
+		}
+
+		logDebug("Received DNS request from ", conn.RemoteAddr())
+		serveQuery(requestBytes, tcpResponseWriter{conn: conn})
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultListenersServeUDPAndTCP(t *testing.T) {
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := probe.Addr().String()
+	probe.Close()
+
+	cfg := DefaultConfig()
+	cfg.DNSAddress = address
+	useConfig(t, cfg, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+
+	listeners := listenerConfigs()
+	if len(listeners) != 2 || listeners[0].Network != "udp" || listeners[1].Network != "tcp" {
+		t.Fatalf("default listeners = %+v, want UDP and TCP on DNSAddress", listeners)
+	}
+	err = StartListeners(listeners)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, useTCP := range []bool{false, true} {
+		responseBytes, err := exchange(context.Background(), address, buildQuery(9, FlagRecursionDesired, "www.example.com", TypeA), useTCP, 2*time.Second)
+		if err != nil {
+			t.Fatalf("query with TCP %v: %v", useTCP, err)
+		}
+		response, err := parseResponse(responseBytes)
+		if err != nil || len(response.Answers) != 1 {
+			t.Errorf("query with TCP %v got %d answers, want 1", useTCP, len(response.Answers))
+		}
+	}
+}
+
+func TestIPv6Listeners(t *testing.T) {
+	probe, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback isn't available:", err)
+	}
+	address := probe.Addr().String()
+	probe.Close()
+
+	useConfig(t, DefaultConfig(), NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+	err = StartListeners([]ListenerConfig{{Network: "udp6", Address: address}, {Network: "tcp6", Address: address}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, useTCP := range []bool{false, true} {
+		responseBytes, err := exchange(context.Background(), address, buildQuery(9, 0, "www.example.com", TypeA), useTCP, 2*time.Second)
+		if err != nil {
+			t.Fatalf("query over IPv6 with TCP %v: %v", useTCP, err)
+		}
+		response, _ := parseResponse(responseBytes)
+		if len(response.Answers) != 1 {
+			t.Errorf("query over IPv6 with TCP %v got %d answers, want 1", useTCP, len(response.Answers))
+		}
+	}
+
+	err = StartListeners([]ListenerConfig{{Network: "sctp", Address: address}})
+	if err == nil {
+		t.Error("an unknown listener network was accepted")
+	}
+}
+
+func TestStalledTCPClientsAreDisconnected(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TCPReadTimeoutMillis = 100
+	useConfig(t, cfg)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleTCPConnection(server)
+
+	// Half a length prefix, then nothing
+	client.Write([]byte{0})
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := client.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatal("the server kept a stalled connection open past its read timeout")
+	}
+	if err == nil {
+		t.Fatal("the server answered a stalled connection")
+	}
+}
+
+func TestUnreadTCPResponsesTimeOut(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TCPWriteTimeoutMillis = 100
+	useConfig(t, cfg, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	closed := make(chan struct{})
+	go func() {
+		handleTCPConnection(server)
+		close(closed)
+	}()
+
+	request := buildQuery(1, 0, "www.example.com", TypeA)
+	client.Write(binary.BigEndian.AppendUint16(nil, uint16(len(request))))
+	client.Write(request)
+
+	// The client never reads the response
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the server kept writing to a client that doesn't read past its write timeout")
+	}
+}
+
+func TestOversizedTCPLengthPrefixClosesConnection(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TCPMaxMessageSize = 512
+	useConfig(t, cfg, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+	logBuffer := captureLog(t)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	closed := make(chan struct{})
+	go func() {
+		handleTCPConnection(server)
+		close(closed)
+	}()
+
+	// Claims a 65535 byte message and sends none of it
+	client.Write([]byte{0xff, 0xff})
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the server waited for a message larger than tcpMaxMessageSize")
+	}
+	if !strings.Contains(logBuffer.String(), "message length 65535") {
+		t.Errorf("log = %q, want the rejected length", logBuffer.String())
+	}
+}
+
+func TestTCPMessagesWithinMaxSizeAreAnswered(t *testing.T) {
+	cfg := DefaultConfig()
+	useConfig(t, cfg, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleTCPConnection(server)
+
+	request := buildQuery(1, 0, "www.example.com", TypeA)
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	client.Write(binary.BigEndian.AppendUint16(nil, uint16(len(request))))
+	client.Write(request)
+
+	var lengthBytes [2]byte
+	_, err := io.ReadFull(client, lengthBytes[:])
+	if err != nil {
+		t.Fatal("no response to a query within the maximum size:", err)
+	}
+	responseBytes := make([]byte, binary.BigEndian.Uint16(lengthBytes[:]))
+	_, err = io.ReadFull(client, responseBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := parseResponse(responseBytes)
+	if err != nil || len(response.Answers) != 1 {
+		t.Errorf("got %d answers, want 1", len(response.Answers))
+	}
+}
+
+func TestStalledTCPMessageBodyTimesOut(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TCPReadTimeoutMillis = 100
+	useConfig(t, cfg)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	closed := make(chan struct{})
+	go func() {
+		handleTCPConnection(server)
+		close(closed)
+	}()
+
+	// A valid length prefix followed by only part of the message
+	client.Write([]byte{0, 100})
+	client.Write(make([]byte, 20))
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the server kept waiting for the rest of a stalled message")
+	}
+}
+
+// startUDPListener serves DNS over UDP on a free loopback port and returns
+// the address.
+func startUDPListener(t *testing.T) string {
+	t.Helper()
+	probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := probe.LocalAddr().String()
+	probe.Close()
+
+	err = StartListeners([]ListenerConfig{{Network: "udp", Address: address}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return address
+}
+
+// paddedQuery asks for www.example.com with an EDNS padding option that
+// takes the query well past 512 bytes.
+func paddedQuery(transactionID uint16) []byte {
+	padding := binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, 12), 800)
+	padding = append(padding, make([]byte, 800)...)
+	return withOPT(buildQuery(transactionID, 0, "www.example.com", TypeA), 0, padding)
+}
+
+func TestLargeUDPQueriesAreReadWhole(t *testing.T) {
+	cfg := DefaultConfig()
+	useConfig(t, cfg, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+	address := startUDPListener(t)
+
+	request := paddedQuery(11)
+	if len(request) <= 512 {
+		t.Fatalf("the query is only %d bytes", len(request))
+	}
+
+	responseBytes, err := exchange(context.Background(), address, request, false, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := parseResponse(responseBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responseCode(response) != RcodeNoError || len(response.Answers) != 1 {
+		t.Errorf("rcode = %d with %d answers, want the %d byte query answered", responseCode(response), len(response.Answers), len(request))
+	}
+	if responseOPTOf(response) == nil {
+		t.Error("the response has no OPT record, so the query's OPT record wasn't read")
+	}
+}
+
+func TestUDPReadBufferSizeLimitsQueries(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.UDPReadBufferSize = 512
+	useConfig(t, cfg, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+	address := startUDPListener(t)
+
+	request := paddedQuery(12)
+
+	responseBytes, err := exchange(context.Background(), address, request, false, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := parseResponse(responseBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The OPT record past the first 512 bytes is lost, so the query is
+	// answered as a plain DNS one
+	if responseOPTOf(response) != nil {
+		t.Error("a query cut short by a 512 byte read buffer was answered as if whole")
+	}
+}
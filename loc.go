@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const TypeLOC uint16 = 29 // location information, RFC 1876
+
+// LOCRecord describes a location. Latitude and longitude are written as
+// degrees, minutes and seconds followed by a hemisphere, e.g. "42 21 43.528 N",
+// or as signed decimal degrees. Altitude and the sizes are in meters; the sizes
+// default to the RFC 1876 values when omitted.
+type LOCRecord struct {
+	Latitude            string   `json:"latitude"`
+	Longitude           string   `json:"longitude"`
+	Altitude            float64  `json:"altitude"`
+	Size                *float64 `json:"size,omitempty"`
+	HorizontalPrecision *float64 `json:"horizontalPrecision,omitempty"`
+	VerticalPrecision   *float64 `json:"verticalPrecision,omitempty"`
+}
+
+const (
+	locEquator        uint32  = 1 << 31     // latitude and longitude origin
+	locAltitudeOffset float64 = 10000000    // 100000m below the WGS 84 spheroid, in cm
+	locDefaultSize    float64 = 1           // meters
+	locDefaultHorizPr float64 = 10000       // meters
+	locDefaultVertPr  float64 = 10          // meters
+	locMaxAltitude    float64 = 42849672.95 // meters
+)
+
+// encodeLOC builds the 16 byte LOC rdata of RFC 1876 section 2.
+func encodeLOC(loc LOCRecord) ([]byte, error) {
+	latitude, err := parseLOCCoordinate(loc.Latitude, "N", "S", 90)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LOC latitude: %v", err)
+	}
+
+	longitude, err := parseLOCCoordinate(loc.Longitude, "E", "W", 180)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LOC longitude: %v", err)
+	}
+
+	if loc.Altitude < -100000 || loc.Altitude > locMaxAltitude {
+		return nil, fmt.Errorf("LOC altitude %v out of range", loc.Altitude)
+	}
+
+	data := []byte{
+		0, // version
+		encodeLOCPrecision(valueOrDefault(loc.Size, locDefaultSize)),
+		encodeLOCPrecision(valueOrDefault(loc.HorizontalPrecision, locDefaultHorizPr)),
+		encodeLOCPrecision(valueOrDefault(loc.VerticalPrecision, locDefaultVertPr)),
+	}
+	data = binary.BigEndian.AppendUint32(data, uint32(int64(locEquator)+latitude))
+	data = binary.BigEndian.AppendUint32(data, uint32(int64(locEquator)+longitude))
+	data = binary.BigEndian.AppendUint32(data, uint32(math.Round(loc.Altitude*100+locAltitudeOffset)))
+
+	return data, nil
+}
+
+// parseLOCCoordinate converts a coordinate into signed thousandths of an arc
+// second, positive towards the given hemisphere.
+func parseLOCCoordinate(coordinate string, positive string, negative string, maxDegrees float64) (int64, error) {
+	fields := strings.Fields(strings.ToUpper(coordinate))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty coordinate")
+	}
+
+	sign := 1.0
+	switch fields[len(fields)-1] {
+	case positive:
+		fields = fields[:len(fields)-1]
+	case negative:
+		sign = -1
+		fields = fields[:len(fields)-1]
+	}
+
+	if len(fields) == 0 || len(fields) > 3 {
+		return 0, fmt.Errorf("expected degrees [minutes [seconds]] [%s|%s], got %q", positive, negative, coordinate)
+	}
+
+	var degrees float64
+	for i, field := range fields {
+		value, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %q", field)
+		}
+		if i > 0 && (value < 0 || value >= 60) {
+			return 0, fmt.Errorf("minutes and seconds must be in [0, 60), got %q", field)
+		}
+		degrees += value / math.Pow(60, float64(i))
+	}
+
+	degrees *= sign
+	if math.Abs(degrees) > maxDegrees {
+		return 0, fmt.Errorf("%v degrees out of range", degrees)
+	}
+
+	return int64(math.Round(degrees * 3600 * 1000)), nil
+}
+
+// encodeLOCPrecision encodes a size in meters as the mantissa/exponent byte
+// of RFC 1876: the high nibble is the mantissa and the low nibble the power of
+// ten, in centimeters.
+func encodeLOCPrecision(meters float64) byte {
+	centimeters := uint64(math.Round(meters * 100))
+
+	var exponent byte
+	for centimeters >= 10 && exponent < 9 {
+		centimeters /= 10
+		exponent++
+	}
+	if centimeters > 9 {
+		centimeters = 9
+	}
+
+	return byte(centimeters)<<4 | exponent
+}
+
+func valueOrDefault(value *float64, defaultValue float64) float64 {
+	if value == nil {
+		return defaultValue
+	}
+	return *value
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Log levels, from most to least severe. Messages below the configured
+// level are dropped.
+const (
+	LogLevelError int32 = iota
+	LogLevelWarn
+	LogLevelInfo
+	LogLevelDebug
+)
+
+var logLevelNames = map[string]int32{
+	"error": LogLevelError,
+	"warn":  LogLevelWarn,
+	"info":  LogLevelInfo,
+	"debug": LogLevelDebug,
+}
+
+// logLevel is read on every query, so it is atomic rather than looked up
+// in the config snapshot.
+var logLevel atomic.Int32
+
+// logOutput is where log lines are written. Lines come from every query's
+// goroutine, so it is only written to and swapped under logLock.
+var (
+	logLock   sync.Mutex
+	logOutput io.Writer = os.Stdout
+)
+
+func init() {
+	logLevel.Store(LogLevelInfo)
+}
+
+// parseLogLevel returns the level with the given name. An empty name means
+// info.
+func parseLogLevel(name string) (int32, error) {
+	if name == "" {
+		return LogLevelInfo, nil
+	}
+	level, ok := logLevelNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q, expected error, warn, info or debug", name)
+	}
+	return level, nil
+}
+
+// SetLogLevel sets the minimum level that is logged.
+func SetLogLevel(name string) error {
+	level, err := parseLogLevel(name)
+	if err != nil {
+		return err
+	}
+	logLevel.Store(level)
+	return nil
+}
+
+// logAt writes a line like fmt.Println if the level is enabled.
+func logAt(level int32, args ...any) {
+	if level > logLevel.Load() {
+		return
+	}
+	line := fmt.Sprintln(args...)
+	logLock.Lock()
+	defer logLock.Unlock()
+	io.WriteString(logOutput, line)
+}
+
+// setLogOutput sends the log lines to w from now on.
+func setLogOutput(w io.Writer) {
+	logLock.Lock()
+	defer logLock.Unlock()
+	logOutput = w
+}
+
+func logError(args ...any) { logAt(LogLevelError, args...) }
+func logWarn(args ...any)  { logAt(LogLevelWarn, args...) }
+func logInfo(args ...any)  { logAt(LogLevelInfo, args...) }
+func logDebug(args ...any) { logAt(LogLevelDebug, args...) }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// useLogLevel sets the log level for one test.
+func useLogLevel(t *testing.T, name string) {
+	t.Helper()
+	previous := logLevel.Load()
+	t.Cleanup(func() { logLevel.Store(previous) })
+	err := SetLogLevel(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWarnLevelSuppressesInfo(t *testing.T) {
+	logBuffer := captureLog(t)
+	useLogLevel(t, "WARN")
+
+	logDebug("debug line")
+	logInfo("info line")
+	logWarn("warn line")
+	logError("error line")
+
+	if got := logBuffer.String(); got != "warn line\nerror line\n" {
+		t.Errorf("logged %q, want only the warn and error lines", got)
+	}
+}
+
+func TestQueriesAreLoggedOnlyAtDebug(t *testing.T) {
+	useConfig(t, DefaultConfig(), NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+	logBuffer := captureLog(t)
+
+	useLogLevel(t, "info")
+	query(t, "www.example.com", TypeA)
+	if strings.Contains(logBuffer.String(), "www.example.com") {
+		t.Errorf("a routine query was logged at info: %q", logBuffer.String())
+	}
+
+	useLogLevel(t, "debug")
+	query(t, "www.example.com", TypeA)
+	if !strings.Contains(logBuffer.String(), "www.example.com") {
+		t.Error("the query wasn't logged at debug")
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	levels := map[string]int32{"": LogLevelInfo, "error": LogLevelError, "Debug": LogLevelDebug}
+	for name, want := range levels {
+		level, err := parseLogLevel(name)
+		if err != nil || level != want {
+			t.Errorf("parseLogLevel(%q) = %d, %v; want %d", name, level, err, want)
+		}
+	}
+	_, err := parseLogLevel("verbose")
+	if err == nil {
+		t.Error("parseLogLevel accepted an unknown level")
+	}
+}
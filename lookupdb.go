@@ -1,143 +1,617 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net"
 	"net/http"
 	"os"
-	"sync"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 )
 
+// NameModel is the on-disk schema of a store entry, shared by every reader
+// and writer of names.json: lowercase keys, the address as a string, and one
+// optional object per structured record type. ToName is the one place it is
+// converted into the runtime Name.
 type NameModel struct {
-	Name    string `json:"name"`
-	Address string `json:"address"`
+	Name    string       `json:"name"`
+	Type    string       `json:"type,omitempty"`
+	Address string       `json:"address,omitempty"`
+	Target  string       `json:"target,omitempty"`
+	Weight  uint32       `json:"weight,omitempty"`
+	TTL     uint32       `json:"ttl,omitempty"`
+	Enabled *bool        `json:"enabled,omitempty"`
+	TXT     string       `json:"txt,omitempty"`
+	HINFO   *HINFORecord `json:"hinfo,omitempty"`
+	NAPTR   *NAPTRRecord `json:"naptr,omitempty"`
+	LOC     *LOCRecord   `json:"loc,omitempty"`
+	URI     *URIRecord   `json:"uri,omitempty"`
+	CAA     *CAARecord   `json:"caa,omitempty"`
+	SSHFP   *SSHFPRecord `json:"sshfp,omitempty"`
+	TLSA    *TLSARecord  `json:"tlsa,omitempty"`
+	SVCB    *SVCBRecord  `json:"svcb,omitempty"`
 }
 
+// IsEnabled reports whether the entry is served. Entries are enabled unless
+// explicitly disabled, so they can stay in the store without being answered.
+func (model NameModel) IsEnabled() bool {
+	return model.Enabled == nil || *model.Enabled
+}
+
+// Name is the runtime form of a NameModel. Addresses only live on in the
+// encoded ResourceData, so the stored string form is the one source of truth.
 type Name struct {
-	Name    string
-	Address net.IP
+	Name         string
+	Type         uint16
+	Target       string
+	Weight       uint32
+	TTL          uint32
+	ResourceData []byte
 }
 
+// handleAddEntry adds a POSTed entry to the store. A plain A record can be
+// given with the 'name' and 'ip' query parameters, which replaces any
+// existing A record for the name. Other record types are sent as a JSON
+// entry in the body and are appended alongside existing records of the same
+// name.
 func handleAddEntry(w http.ResponseWriter, r *http.Request) {
+	var newEntry NameModel
+	replaceExisting := false
+
+	if !r.URL.Query().Has("name") {
+		err := json.NewDecoder(r.Body).Decode(&newEntry)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid JSON entry: %v", err), http.StatusBadRequest)
+			return
+		}
+		if newEntry.Name == "" {
+			http.Error(w, "The 'name' field is required", http.StatusBadRequest)
+			return
+		}
+	} else {
+		name := r.URL.Query().Get("name")
+		ip := r.URL.Query().Get("ip")
+
+		if name == "" || ip == "" {
+			http.Error(w, "Both 'name' and 'ip' query parameters are required", http.StatusBadRequest)
+			return
+		}
+
+		newEntry = NameModel{Name: name, Address: ip}
+		replaceExisting = true
+	}
+
+	// Store names in canonical form, with internationalized names as A-labels
+	name, err := CanonicalName(newEntry.Name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid domain name: %v", err), http.StatusBadRequest)
+		return
+	}
+	newEntry.Name = name
+	newEntry.Type = recordTypeName(newEntry)
+
+	_, err = ToName(newEntry)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid entry: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// The limit check and the write must not interleave with other changes
+	updateLock.Lock()
+	defer updateLock.Unlock()
+
+	models, err := currentConfig().store.All(r.Context())
+	if err == nil {
+		err = checkRecordLimits(currentConfig(), putEntry(slices.Clone(models), newEntry, replaceExisting))
+	}
+	if errors.Is(err, ErrLimitExceeded) {
+		http.Error(w, fmt.Sprintf("Entry not added: %v", err), http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error loading entries: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	err = currentConfig().store.Put(r.Context(), newEntry, replaceExisting)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error saving entry: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	zoneChanged(name)
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Added/Updated entry: %s -> %s in the in-memory database", name, describeEntry(newEntry))
+	logInfo("Added/Updated entry:", name, "->", describeEntry(newEntry))
+}
+
+// EntriesPage is the /entries response when a page is requested with the
+// 'limit' or 'offset' query parameters. Total counts every entry matching the
+// filters, not just the ones on the page.
+type EntriesPage struct {
+	Total   int         `json:"total"`
+	Offset  int         `json:"offset"`
+	Limit   int         `json:"limit"`
+	Entries []NameModel `json:"entries"`
+}
+
+// handleListEntries lists the store as JSON. Entries can be filtered with the
+// 'type' and 'suffix' query parameters and paged with 'limit' and 'offset'.
+// Entries are sorted by name and type so pages stay consistent between
+// requests; the total matching count is always sent in X-Total-Count.
+func handleListEntries(w http.ResponseWriter, r *http.Request) {
+	models, err := currentConfig().store.All(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error loading entries: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	recordType := strings.ToUpper(r.URL.Query().Get("type"))
+	suffix := r.URL.Query().Get("suffix")
+	if suffix != "" {
+		suffix, err = CanonicalName(suffix)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid domain name: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	offset, err := nonNegativeParam(r, "offset")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := nonNegativeParam(r, "limit")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	matching := make([]NameModel, 0, len(models))
+	for _, model := range models {
+		if recordType != "" && recordTypeName(model) != recordType {
+			continue
+		}
+		if suffix != "" && model.Name != suffix && !strings.HasSuffix(model.Name, "."+suffix) {
+			continue
+		}
+		matching = append(matching, model)
+	}
+
+	// Stable sort keeps entries sharing a name and type in store order
+	sort.SliceStable(matching, func(i, j int) bool {
+		if matching[i].Name != matching[j].Name {
+			return matching[i].Name < matching[j].Name
+		}
+		return recordTypeName(matching[i]) < recordTypeName(matching[j])
+	})
+
+	total := len(matching)
+	page := matching[min(offset, total):]
+	if limit > 0 {
+		page = page[:min(limit, len(page))]
+	}
+
+	// Names are stored as A-labels, optionally show them in Unicode form
+	for i := range page {
+		if r.URL.Query().Get("unicode") == "true" {
+			page[i].Name = ToUnicodeName(page[i].Name)
+		}
+		page[i].Enabled = pointerTo(page[i].IsEnabled())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if r.URL.Query().Has("limit") || r.URL.Query().Has("offset") {
+		json.NewEncoder(w).Encode(EntriesPage{Total: total, Offset: offset, Limit: limit, Entries: page})
+		return
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+// nonNegativeParam parses an optional integer query parameter, returning 0
+// when it is missing.
+func nonNegativeParam(r *http.Request, key string) (int, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return 0, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("The '%s' query parameter must be a non-negative integer", key)
+	}
+	return number, nil
+}
+
+// handleToggleEntry enables or disables the entries stored under a name,
+// optionally only those of one record type, without deleting them.
+func handleToggleEntry(w http.ResponseWriter, r *http.Request) {
 	name := r.URL.Query().Get("name")
-	ip := r.URL.Query().Get("ip")
+	recordType := strings.ToUpper(r.URL.Query().Get("type"))
 
-	if name == "" || ip == "" {
-		http.Error(w, "Both 'name' and 'ip' query parameters are required", http.StatusBadRequest)
+	if name == "" {
+		http.Error(w, "The 'name' query parameter is required", http.StatusBadRequest)
 		return
 	}
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		http.Error(w, "The 'enabled' query parameter must be true or false", http.StatusBadRequest)
+		return
+	}
+
+	name, err = CanonicalName(name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid domain name: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Entries are rewritten from what was read, which must not interleave
+	// with dynamic updates of the same names
+	updateLock.Lock()
+	defer updateLock.Unlock()
 
-	// Load existing entries from the file
-	existingEntries, err := GetNames()
+	entries, err := lookupExisting(r.Context(), currentConfig().store, name, recordType)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, fmt.Sprintf("No entries found for %s", name), http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error loading existing entries: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error loading entries: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Check if the name already exists
-	nameExists := false
-	for i, entry := range existingEntries {
-		if entry.Name == name {
-			// Update the existing entry with the new IP
-			existingEntries[i].Address = net.ParseIP(ip)
-			nameExists = true
-			break
+	for i := range entries {
+		entries[i].Enabled = nil
+		if !enabled {
+			entries[i].Enabled = pointerTo(false)
 		}
 	}
+	err = rewriteRRset(r.Context(), name, recordType, entries)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error saving entry: %v", err), http.StatusInternalServerError)
+		return
+	}
 
-	// If the name doesn't exist, add a new entry
-	if !nameExists {
-		existingEntries = append(existingEntries, Name{
-			Name:    name,
-			Address: net.ParseIP(ip),
-		})
+	zoneChanged(name)
+
+	state := "Disabled"
+	if enabled {
+		state = "Enabled"
+	}
+	fmt.Fprintf(w, "%s %d entry(s) for %s", state, len(entries), name)
+	logInfo(state, len(entries), "entry(s) for", name)
+}
+
+// handleDeleteEntry removes records the way nsupdate deletes them: with
+// just 'name' every record of the name goes, with 'type' only that RRset,
+// and with 'type' and 'value' only the one record whose value matches.
+func handleDeleteEntry(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	recordType := strings.ToUpper(r.URL.Query().Get("type"))
+	value := r.URL.Query().Get("value")
+
+	if name == "" {
+		http.Error(w, "The 'name' query parameter is required", http.StatusBadRequest)
+		return
+	}
+	if value != "" && recordType == "" {
+		http.Error(w, "The 'value' query parameter requires 'type'", http.StatusBadRequest)
+		return
+	}
+
+	name, err := CanonicalName(name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid domain name: %v", err), http.StatusBadRequest)
+		return
 	}
 
-	// Save the updated entries back to the file
-	data, err := json.MarshalIndent(existingEntries, "", "    ")
+	// Deleting one record rewrites its RRset, which must not interleave with
+	// dynamic updates of the same names
+	updateLock.Lock()
+	defer updateLock.Unlock()
+
+	entries, err := lookupExisting(r.Context(), currentConfig().store, name, recordType)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, fmt.Sprintf("No entries found for %s", name), http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error marshalling data: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error loading entries: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	err = os.WriteFile("./names.json", data, 0644)
+	removed := len(entries)
+	if value == "" {
+		_, err = currentConfig().store.Delete(r.Context(), name, recordType)
+	} else {
+		kept := slices.DeleteFunc(entries, func(entry NameModel) bool {
+			return entryHasValue(entry, value)
+		})
+		removed -= len(kept)
+		if removed == 0 {
+			http.Error(w, fmt.Sprintf("No %s entry for %s has the value %q", recordType, name, value), http.StatusNotFound)
+			return
+		}
+		err = rewriteRRset(r.Context(), name, recordType, kept)
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error writing to file: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error deleting entries: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Added/Updated entry: %s -> %s in the in-memory database", name, ip)
-	fmt.Println("Added/Updated entry:", name, "->", ip)
+	zoneChanged(name)
+
+	fmt.Fprintf(w, "Deleted %d entry(s) for %s", removed, name)
+	logInfo("Deleted", removed, "entry(s) for", name)
 }
 
-type InMemoryDB struct {
-	sync.RWMutex
-	data map[string]net.IP
+// entryHasValue reports whether value names an entry's record: its address,
+// target or TXT string, or the value as describeEntry renders it, with or
+// without the type. Addresses are compared as addresses, so any spelling of
+// an IPv6 address matches.
+func entryHasValue(entry NameModel, value string) bool {
+	if address := net.ParseIP(entry.Address); address != nil && address.Equal(net.ParseIP(value)) {
+		return true
+	}
+	if entry.Target != "" && canonicalTarget(entry.Target) == canonicalTarget(value) {
+		return true
+	}
+	if entry.TXT != "" && entry.TXT == value {
+		return true
+	}
+	description := describeEntry(entry)
+	return description == value || strings.TrimPrefix(description, recordTypeName(entry)+" ") == value
 }
 
-var nameDB = InMemoryDB{data: make(map[string]net.IP)}
+// handleGetEntry returns the entries stored under a single name as JSON,
+// optionally filtered by record type.
+func handleGetEntry(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	recordType := strings.ToUpper(r.URL.Query().Get("type"))
+
+	if name == "" {
+		http.Error(w, "The 'name' query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	name, err := CanonicalName(name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid domain name: %v", err), http.StatusBadRequest)
+		return
+	}
 
-func GetNames() ([]Name, error) {
+	entries, err := lookupExisting(r.Context(), currentConfig().store, name, recordType)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, fmt.Sprintf("No entries found for %s", name), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error loading entries: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// GetNameModelsFrom is the single loader for store files. A missing file is
+// an empty store, so the first entry added creates it. Gzipped files are
+// read transparently.
+func GetNameModelsFrom(path string) ([]NameModel, error) {
 	// read file
-	data, err := os.ReadFile("./names.json")
+	data, err := readStoreFile(path)
 	if err != nil {
-		fmt.Print(err)
-		return nil, err
+		if os.IsNotExist(err) {
+			return []NameModel{}, nil
+		}
+		logError(err)
+		return nil, fmt.Errorf("%w: %w", ErrIO, err)
+	}
+	data, err = decompressStore(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrMalformed, path, err)
 	}
+
 	// json data
 	var models []NameModel
 
 	// unmarshall it
 	err = json.Unmarshal(data, &models)
 	if err != nil {
-		fmt.Println("error:", err)
-		return nil, err
+		logError("error:", err)
+		return nil, fmt.Errorf("%w: %s: %w", ErrMalformed, path, err)
+	}
+
+	return models, nil
+}
+
+// SaveNameModels writes the entries to a store file atomically: the data goes
+// to a temp file in the same directory which is then renamed over the store,
+// so a crash mid-write never leaves a truncated file behind. Stores named
+// *.gz, or already gzipped, are written gzipped. Callers serialize writers.
+func SaveNameModels(path string, models []NameModel) error {
+	data, err := json.MarshalIndent(models, "", "    ")
+	if err != nil {
+		return fmt.Errorf("error marshalling data: %v", err)
+	}
+
+	if compressedStore(path) {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		_, err = writer.Write(data)
+		if err == nil {
+			err = writer.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("error compressing data: %v", err)
+		}
+		data = compressed.Bytes()
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(path), ".names-*.json.tmp")
+	if err != nil {
+		return fmt.Errorf("%w: error creating temp file: %w", ErrIO, err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("%w: error writing temp file: %w", ErrIO, err)
+	}
+
+	err = os.Chmod(tempFile.Name(), 0644)
+	if err != nil {
+		return fmt.Errorf("%w: error setting file mode: %w", ErrIO, err)
+	}
+
+	err = os.Rename(tempFile.Name(), path)
+	if err != nil {
+		return fmt.Errorf("%w: error replacing store file: %w", ErrIO, err)
 	}
 
-	return To(models), nil
+	return nil
+}
+
+// gzipMagic starts every gzip stream (RFC 1952 section 2.3.1).
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decompressStore returns the contents of a store file, unpacking it when it
+// is gzipped. Plain JSON never starts with the gzip magic bytes.
+func decompressStore(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return data, nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
 
+// compressedStore reports whether a store file is written gzipped: when it
+// is named *.gz, or when the file being replaced is gzipped.
+func compressedStore(path string) bool {
+	if strings.HasSuffix(path, ".gz") {
+		return true
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	magic := make([]byte, len(gzipMagic))
+	_, err = io.ReadFull(file, magic)
+	return err == nil && bytes.Equal(magic, gzipMagic)
 }
 
+// To converts stored entries into their runtime form, skipping disabled
+// entries and entries that fail validation so one bad record doesn't take
+// down every lookup.
 func To(models []NameModel) []Name {
 	names := make([]Name, 0, len(models))
 	for _, value := range models {
-		names = append(names, Name{
-			Name:    value.Name,
-			Address: net.ParseIP(value.Address),
-		})
+		if !value.IsEnabled() {
+			continue
+		}
+		name, err := ToName(value)
+		if err != nil {
+			logWarn("Skipping invalid entry", value.Name, ":", err)
+			continue
+		}
+		names = append(names, name)
 	}
 	return names
 }
 
-func LoadFromFile() error {
-	data, err := ioutil.ReadFile("./names.json")
+func ToName(model NameModel) (Name, error) {
+	err := ValidateDomainName(model.Name)
 	if err != nil {
-		// If the file doesn't exist, it's not an error
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return fmt.Errorf("error reading file: %v", err)
+		return Name{}, err
 	}
 
-	var models []Name
-	err = json.Unmarshal(data, &models)
+	recordType, resourceData, err := encodeResourceData(model)
 	if err != nil {
-		return fmt.Errorf("error unmarshalling data: %v", err)
+		return Name{}, err
 	}
 
-	nameDB.Lock()
-	defer nameDB.Unlock()
+	return Name{
+		Name:         canonicalTarget(model.Name),
+		Type:         recordType,
+		Target:       canonicalTarget(model.Target),
+		Weight:       model.Weight,
+		TTL:          model.TTL,
+		ResourceData: resourceData,
+	}, nil
+}
+
+// LoadFromFile checks the config's store file and seeds the config's store
+// backend with its entries, unless the backend is the file itself.
+func LoadFromFile(cfg *Config) error {
+	// The compiled store was validated when it was generated
+	if _, ok := cfg.store.(*StaticStore); ok {
+		logInfo("Serving", len(staticEntries), "compiled entries")
+		return nil
+	}
 
-	// Clear existing data
-	nameDB.data = make(map[string]net.IP)
+	embeddedStoreFor.Store("")
+	if shouldUseEmbeddedStore(cfg) {
+		logInfo("No store or config file found, serving the embedded default zone")
+		embeddedStoreFor.Store(cfg.StoreFile)
+	}
 
-	// Populate in-memory database
+	models, err := GetNameModelsFrom(cfg.StoreFile)
+	if err != nil {
+		return fmt.Errorf("error loading store file: %w", err)
+	}
+
+	models, duplicates := removeDuplicateEntries(models)
+	if len(duplicates) > 0 {
+		if cfg.FailOnDuplicates {
+			return fmt.Errorf("store has duplicate entries: %v", errors.Join(duplicates...))
+		}
+		for _, duplicate := range duplicates {
+			logWarn("Ignoring duplicate entry:", duplicate)
+		}
+	}
+
+	// Check every entry the same way lookups will, so a bad address is
+	// reported at startup instead of being silently dropped later
+	validModels := make([]NameModel, 0, len(models))
 	for _, entry := range models {
-		fmt.Println("Adding entry:", entry.Name, "->", entry.Address)
-		nameDB.data[entry.Name] = net.ParseIP(string(entry.Address))
+		_, err := ToName(entry)
+		if err != nil {
+			logWarn("Skipping invalid entry", entry.Name, ":", err)
+			continue
+		}
+		logDebug("Adding entry:", entry.Name, "->", describeEntry(entry))
+		validModels = append(validModels, entry)
+	}
+	models = validModels
+
+	err = checkRecordLimits(cfg, models)
+	if err != nil {
+		return fmt.Errorf("error loading store file: %w", err)
+	}
+
+	// Backends other than the file itself start out with its entries
+	if seedable, ok := cfg.store.(seedableStore); ok {
+		return seedable.Seed(models)
 	}
 
 	return nil
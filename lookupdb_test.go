@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testToken = "test-token"
+
+func apiConfig(t *testing.T, entries ...NameModel) *Config {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.APIToken = testToken
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	return useConfig(t, cfg, entries...)
+}
+
+// apiRequest sends a request to the HTTP API, with the API token unless
+// token is empty.
+func apiRequest(t *testing.T, method string, target string, body string, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	httpHandlers().ServeHTTP(w, r)
+	return w
+}
+
+func storedEntries(t *testing.T, cfg *Config, name string) []NameModel {
+	t.Helper()
+	entries, err := cfg.store.Lookup(context.Background(), name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestChangesNeedTokenAndMethod(t *testing.T) {
+	cfg := apiConfig(t, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+
+	tests := []struct {
+		method string
+		target string
+		token  string
+		status int
+	}{
+		{http.MethodGet, "/add-entry?name=new.example.com&ip=192.0.2.20", testToken, http.StatusMethodNotAllowed},
+		{http.MethodPost, "/add-entry?name=new.example.com&ip=192.0.2.20", "", http.StatusUnauthorized},
+		{http.MethodPost, "/add-entry?name=new.example.com&ip=192.0.2.20", "wrong", http.StatusUnauthorized},
+		{http.MethodGet, "/toggle-entry?name=www.example.com&enabled=false", testToken, http.StatusMethodNotAllowed},
+		{http.MethodPost, "/toggle-entry?name=www.example.com&enabled=false", "", http.StatusUnauthorized},
+		{http.MethodGet, "/delete-entry?name=www.example.com", testToken, http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/delete-entry?name=www.example.com", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		w := apiRequest(t, test.method, test.target, "", test.token)
+		if w.Code != test.status {
+			t.Errorf("%s %s: status %d, want %d", test.method, test.target, w.Code, test.status)
+		}
+	}
+
+	if len(storedEntries(t, cfg, "new.example.com")) != 0 || len(storedEntries(t, cfg, "www.example.com")) != 1 {
+		t.Fatal("a rejected request changed the store")
+	}
+}
+
+func TestChangesWithoutConfiguredToken(t *testing.T) {
+	cfg := DefaultConfig()
+	useConfig(t, cfg)
+
+	w := apiRequest(t, http.MethodPost, "/add-entry?name=new.example.com&ip=192.0.2.20", "", "")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status %d, want 403 while no API token is configured", w.Code)
+	}
+}
+
+func TestAddEntry(t *testing.T) {
+	cfg := apiConfig(t, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+
+	w := apiRequest(t, http.MethodPost, "/add-entry?name=www.example.com&ip=192.0.2.11", "", testToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	entries := storedEntries(t, cfg, "www.example.com")
+	if len(entries) != 1 || entries[0].Address != "192.0.2.11" {
+		t.Errorf("the query-parameter form didn't replace the A record: %+v", entries)
+	}
+
+	w = apiRequest(t, http.MethodPost, "/add-entry", `{"name": "WWW.Example.com", "type": "TXT", "txt": "hello"}`, testToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if entries := storedEntries(t, cfg, "www.example.com"); len(entries) != 2 {
+		t.Errorf("the JSON form didn't add alongside the A record: %+v", entries)
+	}
+
+	w = apiRequest(t, http.MethodPost, "/add-entry", `{"name": "bad..name", "address": "192.0.2.1"}`, testToken)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid name: status %d, want 400", w.Code)
+	}
+}
+
+func TestToggleEntry(t *testing.T) {
+	cfg := apiConfig(t,
+		NameModel{Name: "www.example.com", Address: "192.0.2.10"},
+		NameModel{Name: "www.example.com", Type: "TXT", TXT: "hello"},
+		NameModel{Name: "other.example.com", Address: "192.0.2.30"},
+	)
+
+	w := apiRequest(t, http.MethodPost, "/toggle-entry?name=www.example.com&type=A&enabled=false", "", testToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if response := query(t, "www.example.com", TypeA); len(response.Answers) != 0 {
+		t.Error("a disabled record is still served")
+	}
+	if response := query(t, "www.example.com", TypeTXT); len(response.Answers) != 1 {
+		t.Error("toggling the A record disabled the TXT record too")
+	}
+
+	all, _ := cfg.store.All(context.Background())
+	if len(all) != 3 || all[0].Address != "192.0.2.10" || all[2].Name != "other.example.com" {
+		t.Errorf("toggling reordered or lost entries: %+v", all)
+	}
+
+	apiRequest(t, http.MethodPost, "/toggle-entry?name=www.example.com&enabled=true", "", testToken)
+	if response := query(t, "www.example.com", TypeA); len(response.Answers) != 1 {
+		t.Error("a re-enabled record isn't served")
+	}
+
+	w = apiRequest(t, http.MethodPost, "/toggle-entry?name=missing.example.com&enabled=true", "", testToken)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown name: status %d, want 404", w.Code)
+	}
+}
+
+func TestDeleteEntry(t *testing.T) {
+	entries := []NameModel{
+		{Name: "www.example.com", Address: "192.0.2.10"},
+		{Name: "www.example.com", Address: "192.0.2.11"},
+		{Name: "www.example.com", Type: "TXT", TXT: "hello"},
+	}
+
+	tests := []struct {
+		target    string
+		remaining int
+	}{
+		{"/delete-entry?name=www.example.com&type=A&value=192.0.2.11", 2},
+		{"/delete-entry?name=www.example.com&type=A", 1},
+		{"/delete-entry?name=www.example.com", 0},
+	}
+	for _, test := range tests {
+		cfg := apiConfig(t, entries...)
+		w := apiRequest(t, http.MethodDelete, test.target, "", testToken)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", test.target, w.Code, w.Body)
+		}
+		if remaining := storedEntries(t, cfg, "www.example.com"); len(remaining) != test.remaining {
+			t.Errorf("%s left %d entries, want %d", test.target, len(remaining), test.remaining)
+		}
+	}
+
+	apiConfig(t, entries...)
+	w := apiRequest(t, http.MethodPost, "/delete-entry?name=www.example.com&type=A&value=192.0.2.99", "", testToken)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown value: status %d, want 404", w.Code)
+	}
+	w = apiRequest(t, http.MethodPost, "/delete-entry?name=www.example.com&value=192.0.2.10", "", testToken)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("value without type: status %d, want 400", w.Code)
+	}
+}
+
+func TestGetEntry(t *testing.T) {
+	apiConfig(t,
+		NameModel{Name: "www.example.com", Address: "192.0.2.10"},
+		NameModel{Name: "www.example.com", Type: "TXT", TXT: "hello"},
+	)
+
+	tests := []struct {
+		target  string
+		status  int
+		entries int
+	}{
+		{"/entry?name=www.example.com", http.StatusOK, 2},
+		{"/entry?name=WWW.example.com&type=txt", http.StatusOK, 1},
+		{"/entry?name=www.example.com&type=AAAA", http.StatusNotFound, 0},
+		{"/entry?name=missing.example.com", http.StatusNotFound, 0},
+		{"/entry", http.StatusBadRequest, 0},
+	}
+	for _, test := range tests {
+		w := apiRequest(t, http.MethodGet, test.target, "", "")
+		if w.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.target, w.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var entries []NameModel
+		err := json.NewDecoder(w.Body).Decode(&entries)
+		if err != nil || len(entries) != test.entries {
+			t.Errorf("%s returned %d entries, want %d", test.target, len(entries), test.entries)
+		}
+	}
+}
+
+func TestConcurrentAddsKeepStoreFileValid(t *testing.T) {
+	cfg := apiConfig(t)
+	path := filepath.Join(t.TempDir(), "names.json")
+	cfg.StoreFile = path
+	cfg.store = &FileStore{Path: path}
+
+	const adds = 20
+	var wg sync.WaitGroup
+	for i := 0; i < adds; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"name": "host%d.example.com", "address": "192.0.2.%d"}`, i, i+1)
+			w := apiRequest(t, http.MethodPost, "/add-entry", body, testToken)
+			if w.Code != http.StatusOK {
+				t.Errorf("add %d: status %d: %s", i, w.Code, w.Body)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	models, err := GetNameModelsFrom(path)
+	if err != nil {
+		t.Fatal("the store file isn't valid after concurrent adds:", err)
+	}
+	if len(models) != adds {
+		t.Errorf("the store file holds %d entries, want %d", len(models), adds)
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".names-*"))
+	if len(leftovers) != 0 {
+		t.Errorf("temp files were left behind: %v", leftovers)
+	}
+}
+
+func TestLoadFromFileDuplicates(t *testing.T) {
+	path := writeRawStoreFile(t, `[
+		{"name": "www.example.com", "address": "192.0.2.1"},
+		{"name": "www.example.com", "address": "192.0.2.2"},
+		{"name": "WWW.example.com", "address": "192.0.2.1"}
+	]`)
+
+	for _, fail := range []bool{false, true} {
+		cfg := DefaultConfig()
+		cfg.StoreFile = path
+		cfg.FailOnDuplicates = fail
+		cfg.store = &MemoryStore{}
+
+		err := LoadFromFile(&cfg)
+		if fail {
+			if err == nil {
+				t.Error("duplicates loaded with failOnDuplicates set")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries := storedEntries(t, &cfg, "www.example.com")
+		if len(entries) != 2 || entries[0].Address != "192.0.2.1" || entries[1].Address != "192.0.2.2" {
+			t.Errorf("loaded %+v, want the two distinct records once each", entries)
+		}
+	}
+}
+
+func TestTrailingDotNamesMatch(t *testing.T) {
+	cfg := apiConfig(t)
+
+	w := apiRequest(t, http.MethodPost, "/add-entry", `{"name": "Dotted.Example.com.", "address": "192.0.2.1"}`, testToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	w = apiRequest(t, http.MethodPost, "/add-entry", `{"name": "plain.example.com", "address": "192.0.2.2"}`, testToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	if entries := storedEntries(t, cfg, "dotted.example.com"); len(entries) != 1 || entries[0].Name != "dotted.example.com" {
+		t.Errorf("stored %+v, want the canonical name dotted.example.com", entries)
+	}
+	for _, name := range []string{"dotted.example.com", "dotted.example.com.", "plain.example.com", "plain.example.com."} {
+		if response := query(t, name, TypeA); len(response.Answers) != 1 {
+			t.Errorf("query for %q got %d answers, want 1", name, len(response.Answers))
+		}
+	}
+	for _, target := range []string{"/entry?name=plain.example.com.", "/entry?name=dotted.example.com"} {
+		if w := apiRequest(t, http.MethodGet, target, "", ""); w.Code != http.StatusOK {
+			t.Errorf("%s: status %d, want 200", target, w.Code)
+		}
+	}
+}
+
+func TestFirstAddCreatesMissingStoreFile(t *testing.T) {
+	cfg := apiConfig(t)
+	path := filepath.Join(t.TempDir(), "names.json")
+	cfg.StoreFile = path
+	cfg.ConfigFile = writeConfigFile(t, `{}`)
+	cfg.store = &FileStore{Path: path}
+
+	// A missing file is an empty store both at startup and at runtime
+	err := LoadFromFile(cfg)
+	if err != nil {
+		t.Fatal("loading a missing store file:", err)
+	}
+	w := apiRequest(t, http.MethodGet, "/entries", "", "")
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Fatalf("/entries = %d %s, want an empty list", w.Code, w.Body)
+	}
+
+	w = apiRequest(t, http.MethodPost, "/add-entry?name=www.example.com&ip=192.0.2.10", "", testToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("the first add: status %d: %s", w.Code, w.Body)
+	}
+	models, err := GetNameModelsFrom(path)
+	if err != nil || len(models) != 1 || models[0].Name != "www.example.com" {
+		t.Errorf("the store file holds %+v, %v; want the added entry", models, err)
+	}
+	if answerAddress(query(t, "www.example.com", TypeA)) != "192.0.2.10" {
+		t.Error("the added entry isn't answered")
+	}
+}
+
+func TestAddedAddressesSurviveReload(t *testing.T) {
+	cfg := apiConfig(t)
+	path := filepath.Join(t.TempDir(), "names.json")
+	cfg.StoreFile = path
+	cfg.store = &FileStore{Path: path}
+
+	w := apiRequest(t, http.MethodPost, "/add-entry?name=www.example.com&ip=192.0.2.10", "", testToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("adding the A record: status %d: %s", w.Code, w.Body)
+	}
+	w = apiRequest(t, http.MethodPost, "/add-entry", `{"name": "www.example.com", "type": "AAAA", "address": "2001:db8::10"}`, testToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("adding the AAAA record: status %d: %s", w.Code, w.Body)
+	}
+
+	// Load the file into a fresh memory store, as at startup
+	reloaded := DefaultConfig()
+	reloaded.Zones = []ZoneConfig{{Name: "example.com"}}
+	reloaded.StoreFile = path
+	err := LoadFromFile(useConfig(t, reloaded))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := answerAddress(query(t, "www.example.com", TypeA)); got != "192.0.2.10" {
+		t.Errorf("reloaded A answer = %q, want 192.0.2.10", got)
+	}
+	if got := answerAddress(query(t, "www.example.com", TypeAAAA)); got != "2001:db8::10" {
+		t.Errorf("reloaded AAAA answer = %q, want 2001:db8::10", got)
+	}
+}
+
+func TestStoreFileFormat(t *testing.T) {
+	models := []NameModel{
+		{Name: "www.example.com", Address: "192.0.2.10"},
+		{Name: "www.example.com", Type: "AAAA", Address: "2001:db8::10", TTL: 60},
+		{Name: "old.example.com", Type: "DNAME", Target: "example.net", Enabled: pointerTo(false)},
+		{Name: "example.com", Type: "TXT", TXT: "v=spf1 -all"},
+	}
+	path := writeStoreFile(t, models...)
+
+	// The on-disk schema is lowercase keys with addresses as strings
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw []map[string]any
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]any{
+		{"name": "www.example.com", "address": "192.0.2.10"},
+		{"name": "www.example.com", "type": "AAAA", "address": "2001:db8::10", "ttl": float64(60)},
+		{"name": "old.example.com", "type": "DNAME", "target": "example.net", "enabled": false},
+		{"name": "example.com", "type": "TXT", "txt": "v=spf1 -all"},
+	}
+	if !reflect.DeepEqual(raw, want) {
+		t.Errorf("the store file holds %v, want %v", raw, want)
+	}
+
+	read, err := GetNameModelsFrom(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, models) {
+		t.Errorf("read back %+v, want %+v", read, models)
+	}
+}
+
+func TestListEntriesPages(t *testing.T) {
+	var entries []NameModel
+	for i := 29; i >= 0; i-- {
+		entries = append(entries, NameModel{Name: fmt.Sprintf("host%02d.example.com", i), Address: "192.0.2.10"})
+	}
+	apiConfig(t, entries...)
+
+	var seen []string
+	for offset := 0; offset < 40; offset += 10 {
+		w := apiRequest(t, http.MethodGet, fmt.Sprintf("/entries?limit=10&offset=%d", offset), "", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("offset %d: status %d: %s", offset, w.Code, w.Body)
+		}
+		var page EntriesPage
+		err := json.Unmarshal(w.Body.Bytes(), &page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Total != 30 || page.Offset != offset || page.Limit != 10 || w.Header().Get("X-Total-Count") != "30" {
+			t.Errorf("offset %d: page %+v, X-Total-Count %s, want a total of 30", offset, page, w.Header().Get("X-Total-Count"))
+		}
+		if want := min(10, max(0, 30-offset)); len(page.Entries) != want {
+			t.Errorf("offset %d: %d entries, want %d", offset, len(page.Entries), want)
+		}
+		for _, entry := range page.Entries {
+			seen = append(seen, entry.Name)
+		}
+	}
+
+	if len(seen) != 30 {
+		t.Fatalf("paged through %d entries, want 30", len(seen))
+	}
+	for i, name := range seen {
+		if want := fmt.Sprintf("host%02d.example.com", i); name != want {
+			t.Errorf("entry %d = %s, want %s in name order", i, name, want)
+		}
+	}
+}
+
+func TestListEntriesFilters(t *testing.T) {
+	apiConfig(t,
+		NameModel{Name: "www.example.com", Address: "192.0.2.10"},
+		NameModel{Name: "www.example.com", Type: "TXT", TXT: "hello"},
+		NameModel{Name: "mail.example.org", Address: "192.0.2.20"},
+		NameModel{Name: "notexample.com", Address: "192.0.2.30"},
+	)
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"?type=a", "mail.example.org,notexample.com,www.example.com"},
+		{"?suffix=example.com", "www.example.com,www.example.com"},
+		{"?suffix=example.com&type=TXT", "www.example.com"},
+		{"?suffix=www.example.com.", "www.example.com,www.example.com"},
+	}
+	for _, test := range tests {
+		w := apiRequest(t, http.MethodGet, "/entries"+test.query, "", "")
+		var entries []NameModel
+		err := json.Unmarshal(w.Body.Bytes(), &entries)
+		if err != nil {
+			t.Fatalf("%s: %v: %s", test.query, err, w.Body)
+		}
+		if got := describeNames(entries); got != test.want {
+			t.Errorf("/entries%s = %s, want %s", test.query, got, test.want)
+		}
+	}
+
+	for _, query := range []string{"?limit=-1", "?offset=ten"} {
+		if w := apiRequest(t, http.MethodGet, "/entries"+query, "", ""); w.Code != http.StatusBadRequest {
+			t.Errorf("/entries%s: status %d, want 400", query, w.Code)
+		}
+	}
+}
+
+// describeNames joins the names of entries in order.
+func describeNames(entries []NameModel) string {
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name
+	}
+	return strings.Join(names, ",")
+}
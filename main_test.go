@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	setLogOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// useConfig publishes cfg as the config snapshot for one test, with a memory
+// store holding entries, and restores the previous snapshot afterwards. The
+// default serial file is moved to a temp directory.
+func useConfig(t *testing.T, cfg Config, entries ...NameModel) *Config {
+	t.Helper()
+
+	if cfg.SerialFile == DefaultConfig().SerialFile {
+		cfg.SerialFile = filepath.Join(t.TempDir(), "serials.json")
+	}
+
+	previous := currentConfig()
+	t.Cleanup(func() { configSnapshot.Store(previous) })
+
+	memoryStore := &MemoryStore{}
+	err := memoryStore.Seed(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.store = memoryStore
+
+	err = LoadRuntime(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configSnapshot.Store(&cfg)
+	return &cfg
+}
+
+// recordingResponseWriter keeps every message written to it, like a TCP
+// connection unless udp is set.
+type recordingResponseWriter struct {
+	remoteAddr net.Addr
+	udp        bool
+	responses  [][]byte
+}
+
+func (w *recordingResponseWriter) WriteResponse(responseBytes []byte) error {
+	w.responses = append(w.responses, append([]byte(nil), responseBytes...))
+	return nil
+}
+
+func (w *recordingResponseWriter) RemoteAddr() net.Addr { return w.remoteAddr }
+func (w *recordingResponseWriter) IsUDP() bool          { return w.udp }
+
+// newWriter returns a writer for a client at ip, over UDP or TCP.
+func newWriter(ip string, udp bool) *recordingResponseWriter {
+	if udp {
+		return &recordingResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP(ip), Port: 5300}, udp: true}
+	}
+	return &recordingResponseWriter{remoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 5300}}
+}
+
+// serve answers one query from the client behind w and decodes the last
+// message sent back.
+func serve(t *testing.T, w *recordingResponseWriter, requestBytes []byte) DNSResponse {
+	t.Helper()
+
+	handleDNSClient(context.Background(), requestBytes, w)
+	if len(w.responses) == 0 {
+		t.Fatal("no response was sent")
+	}
+	response, err := parseResponse(w.responses[len(w.responses)-1])
+	if err != nil {
+		t.Fatal("error decoding the response:", err)
+	}
+	return response
+}
+
+// query answers a single question over UDP from 192.0.2.1.
+func query(t *testing.T, name string, queryType uint16) DNSResponse {
+	t.Helper()
+	return serve(t, newWriter("192.0.2.1", true), buildQuery(0x1234, FlagRecursionDesired, name, queryType))
+}
+
+// responseCode returns the rcode of a response header.
+func responseCode(response DNSResponse) uint16 {
+	return response.Header.Flags & 0x0f
+}
+
+// withOPT appends an OPT record carrying the encoded options to a query.
+func withOPT(requestBytes []byte, flags uint32, options ...[]byte) []byte {
+	var resourceData []byte
+	for _, option := range options {
+		resourceData = append(resourceData, option...)
+	}
+
+	request := bytes.NewBuffer(append([]byte(nil), requestBytes...))
+	binary.BigEndian.PutUint16(request.Bytes()[10:], binary.BigEndian.Uint16(requestBytes[10:])+1)
+	writeResourceRecord(request, DNSResourceRecord{
+		Type:               TypeOPT,
+		Class:              1232,
+		TimeToLive:         flags,
+		ResourceData:       resourceData,
+		ResourceDataLength: uint16(len(resourceData)),
+	}, make(nameCompression))
+	return request.Bytes()
+}
+
+// responseOPTOf returns the EDNS parameters of a response, or nil without
+// an OPT record.
+func responseOPTOf(response DNSResponse) *EDNSOptions {
+	for _, resourceRecord := range response.Additionals {
+		if resourceRecord.Type == TypeOPT {
+			edns := parseEDNS(resourceRecord)
+			return &edns
+		}
+	}
+	return nil
+}
+
+// logCapture holds captured log lines. Goroutines may still be logging
+// while a test reads them, so reads take the lock writes are made under.
+type logCapture struct {
+	buffer bytes.Buffer
+}
+
+func (c *logCapture) Write(p []byte) (int, error) { return c.buffer.Write(p) }
+
+func (c *logCapture) String() string {
+	logLock.Lock()
+	defer logLock.Unlock()
+	return c.buffer.String()
+}
+
+// captureLog collects the log lines written during one test.
+func captureLog(t *testing.T) *logCapture {
+	t.Helper()
+	capture := &logCapture{}
+	setLogOutput(capture)
+	t.Cleanup(func() { setLogOutput(io.Discard) })
+	return capture
+}
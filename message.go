@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	TypeNS  uint16 = 2  // an authoritative name server
+	TypePTR uint16 = 12 // a domain name pointer
+	TypeMX  uint16 = 15 // mail exchange
+)
+
+// maxCompressionPointers bounds how many compression pointers one name may
+// follow, so a pointer loop in a malformed message can't hang the parser.
+const maxCompressionPointers = 32
+
+// DNSResponse is a decoded response message.
+type DNSResponse struct {
+	Header      DNSHeader
+	Questions   []DNSResourceRecord
+	Answers     []DNSResourceRecord
+	Authorities []DNSResourceRecord
+	Additionals []DNSResourceRecord
+}
+
+// readMessageName reads a possibly compressed name (RFC 1035 section 4.1.4)
+// at offset, returning it and the offset just past it.
+func readMessageName(message []byte, offset int) (string, int, error) {
+	var labels []string
+	nameLength := 0
+	end := -1
+
+	for pointers := 0; ; {
+		if offset >= len(message) {
+			return "", 0, fmt.Errorf("%w: name truncated", ErrMalformed)
+		}
+
+		labelLength := int(message[offset])
+		switch {
+		case labelLength == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case labelLength&0xc0 == 0xc0:
+			if offset+1 >= len(message) {
+				return "", 0, fmt.Errorf("%w: compression pointer truncated", ErrMalformed)
+			}
+			pointers++
+			if pointers > maxCompressionPointers {
+				return "", 0, fmt.Errorf("%w: too many compression pointers", ErrMalformed)
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(message[offset:offset+2]) & 0x3fff)
+		case labelLength&0xc0 != 0:
+			return "", 0, fmt.Errorf("%w: unsupported label type %#x", ErrMalformed, labelLength&0xc0)
+		default:
+			if offset+1+labelLength > len(message) {
+				return "", 0, fmt.Errorf("%w: label truncated", ErrMalformed)
+			}
+			nameLength += labelLength + 1
+			if nameLength > 255 {
+				return "", 0, fmt.Errorf("%w: name too long", ErrMalformed)
+			}
+			labels = append(labels, string(message[offset+1:offset+1+labelLength]))
+			offset += 1 + labelLength
+		}
+	}
+}
+
+// expandResourceData copies the rdata of a record, rewriting the names of
+// the types that may be compressed (RFC 3597 section 4) in uncompressed form
+// so the rdata can be reused outside the message.
+func expandResourceData(message []byte, recordType uint16, start int, length int) ([]byte, error) {
+	resourceData := message[start : start+length]
+
+	var nameFields int
+	var prefixLength, suffixLength int
+	switch recordType {
+	case TypeCNAME, TypeNS, TypePTR, TypeDNAME:
+		nameFields = 1
+	case TypeMX:
+		nameFields, prefixLength = 1, 2
+	case TypeSOA:
+		nameFields, suffixLength = 2, 20
+	default:
+		return append([]byte(nil), resourceData...), nil
+	}
+
+	if length < prefixLength {
+		return nil, fmt.Errorf("%w: rdata truncated", ErrMalformed)
+	}
+
+	var expanded bytes.Buffer
+	expanded.Write(resourceData[:prefixLength])
+
+	offset := start + prefixLength
+	for i := 0; i < nameFields; i++ {
+		name, next, err := readMessageName(message, offset)
+		if err != nil {
+			return nil, err
+		}
+		writeDomainName(&expanded, name)
+		offset = next
+	}
+
+	if offset+suffixLength != start+length {
+		return nil, fmt.Errorf("%w: rdata length doesn't match its contents", ErrMalformed)
+	}
+	expanded.Write(message[offset : offset+suffixLength])
+
+	return expanded.Bytes(), nil
+}
+
+// parseResponse decodes a response message, following name compression.
+func parseResponse(message []byte) (DNSResponse, error) {
+	var response DNSResponse
+
+	err := binary.Read(bytes.NewReader(message), binary.BigEndian, &response.Header)
+	if err != nil {
+		return response, fmt.Errorf("%w: error decoding header: %v", ErrMalformed, err)
+	}
+	offset := DNSHeaderSizeBytes
+
+	for i := 0; i < int(response.Header.NumQuestions); i++ {
+		var question DNSResourceRecord
+		question.DomainName, offset, err = readMessageName(message, offset)
+		if err != nil {
+			return response, err
+		}
+		if offset+4 > len(message) {
+			return response, fmt.Errorf("%w: question truncated", ErrMalformed)
+		}
+		question.Type = binary.BigEndian.Uint16(message[offset:])
+		question.Class = binary.BigEndian.Uint16(message[offset+2:])
+		offset += 4
+		response.Questions = append(response.Questions, question)
+	}
+
+	sections := []struct {
+		count   uint16
+		records *[]DNSResourceRecord
+	}{
+		{response.Header.NumAnswers, &response.Answers},
+		{response.Header.NumAuthorities, &response.Authorities},
+		{response.Header.NumAdditionals, &response.Additionals},
+	}
+	for _, section := range sections {
+		for i := 0; i < int(section.count); i++ {
+			var resourceRecord DNSResourceRecord
+			resourceRecord.DomainName, offset, err = readMessageName(message, offset)
+			if err != nil {
+				return response, err
+			}
+			if offset+10 > len(message) {
+				return response, fmt.Errorf("%w: resource record truncated", ErrMalformed)
+			}
+
+			resourceRecord.Type = binary.BigEndian.Uint16(message[offset:])
+			resourceRecord.Class = binary.BigEndian.Uint16(message[offset+2:])
+			resourceRecord.TimeToLive = binary.BigEndian.Uint32(message[offset+4:])
+			length := int(binary.BigEndian.Uint16(message[offset+8:]))
+			offset += 10
+
+			if offset+length > len(message) {
+				return response, fmt.Errorf("%w: resource record data truncated", ErrMalformed)
+			}
+			resourceRecord.ResourceData, err = expandResourceData(message, resourceRecord.Type, offset, length)
+			if err != nil {
+				return response, fmt.Errorf("error decoding %s rdata: %w", typeName(resourceRecord.Type), err)
+			}
+			resourceRecord.ResourceDataLength = uint16(len(resourceRecord.ResourceData))
+			offset += length
+
+			*section.records = append(*section.records, resourceRecord)
+		}
+	}
+
+	return response, nil
+}
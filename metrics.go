@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var queriesTotal atomic.Uint64
+
+// distinctNameCounter counts distinct query names over a rolling window. Two
+// estimators are kept: the current window and the one before it, so the
+// reported count always covers between one and two full windows instead of
+// dropping to zero each time the window rolls over.
+type distinctNameCounter struct {
+	sync.Mutex
+	current       *HyperLogLog
+	previous      *HyperLogLog
+	windowStarted time.Time
+}
+
+var distinctQueryNames = distinctNameCounter{current: &HyperLogLog{}, previous: &HyperLogLog{}}
+
+// rotate starts a new window once the configured window length has passed.
+// Callers hold the lock.
+func (c *distinctNameCounter) rotate(now time.Time) {
+	window := time.Duration(currentConfig().DistinctNamesWindowSeconds) * time.Second
+	if window <= 0 {
+		return
+	}
+
+	if c.windowStarted.IsZero() {
+		c.windowStarted = now
+	}
+
+	elapsed := now.Sub(c.windowStarted)
+	if elapsed < window {
+		return
+	}
+
+	// After more than two windows of silence nothing recent is left
+	if elapsed >= 2*window {
+		c.previous = &HyperLogLog{}
+	} else {
+		c.previous = c.current
+	}
+	c.current = &HyperLogLog{}
+	c.windowStarted = now
+}
+
+func (c *distinctNameCounter) Add(name string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.rotate(time.Now())
+	c.current.Add(name)
+}
+
+func (c *distinctNameCounter) Estimate() uint64 {
+	c.Lock()
+	defer c.Unlock()
+
+	c.rotate(time.Now())
+	merged := *c.previous
+	merged.Merge(c.current)
+	return merged.Estimate()
+}
+
+// recordQuery updates the query metrics for one question.
+func recordQuery(queryResourceRecord DNSResourceRecord) {
+	queriesTotal.Add(1)
+	countQueryType(queryResourceRecord.Type)
+
+	name, err := CanonicalName(queryResourceRecord.DomainName)
+	if err != nil {
+		name = queryResourceRecord.DomainName
+	}
+	distinctQueryNames.Add(name)
+}
+
+// Response sizes, next to what they would be without name compression, so
+// the ratio shows how much compression saves
+var (
+	responsesTotal                 atomic.Uint64
+	responseBytesTotal             atomic.Uint64
+	responseUncompressedBytesTotal atomic.Uint64
+)
+
+func recordResponseSize(size int, uncompressedSize int) {
+	responsesTotal.Add(1)
+	responseBytesTotal.Add(uint64(size))
+	responseUncompressedBytesTotal.Add(uint64(uncompressedSize))
+}
+
+// handleMetrics serves the metrics in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP lightdns_queries_total Questions received.")
+	fmt.Fprintln(w, "# TYPE lightdns_queries_total counter")
+	fmt.Fprintln(w, "lightdns_queries_total", queriesTotal.Load())
+
+	fmt.Fprintln(w, "# HELP lightdns_distinct_query_names Approximate distinct query names seen in the recent window.")
+	fmt.Fprintln(w, "# TYPE lightdns_distinct_query_names gauge")
+	fmt.Fprintln(w, "lightdns_distinct_query_names", distinctQueryNames.Estimate())
+
+	responses := responsesTotal.Load()
+	responseBytes := responseBytesTotal.Load()
+	uncompressedBytes := responseUncompressedBytesTotal.Load()
+
+	fmt.Fprintln(w, "# HELP lightdns_responses_total Responses built.")
+	fmt.Fprintln(w, "# TYPE lightdns_responses_total counter")
+	fmt.Fprintln(w, "lightdns_responses_total", responses)
+
+	fmt.Fprintln(w, "# HELP lightdns_response_bytes_total Bytes of responses built, before any truncation clamp.")
+	fmt.Fprintln(w, "# TYPE lightdns_response_bytes_total counter")
+	fmt.Fprintln(w, "lightdns_response_bytes_total", responseBytes)
+
+	fmt.Fprintln(w, "# HELP lightdns_response_uncompressed_bytes_total Bytes the same responses take without name compression.")
+	fmt.Fprintln(w, "# TYPE lightdns_response_uncompressed_bytes_total counter")
+	fmt.Fprintln(w, "lightdns_response_uncompressed_bytes_total", uncompressedBytes)
+
+	fmt.Fprintln(w, "# HELP lightdns_response_compression_saved_bytes_total Bytes saved by name compression.")
+	fmt.Fprintln(w, "# TYPE lightdns_response_compression_saved_bytes_total counter")
+	fmt.Fprintln(w, "lightdns_response_compression_saved_bytes_total", uncompressedBytes-min(responseBytes, uncompressedBytes))
+
+	compressionRatio := 1.0
+	if uncompressedBytes > 0 {
+		compressionRatio = float64(responseBytes) / float64(uncompressedBytes)
+	}
+	fmt.Fprintln(w, "# HELP lightdns_response_compression_ratio Response bytes relative to their uncompressed size.")
+	fmt.Fprintln(w, "# TYPE lightdns_response_compression_ratio gauge")
+	fmt.Fprintln(w, "lightdns_response_compression_ratio", compressionRatio)
+
+	cacheHits, cacheMisses, cacheEntries := forwardCache.Counters()
+	fmt.Fprintln(w, "# HELP lightdns_cache_hits_total Forwarded answers served from the cache.")
+	fmt.Fprintln(w, "# TYPE lightdns_cache_hits_total counter")
+	fmt.Fprintln(w, "lightdns_cache_hits_total", cacheHits)
+
+	fmt.Fprintln(w, "# HELP lightdns_cache_misses_total Forwarded questions not found in the cache.")
+	fmt.Fprintln(w, "# TYPE lightdns_cache_misses_total counter")
+	fmt.Fprintln(w, "lightdns_cache_misses_total", cacheMisses)
+
+	fmt.Fprintln(w, "# HELP lightdns_cache_entries Answers held in the forwarding cache.")
+	fmt.Fprintln(w, "# TYPE lightdns_cache_entries gauge")
+	fmt.Fprintln(w, "lightdns_cache_entries", cacheEntries)
+
+	fmt.Fprintln(w, "# HELP lightdns_rrl_slipped_total Responses sent truncated by response rate limiting.")
+	fmt.Fprintln(w, "# TYPE lightdns_rrl_slipped_total counter")
+	fmt.Fprintln(w, "lightdns_rrl_slipped_total", rrlSlippedTotal.Load())
+
+	fmt.Fprintln(w, "# HELP lightdns_rrl_dropped_total Responses dropped by response rate limiting.")
+	fmt.Fprintln(w, "# TYPE lightdns_rrl_dropped_total counter")
+	fmt.Fprintln(w, "lightdns_rrl_dropped_total", rrlDroppedTotal.Load())
+
+	fmt.Fprintln(w, "# HELP lightdns_shed_queries_total UDP queries answered with SERVFAIL because the query queue was full.")
+	fmt.Fprintln(w, "# TYPE lightdns_shed_queries_total counter")
+	fmt.Fprintln(w, "lightdns_shed_queries_total", shedQueriesTotal.Load())
+
+	fmt.Fprintln(w, "# HELP lightdns_udp_queries_queued UDP queries waiting to be answered.")
+	fmt.Fprintln(w, "# TYPE lightdns_udp_queries_queued gauge")
+	fmt.Fprintln(w, "lightdns_udp_queries_queued", udpQueriesQueued.Load())
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// metricValue reads one unlabelled value from /metrics.
+func metricValue(t *testing.T, name string) float64 {
+	t.Helper()
+	w := apiRequest(t, http.MethodGet, "/metrics", "", "")
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		value, found := strings.CutPrefix(scanner.Text(), name+" ")
+		if found {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return parsed
+		}
+	}
+	t.Fatalf("/metrics has no %s", name)
+	return 0
+}
+
+func TestCompressionSavingsAreMeasured(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	useConfig(t, cfg,
+		NameModel{Name: "www.example.com", Address: "192.0.2.1"},
+		NameModel{Name: "www.example.com", Address: "192.0.2.2"},
+		NameModel{Name: "www.example.com", Address: "192.0.2.3"},
+	)
+
+	responses := metricValue(t, "lightdns_responses_total")
+	responseBytes := metricValue(t, "lightdns_response_bytes_total")
+	saved := metricValue(t, "lightdns_response_compression_saved_bytes_total")
+
+	w := newWriter("192.0.2.1", true)
+	response := serve(t, w, buildQuery(1, FlagRecursionDesired, "www.example.com", TypeA))
+	if len(response.Answers) != 3 {
+		t.Fatalf("got %d answers, want 3", len(response.Answers))
+	}
+
+	// Each answer owner is a 2 byte pointer instead of the 17 byte name
+	if got := metricValue(t, "lightdns_response_compression_saved_bytes_total") - saved; got != 3*15 {
+		t.Errorf("compression saved %v bytes, want 45", got)
+	}
+	if got := metricValue(t, "lightdns_responses_total") - responses; got != 1 {
+		t.Errorf("counted %v responses, want 1", got)
+	}
+	if got := metricValue(t, "lightdns_response_bytes_total") - responseBytes; got != float64(len(w.responses[0])) {
+		t.Errorf("counted %v response bytes, want %d", got, len(w.responses[0]))
+	}
+	if ratio := metricValue(t, "lightdns_response_compression_ratio"); ratio <= 0 || ratio >= 1 {
+		t.Errorf("compression ratio = %v, want between 0 and 1", ratio)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// OpcodeNotify marks a zone change notification (RFC 1996).
+const OpcodeNotify uint16 = 4
+
+// notifyAttempts is how often a secondary is notified before giving up.
+const notifyAttempts = 3
+
+// notifySerialChanges notifies the secondaries of every zone whose serial
+// differs from the one in oldSerials. Zones that are new are notified too.
+func notifySerialChanges(oldSerials map[string]uint32, zones []ZoneConfig) {
+	for i := range zones {
+		serial, ok := oldSerials[canonicalTarget(zones[i].Name)]
+		if !ok || serial != zones[i].CurrentSerial() {
+			go sendNotify(zones[i])
+		}
+	}
+}
+
+// sendNotify tells each of the zone's secondaries the zone changed, retrying
+// until one answers. The current SOA goes along as a hint.
+func sendNotify(zone ZoneConfig) {
+	soa := zone.SOARecord()
+	serial := zone.CurrentSerial()
+	for _, secondary := range zone.Notify {
+		query := buildQuery(uint16(rand.Uint32()), OpcodeNotify<<11|FlagAuthoritative, soa.DomainName, TypeSOA)
+		query[7] = 1 // one answer
+		responseBuffer := bytes.NewBuffer(query)
+		writeResourceRecord(responseBuffer, soa, make(nameCompression))
+
+		client := Client{Timeout: 2 * time.Second}
+		var err error
+		for attempt := 0; attempt < notifyAttempts; attempt++ {
+			var response DNSResponse
+			response, err = client.Exchange(serverContext, responseBuffer.Bytes(), secondary)
+			if err == nil && (response.Header.Flags>>11)&0x0f != OpcodeNotify {
+				err = fmt.Errorf("response isn't a NOTIFY response")
+			}
+			if err == nil && response.Header.Flags&0x0f != RcodeNoError {
+				err = fmt.Errorf("secondary answered %s", rcodeName(response.Header.Flags))
+			}
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			logWarn("Error notifying", secondary, "of zone", soa.DomainName, ":", err)
+			continue
+		}
+		logInfo("Notified", secondary, "of zone", soa.DomainName, "serial", serial)
+	}
+}
+
+// handleNotify answers a NOTIFY for a zone. The server keeps no copy of zones
+// it is secondary for, so a refresh drops the zone's cached forwarded
+// answers, making the next queries for the zone go to the upstreams again.
+// Only primaries in the zone's allowNotify networks are listened to.
+func handleNotify(queryHeader DNSHeader, requestBytes []byte, responseWriter DNSResponseWriter) {
+	rcode := RcodeFormatError
+	var zoneSection []DNSResourceRecord
+
+	message, err := parseResponse(requestBytes)
+	if err != nil {
+		logDebug("Error decoding NOTIFY message:", err)
+		rcode = rcodeForError(err)
+	} else {
+		zoneSection = message.Questions
+		rcode = acceptNotify(message, clientIP(responseWriter.RemoteAddr()))
+	}
+	if len(zoneSection) > 1 {
+		zoneSection = zoneSection[:1]
+	}
+
+	responseFlags := FlagResponse | OpcodeNotify<<11 | FlagAuthoritative | rcode
+	responseBuffer := zoneResponse(queryHeader.TransactionID, responseFlags, zoneSection)
+
+	logQuery(zoneSection, responseWriter.RemoteAddr(), responseFlags, SourceLocal)
+
+	captureExchange(requestBytes, responseBuffer.Bytes(), responseWriter)
+
+	err = responseWriter.WriteResponse(responseBuffer.Bytes())
+	if err != nil {
+		logWarn("Error sending response to", responseWriter.RemoteAddr(), ":", err)
+	}
+}
+
+// acceptNotify checks a NOTIFY and refreshes its zone, returning the
+// response code.
+func acceptNotify(message DNSResponse, clientIP net.IP) uint16 {
+	if len(message.Questions) != 1 || message.Questions[0].Type != TypeSOA {
+		return RcodeFormatError
+	}
+
+	zoneName := canonicalTarget(message.Questions[0].DomainName)
+	zone := exactZone(zoneName)
+	if zone == nil {
+		return RcodeNotAuth
+	}
+	if !zone.AllowsNotify(clientIP) {
+		logWarn("Refused NOTIFY for zone", zoneName, "from", clientIP)
+		return RcodeRefused
+	}
+
+	removed := forwardCache.RemoveZone(zoneName)
+	logInfo("Got NOTIFY for zone", zoneName, "from", clientIP, "- dropped", removed, "cached answers")
+	return RcodeNoError
+}
+
+// RemoveZone drops the cached answers for names at or below the zone apex
+// and returns how many were dropped.
+func (c *answerCache) RemoveZone(zoneName string) int {
+	c.Lock()
+	defer c.Unlock()
+
+	removed := 0
+	for key := range c.entries {
+		if key.name == zoneName || strings.HasSuffix(key.name, "."+zoneName) {
+			delete(c.entries, key)
+			removed++
+		}
+	}
+	return removed
+}
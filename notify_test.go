@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestSerialChangeNotifiesSecondary(t *testing.T) {
+	notifications := make(chan []byte, 4)
+	secondary := startUpstream(t, func(requestBytes []byte) []byte {
+		notifications <- requestBytes
+		response := upstreamResponse(requestBytes, RcodeNoError)
+		binary.BigEndian.PutUint16(response[2:], FlagResponse|OpcodeNotify<<11|FlagAuthoritative)
+		binary.BigEndian.PutUint16(response[6:], 0)
+		return response
+	})
+
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com", Notify: []string{secondary.address}}}
+	before := useConfig(t, cfg).Zones[0].CurrentSerial()
+
+	zoneChanged("www.example.com")
+
+	var requestBytes []byte
+	select {
+	case requestBytes = <-notifications:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the secondary wasn't notified of the serial change")
+	}
+
+	request, err := parseResponse(requestBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Header.Flags>>11&0x0f != OpcodeNotify || request.Header.Flags&FlagAuthoritative == 0 {
+		t.Errorf("flags = %#x, want an authoritative NOTIFY", request.Header.Flags)
+	}
+	if len(request.Questions) != 1 || request.Questions[0].DomainName != "example.com" || request.Questions[0].Type != TypeSOA {
+		t.Fatalf("question = %+v, want the example.com SOA", request.Questions)
+	}
+	if len(request.Answers) != 1 || request.Answers[0].Type != TypeSOA {
+		t.Fatalf("answers = %+v, want the SOA as a hint", request.Answers)
+	}
+	soa := request.Answers[0].ResourceData
+	serial := binary.BigEndian.Uint32(soa[len(soa)-20:])
+	if serial == before || serial != currentConfig().Zones[0].CurrentSerial() {
+		t.Errorf("notified serial %d, want the new serial after %d", serial, before)
+	}
+
+	// A NOERROR answer ends the retries
+	select {
+	case <-notifications:
+		t.Error("the secondary was notified again after answering")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNotifyDropsCachedZone(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com", AllowNotify: []string{"198.51.100.0/24"}}}
+	useForwarding(t, cfg, "192.0.2.53:53")
+
+	now := time.Now()
+	for _, name := range []string{"example.com", "www.example.com", "www.example.org"} {
+		forwardCache.Store(cacheKey{name: name, qtype: TypeA, class: ClassINET}, []DNSResourceRecord{addressRecord(name, 300)}, nil, RcodeNoError, now)
+	}
+
+	notify := buildQuery(9, OpcodeNotify<<11|FlagAuthoritative, "example.com", TypeSOA)
+
+	response := serve(t, newWriter("203.0.113.5", true), notify)
+	if responseCode(response) != RcodeRefused {
+		t.Errorf("NOTIFY from elsewhere: rcode = %d, want REFUSED", responseCode(response))
+	}
+	if _, _, entries := forwardCache.Counters(); entries != 3 {
+		t.Fatalf("a refused NOTIFY left %d cached answers, want 3", entries)
+	}
+
+	w := newWriter("198.51.100.7", true)
+	response = serve(t, w, notify)
+	if responseCode(response) != RcodeNoError || response.Header.Flags>>11&0x0f != OpcodeNotify {
+		t.Errorf("flags = %#x, want a NOTIFY response with NOERROR", response.Header.Flags)
+	}
+	if !bytes.Equal(w.responses[0][:2], notify[:2]) {
+		t.Error("the response doesn't carry the NOTIFY's ID")
+	}
+	_, _, entries := forwardCache.Counters()
+	if _, _, _, ok := forwardCache.Get(cacheKey{name: "www.example.org", qtype: TypeA, class: ClassINET}, now); entries != 1 || !ok {
+		t.Errorf("%d cached answers left, want only www.example.org", entries)
+	}
+
+	other := buildQuery(10, OpcodeNotify<<11, "example.net", TypeSOA)
+	if response := serve(t, newWriter("198.51.100.7", true), other); responseCode(response) != RcodeNotAuth {
+		t.Errorf("NOTIFY for another zone: rcode = %d, want NOTAUTH", responseCode(response))
+	}
+}
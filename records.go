@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	TypeHINFO uint16 = 13  // host information
+	TypeTXT   uint16 = 16  // text strings
+	TypeNAPTR uint16 = 35  // naming authority pointer, RFC 3403
+	TypeDNAME uint16 = 39  // redirection of a subtree, RFC 6672
+	TypeSSHFP uint16 = 44  // SSH key fingerprint, RFC 4255
+	TypeTLSA  uint16 = 52  // TLS certificate association for DANE, RFC 6698
+	TypeSVCB  uint16 = 64  // general service binding, RFC 9460
+	TypeHTTPS uint16 = 65  // service binding for HTTPS, RFC 9460
+	TypeURI   uint16 = 256 // uniform resource identifier, RFC 7553
+	TypeCAA   uint16 = 257 // certification authority restriction, RFC 6844
+)
+
+// SvcParamKeys from RFC 9460 section 14.3.2
+const (
+	SvcParamALPN     uint16 = 1
+	SvcParamPort     uint16 = 3
+	SvcParamIPv4Hint uint16 = 4
+	SvcParamECH      uint16 = 5
+	SvcParamIPv6Hint uint16 = 6
+)
+
+// recordTypes maps the record type names used in names.json and the HTTP API
+// to their wire type codes.
+var recordTypes = map[string]uint16{
+	"A":     TypeA,
+	"AAAA":  TypeAAAA,
+	"HINFO": TypeHINFO,
+	"TXT":   TypeTXT,
+	"LOC":   TypeLOC,
+	"NAPTR": TypeNAPTR,
+	"DNAME": TypeDNAME,
+	"SSHFP": TypeSSHFP,
+	"TLSA":  TypeTLSA,
+	"SVCB":  TypeSVCB,
+	"HTTPS": TypeHTTPS,
+	"URI":   TypeURI,
+	"CAA":   TypeCAA,
+}
+
+type URIRecord struct {
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+	Target   string `json:"target"`
+}
+
+// NAPTRRecord is a naming authority pointer. An empty Replacement, or ".",
+// means the record has none and Regexp is used instead.
+type NAPTRRecord struct {
+	Order       uint16 `json:"order"`
+	Preference  uint16 `json:"preference"`
+	Flags       string `json:"flags"`
+	Service     string `json:"service"`
+	Regexp      string `json:"regexp"`
+	Replacement string `json:"replacement"`
+}
+
+type CAARecord struct {
+	Flags uint8  `json:"flags"`
+	Tag   string `json:"tag"`
+	Value string `json:"value"`
+}
+
+type HINFORecord struct {
+	CPU string `json:"cpu"`
+	OS  string `json:"os"`
+}
+
+type SSHFPRecord struct {
+	Algorithm       uint8  `json:"algorithm"`
+	FingerprintType uint8  `json:"fingerprintType"`
+	Fingerprint     string `json:"fingerprint"` // hex encoded
+}
+
+type TLSARecord struct {
+	Usage        uint8  `json:"usage"`
+	Selector     uint8  `json:"selector"`
+	MatchingType uint8  `json:"matchingType"`
+	Certificate  string `json:"certificate"` // hex encoded association data
+}
+
+// maxDNAMEChain bounds how many DNAME redirections are followed for one query.
+const maxDNAMEChain = 8
+
+// SVCBRecord is used for both SVCB and HTTPS entries. A priority of 0 is
+// AliasMode, which carries no SvcParams.
+type SVCBRecord struct {
+	Priority uint16   `json:"priority"`
+	Target   string   `json:"target"`
+	ALPN     []string `json:"alpn,omitempty"`
+	Port     *uint16  `json:"port,omitempty"`
+	IPv4Hint []string `json:"ipv4hint,omitempty"`
+	ECH      string   `json:"ech,omitempty"` // base64 encoded ECHConfigList
+	IPv6Hint []string `json:"ipv6hint,omitempty"`
+}
+
+// tlsaDigestLengths holds the association data length required by each hashed
+// TLSA matching type; matching type 0 carries the full selected content.
+var tlsaDigestLengths = map[uint8]int{
+	1: 32, // SHA-256
+	2: 64, // SHA-512
+}
+
+// typeNames names the types that aren't in recordTypes because they can't be
+// stored in names.json but can still be queried.
+var typeNames = map[uint16]string{
+	TypeNS:     "NS",
+	TypeCNAME:  "CNAME",
+	TypePTR:    "PTR",
+	TypeMX:     "MX",
+	TypeSOA:    "SOA",
+	TypeAAAA:   "AAAA",
+	TypeOPT:    "OPT",
+	TypeRRSIG:  "RRSIG",
+	TypeDNSKEY: "DNSKEY",
+	TypeANY:    "ANY",
+}
+
+// typeName returns the mnemonic of a record type, or the generic TYPEnnn
+// form from RFC 3597 for unknown types.
+func typeName(recordType uint16) string {
+	if name, ok := typeNames[recordType]; ok {
+		return name
+	}
+	for name, code := range recordTypes {
+		if code == recordType {
+			return name
+		}
+	}
+	return fmt.Sprintf("TYPE%d", recordType)
+}
+
+// typeCode is the inverse of typeName.
+func typeCode(name string) (uint16, bool) {
+	name = strings.ToUpper(name)
+	if code, ok := recordTypes[name]; ok {
+		return code, true
+	}
+	for code, typeName := range typeNames {
+		if typeName == name {
+			return code, true
+		}
+	}
+	if number, found := strings.CutPrefix(name, "TYPE"); found {
+		code, err := strconv.ParseUint(number, 10, 16)
+		return uint16(code), err == nil
+	}
+	return 0, false
+}
+
+// recordTypeName returns the normalized type name of a model, defaulting to A
+// for entries written before record types existed.
+func recordTypeName(model NameModel) string {
+	if model.Type == "" {
+		return "A"
+	}
+	return strings.ToUpper(model.Type)
+}
+
+// canonicalTarget returns the canonical form of a name used inside rdata. It
+// returns an empty string for names that can't be converted.
+func canonicalTarget(target string) string {
+	canonicalName, err := CanonicalName(target)
+	if err != nil {
+		return ""
+	}
+	return canonicalName
+}
+
+// encodeResourceData validates a model and serializes it into the wire type
+// code and ResourceData of its record.
+func encodeResourceData(model NameModel) (uint16, []byte, error) {
+	typeName := recordTypeName(model)
+	recordType, ok := recordTypes[typeName]
+	if !ok {
+		return 0, nil, fmt.Errorf("unknown record type %q", model.Type)
+	}
+
+	switch recordType {
+	case TypeA:
+		ip := net.ParseIP(model.Address).To4()
+		if ip == nil {
+			return 0, nil, fmt.Errorf("invalid IPv4 address %q", model.Address)
+		}
+		return recordType, ip, nil
+	case TypeAAAA:
+		ip := net.ParseIP(model.Address)
+		if ip == nil || ip.To4() != nil {
+			return 0, nil, fmt.Errorf("invalid IPv6 address %q", model.Address)
+		}
+		return recordType, ip.To16(), nil
+	case TypeURI:
+		if model.URI == nil || model.URI.Target == "" {
+			return 0, nil, fmt.Errorf("URI record requires a 'uri' field with a target")
+		}
+		data := binary.BigEndian.AppendUint16(nil, model.URI.Priority)
+		data = binary.BigEndian.AppendUint16(data, model.URI.Weight)
+		return recordType, append(data, model.URI.Target...), nil
+	case TypeCAA:
+		if model.CAA == nil {
+			return 0, nil, fmt.Errorf("CAA record requires a 'caa' field")
+		}
+		data, err := encodeCAA(*model.CAA)
+		return recordType, data, err
+	case TypeNAPTR:
+		if model.NAPTR == nil {
+			return 0, nil, fmt.Errorf("NAPTR record requires a 'naptr' field")
+		}
+		data, err := encodeNAPTR(*model.NAPTR)
+		return recordType, data, err
+	case TypeHINFO:
+		if model.HINFO == nil {
+			return 0, nil, fmt.Errorf("HINFO record requires a 'hinfo' field")
+		}
+		var buffer bytes.Buffer
+		err := writeCharacterString(&buffer, model.HINFO.CPU)
+		if err == nil {
+			err = writeCharacterString(&buffer, model.HINFO.OS)
+		}
+		return recordType, buffer.Bytes(), err
+	case TypeTXT:
+		data, err := encodeTXT(model.TXT)
+		return recordType, data, err
+	case TypeLOC:
+		if model.LOC == nil {
+			return 0, nil, fmt.Errorf("LOC record requires a 'loc' field")
+		}
+		data, err := encodeLOC(*model.LOC)
+		return recordType, data, err
+	case TypeDNAME:
+		target := canonicalTarget(model.Target)
+		if target == "" {
+			return 0, nil, fmt.Errorf("DNAME record requires a valid 'target' name")
+		}
+		var buffer bytes.Buffer
+		writeDomainName(&buffer, target)
+		return recordType, buffer.Bytes(), nil
+	case TypeSSHFP:
+		if model.SSHFP == nil {
+			return 0, nil, fmt.Errorf("SSHFP record requires a 'sshfp' field")
+		}
+		data, err := encodeSSHFP(*model.SSHFP)
+		return recordType, data, err
+	case TypeTLSA:
+		if model.TLSA == nil {
+			return 0, nil, fmt.Errorf("TLSA record requires a 'tlsa' field")
+		}
+		data, err := encodeTLSA(*model.TLSA)
+		return recordType, data, err
+	case TypeSVCB, TypeHTTPS:
+		if model.SVCB == nil {
+			return 0, nil, fmt.Errorf("%s record requires a 'svcb' field", typeName)
+		}
+		data, err := encodeSVCB(*model.SVCB)
+		return recordType, data, err
+	}
+
+	return 0, nil, fmt.Errorf("unsupported record type %q", typeName)
+}
+
+// writeCharacterString writes a length-prefixed <character-string> as defined
+// in RFC 1035 section 3.3.
+func writeCharacterString(buffer *bytes.Buffer, value string) error {
+	if len(value) > 255 {
+		return fmt.Errorf("character-string longer than 255 bytes")
+	}
+
+	buffer.WriteByte(byte(len(value)))
+	buffer.WriteString(value)
+
+	return nil
+}
+
+// txtChunks splits a TXT value into the <character-string>s of its rdata. A
+// character-string holds at most 255 bytes, so longer values are stored as
+// one string and only split on the wire. An empty value is one empty
+// character-string.
+func txtChunks(value string) []string {
+	chunks := []string{}
+	for len(value) > 255 {
+		chunks = append(chunks, value[:255])
+		value = value[255:]
+	}
+	return append(chunks, value)
+}
+
+// encodeTXT serializes a TXT value as consecutive character-strings.
+func encodeTXT(value string) ([]byte, error) {
+	var buffer bytes.Buffer
+	for _, chunk := range txtChunks(value) {
+		writeCharacterString(&buffer, chunk)
+	}
+	if buffer.Len() > 65535 {
+		return nil, fmt.Errorf("TXT value of %d bytes is too long", len(value))
+	}
+	return buffer.Bytes(), nil
+}
+
+// decodeTXT joins the character-strings of TXT rdata back into one value.
+func decodeTXT(resourceData []byte) (string, error) {
+	var value strings.Builder
+	for offset := 0; offset < len(resourceData); {
+		length := int(resourceData[offset])
+		if offset+1+length > len(resourceData) {
+			return "", fmt.Errorf("%w: TXT character-string truncated", ErrMalformed)
+		}
+		value.Write(resourceData[offset+1 : offset+1+length])
+		offset += 1 + length
+	}
+	return value.String(), nil
+}
+
+// naptrReplacement returns the canonical replacement name of a NAPTR
+// record, empty for the root.
+func naptrReplacement(naptr NAPTRRecord) (string, error) {
+	if naptr.Replacement == "" || naptr.Replacement == "." {
+		return "", nil
+	}
+	return CanonicalName(naptr.Replacement)
+}
+
+// encodeNAPTR serializes order + preference + flags, service and regexp
+// character-strings + uncompressed replacement name as in RFC 3403 section 4.1.
+func encodeNAPTR(naptr NAPTRRecord) ([]byte, error) {
+	replacement, err := naptrReplacement(naptr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid NAPTR replacement name: %v", err)
+	}
+	if replacement != "" && naptr.Regexp != "" {
+		return nil, fmt.Errorf("NAPTR record can't have both a regexp and a replacement")
+	}
+	for _, flag := range naptr.Flags {
+		if !(flag >= 'a' && flag <= 'z' || flag >= 'A' && flag <= 'Z' || flag >= '0' && flag <= '9') {
+			return nil, fmt.Errorf("NAPTR flags must be alphanumeric")
+		}
+	}
+
+	var buffer bytes.Buffer
+	Write(&buffer, naptr.Order)
+	Write(&buffer, naptr.Preference)
+	for _, value := range []string{naptr.Flags, naptr.Service, naptr.Regexp} {
+		err = writeCharacterString(&buffer, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = writeDomainName(&buffer, replacement)
+	return buffer.Bytes(), err
+}
+
+// encodeCAA serializes flags + tag length + tag + value as in RFC 6844 section 5.1.
+func encodeCAA(caa CAARecord) ([]byte, error) {
+	if len(caa.Tag) == 0 || len(caa.Tag) > 255 {
+		return nil, fmt.Errorf("CAA tag must be between 1 and 255 characters")
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteByte(caa.Flags)
+	buffer.WriteByte(byte(len(caa.Tag)))
+	buffer.WriteString(caa.Tag)
+	buffer.WriteString(caa.Value)
+
+	return buffer.Bytes(), nil
+}
+
+// decodeCAA parses CAA ResourceData back into its three fields.
+func decodeCAA(data []byte) (CAARecord, error) {
+	if len(data) < 2 {
+		return CAARecord{}, fmt.Errorf("CAA rdata too short")
+	}
+
+	tagLength := int(data[1])
+	if len(data) < 2+tagLength {
+		return CAARecord{}, fmt.Errorf("CAA tag length exceeds rdata")
+	}
+
+	return CAARecord{
+		Flags: data[0],
+		Tag:   string(data[2 : 2+tagLength]),
+		Value: string(data[2+tagLength:]),
+	}, nil
+}
+
+// encodeSSHFP serializes algorithm + fingerprint type + raw fingerprint bytes
+// as in RFC 4255 section 3.1.
+func encodeSSHFP(sshfp SSHFPRecord) ([]byte, error) {
+	fingerprint, err := hex.DecodeString(sshfp.Fingerprint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSHFP fingerprint hex: %v", err)
+	}
+	if len(fingerprint) == 0 {
+		return nil, fmt.Errorf("SSHFP fingerprint is empty")
+	}
+
+	data := []byte{sshfp.Algorithm, sshfp.FingerprintType}
+	return append(data, fingerprint...), nil
+}
+
+// encodeTLSA serializes usage + selector + matching type + association data
+// as in RFC 6698 section 2.1.
+func encodeTLSA(tlsa TLSARecord) ([]byte, error) {
+	certificate, err := hex.DecodeString(tlsa.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLSA certificate association hex: %v", err)
+	}
+	if len(certificate) == 0 {
+		return nil, fmt.Errorf("TLSA certificate association data is empty")
+	}
+	if digestLength, ok := tlsaDigestLengths[tlsa.MatchingType]; ok && len(certificate) != digestLength {
+		return nil, fmt.Errorf("TLSA matching type %d requires %d bytes of association data, got %d", tlsa.MatchingType, digestLength, len(certificate))
+	}
+
+	data := []byte{tlsa.Usage, tlsa.Selector, tlsa.MatchingType}
+	return append(data, certificate...), nil
+}
+
+// encodeSVCB serializes priority + uncompressed target name + SvcParams as in
+// RFC 9460 section 2.2. Params are written in increasing key order as the wire
+// format requires.
+func encodeSVCB(svcb SVCBRecord) ([]byte, error) {
+	target, err := CanonicalName(svcb.Target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SVCB target name: %v", err)
+	}
+
+	var buffer bytes.Buffer
+	Write(&buffer, svcb.Priority)
+	writeDomainName(&buffer, target)
+
+	params := make(map[uint16][]byte)
+
+	if len(svcb.ALPN) > 0 {
+		var alpn bytes.Buffer
+		for _, protocol := range svcb.ALPN {
+			if len(protocol) == 0 || len(protocol) > 255 {
+				return nil, fmt.Errorf("invalid SVCB alpn id %q", protocol)
+			}
+			alpn.WriteByte(byte(len(protocol)))
+			alpn.WriteString(protocol)
+		}
+		params[SvcParamALPN] = alpn.Bytes()
+	}
+
+	if svcb.Port != nil {
+		params[SvcParamPort] = binary.BigEndian.AppendUint16(nil, *svcb.Port)
+	}
+
+	if len(svcb.IPv4Hint) > 0 {
+		var hints []byte
+		for _, address := range svcb.IPv4Hint {
+			ip := net.ParseIP(address).To4()
+			if ip == nil {
+				return nil, fmt.Errorf("invalid SVCB ipv4hint %q", address)
+			}
+			hints = append(hints, ip...)
+		}
+		params[SvcParamIPv4Hint] = hints
+	}
+
+	if svcb.ECH != "" {
+		ech, err := base64.StdEncoding.DecodeString(svcb.ECH)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SVCB ech base64: %v", err)
+		}
+		params[SvcParamECH] = ech
+	}
+
+	if len(svcb.IPv6Hint) > 0 {
+		var hints []byte
+		for _, address := range svcb.IPv6Hint {
+			ip := net.ParseIP(address)
+			if ip == nil || ip.To4() != nil {
+				return nil, fmt.Errorf("invalid SVCB ipv6hint %q", address)
+			}
+			hints = append(hints, ip.To16()...)
+		}
+		params[SvcParamIPv6Hint] = hints
+	}
+
+	if svcb.Priority == 0 && len(params) > 0 {
+		return nil, fmt.Errorf("SVCB AliasMode records (priority 0) cannot carry SvcParams")
+	}
+
+	keys := make([]uint16, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	for _, key := range keys {
+		Write(&buffer, key)
+		Write(&buffer, uint16(len(params[key])))
+		buffer.Write(params[key])
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// sortByPriority orders records whose rdata starts with two uint16 ranking
+// fields, such as URI priority and weight or NAPTR order and preference,
+// lowest first.
+func sortByPriority(records []DNSResourceRecord) {
+	rank := func(record DNSResourceRecord) uint32 {
+		if len(record.ResourceData) < 4 {
+			return 0
+		}
+		return binary.BigEndian.Uint32(record.ResourceData[:4])
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return rank(records[i]) < rank(records[j])
+	})
+}
+
+// dedupRecords removes records repeating an earlier one's owner, type, class
+// and rdata, keeping the first of them in place. Owner names compare case
+// insensitively and TTLs are ignored, since the records of one RRset share
+// a TTL anyway.
+func dedupRecords(records []DNSResourceRecord) []DNSResourceRecord {
+	if len(records) < 2 {
+		return records
+	}
+
+	seen := make(map[string]bool, len(records))
+	deduped := records[:0:0]
+	for _, record := range records {
+		key := fmt.Sprintf("%s|%d|%d|%x", strings.ToLower(strings.TrimSuffix(record.DomainName, ".")), record.Type, record.Class, record.ResourceData)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		deduped = append(deduped, record)
+	}
+	return deduped
+}
+
+// describeEntry renders a model's value for log and API messages.
+func describeEntry(model NameModel) string {
+	switch recordTypeName(model) {
+	case "URI":
+		if model.URI != nil {
+			return fmt.Sprintf("URI %d %d %q", model.URI.Priority, model.URI.Weight, model.URI.Target)
+		}
+	case "CAA":
+		if model.CAA != nil {
+			return fmt.Sprintf("CAA %d %s %q", model.CAA.Flags, model.CAA.Tag, model.CAA.Value)
+		}
+	case "HINFO":
+		if model.HINFO != nil {
+			return fmt.Sprintf("HINFO %q %q", model.HINFO.CPU, model.HINFO.OS)
+		}
+	case "TXT":
+		return fmt.Sprintf("TXT %q", model.TXT)
+	case "NAPTR":
+		if model.NAPTR != nil {
+			return fmt.Sprintf("NAPTR %d %d %q %q %q %s", model.NAPTR.Order, model.NAPTR.Preference, model.NAPTR.Flags, model.NAPTR.Service, model.NAPTR.Regexp, model.NAPTR.Replacement)
+		}
+	case "LOC":
+		if model.LOC != nil {
+			return fmt.Sprintf("LOC %s %s %vm", model.LOC.Latitude, model.LOC.Longitude, model.LOC.Altitude)
+		}
+	case "DNAME":
+		return "DNAME " + model.Target
+	case "SSHFP":
+		if model.SSHFP != nil {
+			return fmt.Sprintf("SSHFP %d %d %s", model.SSHFP.Algorithm, model.SSHFP.FingerprintType, model.SSHFP.Fingerprint)
+		}
+	case "TLSA":
+		if model.TLSA != nil {
+			return fmt.Sprintf("TLSA %d %d %d %s", model.TLSA.Usage, model.TLSA.Selector, model.TLSA.MatchingType, model.TLSA.Certificate)
+		}
+	case "SVCB", "HTTPS":
+		if model.SVCB != nil {
+			return fmt.Sprintf("%s %d %s", recordTypeName(model), model.SVCB.Priority, model.SVCB.Target)
+		}
+	}
+	return model.Address
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// recordsZone serves entries from the example.com zone.
+func recordsZone(t *testing.T, entries ...NameModel) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	useConfig(t, cfg, entries...)
+}
+
+// answerData queries a name and returns the rdata of the answers of the
+// queried type.
+func answerData(t *testing.T, name string, queryType uint16) [][]byte {
+	t.Helper()
+	response := query(t, name, queryType)
+	if responseCode(response) != RcodeNoError {
+		t.Fatalf("query for %s type %d: rcode %d", name, queryType, responseCode(response))
+	}
+	var resourceData [][]byte
+	for _, answer := range response.Answers {
+		if answer.Type == queryType {
+			resourceData = append(resourceData, answer.ResourceData)
+		}
+	}
+	return resourceData
+}
+
+func TestCAARecords(t *testing.T) {
+	caa := CAARecord{Flags: 128, Tag: "issue", Value: "letsencrypt.org"}
+	recordsZone(t, NameModel{Name: "example.com", Type: "CAA", CAA: &caa})
+
+	resourceData := answerData(t, "example.com", TypeCAA)
+	if len(resourceData) != 1 {
+		t.Fatalf("got %d CAA records, want 1", len(resourceData))
+	}
+	want := append([]byte{128, 5}, "issueletsencrypt.org"...)
+	if !bytes.Equal(resourceData[0], want) {
+		t.Errorf("CAA rdata = %q, want %q", resourceData[0], want)
+	}
+	decoded, err := decodeCAA(resourceData[0])
+	if err != nil || decoded != caa {
+		t.Errorf("decodeCAA = %+v, %v; want %+v", decoded, err, caa)
+	}
+
+	_, err = ToName(NameModel{Name: "example.com", Type: "CAA", CAA: &CAARecord{Value: "letsencrypt.org"}})
+	if err == nil {
+		t.Error("a CAA record without a tag was accepted")
+	}
+}
+
+func TestSSHFPRecords(t *testing.T) {
+	sshfp := SSHFPRecord{Algorithm: 4, FingerprintType: 2, Fingerprint: "0a1b2c3d"}
+	recordsZone(t, NameModel{Name: "host.example.com", Type: "SSHFP", SSHFP: &sshfp})
+
+	resourceData := answerData(t, "host.example.com", TypeSSHFP)
+	if len(resourceData) != 1 || !bytes.Equal(resourceData[0], []byte{4, 2, 0x0a, 0x1b, 0x2c, 0x3d}) {
+		t.Errorf("SSHFP rdata = %x, want 04020a1b2c3d", resourceData)
+	}
+
+	for _, fingerprint := range []string{"", "not hex"} {
+		_, err := ToName(NameModel{Name: "host.example.com", Type: "SSHFP", SSHFP: &SSHFPRecord{Algorithm: 4, FingerprintType: 2, Fingerprint: fingerprint}})
+		if err == nil {
+			t.Errorf("SSHFP fingerprint %q was accepted", fingerprint)
+		}
+	}
+}
+
+func TestTLSARecords(t *testing.T) {
+	digest := strings.Repeat("ab", 32)
+	tlsa := TLSARecord{Usage: 3, Selector: 1, MatchingType: 1, Certificate: digest}
+	recordsZone(t, NameModel{Name: "_443._tcp.www.example.com", Type: "TLSA", TLSA: &tlsa})
+
+	resourceData := answerData(t, "_443._tcp.www.example.com", TypeTLSA)
+	want := append([]byte{3, 1, 1}, bytes.Repeat([]byte{0xab}, 32)...)
+	if len(resourceData) != 1 || !bytes.Equal(resourceData[0], want) {
+		t.Errorf("TLSA rdata = %x, want %x", resourceData, want)
+	}
+
+	// A SHA-512 association must be 64 bytes
+	_, err := ToName(NameModel{Name: "_443._tcp.www.example.com", Type: "TLSA", TLSA: &TLSARecord{Usage: 3, Selector: 1, MatchingType: 2, Certificate: digest}})
+	if err == nil {
+		t.Error("a 32 byte SHA-512 association was accepted")
+	}
+}
+
+func TestSVCBRecords(t *testing.T) {
+	https := SVCBRecord{Priority: 1, Target: "svc.example.net", ALPN: []string{"h2", "h3"}, Port: pointerTo(uint16(8443)), IPv4Hint: []string{"192.0.2.1"}}
+	recordsZone(t, NameModel{Name: "www.example.com", Type: "HTTPS", SVCB: &https})
+
+	resourceData := answerData(t, "www.example.com", TypeHTTPS)
+	if len(resourceData) != 1 {
+		t.Fatalf("got %d HTTPS records, want 1", len(resourceData))
+	}
+	var want bytes.Buffer
+	Write(&want, uint16(1))
+	writeDomainName(&want, "svc.example.net")
+	// SvcParams in increasing key order: alpn, port, ipv4hint
+	want.Write([]byte{0, 1, 0, 6, 2, 'h', '2', 2, 'h', '3'})
+	want.Write([]byte{0, 3, 0, 2, 0x20, 0xfb})
+	want.Write([]byte{0, 4, 0, 4, 192, 0, 2, 1})
+	if !bytes.Equal(resourceData[0], want.Bytes()) {
+		t.Errorf("HTTPS rdata = %x, want %x", resourceData[0], want.Bytes())
+	}
+
+	_, err := ToName(NameModel{Name: "www.example.com", Type: "SVCB", SVCB: &SVCBRecord{Priority: 0, Target: "svc.example.net", ALPN: []string{"h2"}}})
+	if err == nil {
+		t.Error("an AliasMode record with SvcParams was accepted")
+	}
+}
+
+func TestDNAMESynthesizesCNAME(t *testing.T) {
+	recordsZone(t,
+		NameModel{Name: "old.example.com", Type: "DNAME", Target: "new.example.com"},
+		NameModel{Name: "host.new.example.com", Address: "192.0.2.10"},
+		NameModel{Name: "loop.example.com", Type: "DNAME", Target: "a.loop.example.com"},
+	)
+
+	response := query(t, "host.old.example.com", TypeA)
+	if len(response.Answers) != 3 {
+		t.Fatalf("got %d answers, want the DNAME, a CNAME and the A record", len(response.Answers))
+	}
+	dname, cname, address := response.Answers[0], response.Answers[1], response.Answers[2]
+	if dname.Type != TypeDNAME || dname.DomainName != "old.example.com" {
+		t.Errorf("first answer = %+v, want the DNAME at old.example.com", dname)
+	}
+	target, _, err := readMessageName(cname.ResourceData, 0)
+	if cname.Type != TypeCNAME || cname.DomainName != "host.old.example.com" || err != nil || target != "host.new.example.com" {
+		t.Errorf("second answer = %s CNAME %s, want host.old.example.com CNAME host.new.example.com", cname.DomainName, target)
+	}
+	if address.Type != TypeA || address.DomainName != "host.new.example.com" {
+		t.Errorf("third answer = %+v, want the A record of the target", address)
+	}
+
+	// A DNAME pointing below itself rewrites forever without the chain cap
+	response = serve(t, newWriter("192.0.2.1", false), buildQuery(1, 0, "x.loop.example.com", TypeA))
+	cnames := 0
+	for _, answer := range response.Answers {
+		if answer.Type == TypeCNAME {
+			cnames++
+		}
+	}
+	if cnames != maxDNAMEChain {
+		t.Errorf("a DNAME loop gave %d CNAMEs, want the chain cut off after %d hops", cnames, maxDNAMEChain)
+	}
+}
+
+func TestHINFORecords(t *testing.T) {
+	recordsZone(t, NameModel{Name: "host.example.com", Type: "HINFO", HINFO: &HINFORecord{CPU: "x86_64", OS: "Linux"}})
+
+	resourceData := answerData(t, "host.example.com", TypeHINFO)
+	want := append([]byte{6}, "x86_64\x05Linux"...)
+	if len(resourceData) != 1 || !bytes.Equal(resourceData[0], want) {
+		t.Errorf("HINFO rdata = %q, want %q", resourceData, want)
+	}
+
+	_, err := ToName(NameModel{Name: "host.example.com", Type: "HINFO", HINFO: &HINFORecord{CPU: strings.Repeat("x", 256), OS: "Linux"}})
+	if err == nil {
+		t.Error("a 256 byte HINFO CPU string was accepted")
+	}
+}
+
+func TestURIRecordsSortByPriorityAndWeight(t *testing.T) {
+	recordsZone(t,
+		NameModel{Name: "_http._tcp.example.com", Type: "URI", URI: &URIRecord{Priority: 20, Weight: 1, Target: "http://c.example.com/"}},
+		NameModel{Name: "_http._tcp.example.com", Type: "URI", URI: &URIRecord{Priority: 10, Weight: 5, Target: "http://b.example.com/"}},
+		NameModel{Name: "_http._tcp.example.com", Type: "URI", URI: &URIRecord{Priority: 10, Weight: 1, Target: "http://a.example.com/"}},
+	)
+
+	resourceData := answerData(t, "_http._tcp.example.com", TypeURI)
+	if len(resourceData) != 3 {
+		t.Fatalf("got %d URI records, want 3", len(resourceData))
+	}
+	want := append([]byte{0, 10, 0, 1}, "http://a.example.com/"...)
+	if !bytes.Equal(resourceData[0], want) {
+		t.Errorf("first URI rdata = %q, want %q", resourceData[0], want)
+	}
+	for i, target := range []string{"http://a.example.com/", "http://b.example.com/", "http://c.example.com/"} {
+		if string(resourceData[i][4:]) != target {
+			t.Errorf("URI record %d targets %q, want %q", i, resourceData[i][4:], target)
+		}
+	}
+}
+
+func TestLOCEncoding(t *testing.T) {
+	// The example from RFC 1876 section 3
+	size := 30.0
+	loc := LOCRecord{Latitude: "42 21 54 N", Longitude: "71 06 18 W", Altitude: -24, Size: &size}
+	want, _ := hex.DecodeString("0033161389172dd070be15f000988d20")
+
+	resourceData, err := encodeLOC(loc)
+	if err != nil || !bytes.Equal(resourceData, want) {
+		t.Errorf("encodeLOC = %x, %v; want %x", resourceData, err, want)
+	}
+
+	// Decimal degrees encode the same position
+	decimal := loc
+	decimal.Latitude, decimal.Longitude = "42.365", "-71.105"
+	resourceData, err = encodeLOC(decimal)
+	if err != nil || !bytes.Equal(resourceData, want) {
+		t.Errorf("encodeLOC in decimal degrees = %x, %v; want %x", resourceData, err, want)
+	}
+
+	for _, latitude := range []string{"91 N", "42 61 N", "north"} {
+		_, err := encodeLOC(LOCRecord{Latitude: latitude, Longitude: "0"})
+		if err == nil {
+			t.Errorf("latitude %q was accepted", latitude)
+		}
+	}
+}
+
+// decodeNAPTR reads NAPTR rdata back into its fields.
+func decodeNAPTR(t *testing.T, resourceData []byte) NAPTRRecord {
+	t.Helper()
+	buffer := bytes.NewBuffer(resourceData)
+	naptr := NAPTRRecord{
+		Order:      binary.BigEndian.Uint16(buffer.Next(2)),
+		Preference: binary.BigEndian.Uint16(buffer.Next(2)),
+	}
+	for _, field := range []*string{&naptr.Flags, &naptr.Service, &naptr.Regexp} {
+		length, err := buffer.ReadByte()
+		if err != nil {
+			t.Fatal("NAPTR rdata ends early")
+		}
+		*field = string(buffer.Next(int(length)))
+	}
+	replacement, err := readDomainName(buffer)
+	if err != nil || buffer.Len() != 0 {
+		t.Fatalf("bad NAPTR replacement: %v, %d bytes left", err, buffer.Len())
+	}
+	naptr.Replacement = replacement
+	return naptr
+}
+
+func TestNAPTRRecords(t *testing.T) {
+	sip := NAPTRRecord{Order: 100, Preference: 20, Flags: "s", Service: "SIP+D2U", Replacement: "_sip._udp.example.com"}
+	enum := NAPTRRecord{Order: 100, Preference: 10, Flags: "u", Service: "E2U+sip", Regexp: "!^.*$!sip:info@example.com!"}
+	first := NAPTRRecord{Order: 50, Preference: 50, Flags: "a", Service: "SIP+D2T", Replacement: "sip.example.com"}
+	recordsZone(t,
+		NameModel{Name: "example.com", Type: "NAPTR", NAPTR: &sip},
+		NameModel{Name: "example.com", Type: "NAPTR", NAPTR: &enum},
+		NameModel{Name: "example.com", Type: "NAPTR", NAPTR: &first},
+	)
+
+	// Ordered by order, then preference
+	resourceData := answerData(t, "example.com", TypeNAPTR)
+	want := []NAPTRRecord{first, enum, sip}
+	if len(resourceData) != len(want) {
+		t.Fatalf("got %d NAPTR records, want %d", len(resourceData), len(want))
+	}
+	for i := range want {
+		if decoded := decodeNAPTR(t, resourceData[i]); decoded != want[i] {
+			t.Errorf("NAPTR record %d = %+v, want %+v", i, decoded, want[i])
+		}
+	}
+
+	for _, bad := range []NAPTRRecord{
+		{Flags: "s", Regexp: "!x!y!", Replacement: "sip.example.com"},
+		{Flags: "s!", Replacement: "sip.example.com"},
+	} {
+		_, err := ToName(NameModel{Name: "example.com", Type: "NAPTR", NAPTR: &bad})
+		if err == nil {
+			t.Errorf("the NAPTR record %+v was accepted", bad)
+		}
+	}
+}
+
+func TestLongTXTIsSplitOnTheWire(t *testing.T) {
+	loaded := apiConfig(t)
+	value := strings.Repeat("0123456789", 60)
+
+	w := apiRequest(t, http.MethodPost, "/add-entry", `{"name": "long.example.com", "type": "TXT", "txt": "`+value+`"}`, testToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("adding a 600 byte TXT: status %d: %s", w.Code, w.Body)
+	}
+	stored := storedEntries(t, loaded, "long.example.com")
+	if len(stored) != 1 || stored[0].TXT != value {
+		t.Fatalf("stored %+v, want the value as one string", stored)
+	}
+
+	response := serve(t, newWriter("192.0.2.1", false), buildQuery(1, 0, "long.example.com", TypeTXT))
+	if len(response.Answers) != 1 {
+		t.Fatalf("got %d answers, want 1", len(response.Answers))
+	}
+	resourceData := response.Answers[0].ResourceData
+	var lengths []int
+	for offset := 0; offset < len(resourceData); offset += 1 + int(resourceData[offset]) {
+		lengths = append(lengths, int(resourceData[offset]))
+	}
+	if fmt.Sprint(lengths) != "[255 255 90]" {
+		t.Errorf("character-string lengths %v, want [255 255 90]", lengths)
+	}
+	decoded, err := decodeTXT(resourceData)
+	if err != nil || decoded != value {
+		t.Errorf("decoded %d bytes (%v), want the 600 byte value", len(decoded), err)
+	}
+
+	w = apiRequest(t, http.MethodGet, "/entries?suffix=long.example.com", "", "")
+	var listed []NameModel
+	err = json.Unmarshal(w.Body.Bytes(), &listed)
+	if err != nil || len(listed) != 1 || listed[0].TXT != value {
+		t.Errorf("listed %s, want one entry with the whole value", w.Body)
+	}
+}
+
+func TestTXTChunkBoundaries(t *testing.T) {
+	tests := map[int][]int{0: {0}, 255: {255}, 256: {255, 1}, 510: {255, 255}}
+	for size, want := range tests {
+		chunks := txtChunks(strings.Repeat("x", size))
+		var lengths []int
+		for _, chunk := range chunks {
+			lengths = append(lengths, len(chunk))
+		}
+		if fmt.Sprint(lengths) != fmt.Sprint(want) {
+			t.Errorf("%d bytes split into %v, want %v", size, lengths, want)
+		}
+	}
+
+	_, err := decodeTXT([]byte{5, 'a', 'b'})
+	if !errors.Is(err, ErrMalformed) {
+		t.Errorf("decodeTXT of a truncated string = %v, want ErrMalformed", err)
+	}
+}
+
+func TestDedupRecords(t *testing.T) {
+	first := addressRecord("www.example.com", 60)
+	sameWithOtherCase := addressRecord("WWW.example.com.", 300)
+	other := addressRecord("www.example.com", 60)
+	other.ResourceData = []byte{192, 0, 2, 2}
+	otherName := addressRecord("mail.example.com", 60)
+
+	deduped := dedupRecords([]DNSResourceRecord{first, other, sameWithOtherCase, otherName, other})
+	if len(deduped) != 3 {
+		t.Fatalf("kept %d records, want 3", len(deduped))
+	}
+	if deduped[0].TimeToLive != 60 || deduped[1].ResourceData[3] != 2 || deduped[2].DomainName != "mail.example.com" {
+		t.Errorf("deduped to %+v, want the first of each in order", deduped)
+	}
+}
+
+func TestOverlappingLookupsDontRepeatRecords(t *testing.T) {
+	recordsZone(t,
+		NameModel{Name: "www.example.com", Address: "192.0.2.10"},
+		NameModel{Name: "www.example.com", Address: "192.0.2.10"},
+		NameModel{Name: "www.example.com", Type: "AAAA", Address: "2001:db8::10"},
+	)
+
+	response := query(t, "www.example.com", TypeA)
+	if len(response.Answers) != 1 {
+		t.Errorf("got %d answers for one stored record, want 1", len(response.Answers))
+	}
+
+	response = query(t, "www.example.com", TypeANY)
+	counts := make(map[uint16]int)
+	for _, answer := range response.Answers {
+		counts[answer.Type]++
+	}
+	if counts[TypeA] != 1 || counts[TypeAAAA] != 1 {
+		t.Errorf("ANY answered %v records by type, want one A and one AAAA", counts)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisConfig configures the Redis store backend, for several instances
+// sharing one dataset.
+type RedisConfig struct {
+	Address   string `json:"address"`
+	Password  string `json:"password"`
+	DB        int    `json:"db"`
+	KeyPrefix string `json:"keyPrefix"`
+
+	// CacheSeconds is how long entries read from Redis are served from
+	// memory before being read again
+	CacheSeconds int `json:"cacheSeconds"`
+
+	// Subscribe listens for change notifications from other instances and
+	// drops the local cache as soon as one arrives
+	Subscribe bool `json:"subscribe"`
+}
+
+// RedisStore keeps each name's entries in a Redis hash, keyed by type and
+// rdata, next to a set of all names. Reads are cached locally for a short
+// while, and every change is announced on a pub/sub channel so other
+// instances can drop their cache.
+type RedisStore struct {
+	client    *redis.Client
+	keyPrefix string
+	cacheTTL  time.Duration
+
+	cacheLock    sync.Mutex
+	cached       []NameModel
+	cachedAt     time.Time
+	cacheIsValid bool
+}
+
+// NewRedisStore connects to Redis. An unreachable server is logged but not
+// fatal: the client keeps reconnecting and lookups fail until it is back.
+func NewRedisStore(redisConfig RedisConfig) *RedisStore {
+	s := &RedisStore{
+		client: redis.NewClient(&redis.Options{
+			Addr:     redisConfig.Address,
+			Password: redisConfig.Password,
+			DB:       redisConfig.DB,
+			// Fail fast while Redis is down so queries aren't held up
+			DialTimeout:   time.Second,
+			DialerRetries: 1,
+			MaxRetries:    1,
+		}),
+		keyPrefix: redisConfig.KeyPrefix,
+		cacheTTL:  time.Duration(valueOrDefaultInt(redisConfig.CacheSeconds, 5)) * time.Second,
+	}
+	if s.keyPrefix == "" {
+		s.keyPrefix = "lightdns:"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err := s.client.Ping(ctx).Err()
+	if err != nil {
+		logWarn("Redis at", redisConfig.Address, "is unreachable, will keep retrying:", err)
+	}
+
+	if redisConfig.Subscribe {
+		go s.subscribe()
+	}
+
+	return s
+}
+
+func (s *RedisStore) namesKey() string              { return s.keyPrefix + "names" }
+func (s *RedisStore) entriesKey(name string) string { return s.keyPrefix + "entries:" + name }
+func (s *RedisStore) changesChannel() string        { return s.keyPrefix + "changes" }
+
+// subscribe drops the cache whenever any instance changes the dataset.
+func (s *RedisStore) subscribe() {
+	pubsub := s.client.Subscribe(context.Background(), s.changesChannel())
+	for range pubsub.Channel() {
+		s.invalidate()
+	}
+}
+
+func (s *RedisStore) invalidate() {
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+
+	s.cacheIsValid = false
+}
+
+// entryField is the hash field an entry is stored under.
+func entryField(entry NameModel) (string, error) {
+	_, resourceData, err := encodeResourceData(entry)
+	if err != nil {
+		return "", err
+	}
+	return recordTypeName(entry) + ":" + hex.EncodeToString(resourceData), nil
+}
+
+// All reads every entry, from the local cache while it is fresh. If Redis
+// can't be reached the last entries read are served instead of failing.
+func (s *RedisStore) All(ctx context.Context) ([]NameModel, error) {
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+
+	if s.cacheIsValid && time.Since(s.cachedAt) < s.cacheTTL {
+		return append([]NameModel(nil), s.cached...), nil
+	}
+
+	entries, err := s.readAll(ctx)
+	if err != nil {
+		if s.cached != nil {
+			logWarn("Error reading from Redis, serving cached entries:", err)
+			return append([]NameModel(nil), s.cached...), nil
+		}
+		return nil, err
+	}
+
+	s.cached = entries
+	s.cachedAt = time.Now()
+	s.cacheIsValid = true
+
+	return append([]NameModel(nil), entries...), nil
+}
+
+func (s *RedisStore) readAll(ctx context.Context) ([]NameModel, error) {
+	names, err := s.client.SMembers(ctx, s.namesKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	pipeline := s.client.Pipeline()
+	results := make([]*redis.MapStringStringCmd, len(names))
+	for i, name := range names {
+		results[i] = pipeline.HGetAll(ctx, s.entriesKey(name))
+	}
+	_, err = pipeline.Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]NameModel, 0)
+	for _, result := range results {
+		fields := result.Val()
+		keys := make([]string, 0, len(fields))
+		for key := range fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			var entry NameModel
+			err = json.Unmarshal([]byte(fields[key]), &entry)
+			if err != nil {
+				return nil, fmt.Errorf("%w: error decoding stored entry: %w", ErrMalformed, err)
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+func (s *RedisStore) Lookup(ctx context.Context, name string, recordType string) ([]NameModel, error) {
+	entries, err := s.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return lookupEntries(entries, name, recordType), nil
+}
+
+func (s *RedisStore) Put(ctx context.Context, entry NameModel, replace bool) error {
+	field, err := entryField(entry)
+	if err != nil {
+		return err
+	}
+	encodedEntry, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	name := canonicalTarget(entry.Name)
+	key := s.entriesKey(name)
+
+	if replace {
+		return s.Replace(ctx, name, recordTypeName(entry), []NameModel{entry})
+	}
+
+	// The same record stored again takes the new entry, e.g. a changed TTL
+	// or enabled flag
+	pipeline := s.client.TxPipeline()
+	pipeline.HSet(ctx, key, field, encodedEntry)
+	pipeline.SAdd(ctx, s.namesKey(), name)
+	_, err = pipeline.Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	return s.announceChange(ctx, name)
+}
+
+func (s *RedisStore) Delete(ctx context.Context, name string, recordType string) (int, error) {
+	key := s.entriesKey(name)
+
+	fields, err := s.typeFields(ctx, key, recordType)
+	if err != nil || len(fields) == 0 {
+		return 0, err
+	}
+
+	removed, err := s.client.HDel(ctx, key, fields...).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	// Drop the name from the set once its last entry is gone
+	remaining, err := s.client.HLen(ctx, key).Result()
+	if err == nil && remaining == 0 {
+		s.client.SRem(ctx, s.namesKey(), name)
+	}
+
+	return int(removed), s.announceChange(ctx, name)
+}
+
+// Replace deletes and sets the name's fields in one MULTI transaction.
+func (s *RedisStore) Replace(ctx context.Context, name string, recordType string, entries []NameModel) error {
+	key := s.entriesKey(name)
+
+	existing, err := s.typeFields(ctx, key, recordType)
+	if err != nil {
+		return err
+	}
+
+	pipeline := s.client.TxPipeline()
+	if len(existing) > 0 {
+		pipeline.HDel(ctx, key, existing...)
+	}
+	for _, entry := range entries {
+		field, err := entryField(entry)
+		if err != nil {
+			return err
+		}
+		encodedEntry, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		pipeline.HSet(ctx, key, field, encodedEntry)
+	}
+	pipeline.SAdd(ctx, s.namesKey(), name)
+	_, err = pipeline.Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Drop the name from the set once its last entry is gone
+	remaining, err := s.client.HLen(ctx, key).Result()
+	if err == nil && remaining == 0 {
+		s.client.SRem(ctx, s.namesKey(), name)
+	}
+
+	return s.announceChange(ctx, name)
+}
+
+// typeFields returns the hash fields holding entries of a type, or every
+// field for an empty type.
+func (s *RedisStore) typeFields(ctx context.Context, key string, recordType string) ([]string, error) {
+	fields, err := s.client.HKeys(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	matching := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if recordType == "" || strings.HasPrefix(field, recordType+":") {
+			matching = append(matching, field)
+		}
+	}
+	return matching, nil
+}
+
+// announceChange drops the local cache and tells other instances to do the same.
+func (s *RedisStore) announceChange(ctx context.Context, name string) error {
+	s.invalidate()
+	return s.client.Publish(ctx, s.changesChannel(), name).Err()
+}
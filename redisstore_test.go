@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// startRedisStore connects a store to a fresh in-process Redis server.
+func startRedisStore(t *testing.T, redisConfig RedisConfig) *RedisStore {
+	t.Helper()
+	server := miniredis.RunT(t)
+	redisConfig.Address = server.Addr()
+	s := NewRedisStore(redisConfig)
+	t.Cleanup(func() { s.client.Close() })
+	return s
+}
+
+func TestRedisChangesReachOtherInstances(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+
+	// A long cache, so only a change notification refreshes the reader
+	redisConfig := RedisConfig{Address: server.Addr(), CacheSeconds: 3600, Subscribe: true}
+	reader := NewRedisStore(redisConfig)
+	redisConfig.Subscribe = false
+	writer := NewRedisStore(redisConfig)
+	t.Cleanup(func() { writer.client.Close(); reader.client.Close() })
+
+	entries, err := reader.All(ctx)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("All = %d entries, %v, want an empty store", len(entries), err)
+	}
+
+	// Wait for the reader's subscription before announcing anything
+	deadline := time.Now().Add(2 * time.Second)
+	for server.PubSubNumSub(reader.changesChannel())[reader.changesChannel()] == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	err = writer.Put(ctx, NameModel{Name: "www.example.com", Address: "192.0.2.10"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for time.Now().Before(deadline) {
+		entries, err = reader.Lookup(ctx, "www.example.com", "A")
+		if err == nil && len(entries) == 1 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("the other instance still serves its cached entries after the change")
+}
+
+func TestRedisCachesReads(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	s := NewRedisStore(RedisConfig{Address: server.Addr(), CacheSeconds: 3600})
+	t.Cleanup(func() { s.client.Close() })
+
+	err := s.Put(ctx, NameModel{Name: "www.example.com", Address: "192.0.2.10"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a subscription a change made behind the store's back waits
+	// for the cache to expire
+	server.Del(s.entriesKey("www.example.com"))
+	server.SRem(s.namesKey(), "www.example.com")
+	entries, err := s.Lookup(ctx, "www.example.com", "A")
+	if err != nil || len(entries) != 1 {
+		t.Errorf("Lookup = %d entries, %v, want the cached entry", len(entries), err)
+	}
+}
+
+func TestRedisUnreachable(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	address := server.Addr()
+	server.Close()
+
+	// Starting without Redis isn't fatal, lookups just fail
+	s := NewRedisStore(RedisConfig{Address: address, CacheSeconds: 1})
+	t.Cleanup(func() { s.client.Close() })
+	_, err := s.Lookup(ctx, "www.example.com", "A")
+	if err == nil {
+		t.Fatal("Lookup succeeded without Redis")
+	}
+
+	// Once it is back, and then gone again, the last entries read are served
+	err = server.StartAddr(address)
+	if err != nil {
+		t.Skip("can't restart Redis on the same address:", err)
+	}
+	err = s.Put(ctx, NameModel{Name: "www.example.com", Address: "192.0.2.10"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	s.invalidate()
+
+	entries, err := s.Lookup(ctx, "www.example.com", "A")
+	if err != nil || len(entries) != 1 {
+		t.Errorf("Lookup while Redis is down = %d entries, %v, want the last entries read", len(entries), err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reloadLock serializes reloads. Readers never take it: they read the
+// config snapshot, which a reload replaces in one atomic swap.
+var reloadLock sync.Mutex
+
+// restartSettings can't be changed on a running server: they are bound to
+// open sockets, connections or keys loaded at startup.
+var restartSettings = []string{"dnsAddress", "httpAddress", "disableHTTP", "listeners", "storeBackend", "sqliteFile", "redis", "dnssec", "cookies", "distinctNamesWindowSeconds", "captureFile", "serialFile", "udpSocketReceiveBuffer", "udpSocketSendBuffer", "reusePort", "reusePortSockets"}
+
+// watchReloadSignal reloads the config whenever the process gets SIGHUP. The
+// command line is parsed again too, so flags keep overriding the file.
+func watchReloadSignal(args []string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			logInfo("Got SIGHUP, reloading", currentConfig().ConfigFile)
+			err := reloadConfig(args)
+			if err != nil {
+				logError("Error reloading config, keeping the current one:", err)
+			}
+		}
+	}()
+}
+
+// configChanges lists the json names of the top-level settings that differ
+// between two configs.
+func configChanges(oldConfig, newConfig Config) []string {
+	var changes []string
+
+	oldValue := reflect.ValueOf(oldConfig)
+	newValue := reflect.ValueOf(newConfig)
+	for i := 0; i < oldValue.NumField(); i++ {
+		name, _, _ := strings.Cut(oldValue.Type().Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			changes = append(changes, name)
+		}
+	}
+
+	return changes
+}
+
+// reloadConfig re-reads the config and applies every change that doesn't
+// need a restart. Everything is loaded before anything is swapped, so a
+// broken config leaves the server as it was.
+func reloadConfig(args []string) error {
+	newConfig, err := ParseConfig(args)
+	if err != nil {
+		return err
+	}
+
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	oldConfig := *currentConfig()
+
+	// The imported entries of the other backends only come from the store
+	// file when they start out empty
+	restartNeeded := restartSettings
+	backend := strings.ToLower(oldConfig.StoreBackend)
+	if backend == "sqlite" || backend == "redis" || backend == "static" {
+		restartNeeded = append(restartNeeded, "storeFile")
+	}
+
+	var applied, ignored []string
+	for _, change := range configChanges(oldConfig, newConfig) {
+		if slices.Contains(restartNeeded, change) {
+			ignored = append(ignored, change)
+		} else {
+			applied = append(applied, change)
+		}
+	}
+
+	// Settings that need a restart keep their running values
+	for _, setting := range ignored {
+		field := configField(setting)
+		reflect.ValueOf(&newConfig).Elem().FieldByName(field).Set(reflect.ValueOf(oldConfig).FieldByName(field))
+	}
+
+	_, err = parseLogLevel(newConfig.LogLevel)
+	if err != nil {
+		return err
+	}
+
+	err = LoadRuntime(&newConfig)
+	if err != nil {
+		return err
+	}
+
+	// A new store is seeded before it is swapped in, so queries never see
+	// it empty
+	newConfig.store = oldConfig.store
+	storeChanged := newConfig.StoreFile != oldConfig.StoreFile
+	var loadErr error
+	if storeChanged {
+		newConfig.store, err = NewStore(newConfig)
+		if err != nil {
+			return err
+		}
+		loadErr = LoadFromFile(&newConfig)
+	}
+
+	oldSerials := currentSerials(oldConfig.Zones)
+
+	configSnapshot.Store(&newConfig)
+	SetLogLevel(newConfig.LogLevel)
+	if storeChanged {
+		serverReady.Store(loadErr == nil)
+	}
+	// Applied changes may change any zone's answers
+	if len(applied) > 0 {
+		for i := range newConfig.Zones {
+			newConfig.Zones[i].BumpSerial(time.Now())
+		}
+	}
+
+	notifySerialChanges(oldSerials, newConfig.Zones)
+
+	if loadErr != nil {
+		logError("Error loading from file:", loadErr)
+	}
+	if len(applied) == 0 && len(ignored) == 0 {
+		logInfo("Config reloaded, nothing changed")
+	}
+	if len(applied) > 0 {
+		logInfo("Config reloaded, applied changes to:", strings.Join(applied, ", "))
+	}
+	if len(ignored) > 0 {
+		logWarn("Changes to", strings.Join(ignored, ", "), "require a restart and were not applied")
+	}
+
+	return nil
+}
+
+// configField returns the Go name of the Config field with the json name.
+func configField(jsonName string) string {
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		name, _, _ := strings.Cut(configType.Field(i).Tag.Get("json"), ",")
+		if name == jsonName {
+			return configType.Field(i).Name
+		}
+	}
+	return ""
+}
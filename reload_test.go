@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSIGHUPAppliesChangedACL(t *testing.T) {
+	path := writeConfigFile(t, `{"zones": [{"name": "example.com"}]}`)
+	args := []string{"-config", path}
+	cfg, err := ParseConfig(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, cfg, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+	logged := captureLog(t)
+
+	if response := query(t, "www.example.com", TypeA); len(response.Answers) != 1 {
+		t.Fatalf("got %d answers before the reload, want 1", len(response.Answers))
+	}
+
+	err = os.WriteFile(path, []byte(`{"dnsAddress": ":5399", "zones": [{"name": "example.com", "allowQuery": ["10.0.0.0/8"]}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchReloadSignal(args)
+	// A watcher left behind would reload this test's config file once
+	// it's gone
+	t.Cleanup(func() { signal.Reset(syscall.SIGHUP) })
+	err = syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(currentConfig().Zones[0].AllowQuery) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// The reload holds the lock until it has logged what changed
+	reloadLock.Lock()
+	reloadLock.Unlock()
+
+	if response := query(t, "www.example.com", TypeA); responseCode(response) != RcodeRefused {
+		t.Errorf("rcode %d after the reload, want REFUSED by the new ACL", responseCode(response))
+	}
+	if response := serve(t, newWriter("10.1.2.3", true), buildQuery(1, 0, "www.example.com", TypeA)); len(response.Answers) != 1 {
+		t.Error("a client inside the new ACL wasn't answered")
+	}
+
+	// Listen addresses only change on a restart, and the store is kept
+	if currentConfig().DNSAddress != cfg.DNSAddress {
+		t.Errorf("dnsAddress was changed to %q without a restart", currentConfig().DNSAddress)
+	}
+	if !strings.Contains(logged.String(), "Changes to dnsAddress") {
+		t.Errorf("the ignored change wasn't logged:\n%s", logged)
+	}
+}
+
+func TestQueriesSeeOneWholeStoreDuringReloads(t *testing.T) {
+	stores := []string{
+		writeStoreFile(t, NameModel{Name: "www.example.com", Address: "192.0.2.1"}, NameModel{Name: "www.example.com", Address: "192.0.2.2"}),
+		writeStoreFile(t, NameModel{Name: "www.example.com", Address: "192.0.2.3"}, NameModel{Name: "www.example.com", Address: "192.0.2.4"}),
+	}
+	configFile := func(store string) string {
+		return `{"storeFile": "` + store + `", "zones": [{"name": "example.com"}]}`
+	}
+	path := writeConfigFile(t, configFile(stores[0]))
+	args := []string{"-config", path}
+	cfg, err := ParseConfig(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := useConfig(t, cfg)
+	loaded.store = &FileStore{Path: stores[0]}
+
+	done := make(chan struct{})
+	failures := make(chan string, 1)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				w := newWriter("192.0.2.1", false)
+				handleDNSClient(context.Background(), buildQuery(1, 0, "www.example.com", TypeA), w)
+				response, err := parseResponse(w.responses[0])
+				var addresses []string
+				for _, answer := range response.Answers {
+					addresses = append(addresses, net.IP(answer.ResourceData).String())
+				}
+				slices.Sort(addresses)
+				got := strings.Join(addresses, ",")
+				if err != nil || got != "192.0.2.1,192.0.2.2" && got != "192.0.2.3,192.0.2.4" {
+					select {
+					case failures <- got:
+					default:
+					}
+				}
+			}
+		}()
+	}
+
+	for i := 1; i <= 20; i++ {
+		err = os.WriteFile(path, []byte(configFile(stores[i%2])), 0644)
+		if err == nil {
+			err = reloadConfig(args)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	select {
+	case got := <-failures:
+		t.Errorf("a query during a reload was answered with %q, a mix or neither store", got)
+	default:
+	}
+}
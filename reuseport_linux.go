@@ -0,0 +1,21 @@
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reusePortControl sets SO_REUSEPORT on a socket before it is bound, so
+// several sockets can share a port and the kernel spreads packets across
+// them.
+func reusePortControl(network string, address string, rawConn syscall.RawConn) error {
+	var sockoptErr error
+	err := rawConn.Control(func(fd uintptr) {
+		sockoptErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockoptErr
+}
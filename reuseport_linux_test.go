@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReusePortSocketsShareTraffic(t *testing.T) {
+	probe, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := probe.LocalAddr().String()
+	probe.Close()
+
+	cfg := DefaultConfig()
+	cfg.ReusePort = true
+	cfg.ReusePortSockets = 2
+	useConfig(t, cfg)
+
+	serverConns, err := listenUDP("udp4", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serverConns) != 2 {
+		t.Fatalf("opened %d sockets, want 2", len(serverConns))
+	}
+
+	var received [2]atomic.Int32
+	for i, serverConn := range serverConns {
+		defer serverConn.Close()
+		i, serverConn := i, serverConn
+		go func() {
+			buffer := make([]byte, 512)
+			for {
+				_, _, err := serverConn.ReadFromUDP(buffer)
+				if err != nil {
+					return
+				}
+				received[i].Add(1)
+			}
+		}()
+	}
+
+	// The kernel picks a socket by hashing the client's address, so send
+	// from many client ports
+	for i := 0; i < 64; i++ {
+		client, err := net.Dial("udp4", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Write([]byte("ping"))
+		client.Close()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for received[0].Load()+received[1].Load() < 64 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if received[0].Load() == 0 || received[1].Load() == 0 {
+		t.Errorf("the sockets received %d and %d packets, want both to get some", received[0].Load(), received[1].Load())
+	}
+}
+
+func TestReusePortListenersAnswer(t *testing.T) {
+	probe, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := probe.LocalAddr().String()
+	probe.Close()
+
+	cfg := DefaultConfig()
+	cfg.ReusePort = true
+	cfg.ReusePortSockets = 3
+	useConfig(t, cfg, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+	err = StartListeners([]ListenerConfig{{Network: "udp4", Address: address}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		response, err := Client{}.Exchange(context.Background(), buildQuery(uint16(i), 0, "www.example.com", TypeA), address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if answerAddress(response) != "192.0.2.10" {
+			t.Errorf("query %d answered %+v", i, response.Answers)
+		}
+	}
+}
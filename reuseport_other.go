@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// reusePortControl fails outside Linux, where SO_REUSEPORT doesn't spread
+// packets across the sockets sharing a port.
+func reusePortControl(network string, address string, rawConn syscall.RawConn) error {
+	return fmt.Errorf("reusePort is only supported on Linux")
+}
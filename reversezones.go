@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ReverseZoneConfig synthesizes PTR answers for every address in Network
+// from a naming template. {last-octet} is replaced by the last byte of the
+// address and {ip} by the whole address with dashes for separators, so
+// "host-{ip}.example.com" answers 10.0.0.5 with host-10-0-0-5.example.com.
+type ReverseZoneConfig struct {
+	Network  string `json:"network"`
+	Template string `json:"template"`
+}
+
+type reverseZone struct {
+	network  *net.IPNet
+	template string
+}
+
+// LoadReverseZones parses the reverse zone networks.
+func LoadReverseZones(reverseZoneConfigs []ReverseZoneConfig) ([]reverseZone, error) {
+	loaded := make([]reverseZone, 0, len(reverseZoneConfigs))
+
+	for _, reverseZoneConfig := range reverseZoneConfigs {
+		_, ipNet, err := net.ParseCIDR(reverseZoneConfig.Network)
+		if err != nil {
+			return nil, fmt.Errorf("reverse zone: invalid network %q", reverseZoneConfig.Network)
+		}
+		if reverseZoneConfig.Template == "" {
+			return nil, fmt.Errorf("reverse zone %s has no template", reverseZoneConfig.Network)
+		}
+		loaded = append(loaded, reverseZone{network: ipNet, template: reverseZoneConfig.Template})
+	}
+
+	return loaded, nil
+}
+
+// parseReverseName returns the address an in-addr.arpa or ip6.arpa name
+// stands for, or nil when the name isn't a complete reverse name.
+func parseReverseName(name string) net.IP {
+	if labels, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		octets := strings.Split(labels, ".")
+		if len(octets) != net.IPv4len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, octet := range octets {
+			value, err := strconv.ParseUint(octet, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[net.IPv4len-1-i] = byte(value)
+		}
+		return ip
+	}
+
+	if labels, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		nibbles := strings.Split(labels, ".")
+		if len(nibbles) != net.IPv6len*2 {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, nibble := range nibbles {
+			value, err := strconv.ParseUint(nibble, 16, 4)
+			if err != nil || len(nibble) != 1 {
+				return nil
+			}
+			position := len(nibbles) - 1 - i
+			ip[position/2] |= byte(value) << (4 * (1 - position%2))
+		}
+		return ip
+	}
+
+	return nil
+}
+
+// synthesizePTR builds the PTR answer for a reverse name inside a configured
+// reverse zone.
+func synthesizePTR(queryName string) (DNSResourceRecord, bool) {
+	ip := parseReverseName(queryName)
+	if ip == nil {
+		return DNSResourceRecord{}, false
+	}
+
+	for _, zone := range currentConfig().reverseZones {
+		if !zone.network.Contains(ip) {
+			continue
+		}
+
+		address := ip.String()
+		if ipv4 := ip.To4(); ipv4 != nil {
+			ip = ipv4
+		}
+		target := strings.ReplaceAll(zone.template, "{last-octet}", strconv.Itoa(int(ip[len(ip)-1])))
+		target = strings.ReplaceAll(target, "{ip}", strings.NewReplacer(".", "-", ":", "-").Replace(address))
+
+		var buffer bytes.Buffer
+		err := writeDomainName(&buffer, canonicalTarget(target))
+		if err != nil {
+			logWarn("Error synthesizing PTR for", queryName, ":", err)
+			return DNSResourceRecord{}, false
+		}
+
+		return DNSResourceRecord{
+			DomainName:         queryName,
+			Type:               TypePTR,
+			Class:              ClassINET,
+			TimeToLive:         findZone(queryName).TTL(),
+			ResourceData:       buffer.Bytes(),
+			ResourceDataLength: uint16(buffer.Len()),
+		}, true
+	}
+
+	return DNSResourceRecord{}, false
+}
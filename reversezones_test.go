@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestParseReverseName(t *testing.T) {
+	tests := map[string]string{
+		"5.2.0.192.in-addr.arpa": "192.0.2.5",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa": "2001:db8::1",
+		"2.0.192.in-addr.arpa":     "<nil>",
+		"256.2.0.192.in-addr.arpa": "<nil>",
+		"10.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa": "<nil>",
+		"www.example.com": "<nil>",
+	}
+	for name, want := range tests {
+		if got := parseReverseName(name).String(); got != want {
+			t.Errorf("parseReverseName(%q) = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestSynthesizedPTRAnswers(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "2.0.192.in-addr.arpa", DefaultTTL: 600}, {Name: "ip6.arpa"}}
+	cfg.ReverseZones = []ReverseZoneConfig{
+		{Network: "192.0.2.0/24", Template: "host-{last-octet}.example.com"},
+		{Network: "2001:db8::/64", Template: "v6-{ip}.example.com"},
+	}
+	useConfig(t, cfg)
+
+	tests := map[string]string{
+		"5.2.0.192.in-addr.arpa":   "host-5.example.com.",
+		"255.2.0.192.IN-ADDR.ARPA": "host-255.example.com.",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa": "v6-2001-db8--1.example.com.",
+	}
+	for name, want := range tests {
+		response := query(t, name, TypePTR)
+		if len(response.Answers) != 1 || formatWireResourceData(response.Answers[0]) != want {
+			t.Errorf("%s: answers %+v, want PTR %s", name, response.Answers, want)
+		}
+	}
+	if response := query(t, "5.2.0.192.in-addr.arpa", TypePTR); response.Answers[0].TimeToLive != 600 {
+		t.Errorf("synthesized PTR TTL = %d, want the zone's 600", response.Answers[0].TimeToLive)
+	}
+
+	// Addresses outside every reverse zone get no answer
+	response := query(t, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.2.0.0.2.ip6.arpa", TypePTR)
+	if len(response.Answers) != 0 {
+		t.Errorf("an address outside the reverse zones was answered: %+v", response.Answers)
+	}
+
+	_, err := LoadReverseZones([]ReverseZoneConfig{{Network: "192.0.2.0/33", Template: "x"}})
+	if err == nil {
+		t.Error("an invalid network was accepted")
+	}
+	_, err = LoadReverseZones([]ReverseZoneConfig{{Network: "192.0.2.0/24"}})
+	if err == nil {
+		t.Error("a reverse zone without a template was accepted")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RRLConfig configures response rate limiting, which keeps the server from
+// being used to flood a spoofed victim. UDP responses are accounted per
+// client subnet and response signature: the query name and type for
+// answers, the zone for NXDOMAIN and NODATA, and the rcode for errors. Above
+// ResponsesPerSecond identical responses to a subnet, every Slip-th one is
+// sent as an empty truncated response so real clients retry over TCP, and
+// the rest are dropped. A Slip of 1 truncates them all, and a negative Slip
+// drops them all. TCP responses are never limited. 0 disables the limit.
+type RRLConfig struct {
+	ResponsesPerSecond int `json:"responsesPerSecond"`
+	Slip               int `json:"slip"`
+
+	// Clients are grouped by these prefix lengths, defaulting to /24 and /56
+	IPv4PrefixLength int `json:"ipv4PrefixLength"`
+	IPv6PrefixLength int `json:"ipv6PrefixLength"`
+}
+
+// What to do with a rate limited response
+const (
+	rrlSend = iota
+	rrlSlip
+	rrlDrop
+)
+
+type responseRate struct {
+	tokens   float64
+	lastSeen time.Time
+	limited  int
+}
+
+// responseRateLimiter keeps a token bucket per signature holding up to one
+// second of responses. A bucket idle for a second is full again, the same as
+// no bucket, so buckets are swept once they have been idle that long and the
+// table only holds the signatures of the last second.
+type responseRateLimiter struct {
+	sync.Mutex
+	rates     map[string]*responseRate
+	lastSweep time.Time
+}
+
+var responseRateLimit = responseRateLimiter{rates: make(map[string]*responseRate)}
+
+// Responses slipped and dropped by rate limiting
+var (
+	rrlSlippedTotal atomic.Uint64
+	rrlDroppedTotal atomic.Uint64
+)
+
+// Check accounts a response with the given signature to the client and
+// returns whether to send it, slip it or drop it.
+func (l *responseRateLimiter) Check(clientIP net.IP, signature string, now time.Time) int {
+	settings := currentConfig().RRL
+	if settings.ResponsesPerSecond <= 0 || clientIP == nil {
+		return rrlSend
+	}
+	key := rrlClientSubnet(clientIP, settings) + "|" + signature
+	limit := float64(settings.ResponsesPerSecond)
+
+	l.Lock()
+	defer l.Unlock()
+
+	if now.Sub(l.lastSweep) >= time.Second {
+		for rateKey, rate := range l.rates {
+			if now.Sub(rate.lastSeen) >= time.Second {
+				delete(l.rates, rateKey)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	rate := l.rates[key]
+	if rate == nil {
+		rate = &responseRate{tokens: limit, lastSeen: now}
+		l.rates[key] = rate
+	}
+	rate.tokens = min(limit, rate.tokens+now.Sub(rate.lastSeen).Seconds()*limit)
+	rate.lastSeen = now
+
+	if rate.tokens >= 1 {
+		rate.tokens--
+		return rrlSend
+	}
+
+	slip := settings.Slip
+	if slip == 0 {
+		slip = 2
+	}
+	rate.limited++
+	if slip > 0 && rate.limited%slip == 0 {
+		rrlSlippedTotal.Add(1)
+		return rrlSlip
+	}
+	rrlDroppedTotal.Add(1)
+	return rrlDrop
+}
+
+// rrlClientSubnet returns the client's subnet in the configured prefix
+// length.
+func rrlClientSubnet(clientIP net.IP, settings RRLConfig) string {
+	if ipv4 := clientIP.To4(); ipv4 != nil {
+		prefixLength := valueOrDefaultInt(settings.IPv4PrefixLength, 24)
+		return ipv4.Mask(net.CIDRMask(min(prefixLength, 32), 32)).String() + "/" + strconv.Itoa(prefixLength)
+	}
+	prefixLength := valueOrDefaultInt(settings.IPv6PrefixLength, 56)
+	return clientIP.Mask(net.CIDRMask(min(prefixLength, 128), 128)).String() + "/" + strconv.Itoa(prefixLength)
+}
+
+// rrlSignature classifies a response for rate limiting. Misses are grouped
+// by zone, so a flood of random names under one zone shares one bucket.
+func rrlSignature(queryResourceRecords []DNSResourceRecord, rcode uint16, numAnswers int) string {
+	if len(queryResourceRecords) == 0 || (rcode != RcodeNoError && rcode != RcodeNameError) {
+		return "error|" + strconv.Itoa(int(rcode))
+	}
+
+	question := queryResourceRecords[0]
+	queryName := canonicalTarget(question.DomainName)
+	if rcode == RcodeNoError && numAnswers > 0 {
+		return "answer|" + queryName + "|" + strconv.Itoa(int(question.Type))
+	}
+
+	kind := "nodata|"
+	if rcode == RcodeNameError {
+		kind = "nxdomain|"
+	}
+	if zone := findZone(queryName); zone != nil {
+		return kind + canonicalTarget(zone.Name)
+	}
+	return kind + queryName
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// rrlConfig limits responses as given, with a fresh limiter.
+func rrlConfig(t *testing.T, settings RRLConfig, entries ...NameModel) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	cfg.RRL = settings
+	useConfig(t, cfg, entries...)
+
+	previous := responseRateLimit.rates
+	responseRateLimit.rates = make(map[string]*responseRate)
+	t.Cleanup(func() { responseRateLimit.rates = previous })
+}
+
+func TestRRLSlipsAndDropsOverThreshold(t *testing.T) {
+	rrlConfig(t, RRLConfig{ResponsesPerSecond: 3, Slip: 2}, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+	slippedBefore, droppedBefore := rrlSlippedTotal.Load(), rrlDroppedTotal.Load()
+
+	var sent, slipped, dropped int
+	for i := 0; i < 9; i++ {
+		w := newWriter("203.0.113.5", true)
+		handleDNSClient(context.Background(), buildQuery(uint16(i), 0, "www.example.com", TypeA), w)
+		if len(w.responses) == 0 {
+			dropped++
+			continue
+		}
+		response, err := parseResponse(w.responses[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case response.Header.Flags&FlagTruncated != 0 && len(response.Answers) == 0:
+			slipped++
+		case len(response.Answers) == 1:
+			sent++
+		default:
+			t.Fatalf("response %d: flags %#x with %d answers", i, response.Header.Flags, len(response.Answers))
+		}
+	}
+
+	// A burst this short gets no new tokens: three answers, then every
+	// second limited response slips
+	if sent != 3 || slipped != 3 || dropped != 3 {
+		t.Errorf("sent %d, slipped %d, dropped %d; want 3 of each", sent, slipped, dropped)
+	}
+	if rrlSlippedTotal.Load()-slippedBefore != 3 || rrlDroppedTotal.Load()-droppedBefore != 3 {
+		t.Error("the slipped and dropped counters don't match")
+	}
+
+	// TCP is never limited, and other subnets have their own buckets
+	if response := serve(t, newWriter("203.0.113.5", false), buildQuery(20, 0, "www.example.com", TypeA)); len(response.Answers) != 1 {
+		t.Error("a TCP response was rate limited")
+	}
+	if response := serve(t, newWriter("198.51.100.5", true), buildQuery(21, 0, "www.example.com", TypeA)); len(response.Answers) != 1 {
+		t.Error("a client in another subnet was rate limited")
+	}
+}
+
+func TestRRLTokenAccounting(t *testing.T) {
+	rrlConfig(t, RRLConfig{ResponsesPerSecond: 2, Slip: -1, IPv4PrefixLength: 16})
+	now := time.Now()
+	client := net.ParseIP("203.0.113.5")
+	neighbour := net.ParseIP("203.0.1.9")
+
+	checks := []struct {
+		clientIP  net.IP
+		signature string
+		at        time.Duration
+		want      int
+	}{
+		{client, "answer|www.example.com|1", 0, rrlSend},
+		{neighbour, "answer|www.example.com|1", 0, rrlSend},
+		{client, "answer|www.example.com|1", 0, rrlDrop},
+		{client, "nxdomain|example.com", 0, rrlSend},
+		{client, "answer|www.example.com|1", 500 * time.Millisecond, rrlSend},
+		{client, "answer|www.example.com|1", 500 * time.Millisecond, rrlDrop},
+		{client, "answer|www.example.com|1", 2 * time.Second, rrlSend},
+		{client, "answer|www.example.com|1", 2 * time.Second, rrlSend},
+		{client, "answer|www.example.com|1", 2 * time.Second, rrlDrop},
+	}
+	for i, check := range checks {
+		if got := responseRateLimit.Check(check.clientIP, check.signature, now.Add(check.at)); got != check.want {
+			t.Errorf("check %d: %d, want %d", i, got, check.want)
+		}
+	}
+}
+
+func TestRRLSignatures(t *testing.T) {
+	rrlConfig(t, RRLConfig{})
+	question := func(name string) []DNSResourceRecord {
+		return []DNSResourceRecord{{DomainName: name, Type: TypeA, Class: ClassINET}}
+	}
+
+	tests := []struct {
+		name       string
+		rcode      uint16
+		numAnswers int
+		want       string
+	}{
+		{"WWW.example.com.", RcodeNoError, 1, "answer|www.example.com|1"},
+		{"random1.example.com", RcodeNameError, 0, "nxdomain|example.com"},
+		{"random2.example.com", RcodeNameError, 0, "nxdomain|example.com"},
+		{"www.example.com", RcodeNoError, 0, "nodata|example.com"},
+		{"www.example.org", RcodeNameError, 0, "nxdomain|www.example.org"},
+		{"www.example.com", RcodeRefused, 0, "error|5"},
+	}
+	for _, test := range tests {
+		if got := rrlSignature(question(test.name), test.rcode, test.numAnswers); got != test.want {
+			t.Errorf("signature of %s rcode %d = %q, want %q", test.name, test.rcode, got, test.want)
+		}
+	}
+
+	if got := responseRateLimit.Check(net.ParseIP("203.0.113.5"), "answer|www.example.com|1", time.Now()); got != rrlSend {
+		t.Error("responses were limited with rate limiting disabled")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// zoneSerials holds the serials zones were bumped to, by zone name, and is
+// kept in the serial file so it survives restarts. A zone's serial is the
+// larger of this and its configured serial, so it never goes backwards when
+// the config is reloaded or the server restarted.
+var zoneSerials = struct {
+	sync.Mutex
+	serials map[string]uint32
+}{serials: make(map[string]uint32)}
+
+// CurrentSerial returns the serial the zone's SOA carries.
+func (zone *ZoneConfig) CurrentSerial() uint32 {
+	zoneSerials.Lock()
+	defer zoneSerials.Unlock()
+	return max(valueOr(zone.Serial, 1), zoneSerials.serials[canonicalTarget(zone.Name)])
+}
+
+// BumpSerial increments the zone's serial. With the "date" serial format the
+// serial follows the YYYYMMDDnn convention, jumping to today's first serial
+// when the previous one is from an earlier day.
+func (zone *ZoneConfig) BumpSerial(now time.Time) uint32 {
+	serial := zone.CurrentSerial() + 1
+	if zone.SerialFormat == "date" {
+		today, _ := strconv.ParseUint(now.UTC().Format("20060102"), 10, 32)
+		serial = max(serial, uint32(today)*100)
+	}
+
+	zoneSerials.Lock()
+	zoneSerials.serials[canonicalTarget(zone.Name)] = serial
+	err := saveSerials(currentConfig().SerialFile)
+	zoneSerials.Unlock()
+	if err != nil {
+		logWarn("Error saving zone serials:", err)
+	}
+
+	return serial
+}
+
+// loadSerials reads the serials saved by an earlier run. A missing file, as
+// on the first run, is not an error.
+func loadSerials(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: error reading serial file: %w", ErrIO, err)
+	}
+
+	var serials map[string]uint32
+	err = json.Unmarshal(data, &serials)
+	if err != nil {
+		return fmt.Errorf("%w: error parsing serial file %s: %v", ErrMalformed, path, err)
+	}
+
+	zoneSerials.Lock()
+	defer zoneSerials.Unlock()
+	for name, serial := range serials {
+		name = canonicalTarget(name)
+		zoneSerials.serials[name] = max(zoneSerials.serials[name], serial)
+	}
+	return nil
+}
+
+// saveSerials writes the bumped serials to the serial file, through a temp
+// file renamed over it like the store file. The caller holds zoneSerials.
+func saveSerials(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(zoneSerials.serials, "", "    ")
+	if err != nil {
+		return fmt.Errorf("error marshalling serials: %v", err)
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(path), ".serials-*.json.tmp")
+	if err != nil {
+		return fmt.Errorf("%w: error creating temp file: %w", ErrIO, err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("%w: error writing temp file: %w", ErrIO, err)
+	}
+
+	err = os.Rename(tempFile.Name(), path)
+	if err != nil {
+		return fmt.Errorf("%w: error replacing serial file: %w", ErrIO, err)
+	}
+
+	return nil
+}
+
+// zoneChanged bumps the serial of the zone holding a changed name and tells
+// its secondaries. Names outside every zone have no serial to bump.
+func zoneChanged(name string) {
+	zone := findZone(name)
+	if zone == nil {
+		return
+	}
+	serial := zone.BumpSerial(time.Now())
+	logDebug("Zone", canonicalTarget(zone.Name), "serial is now", serial)
+	go sendNotify(*zone)
+}
+
+// currentSerials returns the serial of every zone by name.
+func currentSerials(zones []ZoneConfig) map[string]uint32 {
+	serials := make(map[string]uint32)
+	for i := range zones {
+		serials[canonicalTarget(zones[i].Name)] = zones[i].CurrentSerial()
+	}
+	return serials
+}
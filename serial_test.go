@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// restartSerials forgets the serials bumped in memory, as a restart does.
+func restartSerials() {
+	zoneSerials.Lock()
+	zoneSerials.serials = make(map[string]uint32)
+	zoneSerials.Unlock()
+}
+
+func TestSerialSurvivesRestart(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "serial.example", Serial: 10}}
+	cfg = *useConfig(t, cfg)
+	t.Cleanup(func() { restartSerials() })
+
+	zone := exactZone("serial.example")
+	zone.BumpSerial(time.Now())
+	bumped := zone.BumpSerial(time.Now())
+	if bumped != 12 {
+		t.Fatalf("serial after two bumps = %d, want 12", bumped)
+	}
+
+	restartSerials()
+	if zone.CurrentSerial() != 10 {
+		t.Fatalf("serial with nothing loaded = %d, want the configured 10", zone.CurrentSerial())
+	}
+	err := loadSerials(cfg.SerialFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zone.CurrentSerial() != bumped {
+		t.Errorf("serial after a restart = %d, want %d", zone.CurrentSerial(), bumped)
+	}
+	if zone.BumpSerial(time.Now()) != bumped+1 {
+		t.Errorf("the serial didn't keep counting from %d", bumped)
+	}
+}
+
+func TestLoadSerialsWithoutFile(t *testing.T) {
+	err := loadSerials(t.TempDir() + "/missing.json")
+	if err != nil {
+		t.Errorf("loadSerials of a missing file = %v, want nil", err)
+	}
+}
+
+func TestDateSerial(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "date.example", SerialFormat: "date", Serial: 2024010105}}
+	useConfig(t, cfg)
+	t.Cleanup(func() { restartSerials() })
+
+	zone := exactZone("date.example")
+	sameDay := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	if serial := zone.BumpSerial(sameDay); serial != 2024010106 {
+		t.Errorf("same-day bump = %d, want 2024010106", serial)
+	}
+	nextDay := sameDay.Add(24 * time.Hour)
+	if serial := zone.BumpSerial(nextDay); serial != 2024010200 {
+		t.Errorf("next-day bump = %d, want 2024010200", serial)
+	}
+}
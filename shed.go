@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// udpQueriesQueued counts the UDP queries read but not yet answered. Each
+// gets its own goroutine, so under overload this is the server's queue.
+var udpQueriesQueued atomic.Int64
+
+// Queries answered with SERVFAIL because the queue was full
+var shedQueriesTotal atomic.Uint64
+
+// shouldShed reports whether the queue is past the high-water mark.
+func shouldShed(highWaterMark int) bool {
+	return highWaterMark > 0 && udpQueriesQueued.Load() >= int64(highWaterMark)
+}
+
+// shedResponse builds a SERVFAIL for a query without decoding it, echoing
+// its header and question. The question is only echoed when the query has
+// exactly one, uncompressed as queries send it. Returns nil for messages
+// that aren't worth answering, such as responses and runts.
+func shedResponse(requestBytes []byte) []byte {
+	if len(requestBytes) < DNSHeaderSizeBytes {
+		return nil
+	}
+	flags := binary.BigEndian.Uint16(requestBytes[2:4])
+	if flags&FlagResponse != 0 {
+		return nil
+	}
+
+	responseEnd := DNSHeaderSizeBytes
+	if binary.BigEndian.Uint16(requestBytes[4:6]) == 1 {
+		offset := DNSHeaderSizeBytes
+		for offset < len(requestBytes) && requestBytes[offset] != 0 && requestBytes[offset]&0xc0 == 0 {
+			offset += int(requestBytes[offset]) + 1
+		}
+		// The root label ends the name, followed by the type and class
+		if offset < len(requestBytes) && requestBytes[offset] == 0 && offset+5 <= len(requestBytes) {
+			responseEnd = offset + 5
+		}
+	}
+
+	response := append([]byte(nil), requestBytes[:responseEnd]...)
+	responseFlags := FlagResponse | flags&(0x0f<<11) | flags&FlagRecursionDesired | RcodeServerFailure
+	binary.BigEndian.PutUint16(response[2:4], responseFlags)
+	if responseEnd == DNSHeaderSizeBytes {
+		binary.BigEndian.PutUint16(response[4:6], 0)
+	}
+	binary.BigEndian.PutUint16(response[6:8], 0)
+	binary.BigEndian.PutUint16(response[8:10], 0)
+	binary.BigEndian.PutUint16(response[10:12], 0)
+
+	return response
+}
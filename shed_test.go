@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFullQueueShedsWithSERVFAIL(t *testing.T) {
+	held, release := heldUpstream(t, nil)
+	cfg := DefaultConfig()
+	cfg.UDPQueueHighWaterMark = 2
+	cfg.QueryTimeoutMillis = 500
+	useForwarding(t, cfg, held.address)
+	address := startUDPListener(t)
+	shedBefore := metricValue(t, "lightdns_shed_queries_total")
+
+	// Queries to a held upstream stay queued until they time out
+	clients := make([]net.Conn, 2)
+	t.Cleanup(func() {
+		release()
+		for i := range clients {
+			awaitForward(fmt.Sprintf("queued%d.example.net", i), TypeA)
+		}
+	})
+	for i := range clients {
+		client, err := net.Dial("udp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.Write(buildQuery(uint16(i), FlagRecursionDesired, fmt.Sprintf("queued%d.example.net", i), TypeA))
+		clients[i] = client
+	}
+	deadline := time.Now().Add(time.Second)
+	for udpQueriesQueued.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if udpQueriesQueued.Load() < 2 {
+		t.Fatalf("%d queries queued, want the queue filled", udpQueriesQueued.Load())
+	}
+
+	started := time.Now()
+	responseBytes, err := exchange(context.Background(), address, buildQuery(9, FlagRecursionDesired, "shed.example.net", TypeA), false, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed > 250*time.Millisecond {
+		t.Errorf("the shed query took %v, want an immediate answer", elapsed)
+	}
+	response, err := parseResponse(responseBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responseCode(response) != RcodeServerFailure || response.Header.TransactionID != 9 {
+		t.Errorf("rcode %d for ID %d, want SERVFAIL for 9", responseCode(response), response.Header.TransactionID)
+	}
+	if len(response.Questions) != 1 || response.Questions[0].DomainName != "shed.example.net" {
+		t.Errorf("echoed questions %+v", response.Questions)
+	}
+	if shed := metricValue(t, "lightdns_shed_queries_total") - shedBefore; shed != 1 {
+		t.Errorf("lightdns_shed_queries_total went up by %v, want 1", shed)
+	}
+
+	// The queued queries are still answered once they give up
+	for i, client := range clients {
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buffer := make([]byte, 512)
+		n, err := client.Read(buffer)
+		if err != nil {
+			t.Fatalf("queued query %d got no answer: %v", i, err)
+		}
+		queued, _ := parseResponse(buffer[:n])
+		if responseCode(queued) != RcodeServerFailure {
+			t.Errorf("queued query %d: rcode %d, want SERVFAIL after its timeout", i, responseCode(queued))
+		}
+	}
+}
+
+func TestShedResponse(t *testing.T) {
+	request := buildQuery(0x4242, FlagRecursionDesired, "www.example.com", TypeA)
+	response, err := parseResponse(shedResponse(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Header.TransactionID != 0x4242 || response.Header.Flags != FlagResponse|FlagRecursionDesired|RcodeServerFailure {
+		t.Errorf("header %+v, want the ID and RD echoed with SERVFAIL", response.Header)
+	}
+	if len(response.Questions) != 1 || response.Questions[0].DomainName != "www.example.com" {
+		t.Errorf("questions %+v, want the question echoed", response.Questions)
+	}
+
+	// A name that can't be walked cheaply isn't echoed
+	compressed := append(bytes.Clone(request[:DNSHeaderSizeBytes]), 0xc0, 0x0c, 0, 1, 0, 1)
+	response, err = parseResponse(shedResponse(compressed))
+	if err != nil || len(response.Questions) != 0 {
+		t.Errorf("compressed question: questions %+v (%v), want none", response.Questions, err)
+	}
+
+	answered := bytes.Clone(request)
+	answered[2] |= 0x80
+	for name, message := range map[string][]byte{"response": answered, "runt": request[:5]} {
+		if shedResponse(message) != nil {
+			t.Errorf("a %s was answered", name)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// serverContext is cancelled when the server shuts down, aborting the
+// queries still being answered, such as ones waiting on an upstream.
+var serverContext, stopServer = context.WithCancel(context.Background())
+
+// queriesInFlight counts the queries being answered, so shutdown can wait
+// for them to be sent their SERVFAIL.
+var queriesInFlight atomic.Int64
+
+// serveQuery answers one query with a context cancelled on shutdown and
+// carrying the query's deadline.
+func serveQuery(requestBytes []byte, responseWriter DNSResponseWriter) {
+	queriesInFlight.Add(1)
+	defer queriesInFlight.Add(-1)
+
+	timeout := time.Duration(valueOrDefaultInt(currentConfig().QueryTimeoutMillis, 5000)) * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(serverContext, timeout)
+	defer cancel()
+
+	handleDNSClient(ctx, requestBytes, responseWriter)
+}
+
+// watchShutdownSignal stops the server on SIGINT or SIGTERM.
+func watchShutdownSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		received := <-signals
+		logInfo("Got", received, "- shutting down")
+		stopServer()
+	}()
+}
+
+// waitForQueries gives the cancelled queries up to a second to be answered.
+func waitForQueries() {
+	deadline := time.Now().Add(time.Second)
+	for queriesInFlight.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// socketBufferSizes can't read socket options on this platform.
+func socketBufferSizes(conn *net.UDPConn) (int, int, error) {
+	return 0, 0, fmt.Errorf("reading socket buffer sizes isn't supported on this platform")
+}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// socketBufferSizes returns the receive and send buffer sizes the kernel
+// granted a socket. Linux reports twice the requested size, the extra half
+// being its bookkeeping overhead.
+func socketBufferSizes(conn *net.UDPConn) (int, int, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var receiveSize, sendSize int
+	var sockoptErr error
+	err = rawConn.Control(func(fd uintptr) {
+		receiveSize, sockoptErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+		if sockoptErr == nil {
+			sendSize, sockoptErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF)
+		}
+	})
+	if err == nil {
+		err = sockoptErr
+	}
+	return receiveSize, sendSize, err
+}
@@ -0,0 +1,50 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func listenLoopbackUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestUDPSocketBuffersAreApplied(t *testing.T) {
+	defaultReceive, defaultSend, err := socketBufferSizes(listenLoopbackUDP(t))
+	if err != nil {
+		t.Skip("socket buffer sizes can't be read here:", err)
+	}
+
+	// A quarter of the defaults is still above any kernel minimum, and
+	// can't be mistaken for them even where the kernel doubles it
+	cfg := DefaultConfig()
+	cfg.UDPSocketReceiveBuffer = defaultReceive / 4
+	cfg.UDPSocketSendBuffer = defaultSend / 4
+	useConfig(t, cfg)
+	logBuffer := captureLog(t)
+
+	conn := listenLoopbackUDP(t)
+	setUDPSocketBuffers(conn)
+	receiveSize, sendSize, err := socketBufferSizes(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receiveSize < cfg.UDPSocketReceiveBuffer || receiveSize >= defaultReceive {
+		t.Errorf("granted %d receive bytes for %d, default %d", receiveSize, cfg.UDPSocketReceiveBuffer, defaultReceive)
+	}
+	if sendSize < cfg.UDPSocketSendBuffer || sendSize >= defaultSend {
+		t.Errorf("granted %d send bytes for %d, default %d", sendSize, cfg.UDPSocketSendBuffer, defaultSend)
+	}
+	if !strings.Contains(logBuffer.String(), "UDP socket buffers on") {
+		t.Errorf("the granted sizes weren't logged: %q", logBuffer.String())
+	}
+}
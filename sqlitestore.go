@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteMigrations are applied in order on startup; PRAGMA user_version
+// records how many have run.
+var sqliteMigrations = []string{
+	`CREATE TABLE records (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		type TEXT NOT NULL,
+		rdata BLOB NOT NULL,
+		entry TEXT NOT NULL,
+		UNIQUE (name, type, rdata)
+	);
+	CREATE INDEX records_name_type ON records (name, type);`,
+}
+
+// sqliteUpsert inserts an entry's row, or updates the entry of the row
+// already holding the same record.
+const sqliteUpsert = `INSERT INTO records (name, type, rdata, entry) VALUES (?, ?, ?, ?)
+	ON CONFLICT (name, type, rdata) DO UPDATE SET entry = excluded.entry`
+
+// SQLiteStore keeps one row per entry in a SQLite database, so changes are
+// single-row writes instead of rewriting the whole store file. The full entry
+// is kept as JSON next to the name, type and encoded rdata it is keyed by.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore opens the database, creating and migrating the schema.
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, fmt.Errorf("error opening sqlite database %s: %v", path, err)
+	}
+
+	// SQLite allows a single writer; one connection also keeps ":memory:"
+	// databases from being split across connections
+	db.SetMaxOpenConns(1)
+
+	err = migrateSQLite(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteStore{db: db}, nil
+}
+
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return fmt.Errorf("error reading schema version: %v", err)
+	}
+
+	for ; version < len(sqliteMigrations); version++ {
+		_, err = db.Exec(sqliteMigrations[version])
+		if err != nil {
+			return fmt.Errorf("error applying schema migration %d: %v", version+1, err)
+		}
+		_, err = db.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1))
+		if err != nil {
+			return fmt.Errorf("error updating schema version: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// sqliteRow returns the columns stored for an entry.
+func sqliteRow(entry NameModel) (string, string, []byte, string, error) {
+	_, resourceData, err := encodeResourceData(entry)
+	if err != nil {
+		return "", "", nil, "", err
+	}
+
+	encodedEntry, err := json.Marshal(entry)
+	if err != nil {
+		return "", "", nil, "", err
+	}
+
+	return canonicalTarget(entry.Name), recordTypeName(entry), resourceData, string(encodedEntry), nil
+}
+
+func (s *SQLiteStore) queryEntries(ctx context.Context, query string, args ...any) ([]NameModel, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]NameModel, 0)
+	for rows.Next() {
+		var encodedEntry string
+		err = rows.Scan(&encodedEntry)
+		if err != nil {
+			return nil, err
+		}
+
+		var entry NameModel
+		err = json.Unmarshal([]byte(encodedEntry), &entry)
+		if err != nil {
+			return nil, fmt.Errorf("%w: error decoding stored entry: %w", ErrMalformed, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+func (s *SQLiteStore) All(ctx context.Context) ([]NameModel, error) {
+	return s.queryEntries(ctx, "SELECT entry FROM records ORDER BY id")
+}
+
+func (s *SQLiteStore) Lookup(ctx context.Context, name string, recordType string) ([]NameModel, error) {
+	return s.queryEntries(ctx, "SELECT entry FROM records WHERE name = ? AND (? = '' OR type = ?) ORDER BY id", name, recordType, recordType)
+}
+
+func (s *SQLiteStore) Put(ctx context.Context, entry NameModel, replace bool) error {
+	name, recordType, resourceData, encodedEntry, err := sqliteRow(entry)
+	if err != nil {
+		return err
+	}
+
+	if replace {
+		return s.Replace(ctx, name, recordType, []NameModel{entry})
+	}
+
+	// The same record stored again takes the new entry, e.g. a changed TTL
+	// or enabled flag
+	_, err = s.db.ExecContext(ctx, sqliteUpsert, name, recordType, resourceData, encodedEntry)
+	return err
+}
+
+func (s *SQLiteStore) Delete(ctx context.Context, name string, recordType string) (int, error) {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM records WHERE name = ? AND (? = '' OR type = ?)", name, recordType, recordType)
+	if err != nil {
+		return 0, err
+	}
+
+	removed, err := result.RowsAffected()
+	return int(removed), err
+}
+
+// Replace deletes and inserts in one transaction.
+func (s *SQLiteStore) Replace(ctx context.Context, name string, recordType string, entries []NameModel) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM records WHERE name = ? AND (? = '' OR type = ?)", name, recordType, recordType)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		entryName, entryType, resourceData, encodedEntry, err := sqliteRow(entry)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, sqliteUpsert, entryName, entryType, resourceData, encodedEntry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Seed imports the store file's entries into an empty database, so switching
+// to the SQLite backend keeps the existing records.
+func (s *SQLiteStore) Seed(models []NameModel) error {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM records").Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+
+	for _, model := range models {
+		err = s.Put(context.Background(), model, false)
+		if err != nil {
+			return fmt.Errorf("error importing %s: %v", model.Name, err)
+		}
+	}
+
+	logInfo("Imported", len(models), "entries from", currentConfig().StoreFile, "into the sqlite store")
+	return nil
+}
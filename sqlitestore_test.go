@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteStorePersistsAndSeedsOnce(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "names.db")
+
+	s, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Seed([]NameModel{{Name: "www.example.com", Address: "192.0.2.10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Put(ctx, NameModel{Name: "mail.example.com", Address: "192.0.2.25"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.db.Close()
+
+	// Reopening keeps the rows, and an existing database isn't reseeded
+	s, err = NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.db.Close()
+	err = s.Seed([]NameModel{{Name: "other.example.com", Address: "192.0.2.99"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := s.All(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := describeEntries(entries); got != "mail.example.com 192.0.2.25 ttl=0 enabled=true; www.example.com 192.0.2.10 ttl=0 enabled=true" {
+		t.Errorf("the reopened database holds %s", got)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go/format"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Regenerate the compiled store from names.json, for binaries built with
+// -tags static
+//
+//go:generate go run . -store names.json -generate-static static_names.go
+
+// staticEntries is the store compiled into the binary. It is only set when
+// the binary was built with the static tag and a generated static_names.go.
+var staticEntries []NameModel
+
+// StaticStore answers from the entries compiled into the binary, with no
+// file I/O. It can't be changed at runtime.
+type StaticStore struct {
+	entries []NameModel
+	byName  map[string][]NameModel
+}
+
+// NewStaticStore indexes the compiled entries by name.
+func NewStaticStore() (*StaticStore, error) {
+	if staticEntries == nil {
+		return nil, fmt.Errorf("this binary has no compiled store, generate static_names.go and build with -tags static")
+	}
+
+	s := &StaticStore{entries: staticEntries, byName: make(map[string][]NameModel)}
+	for _, entry := range staticEntries {
+		name := canonicalTarget(entry.Name)
+		s.byName[name] = append(s.byName[name], entry)
+	}
+	return s, nil
+}
+
+func (s *StaticStore) All(ctx context.Context) ([]NameModel, error) {
+	return append([]NameModel(nil), s.entries...), nil
+}
+
+func (s *StaticStore) Lookup(ctx context.Context, name string, recordType string) ([]NameModel, error) {
+	return lookupEntries(s.byName[name], name, recordType), nil
+}
+
+func (s *StaticStore) Put(ctx context.Context, entry NameModel, replace bool) error {
+	return fmt.Errorf("the compiled store is read-only")
+}
+
+func (s *StaticStore) Delete(ctx context.Context, name string, recordType string) (int, error) {
+	return 0, fmt.Errorf("the compiled store is read-only")
+}
+
+func (s *StaticStore) Replace(ctx context.Context, name string, recordType string, entries []NameModel) error {
+	return fmt.Errorf("the compiled store is read-only")
+}
+
+// runGenerateStatic compiles a store file into Go source declaring its
+// entries, for binaries built with -tags static. Entries are validated like
+// the loader does, but any problem is an error so a broken store never gets
+// compiled in.
+func runGenerateStatic(storePath string, outputPath string) int {
+	problems := ValidateStoreFile(storePath)
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		fmt.Println(storePath, "has", len(problems), "problem(s), not generating", outputPath)
+		return 1
+	}
+
+	models, err := GetNameModelsFrom(storePath)
+	if err != nil {
+		fmt.Println("Error loading", storePath, ":", err)
+		return 1
+	}
+
+	var source bytes.Buffer
+	fmt.Fprintf(&source, "// Code generated by lightdns -generate-static from %s; DO NOT EDIT.\n\n", storePath)
+	source.WriteString("//go:build static\n\npackage main\n\nfunc init() {\n\tstaticEntries = []NameModel{\n")
+	for _, model := range models {
+		fmt.Fprintf(&source, "%s,\n", strings.TrimPrefix(goLiteral(reflect.ValueOf(model)), "NameModel"))
+	}
+	source.WriteString("}\n}\n")
+
+	formatted, err := format.Source(source.Bytes())
+	if err != nil {
+		fmt.Println("Error formatting generated source:", err)
+		return 1
+	}
+
+	err = os.WriteFile(outputPath, formatted, 0644)
+	if err != nil {
+		fmt.Println("Error writing", outputPath, ":", err)
+		return 1
+	}
+
+	fmt.Println("Compiled", len(models), "entries from", storePath, "into", outputPath)
+	return 0
+}
+
+// goLiteral renders a store value as a Go composite literal, leaving out
+// zero fields. It covers the kinds NameModel and its records use.
+func goLiteral(value reflect.Value) string {
+	switch value.Kind() {
+	case reflect.Pointer:
+		if value.Elem().Kind() == reflect.Struct {
+			return "&" + goLiteral(value.Elem())
+		}
+		return fmt.Sprintf("pointerTo(%s(%s))", value.Elem().Type().Name(), goLiteral(value.Elem()))
+	case reflect.Struct:
+		var fields []string
+		for i := 0; i < value.NumField(); i++ {
+			if value.Field(i).IsZero() || !value.Type().Field(i).IsExported() {
+				continue
+			}
+			fields = append(fields, value.Type().Field(i).Name+": "+goLiteral(value.Field(i)))
+		}
+		return value.Type().Name() + "{" + strings.Join(fields, ", ") + "}"
+	case reflect.Slice:
+		elements := make([]string, value.Len())
+		for i := range elements {
+			elements[i] = goLiteral(value.Index(i))
+		}
+		return "[]" + value.Type().Elem().Name() + "{" + strings.Join(elements, ", ") + "}"
+	case reflect.String:
+		return strconv.Quote(value.String())
+	case reflect.Bool:
+		return strconv.FormatBool(value.Bool())
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(value.Uint(), 10)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(value.Int(), 10)
+	case reflect.Float64:
+		return strconv.FormatFloat(value.Float(), 'g', -1, 64)
+	}
+	panic(fmt.Sprintf("goLiteral: unsupported kind %s", value.Kind()))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useStaticEntries compiles entries into the binary for one test.
+func useStaticEntries(t *testing.T, entries []NameModel) {
+	t.Helper()
+	previous := staticEntries
+	staticEntries = entries
+	t.Cleanup(func() { staticEntries = previous })
+}
+
+func TestGenerateStatic(t *testing.T) {
+	entries := []NameModel{
+		{Name: "www.example.com", Address: "192.0.2.10", TTL: 60},
+		{Name: "www.example.com", Type: "TXT", TXT: "say \"hi\""},
+		{Name: "box.example.com", Type: "HINFO", HINFO: &HINFORecord{CPU: "arm64", OS: "linux"}},
+		{Name: "off.example.com", Address: "192.0.2.99", Enabled: pointerTo(false)},
+	}
+	storePath := writeStoreFile(t, entries...)
+	outputPath := filepath.Join(t.TempDir(), "static_names.go")
+
+	if status := runGenerateStatic(storePath, outputPath); status != 0 {
+		t.Fatalf("generating exited %d", status)
+	}
+	source, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(source), "//go:build static\n") || !strings.HasPrefix(string(source), "// Code generated") {
+		t.Errorf("generated source lacks its header or build tag:\n%s", source)
+	}
+
+	file, err := parser.ParseFile(token.NewFileSet(), outputPath, source, 0)
+	if err != nil {
+		t.Fatalf("generated source doesn't parse: %v\n%s", err, source)
+	}
+	var literals int
+	ast.Inspect(file, func(node ast.Node) bool {
+		if list, ok := node.(*ast.CompositeLit); ok {
+			if array, ok := list.Type.(*ast.ArrayType); ok && array.Elt.(*ast.Ident).Name == "NameModel" {
+				literals = len(list.Elts)
+			}
+		}
+		return true
+	})
+	if literals != len(entries) {
+		t.Errorf("generated %d entries, want %d", literals, len(entries))
+	}
+	for _, want := range []string{`"say \"hi\""`, `&HINFORecord{CPU: "arm64"`, "pointerTo(bool(false))"} {
+		if !strings.Contains(string(source), want) {
+			t.Errorf("generated source doesn't contain %s:\n%s", want, source)
+		}
+	}
+}
+
+func TestGenerateStaticRefusesBrokenStore(t *testing.T) {
+	storePath := writeRawStoreFile(t, `[{"name": "www.example.com", "address": "not an address"}]`)
+	outputPath := filepath.Join(t.TempDir(), "static_names.go")
+
+	if status := runGenerateStatic(storePath, outputPath); status == 0 {
+		t.Error("a store with problems was compiled")
+	}
+	if _, err := os.Stat(outputPath); err == nil {
+		t.Error("a broken store left generated source behind")
+	}
+}
+
+func TestCompiledStoreResolvesNames(t *testing.T) {
+	useStaticEntries(t, nil)
+	if _, err := NewStaticStore(); err == nil {
+		t.Fatal("NewStaticStore succeeded without compiled entries")
+	}
+
+	useStaticEntries(t, []NameModel{
+		{Name: "www.example.com", Address: "192.0.2.10"},
+		{Name: "Mail.Example.com", Address: "192.0.2.20"},
+	})
+	store, err := NewStore(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.(*StaticStore); !ok {
+		t.Fatalf("NewStore = %T, want the compiled store by default", store)
+	}
+
+	cfg := DefaultConfig()
+	cfg.store = store
+	err = LoadRuntime(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := currentConfig()
+	t.Cleanup(func() { configSnapshot.Store(previous) })
+	configSnapshot.Store(&cfg)
+
+	for name, want := range map[string]string{"www.example.com": "192.0.2.10", "mail.example.com": "192.0.2.20"} {
+		if got := answerAddress(query(t, name, TypeA)); got != want {
+			t.Errorf("%s resolved to %q, want %s", name, got, want)
+		}
+	}
+
+	err = store.Put(context.Background(), NameModel{Name: "new.example.com", Address: "192.0.2.30"}, false)
+	if err == nil {
+		t.Error("the compiled store accepted a change")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var startTime = time.Now()
+
+// queriesByType counts questions per query type, as *atomic.Uint64 values
+// keyed by the uint16 type code.
+var queriesByType sync.Map
+
+func countQueryType(queryType uint16) {
+	counter, ok := queriesByType.Load(queryType)
+	if !ok {
+		counter, _ = queriesByType.LoadOrStore(queryType, new(atomic.Uint64))
+	}
+	counter.(*atomic.Uint64).Add(1)
+}
+
+type Stats struct {
+	UptimeSeconds int64             `json:"uptimeSeconds"`
+	QueriesTotal  uint64            `json:"queriesTotal"`
+	QueriesByType map[string]uint64 `json:"queriesByType"`
+	StoreNames    int               `json:"storeNames"`
+	StoreEntries  int               `json:"storeEntries"`
+
+	// The forwarding cache's lookups and the answers it holds
+	CacheHits    uint64 `json:"cacheHits"`
+	CacheMisses  uint64 `json:"cacheMisses"`
+	CacheEntries int    `json:"cacheEntries"`
+}
+
+// handleStats reports runtime counters as JSON, for quick checks without a
+// Prometheus setup.
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	stats := Stats{
+		UptimeSeconds: int64(time.Since(startTime).Seconds()),
+		QueriesTotal:  queriesTotal.Load(),
+		QueriesByType: make(map[string]uint64),
+	}
+	stats.CacheHits, stats.CacheMisses, stats.CacheEntries = forwardCache.Counters()
+
+	queriesByType.Range(func(key, value any) bool {
+		stats.QueriesByType[typeName(key.(uint16))] = value.(*atomic.Uint64).Load()
+		return true
+	})
+
+	entries, err := currentConfig().store.All(r.Context())
+	if err == nil {
+		storeNames := make(map[string]bool)
+		for _, entry := range entries {
+			storeNames[canonicalTarget(entry.Name)] = true
+		}
+		stats.StoreNames = len(storeNames)
+		stats.StoreEntries = len(entries)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func currentStats(t *testing.T) Stats {
+	t.Helper()
+	var stats Stats
+	err := json.NewDecoder(apiRequest(t, http.MethodGet, "/stats", "", "").Body).Decode(&stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+func TestStatsCountQueriesAndStore(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	useConfig(t, cfg,
+		NameModel{Name: "www.example.com", Address: "192.0.2.10"},
+		NameModel{Name: "www.example.com", Type: "TXT", TXT: "hello"},
+		NameModel{Name: "mail.example.com", Address: "192.0.2.25"},
+	)
+
+	before := currentStats(t)
+	query(t, "www.example.com", TypeA)
+	query(t, "www.example.com", TypeTXT)
+	query(t, "mail.example.com", TypeA)
+	after := currentStats(t)
+
+	if after.QueriesTotal-before.QueriesTotal != 3 {
+		t.Errorf("queriesTotal grew by %d, want 3", after.QueriesTotal-before.QueriesTotal)
+	}
+	if after.QueriesByType["A"]-before.QueriesByType["A"] != 2 || after.QueriesByType["TXT"]-before.QueriesByType["TXT"] != 1 {
+		t.Errorf("queriesByType went from %v to %v, want 2 more A and 1 more TXT", before.QueriesByType, after.QueriesByType)
+	}
+	if after.StoreNames != 2 || after.StoreEntries != 3 {
+		t.Errorf("store has %d names and %d entries, want 2 and 3", after.StoreNames, after.StoreEntries)
+	}
+}
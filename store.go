@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Store is a backend holding the entries the server answers from. Names
+// passed in and returned are canonical; record types are the names used in
+// names.json, e.g. "A" or "CAA", with "" matching every type. Backends
+// doing I/O give up when the context is done.
+type Store interface {
+	// Lookup returns the entries stored under a name
+	Lookup(ctx context.Context, name string, recordType string) ([]NameModel, error)
+	// Put adds an entry. An entry for the same record, with the same name,
+	// type and value, is overwritten, so its TTL or enabled flag can change.
+	// With replace set it replaces every entry of the same name and type
+	// instead.
+	Put(ctx context.Context, entry NameModel, replace bool) error
+	// Delete removes the entries stored under a name and returns how many
+	// were removed
+	Delete(ctx context.Context, name string, recordType string) (int, error)
+	// Replace swaps the entries stored under a name for the given ones in a
+	// single change, so readers see either the old or the new entries
+	Replace(ctx context.Context, name string, recordType string, entries []NameModel) error
+	// All returns every entry in store order
+	All(ctx context.Context) ([]NameModel, error)
+}
+
+// seedableStore is implemented by backends that start out with the entries
+// of the store file.
+type seedableStore interface {
+	Seed(models []NameModel) error
+}
+
+// NewStore creates the backend named in the config: "file" (the default)
+// reads and writes the store file, "memory" serves the store file's entries
+// from memory and drops changes on restart, and "sqlite" keeps entries in
+// the SQLite database at SQLiteFile, "redis" shares them between instances
+// through Redis and "static" serves the entries compiled into the binary.
+// Binaries built with a compiled store use it by default.
+func NewStore(cfg Config) (Store, error) {
+	backend := strings.ToLower(cfg.StoreBackend)
+	if backend == "" && staticEntries != nil {
+		backend = "static"
+	}
+
+	switch backend {
+	case "", "file":
+		return &FileStore{Path: cfg.StoreFile}, nil
+	case "memory":
+		return &MemoryStore{}, nil
+	case "sqlite":
+		return NewSQLiteStore(cfg.SQLiteFile)
+	case "redis":
+		return NewRedisStore(cfg.Redis), nil
+	case "static":
+		return NewStaticStore()
+	}
+	return nil, fmt.Errorf("unknown store backend %q", cfg.StoreBackend)
+}
+
+// lookupEntries returns the entries with the given name and type.
+func lookupEntries(entries []NameModel, name string, recordType string) []NameModel {
+	found := make([]NameModel, 0)
+	for _, entry := range entries {
+		if canonicalTarget(entry.Name) == name && (recordType == "" || recordTypeName(entry) == recordType) {
+			found = append(found, entry)
+		}
+	}
+	return found
+}
+
+// putEntry applies Put to a list of entries.
+func putEntry(entries []NameModel, newEntry NameModel, replace bool) []NameModel {
+	name := canonicalTarget(newEntry.Name)
+	recordType := recordTypeName(newEntry)
+
+	if replace {
+		return replaceEntries(entries, name, recordType, []NameModel{newEntry})
+	}
+
+	for i, entry := range entries {
+		if canonicalTarget(entry.Name) != name || recordTypeName(entry) != recordType {
+			continue
+		}
+		if sameRecord(entry, newEntry) {
+			entries[i] = newEntry
+			return entries
+		}
+	}
+
+	return append(entries, newEntry)
+}
+
+// sameRecord reports whether two entries of the same name and type hold the
+// same record value, comparing their encoded rdata.
+func sameRecord(a NameModel, b NameModel) bool {
+	_, aData, aErr := encodeResourceData(a)
+	_, bData, bErr := encodeResourceData(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aData, bData)
+}
+
+// deleteEntries applies Delete to a list of entries.
+func deleteEntries(entries []NameModel, name string, recordType string) ([]NameModel, int) {
+	kept := make([]NameModel, 0, len(entries))
+	for _, entry := range entries {
+		if canonicalTarget(entry.Name) == name && (recordType == "" || recordTypeName(entry) == recordType) {
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	return kept, len(entries) - len(kept)
+}
+
+// replaceEntries applies Replace to a list of entries. The new entries take
+// the place of the first one replaced, keeping the store order stable.
+func replaceEntries(entries []NameModel, name string, recordType string, replacement []NameModel) []NameModel {
+	position := -1
+	kept := make([]NameModel, 0, len(entries)+len(replacement))
+	for _, entry := range entries {
+		if canonicalTarget(entry.Name) == name && (recordType == "" || recordTypeName(entry) == recordType) {
+			if position < 0 {
+				position = len(kept)
+			}
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	if position < 0 {
+		position = len(kept)
+	}
+	return slices.Insert(kept, position, replacement...)
+}
+
+// lookupExisting returns the entries stored under a name, failing with
+// ErrNotFound when there are none.
+func lookupExisting(ctx context.Context, s Store, name string, recordType string) ([]NameModel, error) {
+	entries, err := s.Lookup(ctx, name, recordType)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w: no entries for %s", ErrNotFound, name)
+	}
+	return entries, nil
+}
+
+// FileStore keeps the entries in a names.json file, which is read on every
+// call so edits to the file take effect immediately.
+type FileStore struct {
+	Path string
+
+	// writeLock serializes read-modify-write cycles so concurrent changes are
+	// applied one after another instead of overwriting each other
+	writeLock sync.Mutex
+}
+
+func (s *FileStore) All(ctx context.Context) ([]NameModel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return GetNameModelsFrom(s.Path)
+}
+
+func (s *FileStore) Lookup(ctx context.Context, name string, recordType string) ([]NameModel, error) {
+	entries, err := s.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return lookupEntries(entries, name, recordType), nil
+}
+
+func (s *FileStore) Put(ctx context.Context, entry NameModel, replace bool) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	entries, err := s.All(ctx)
+	if err != nil {
+		return err
+	}
+
+	return SaveNameModels(s.Path, putEntry(entries, entry, replace))
+}
+
+func (s *FileStore) Delete(ctx context.Context, name string, recordType string) (int, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	entries, err := s.All(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	entries, removed := deleteEntries(entries, name, recordType)
+	if removed == 0 {
+		return 0, nil
+	}
+
+	return removed, SaveNameModels(s.Path, entries)
+}
+
+func (s *FileStore) Replace(ctx context.Context, name string, recordType string, entries []NameModel) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	existing, err := s.All(ctx)
+	if err != nil {
+		return err
+	}
+
+	return SaveNameModels(s.Path, replaceEntries(existing, name, recordType, entries))
+}
+
+// MemoryStore keeps the entries in memory only. The entries are never
+// changed in place: every write builds a new list and swaps it in, so readers
+// don't lock and always see one complete version, never a mix of two.
+type MemoryStore struct {
+	entries atomic.Pointer[[]NameModel]
+
+	// writeLock serializes writers so no concurrent change is lost
+	writeLock sync.Mutex
+}
+
+// load returns the current entries, which callers must not modify.
+func (s *MemoryStore) load() []NameModel {
+	entries := s.entries.Load()
+	if entries == nil {
+		return nil
+	}
+	return *entries
+}
+
+// Seed replaces the store contents with the given entries.
+func (s *MemoryStore) Seed(models []NameModel) error {
+	entries := append([]NameModel(nil), models...)
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	s.entries.Store(&entries)
+	return nil
+}
+
+func (s *MemoryStore) All(ctx context.Context) ([]NameModel, error) {
+	return append([]NameModel(nil), s.load()...), nil
+}
+
+func (s *MemoryStore) Lookup(ctx context.Context, name string, recordType string) ([]NameModel, error) {
+	return lookupEntries(s.load(), name, recordType), nil
+}
+
+func (s *MemoryStore) Put(ctx context.Context, entry NameModel, replace bool) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	// putEntry may overwrite an element, so it works on a copy
+	entries := putEntry(append([]NameModel(nil), s.load()...), entry, replace)
+	s.entries.Store(&entries)
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, name string, recordType string) (int, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	entries, removed := deleteEntries(s.load(), name, recordType)
+	s.entries.Store(&entries)
+	return removed, nil
+}
+
+func (s *MemoryStore) Replace(ctx context.Context, name string, recordType string, entries []NameModel) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	replaced := replaceEntries(s.load(), name, recordType, entries)
+	s.entries.Store(&replaced)
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestReplaceEntries(t *testing.T) {
+	entries := []NameModel{
+		{Name: "a.example.com", Address: "192.0.2.1"},
+		{Name: "www.example.com", Address: "192.0.2.10"},
+		{Name: "www.example.com", Type: "TXT", TXT: "hello"},
+		{Name: "www.example.com", Address: "192.0.2.11"},
+		{Name: "z.example.com", Address: "192.0.2.2"},
+	}
+	replacement := []NameModel{{Name: "www.example.com", Address: "192.0.2.12", Enabled: pointerTo(false)}}
+
+	got := replaceEntries(entries, "www.example.com", "A", replacement)
+	want := []NameModel{entries[0], replacement[0], entries[2], entries[4]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("replacing the A RRset gave %+v, want %+v", got, want)
+	}
+
+	got = replaceEntries(entries, "new.example.com", "", replacement)
+	if len(got) != len(entries)+1 || !reflect.DeepEqual(got[len(got)-1], replacement[0]) {
+		t.Errorf("replacing a missing name didn't append: %+v", got)
+	}
+
+	got = replaceEntries(entries, "www.example.com", "", nil)
+	if len(got) != 2 {
+		t.Errorf("replacing every type with nothing left %d entries, want 2", len(got))
+	}
+}
+
+// testStores returns every backend to run the same sequence against.
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+
+	dir := t.TempDir()
+	err := SaveNameModels(filepath.Join(dir, "names.json"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqliteStore, err := NewSQLiteStore(filepath.Join(dir, "names.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := map[string]Store{
+		"file":   &FileStore{Path: filepath.Join(dir, "names.json")},
+		"memory": &MemoryStore{},
+		"sqlite": sqliteStore,
+		"redis":  startRedisStore(t, RedisConfig{}),
+	}
+	return stores
+}
+
+// describeEntries renders entries in a stable order for comparing backends.
+func describeEntries(entries []NameModel) string {
+	described := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		described = append(described, fmt.Sprintf("%s %s ttl=%d enabled=%v", entry.Name, describeEntry(entry), entry.TTL, entry.IsEnabled()))
+	}
+	sort.Strings(described)
+	return strings.Join(described, "; ")
+}
+
+func TestStoreBackendsAgree(t *testing.T) {
+	ctx := context.Background()
+	address := func(value string, ttl uint32) NameModel {
+		return NameModel{Name: "www.example.com", Type: "A", Address: value, TTL: ttl}
+	}
+	disabled := address("192.0.2.1", 60)
+	disabled.Enabled = pointerTo(false)
+
+	steps := []struct {
+		name string
+		do   func(s Store) error
+		want string
+	}{
+		{"put", func(s Store) error { return s.Put(ctx, address("192.0.2.1", 0), false) },
+			"www.example.com 192.0.2.1 ttl=0 enabled=true"},
+		{"put again with a TTL", func(s Store) error { return s.Put(ctx, address("192.0.2.1", 60), false) },
+			"www.example.com 192.0.2.1 ttl=60 enabled=true"},
+		{"put again disabled", func(s Store) error { return s.Put(ctx, disabled, false) },
+			"www.example.com 192.0.2.1 ttl=60 enabled=false"},
+		{"put another address", func(s Store) error { return s.Put(ctx, address("192.0.2.2", 0), false) },
+			"www.example.com 192.0.2.1 ttl=60 enabled=false; www.example.com 192.0.2.2 ttl=0 enabled=true"},
+		{"put a TXT record", func(s Store) error {
+			return s.Put(ctx, NameModel{Name: "www.example.com", Type: "TXT", TXT: "hello"}, false)
+		}, "www.example.com 192.0.2.1 ttl=60 enabled=false; www.example.com 192.0.2.2 ttl=0 enabled=true; www.example.com TXT \"hello\" ttl=0 enabled=true"},
+		{"put replacing the A records", func(s Store) error { return s.Put(ctx, address("192.0.2.3", 0), true) },
+			"www.example.com 192.0.2.3 ttl=0 enabled=true; www.example.com TXT \"hello\" ttl=0 enabled=true"},
+		{"replace the A records", func(s Store) error {
+			return s.Replace(ctx, "www.example.com", "A", []NameModel{address("192.0.2.4", 0), address("192.0.2.5", 0)})
+		}, "www.example.com 192.0.2.4 ttl=0 enabled=true; www.example.com 192.0.2.5 ttl=0 enabled=true; www.example.com TXT \"hello\" ttl=0 enabled=true"},
+		{"delete the A records", func(s Store) error { _, err := s.Delete(ctx, "www.example.com", "A"); return err },
+			"www.example.com TXT \"hello\" ttl=0 enabled=true"},
+		{"delete the name", func(s Store) error { _, err := s.Delete(ctx, "www.example.com", ""); return err },
+			""},
+	}
+
+	for backend, s := range testStores(t) {
+		for _, step := range steps {
+			err := step.do(s)
+			if err != nil {
+				t.Fatalf("%s: %s: %v", backend, step.name, err)
+			}
+			entries, err := s.Lookup(ctx, "www.example.com", "")
+			if err != nil {
+				t.Fatalf("%s: %s: lookup: %v", backend, step.name, err)
+			}
+			if got := describeEntries(entries); got != step.want {
+				t.Errorf("%s: after %s the store holds %s, want %s", backend, step.name, got, step.want)
+			}
+		}
+	}
+}
+
+func TestNewStore(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SQLiteFile = filepath.Join(t.TempDir(), "names.db")
+
+	backends := map[string]string{
+		"":       "*main.FileStore",
+		"file":   "*main.FileStore",
+		"Memory": "*main.MemoryStore",
+		"sqlite": "*main.SQLiteStore",
+		"redis":  "*main.RedisStore",
+	}
+	for backend, want := range backends {
+		cfg.StoreBackend = backend
+		s, err := NewStore(cfg)
+		if err != nil {
+			t.Errorf("backend %q: %v", backend, err)
+			continue
+		}
+		if got := fmt.Sprintf("%T", s); got != want {
+			t.Errorf("backend %q is a %s, want %s", backend, got, want)
+		}
+	}
+
+	cfg.StoreBackend = "etcd"
+	_, err := NewStore(cfg)
+	if err == nil {
+		t.Error("an unknown backend was accepted")
+	}
+}
+
+func TestQueriesAreAnsweredFromTheBackend(t *testing.T) {
+	for backend, s := range testStores(t) {
+		cfg := DefaultConfig()
+		cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+		loaded := useConfig(t, cfg)
+		loaded.store = s
+
+		err := s.Put(context.Background(), NameModel{Name: "www.example.com", Address: "192.0.2.10"}, true)
+		if err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		if got := answerAddress(query(t, "www.example.com", TypeA)); got != "192.0.2.10" {
+			t.Errorf("%s: answered %q, want the stored address", backend, got)
+		}
+	}
+}
+
+func TestGzippedStoreRoundTrips(t *testing.T) {
+	ctx := context.Background()
+	entries := []NameModel{
+		{Name: "www.example.com", Address: "192.0.2.10"},
+		{Name: "mail.example.com", Address: "192.0.2.11", TTL: 60},
+	}
+	path := filepath.Join(t.TempDir(), "names.json.gz")
+	err := SaveNameModels(path, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil || !bytes.HasPrefix(data, gzipMagic) {
+		t.Fatalf("a *.gz store wasn't written gzipped (%v)", err)
+	}
+	loaded, err := GetNameModelsFrom(path)
+	if err != nil || !reflect.DeepEqual(loaded, entries) {
+		t.Errorf("GetNameModelsFrom = %+v, %v; want the saved entries", loaded, err)
+	}
+
+	// A gzipped store under a plain name stays gzipped when it's written back
+	plainName := filepath.Join(t.TempDir(), "names.json")
+	err = os.WriteFile(plainName, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &FileStore{Path: plainName}
+	err = store.Put(ctx, NameModel{Name: "ftp.example.com", Address: "192.0.2.12"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = os.ReadFile(plainName)
+	if !bytes.HasPrefix(data, gzipMagic) {
+		t.Error("writing a gzipped store decompressed it")
+	}
+	if found, _ := store.Lookup(ctx, "ftp.example.com", ""); len(found) != 1 {
+		t.Errorf("the entry added to the gzipped store reads back as %+v", found)
+	}
+
+	// Plain stores stay plain
+	plain := writeStoreFile(t, entries...)
+	data, _ = os.ReadFile(plain)
+	if bytes.HasPrefix(data, gzipMagic) {
+		t.Error("a plain store was written gzipped")
+	}
+}
+
+func TestCorruptGzippedStoreIsMalformed(t *testing.T) {
+	path := writeRawStoreFile(t, string(gzipMagic)+"not a gzip stream")
+	_, err := GetNameModelsFrom(path)
+	if !errors.Is(err, ErrMalformed) {
+		t.Errorf("GetNameModelsFrom = %v, want ErrMalformed", err)
+	}
+}
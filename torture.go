@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// WaterTortureConfig configures detection of random-subdomain floods. When a
+// zone returns more than Threshold NXDOMAINs within WindowSeconds, further
+// queries for nonexistent names in it are REFUSED for HoldSeconds. In zones
+// that forward misses the NXDOMAINs the upstreams return are counted, and
+// refused misses are never forwarded, so the flood stops at this server.
+type WaterTortureConfig struct {
+	Enabled       bool `json:"enabled"`
+	Threshold     int  `json:"threshold"`
+	WindowSeconds int  `json:"windowSeconds"`
+	HoldSeconds   int  `json:"holdSeconds"`
+}
+
+type zoneNXDomainRate struct {
+	windowStarted  time.Time
+	count          int
+	mitigatedUntil time.Time
+}
+
+// waterTortureDetector tracks the NXDOMAIN rate of each configured zone. It
+// only holds an entry per zone, so its memory doesn't grow with traffic.
+type waterTortureDetector struct {
+	sync.Mutex
+	zones map[string]*zoneNXDomainRate
+}
+
+var waterTorture = waterTortureDetector{zones: make(map[string]*zoneNXDomainRate)}
+
+// ObserveNXDomain records a miss for a name in the zone and reports whether
+// the zone is under mitigation, in which case the miss should be REFUSED.
+// Refused misses keep counting, so the mitigation lasts as long as the flood
+// and clears HoldSeconds after the rate drops below the threshold.
+func (d *waterTortureDetector) ObserveNXDomain(zoneName string, now time.Time) bool {
+	settings := currentConfig().WaterTorture
+	if !settings.Enabled || settings.Threshold <= 0 {
+		return false
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	rate := d.zones[zoneName]
+	if rate == nil {
+		rate = &zoneNXDomainRate{windowStarted: now}
+		d.zones[zoneName] = rate
+	}
+
+	window := time.Duration(valueOrDefaultInt(settings.WindowSeconds, 10)) * time.Second
+	if now.Sub(rate.windowStarted) >= window {
+		rate.windowStarted = now
+		rate.count = 0
+	}
+	rate.count++
+
+	if rate.count > settings.Threshold {
+		if !now.Before(rate.mitigatedUntil) {
+			logWarn("NXDOMAIN flood detected for zone", zoneName, "- refusing nonexistent names")
+		}
+		rate.mitigatedUntil = now.Add(time.Duration(valueOrDefaultInt(settings.HoldSeconds, 60)) * time.Second)
+	}
+
+	return now.Before(rate.mitigatedUntil)
+}
+
+// Mitigating reports whether misses in the zone are currently refused,
+// without counting a miss.
+func (d *waterTortureDetector) Mitigating(zoneName string, now time.Time) bool {
+	if !currentConfig().WaterTorture.Enabled {
+		return false
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	rate := d.zones[zoneName]
+	return rate != nil && now.Before(rate.mitigatedUntil)
+}
+
+func valueOrDefaultInt(value int, fallback int) int {
+	if value <= 0 {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// useWaterTorture starts a test with a fresh flood detector.
+func useWaterTorture(t *testing.T) {
+	t.Helper()
+	previous := waterTorture.zones
+	waterTorture.zones = make(map[string]*zoneNXDomainRate)
+	t.Cleanup(func() { waterTorture.zones = previous })
+}
+
+func tortureConfig(threshold int) Config {
+	cfg := DefaultConfig()
+	cfg.WaterTorture = WaterTortureConfig{Enabled: true, Threshold: threshold, WindowSeconds: 60, HoldSeconds: 60}
+	return cfg
+}
+
+func TestRandomSubdomainFloodIsRefused(t *testing.T) {
+	useWaterTorture(t)
+	cfg := tortureConfig(5)
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	useConfig(t, cfg, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+
+	for i := 0; i < 5; i++ {
+		if rcode := responseCode(query(t, fmt.Sprintf("r%d.example.com", i), TypeA)); rcode != RcodeNameError {
+			t.Fatalf("miss %d: rcode %d, want NXDOMAIN below the threshold", i, rcode)
+		}
+	}
+	if rcode := responseCode(query(t, "r5.example.com", TypeA)); rcode != RcodeRefused {
+		t.Errorf("the miss past the threshold got rcode %d, want REFUSED", rcode)
+	}
+	if response := query(t, "www.example.com", TypeA); len(response.Answers) != 1 {
+		t.Error("existing names aren't answered during mitigation")
+	}
+	if rcode := responseCode(query(t, "r0.example.org", TypeA)); rcode != RcodeRefused {
+		t.Errorf("rcode %d outside the zone", rcode)
+	}
+
+	// The mitigation clears once the hold time passes without a flood
+	later := time.Now().Add(2 * time.Minute)
+	if waterTorture.Mitigating("example.com", later) || waterTorture.ObserveNXDomain("example.com", later) {
+		t.Error("the mitigation didn't clear after the flood stopped")
+	}
+}
+
+func TestRefusedFloodIsNotForwarded(t *testing.T) {
+	useWaterTorture(t)
+	upstream := startUpstream(t, func(requestBytes []byte) []byte {
+		return upstreamResponse(requestBytes, RcodeNameError)
+	})
+
+	for _, forwardZone := range []bool{false, true} {
+		cfg := tortureConfig(3)
+		cfg.Zones = []ZoneConfig{{Name: "example.com", Forward: forwardZone}}
+		useForwarding(t, cfg, upstream.address)
+		waterTorture.zones = make(map[string]*zoneNXDomainRate)
+		upstream.queries.Store(0)
+
+		// Forwarded misses count once the upstream answered, so the miss
+		// crossing the threshold is still forwarded
+		firstRefused := 3
+		if forwardZone {
+			firstRefused = 4
+		}
+		for i := 0; i < 10; i++ {
+			response := query(t, fmt.Sprintf("f%d.example.com", i), TypeA)
+			if i >= firstRefused && responseCode(response) != RcodeRefused {
+				t.Errorf("forward zone %v: miss %d got rcode %d, want REFUSED", forwardZone, i, responseCode(response))
+			}
+		}
+
+		forwarded := int32(0)
+		if forwardZone {
+			forwarded = int32(firstRefused)
+		}
+		if got := upstream.queries.Load(); got != forwarded {
+			t.Errorf("forward zone %v: %d misses were forwarded, want %d", forwardZone, got, forwarded)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+const TypeAXFR uint16 = 252 // whole zone transfer, RFC 5936
+
+// maxTransferMessageSize keeps each transfer message, with its TSIG record,
+// within the two byte TCP length prefix.
+const maxTransferMessageSize = 65535 - 512
+
+// isTransferQuery reports whether a standard query asks for an AXFR.
+func isTransferQuery(queryHeader DNSHeader, requestBytes []byte) bool {
+	if (queryHeader.Flags>>11)&0x0f != 0 || queryHeader.NumQuestions != 1 {
+		return false
+	}
+	_, offset, err := readMessageName(requestBytes, DNSHeaderSizeBytes)
+	return err == nil && offset+2 <= len(requestBytes) && binary.BigEndian.Uint16(requestBytes[offset:]) == TypeAXFR
+}
+
+// handleTransfer answers an AXFR. Only zones listing the client in
+// allowTransfer, or the TSIG key that signed the request in transferKeys,
+// are transferred, and only over TCP. The zone is sent from the default
+// store, between two copies of its SOA, in as many messages as it takes;
+// signed requests get every message signed.
+func handleTransfer(ctx context.Context, queryHeader DNSHeader, requestBytes []byte, responseWriter DNSResponseWriter) {
+	rcode := RcodeFormatError
+	var question []DNSResourceRecord
+	var records []DNSResourceRecord
+
+	now := time.Now()
+	var signature *tsigContext
+	var tsigError uint16
+
+	unsigned, tsigRecord, err := splitTSIG(requestBytes)
+	if err == nil && tsigRecord != nil {
+		signature, tsigError = verifyTSIG(unsigned, *tsigRecord, now)
+	}
+
+	var message DNSResponse
+	if err == nil {
+		message, err = parseResponse(unsigned)
+	}
+	switch {
+	case err != nil:
+		logDebug("Error decoding transfer request:", err)
+		rcode = rcodeForError(err)
+	case tsigError != 0:
+		logWarn("Refused transfer to", responseWriter.RemoteAddr(), "with bad TSIG for key", tsigRecord.KeyName, ": error", tsigError)
+		question = message.Questions
+		rcode = RcodeNotAuth
+	case responseWriter.IsUDP():
+		// AXFR over UDP isn't defined (RFC 5936 section 4.2)
+		question = message.Questions
+		rcode = RcodeNotImplemented
+	default:
+		keyName := ""
+		if signature != nil {
+			keyName = signature.key.name
+		}
+		question = message.Questions
+		records, rcode = transferRecords(ctx, question[0], clientIP(responseWriter.RemoteAddr()), keyName)
+	}
+
+	if len(question) > 1 {
+		question = question[:1]
+	}
+
+	// Failed verifications other than BADTIME are answered unsigned
+	if tsigRecord != nil && tsigError != 0 && tsigError != TSIGErrorBadTime {
+		signature = nil
+	}
+
+	responseFlags := FlagResponse | FlagAuthoritative | rcode
+	logQuery(question, responseWriter.RemoteAddr(), responseFlags, SourceLocal)
+
+	messages := transferMessages(queryHeader.TransactionID, responseFlags, question, records)
+	for i, responseBuffer := range messages {
+		if tsigRecord != nil {
+			var tsigResourceRecord DNSResourceRecord
+			if i == 0 || signature == nil {
+				tsigResourceRecord = tsigResponseRecord(signature, *tsigRecord, responseBuffer.Bytes(), tsigError, now)
+			} else {
+				tsigResourceRecord = tsigContinuationRecord(signature, *tsigRecord, responseBuffer.Bytes(), now)
+			}
+			binary.BigEndian.PutUint16(responseBuffer.Bytes()[10:], 1)
+			writeResourceRecord(responseBuffer, tsigResourceRecord, make(nameCompression))
+		}
+
+		if i == 0 {
+			captureExchange(requestBytes, responseBuffer.Bytes(), responseWriter)
+		}
+
+		err = responseWriter.WriteResponse(responseBuffer.Bytes())
+		if err != nil {
+			logWarn("Error sending transfer to", responseWriter.RemoteAddr(), ":", err)
+			return
+		}
+	}
+}
+
+// transferRecords checks the zone and the client of a transfer and returns
+// the records to send, starting and ending with the zone's SOA. Names in a
+// more specific zone belong to that zone's transfer.
+func transferRecords(ctx context.Context, question DNSResourceRecord, clientIP net.IP, keyName string) ([]DNSResourceRecord, uint16) {
+	zoneName := canonicalTarget(question.DomainName)
+	zone := exactZone(zoneName)
+	if zone == nil {
+		return nil, RcodeNotAuth
+	}
+	if !zone.AllowsTransfer(clientIP, keyName) {
+		logWarn("Refused transfer of zone", zoneName, "to", clientIP)
+		return nil, RcodeRefused
+	}
+
+	models, err := currentConfig().store.All(ctx)
+	if err != nil {
+		logError("Error reading the store for a transfer of", zoneName, ":", err)
+		return nil, RcodeServerFailure
+	}
+
+	soa := zone.SOARecord()
+	records := append([]DNSResourceRecord{soa}, zone.NSRecords()...)
+	if zoneSigner != nil && zoneSigner.Zone == zoneName {
+		records = append(records, zoneSigner.DNSKEYRecords()...)
+	}
+	for _, name := range To(models) {
+		owner := findZone(name.Name)
+		if owner == nil || canonicalTarget(owner.Name) != zoneName {
+			continue
+		}
+		records = append(records, DNSResourceRecord{
+			DomainName:         name.Name,
+			Type:               name.Type,
+			Class:              ClassINET,
+			TimeToLive:         name.ttlIn(zone),
+			ResourceData:       name.ResourceData,
+			ResourceDataLength: uint16(len(name.ResourceData)),
+		})
+	}
+	uniformRRsetTTLs(records)
+	records = append(records, soa)
+
+	logInfo("Transferring zone", zoneName, "to", clientIP, "-", len(records), "records")
+	return records, RcodeNoError
+}
+
+// transferMessages packs the records of a transfer into messages of at most
+// maxTransferMessageSize bytes. Only the first message echoes the question.
+// An error response is a single message without records.
+func transferMessages(transactionID uint16, responseFlags uint16, question []DNSResourceRecord, records []DNSResourceRecord) []*bytes.Buffer {
+	responseBuffer := zoneResponse(transactionID, responseFlags, question)
+	messages := []*bytes.Buffer{responseBuffer}
+	compression := make(nameCompression)
+	numAnswers := 0
+
+	for _, record := range records {
+		size := responseBuffer.Len()
+		writeResourceRecord(responseBuffer, record, compression)
+
+		// A record that doesn't fit starts the next message
+		if responseBuffer.Len() > maxTransferMessageSize && numAnswers > 0 {
+			responseBuffer.Truncate(size)
+			binary.BigEndian.PutUint16(responseBuffer.Bytes()[6:], uint16(numAnswers))
+
+			responseBuffer = zoneResponse(transactionID, responseFlags, nil)
+			messages = append(messages, responseBuffer)
+			compression = make(nameCompression)
+			numAnswers = 0
+			writeResourceRecord(responseBuffer, record, compression)
+		}
+		numAnswers++
+	}
+	binary.BigEndian.PutUint16(responseBuffer.Bytes()[6:], uint16(numAnswers))
+
+	return messages
+}
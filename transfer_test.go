@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func transferConfig(t *testing.T, entries ...NameModel) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.TSIGKeys = []TSIGKeyConfig{testKey}
+	cfg.Zones = []ZoneConfig{
+		{Name: "example.com", TransferKeys: []string{testKey.Name}, AllowTransfer: []string{"198.51.100.0/24"}},
+		{Name: "sub.example.com"},
+	}
+	useConfig(t, cfg, entries...)
+}
+
+// verifyTransfer checks the TSIG records of every message of a transfer,
+// chained from the request's MAC, and returns the records sent.
+func verifyTransfer(t *testing.T, request []byte, responses [][]byte) []DNSResourceRecord {
+	t.Helper()
+
+	keys, _ := LoadTSIGKeys([]TSIGKeyConfig{testKey})
+	key := keys[canonicalTarget(testKey.Name)]
+	previousMAC := requestMAC(t, request)
+
+	var records []DNSResourceRecord
+	for i, responseBytes := range responses {
+		unsigned, record, err := splitTSIG(responseBytes)
+		if err != nil || record == nil {
+			t.Fatalf("message %d isn't signed: %v", i, err)
+		}
+
+		var expected []byte
+		if i == 0 {
+			expected = tsigMAC(key, previousMAC, unsigned, *record)
+		} else {
+			mac := hmac.New(tsigAlgorithms[key.algorithm], key.secret)
+			binary.Write(mac, binary.BigEndian, uint16(len(previousMAC)))
+			mac.Write(previousMAC)
+			mac.Write(unsigned)
+			var timers bytes.Buffer
+			writeTSIGTimes(&timers, *record)
+			mac.Write(timers.Bytes())
+			expected = mac.Sum(nil)
+		}
+		if !hmac.Equal(expected, record.MAC) {
+			t.Fatalf("message %d has a bad MAC", i)
+		}
+		previousMAC = record.MAC
+
+		message, err := parseResponse(unsigned)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, message.Answers...)
+	}
+	return records
+}
+
+func TestSignedTransfer(t *testing.T) {
+	transferConfig(t,
+		NameModel{Name: "www.example.com", Address: "192.0.2.10"},
+		NameModel{Name: "mail.example.com", Address: "192.0.2.20"},
+		NameModel{Name: "host.sub.example.com", Address: "192.0.2.30"},
+		NameModel{Name: "www.example.org", Address: "192.0.2.40"},
+	)
+
+	request := signRequest(t, buildQuery(42, 0, "example.com", TypeAXFR), testKey, time.Now())
+	w := newWriter("203.0.113.5", false)
+	response := serve(t, w, request)
+	if responseCode(response) != RcodeNoError {
+		t.Fatalf("rcode = %d, want NOERROR", responseCode(response))
+	}
+
+	records := verifyTransfer(t, request, w.responses)
+	if records[0].Type != TypeSOA || records[len(records)-1].Type != TypeSOA {
+		t.Error("the transfer doesn't start and end with the SOA")
+	}
+	var owners []string
+	for _, record := range records[1 : len(records)-1] {
+		if record.Type == TypeA {
+			owners = append(owners, record.DomainName)
+		}
+	}
+	got := strings.Join(owners, ",")
+	if got != "www.example.com,mail.example.com" {
+		t.Errorf("transferred A records for %s, want www.example.com and mail.example.com only", got)
+	}
+}
+
+func TestTransferRejectsTamperedRequest(t *testing.T) {
+	transferConfig(t, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+
+	request := signRequest(t, buildQuery(42, 0, "example.com", TypeAXFR), testKey, time.Now())
+	request[DNSHeaderSizeBytes+1] ^= 0x20
+
+	w := newWriter("203.0.113.5", false)
+	response := serve(t, w, request)
+	if responseCode(response) != RcodeNotAuth || len(response.Answers) != 0 {
+		t.Fatalf("rcode = %d with %d answers, want NOTAUTH and none", responseCode(response), len(response.Answers))
+	}
+	_, record, err := splitTSIG(w.responses[0])
+	if err != nil || record == nil {
+		t.Fatal("the error response has no TSIG record")
+	}
+	if record.Error != TSIGErrorBadSig || len(record.MAC) != 0 {
+		t.Errorf("TSIG error = %d with a %d byte MAC, want BADSIG and no MAC", record.Error, len(record.MAC))
+	}
+}
+
+func TestTransferAccess(t *testing.T) {
+	transferConfig(t, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+
+	tests := []struct {
+		name   string
+		client string
+		udp    bool
+		zone   string
+		rcode  uint16
+	}{
+		{"unsigned from an allowed network", "198.51.100.7", false, "example.com", RcodeNoError},
+		{"unsigned from elsewhere", "203.0.113.5", false, "example.com", RcodeRefused},
+		{"zone without transfers", "198.51.100.7", false, "sub.example.com", RcodeRefused},
+		{"not a zone", "198.51.100.7", false, "example.org", RcodeNotAuth},
+		{"over UDP", "198.51.100.7", true, "example.com", RcodeNotImplemented},
+	}
+	for _, test := range tests {
+		response := serve(t, newWriter(test.client, test.udp), buildQuery(1, 0, test.zone, TypeAXFR))
+		if responseCode(response) != test.rcode {
+			t.Errorf("%s: rcode = %d, want %d", test.name, responseCode(response), test.rcode)
+		}
+	}
+}
+
+func TestLargeTransferSpansMessages(t *testing.T) {
+	var entries []NameModel
+	for i := 0; i < 2000; i++ {
+		entries = append(entries, NameModel{Name: fmt.Sprintf("host%d.example.com", i), Type: "TXT", TXT: strings.Repeat("x", 100)})
+	}
+	transferConfig(t, entries...)
+
+	request := signRequest(t, buildQuery(42, 0, "example.com", TypeAXFR), testKey, time.Now())
+	w := newWriter("203.0.113.5", false)
+	serve(t, w, request)
+
+	if len(w.responses) < 2 {
+		t.Fatalf("sent %d messages, want the transfer split", len(w.responses))
+	}
+	for i, responseBytes := range w.responses {
+		if len(responseBytes) > 65535 {
+			t.Errorf("message %d is %d bytes", i, len(responseBytes))
+		}
+	}
+	records := verifyTransfer(t, request, w.responses)
+	txt := 0
+	for _, record := range records {
+		if record.Type == TypeTXT {
+			txt++
+		}
+	}
+	if txt != len(entries) {
+		t.Errorf("transferred %d TXT records, want %d", txt, len(entries))
+	}
+}
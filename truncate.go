@@ -0,0 +1,132 @@
+package main
+
+import "encoding/binary"
+
+const (
+	FlagTruncated uint16 = 1 << 9
+
+	DNSHeaderSizeBytes = 12
+)
+
+// domainNameSize is the uncompressed wire size of a name.
+func domainNameSize(domainName string) int {
+	size := 1 // terminating root label
+	for _, label := range splitLabels(domainName) {
+		size += 1 + len(label)
+	}
+	return size
+}
+
+// resourceRecordSize estimates the wire size of a record: owner name, the
+// fixed type/class/TTL/length fields and the rdata.
+func resourceRecordSize(resourceRecord DNSResourceRecord) int {
+	return domainNameSize(resourceRecord.DomainName) + 10 + len(resourceRecord.ResourceData)
+}
+
+func questionsSize(queryResourceRecords []DNSResourceRecord) int {
+	size := 0
+	for _, queryResourceRecord := range queryResourceRecords {
+		size += domainNameSize(queryResourceRecord.DomainName) + 4
+	}
+	return size
+}
+
+// udpResponseLimit is the largest UDP response the client accepts: 512 bytes
+// without EDNS, otherwise its advertised payload size capped at our own.
+func udpResponseLimit(queryEDNS *EDNSOptions) int {
+	if queryEDNS == nil || queryEDNS.UDPSize <= uint16(UDPMaxMessageSizeBytes) {
+		return int(UDPMaxMessageSizeBytes)
+	}
+	return int(min(queryEDNS.UDPSize, EDNSUDPSizeBytes))
+}
+
+// capAnswers keeps at most currentConfig().MaxAnswers answer records and reports
+// whether any were dropped.
+func capAnswers(answers []DNSResourceRecord) ([]DNSResourceRecord, bool) {
+	if currentConfig().MaxAnswers <= 0 || len(answers) <= currentConfig().MaxAnswers {
+		return answers, false
+	}
+	return answers[:currentConfig().MaxAnswers], true
+}
+
+// fitResponse trims the sections so that they fit in budget bytes and reports
+// whether the response has to be marked truncated.
+func fitResponse(answers, authorities, additionals []DNSResourceRecord, budget int) ([]DNSResourceRecord, []DNSResourceRecord, []DNSResourceRecord, bool) {
+	if currentConfig().PackResponses {
+		return packResponse(answers, authorities, additionals, budget)
+	}
+	return cutResponse(answers, authorities, additionals, budget)
+}
+
+// cutResponse keeps records in message order and drops everything from the
+// first record that doesn't fit.
+func cutResponse(answers, authorities, additionals []DNSResourceRecord, budget int) ([]DNSResourceRecord, []DNSResourceRecord, []DNSResourceRecord, bool) {
+	sections := [][]DNSResourceRecord{answers, authorities, additionals}
+
+	for s, section := range sections {
+		for i, resourceRecord := range section {
+			size := resourceRecordSize(resourceRecord)
+			if size > budget {
+				sections[s] = section[:i]
+				for rest := s + 1; rest < len(sections); rest++ {
+					sections[rest] = nil
+				}
+				return sections[0], sections[1], sections[2], true
+			}
+			budget -= size
+		}
+	}
+
+	return answers, authorities, additionals, false
+}
+
+// packResponse fits as many complete records as possible, preferring the
+// answer section, then authority, then additional. Answers and authority are
+// required, so the response is truncated as soon as one of them doesn't fit.
+// Additional records are optional: any that don't fit are skipped, smaller
+// ones later in the section can still fill the remaining space, and dropping
+// them doesn't set TC (RFC 2181 section 9).
+func packResponse(answers, authorities, additionals []DNSResourceRecord, budget int) ([]DNSResourceRecord, []DNSResourceRecord, []DNSResourceRecord, bool) {
+	for i, resourceRecord := range answers {
+		size := resourceRecordSize(resourceRecord)
+		if size > budget {
+			return answers[:i], nil, nil, true
+		}
+		budget -= size
+	}
+
+	for i, resourceRecord := range authorities {
+		size := resourceRecordSize(resourceRecord)
+		if size > budget {
+			return answers, authorities[:i], nil, true
+		}
+		budget -= size
+	}
+
+	packedAdditionals := make([]DNSResourceRecord, 0, len(additionals))
+	for _, resourceRecord := range additionals {
+		size := resourceRecordSize(resourceRecord)
+		if size <= budget {
+			packedAdditionals = append(packedAdditionals, resourceRecord)
+			budget -= size
+		}
+	}
+
+	return answers, authorities, packedAdditionals, false
+}
+
+// clampUDPResponse cuts an encoded response down to its header and question
+// section and marks it truncated, so the client retries over TCP.
+func clampUDPResponse(responseBytes []byte, questionSectionEnd int) []byte {
+	clamped := append([]byte(nil), responseBytes[:questionSectionEnd]...)
+
+	flags := binary.BigEndian.Uint16(clamped[2:4])
+	binary.BigEndian.PutUint16(clamped[2:4], flags|FlagTruncated)
+
+	// Zero the answer, authority and additional counts
+	binary.BigEndian.PutUint16(clamped[6:8], 0)
+	binary.BigEndian.PutUint16(clamped[8:10], 0)
+	binary.BigEndian.PutUint16(clamped[10:12], 0)
+
+	return clamped
+}
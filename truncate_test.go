@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// sizedRecord returns a TXT record of www.example.com taking size bytes on
+// the wire.
+func sizedRecord(size int) DNSResourceRecord {
+	record := DNSResourceRecord{DomainName: "www.example.com", Type: TypeTXT, Class: ClassINET}
+	record.ResourceData = []byte(strings.Repeat("x", size-resourceRecordSize(record)))
+	record.ResourceDataLength = uint16(len(record.ResourceData))
+	return record
+}
+
+func TestPackResponse(t *testing.T) {
+	answers := []DNSResourceRecord{sizedRecord(200), sizedRecord(200)}
+	authorities := []DNSResourceRecord{sizedRecord(50)}
+	additionals := []DNSResourceRecord{sizedRecord(100), sizedRecord(40), sizedRecord(30)}
+
+	// 520 bytes leave 70 for additionals after the answers and authority:
+	// the 100 byte record is skipped and the two smaller ones fill the room
+	packedAnswers, packedAuthorities, packedAdditionals, truncated := packResponse(answers, authorities, additionals, 520)
+	if truncated || len(packedAnswers) != 2 || len(packedAuthorities) != 1 {
+		t.Fatalf("packResponse dropped required records or set TC: %d answers, %d authorities, truncated %v", len(packedAnswers), len(packedAuthorities), truncated)
+	}
+	if len(packedAdditionals) != 2 || resourceRecordSize(packedAdditionals[0]) != 40 || resourceRecordSize(packedAdditionals[1]) != 30 {
+		t.Errorf("packed additionals = %d records, want the 40 and 30 byte ones", len(packedAdditionals))
+	}
+
+	// Cutting drops everything from the first additional that doesn't fit
+	_, _, cutAdditionals, truncated := cutResponse(answers, authorities, additionals, 520)
+	if len(cutAdditionals) != 0 || !truncated {
+		t.Errorf("cutResponse kept %d additionals with truncated %v, want none and TC", len(cutAdditionals), truncated)
+	}
+
+	// An answer that doesn't fit truncates, leaving the later sections out
+	packedAnswers, packedAuthorities, packedAdditionals, truncated = packResponse(answers, authorities, additionals, 399)
+	if !truncated || len(packedAnswers) != 1 || len(packedAuthorities) != 0 || len(packedAdditionals) != 0 {
+		t.Errorf("packResponse with room for one answer = %d/%d/%d records, truncated %v", len(packedAnswers), len(packedAuthorities), len(packedAdditionals), truncated)
+	}
+}
+
+func TestUDPResponsesStayWithinTheLimit(t *testing.T) {
+	var entries []NameModel
+	for i := 0; i < 20; i++ {
+		entries = append(entries, NameModel{Name: "big.example.com", Type: "TXT", TXT: fmt.Sprintf("%02d%s", i, strings.Repeat("x", 100))})
+	}
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	useConfig(t, cfg, entries...)
+
+	tests := []struct {
+		name    string
+		request []byte
+		limit   int
+	}{
+		{"without EDNS", buildQuery(1, 0, "big.example.com", TypeTXT), 512},
+		{"with EDNS", withOPT(buildQuery(1, 0, "big.example.com", TypeTXT), 0), 1232},
+	}
+	for _, test := range tests {
+		w := newWriter("192.0.2.1", true)
+		response := serve(t, w, test.request)
+		if size := len(w.responses[0]); size > test.limit {
+			t.Errorf("%s: sent a %d byte datagram, over the %d byte limit", test.name, size, test.limit)
+		}
+		if response.Header.Flags&FlagTruncated == 0 {
+			t.Errorf("%s: a response missing records isn't marked truncated", test.name)
+		}
+	}
+
+	// TCP gets every record
+	response := serve(t, newWriter("192.0.2.1", false), buildQuery(1, 0, "big.example.com", TypeTXT))
+	if len(response.Answers) != len(entries) || response.Header.Flags&FlagTruncated != 0 {
+		t.Errorf("TCP got %d of %d records", len(response.Answers), len(entries))
+	}
+}
+
+func TestClampUDPResponse(t *testing.T) {
+	request := buildQuery(1, 0, "www.example.com", TypeA)
+	oversized := append(append([]byte(nil), request...), make([]byte, 600)...)
+	binary.BigEndian.PutUint16(oversized[6:], 30)
+
+	clamped := clampUDPResponse(oversized, len(request))
+	if len(clamped) != len(request) {
+		t.Fatalf("clamped to %d bytes, want the %d bytes of header and question", len(clamped), len(request))
+	}
+	if binary.BigEndian.Uint16(clamped[2:])&FlagTruncated == 0 || binary.BigEndian.Uint16(clamped[6:]) != 0 {
+		t.Error("the clamped response isn't marked truncated with no answers")
+	}
+}
+
+func TestMaxAnswers(t *testing.T) {
+	var entries []NameModel
+	for i := 1; i <= 20; i++ {
+		entries = append(entries, NameModel{Name: "pool.example.com", Address: fmt.Sprintf("192.0.2.%d", i)})
+	}
+	cfg := DefaultConfig()
+	cfg.MaxAnswers = 8
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	useConfig(t, cfg, entries...)
+
+	request := buildQuery(1, FlagRecursionDesired, "pool.example.com", TypeA)
+	response := serve(t, newWriter("192.0.2.1", true), request)
+	if len(response.Answers) != 8 || response.Header.Flags&FlagTruncated == 0 {
+		t.Errorf("UDP response has %d answers, TC %v; want 8 with TC set", len(response.Answers), response.Header.Flags&FlagTruncated != 0)
+	}
+
+	// The TCP retry gets the whole set
+	response = serve(t, newWriter("192.0.2.1", false), request)
+	if len(response.Answers) != 20 || response.Header.Flags&FlagTruncated != 0 {
+		t.Errorf("TCP response has %d answers, TC %v; want all 20", len(response.Answers), response.Header.Flags&FlagTruncated != 0)
+	}
+
+	// Answer sets within the cap are left alone
+	response = serve(t, newWriter("192.0.2.1", true), buildQuery(1, FlagRecursionDesired, "pool.example.com", TypeAAAA))
+	if response.Header.Flags&FlagTruncated != 0 {
+		t.Error("an empty answer was truncated")
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"time"
+)
+
+const TypeTSIG uint16 = 250 // transaction signature, RFC 8945
+
+// TSIG error codes, sent in the TSIG record of a NOTAUTH response
+const (
+	TSIGErrorBadSig  uint16 = 16
+	TSIGErrorBadKey  uint16 = 17
+	TSIGErrorBadTime uint16 = 18
+)
+
+// tsigAlgorithms maps the supported algorithm names to their hash.
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha1":   sha1.New,
+	"hmac-sha256": sha256.New,
+	"hmac-sha512": sha512.New,
+}
+
+// TSIGKeyConfig is a shared key for signing messages. Secret is base64
+// encoded and Algorithm defaults to hmac-sha256.
+type TSIGKeyConfig struct {
+	Name      string `json:"name"`
+	Algorithm string `json:"algorithm"`
+	Secret    string `json:"secret"`
+}
+
+type tsigKey struct {
+	name      string
+	algorithm string
+	secret    []byte
+}
+
+// LoadTSIGKeys decodes the configured keys.
+func LoadTSIGKeys(keys []TSIGKeyConfig) (map[string]tsigKey, error) {
+	loaded := make(map[string]tsigKey)
+	for _, key := range keys {
+		name := canonicalTarget(key.Name)
+		if name == "" {
+			return nil, fmt.Errorf("TSIG key %q: invalid name", key.Name)
+		}
+		algorithm := canonicalTarget(key.Algorithm)
+		if algorithm == "" {
+			algorithm = "hmac-sha256"
+		}
+		if tsigAlgorithms[algorithm] == nil {
+			return nil, fmt.Errorf("TSIG key %q: unsupported algorithm %q", key.Name, key.Algorithm)
+		}
+		secret, err := base64.StdEncoding.DecodeString(key.Secret)
+		if err != nil || len(secret) == 0 {
+			return nil, fmt.Errorf("TSIG key %q: secret must be base64", key.Name)
+		}
+		loaded[name] = tsigKey{name: name, algorithm: algorithm, secret: secret}
+	}
+	return loaded, nil
+}
+
+// TSIGRecord is the decoded rdata of a TSIG record.
+type TSIGRecord struct {
+	KeyName    string
+	Algorithm  string
+	TimeSigned uint64
+	Fudge      uint16
+	MAC        []byte
+	OriginalID uint16
+	Error      uint16
+	OtherData  []byte
+}
+
+// tsigContext is a verified request signature, needed to sign the response.
+type tsigContext struct {
+	key        tsigKey
+	requestMAC []byte
+}
+
+// splitTSIG finds a TSIG record at the end of the additional section. It
+// returns the message as it was before signing, with the record removed and
+// the original ID restored, or a nil record for unsigned messages.
+func splitTSIG(message []byte) ([]byte, *TSIGRecord, error) {
+	var header DNSHeader
+	err := binary.Read(bytes.NewReader(message), binary.BigEndian, &header)
+	if err != nil {
+		return nil, nil, err
+	}
+	if header.NumAdditionals == 0 {
+		return message, nil, nil
+	}
+
+	// Walk to the start of the last record
+	offset := DNSHeaderSizeBytes
+	for i := 0; i < int(header.NumQuestions); i++ {
+		_, offset, err = readMessageName(message, offset)
+		if err != nil {
+			return nil, nil, err
+		}
+		offset += 4
+	}
+	records := int(header.NumAnswers) + int(header.NumAuthorities) + int(header.NumAdditionals)
+	lastStart := offset
+	for i := 0; i < records; i++ {
+		lastStart = offset
+		_, offset, err = readMessageName(message, offset)
+		if err != nil {
+			return nil, nil, err
+		}
+		if offset+10 > len(message) {
+			return nil, nil, fmt.Errorf("%w: resource record truncated", ErrMalformed)
+		}
+		offset += 10 + int(binary.BigEndian.Uint16(message[offset+8:]))
+	}
+	if offset > len(message) {
+		return nil, nil, fmt.Errorf("%w: resource record data truncated", ErrMalformed)
+	}
+
+	keyName, rdataStart, err := readMessageName(message, lastStart)
+	if err != nil {
+		return nil, nil, err
+	}
+	if binary.BigEndian.Uint16(message[rdataStart:]) != TypeTSIG {
+		return message, nil, nil
+	}
+
+	record, err := parseTSIG(message[rdataStart+10 : offset])
+	if err != nil {
+		return nil, nil, err
+	}
+	record.KeyName = canonicalTarget(keyName)
+
+	unsigned := append([]byte(nil), message[:lastStart]...)
+	binary.BigEndian.PutUint16(unsigned[0:], record.OriginalID)
+	binary.BigEndian.PutUint16(unsigned[10:], header.NumAdditionals-1)
+	return unsigned, &record, nil
+}
+
+// parseTSIG decodes TSIG rdata. The algorithm name is never compressed.
+func parseTSIG(resourceData []byte) (TSIGRecord, error) {
+	var record TSIGRecord
+
+	algorithm, offset, err := readMessageName(resourceData, 0)
+	if err != nil {
+		return record, err
+	}
+	record.Algorithm = canonicalTarget(algorithm)
+
+	if offset+10 > len(resourceData) {
+		return record, fmt.Errorf("%w: TSIG record truncated", ErrMalformed)
+	}
+	record.TimeSigned = uint64(binary.BigEndian.Uint16(resourceData[offset:]))<<32 | uint64(binary.BigEndian.Uint32(resourceData[offset+2:]))
+	record.Fudge = binary.BigEndian.Uint16(resourceData[offset+6:])
+	macSize := int(binary.BigEndian.Uint16(resourceData[offset+8:]))
+	offset += 10
+
+	if offset+macSize+6 > len(resourceData) {
+		return record, fmt.Errorf("%w: TSIG record truncated", ErrMalformed)
+	}
+	record.MAC = resourceData[offset : offset+macSize]
+	offset += macSize
+	record.OriginalID = binary.BigEndian.Uint16(resourceData[offset:])
+	record.Error = binary.BigEndian.Uint16(resourceData[offset+2:])
+	otherSize := int(binary.BigEndian.Uint16(resourceData[offset+4:]))
+	offset += 6
+
+	if offset+otherSize != len(resourceData) {
+		return record, fmt.Errorf("%w: TSIG record length doesn't match its contents", ErrMalformed)
+	}
+	record.OtherData = resourceData[offset:]
+
+	return record, nil
+}
+
+// verifyTSIG checks the signature of a request (RFC 8945 section 5.2),
+// returning the TSIG error code on failure.
+func verifyTSIG(unsigned []byte, record TSIGRecord, now time.Time) (*tsigContext, uint16) {
+	key, ok := currentConfig().tsigKeys[record.KeyName]
+	if !ok || key.algorithm != record.Algorithm {
+		return nil, TSIGErrorBadKey
+	}
+
+	expected := tsigMAC(key, nil, unsigned, record)
+	if !hmac.Equal(expected, record.MAC) {
+		return nil, TSIGErrorBadSig
+	}
+
+	// A request signed at the wrong time still gets a signed answer
+	context := &tsigContext{key: key, requestMAC: record.MAC}
+	signed := int64(record.TimeSigned)
+	if now.Unix() > signed+int64(record.Fudge) || now.Unix() < signed-int64(record.Fudge) {
+		return context, TSIGErrorBadTime
+	}
+
+	return context, 0
+}
+
+// tsigMAC computes the MAC of a message and the TSIG variables. Responses
+// include the request's MAC first.
+func tsigMAC(key tsigKey, requestMAC []byte, message []byte, record TSIGRecord) []byte {
+	mac := hmac.New(tsigAlgorithms[key.algorithm], key.secret)
+
+	if requestMAC != nil {
+		binary.Write(mac, binary.BigEndian, uint16(len(requestMAC)))
+		mac.Write(requestMAC)
+	}
+	mac.Write(message)
+
+	var variables bytes.Buffer
+	writeDomainName(&variables, key.name)
+	Write(&variables, ClassANY)
+	Write(&variables, uint32(0))
+	writeDomainName(&variables, key.algorithm)
+	writeTSIGTimes(&variables, record)
+	Write(&variables, record.Error)
+	Write(&variables, uint16(len(record.OtherData)))
+	variables.Write(record.OtherData)
+	mac.Write(variables.Bytes())
+
+	return mac.Sum(nil)
+}
+
+func writeTSIGTimes(buffer *bytes.Buffer, record TSIGRecord) {
+	Write(buffer, uint16(record.TimeSigned>>32))
+	Write(buffer, uint32(record.TimeSigned))
+	Write(buffer, record.Fudge)
+}
+
+// tsigResponseRecord builds the TSIG record for a response. With a verified
+// context the response is signed, and the context then holds its MAC for the
+// next message of a zone transfer to chain from; an error response to a
+// request that failed verification carries an empty MAC. BADTIME responses
+// carry the server's time in the other data (RFC 8945 section 5.2.3).
+func tsigResponseRecord(context *tsigContext, record TSIGRecord, responseBytes []byte, tsigError uint16, now time.Time) DNSResourceRecord {
+	response := TSIGRecord{
+		KeyName:    record.KeyName,
+		Algorithm:  record.Algorithm,
+		TimeSigned: uint64(now.Unix()),
+		Fudge:      record.Fudge,
+		OriginalID: record.OriginalID,
+		Error:      tsigError,
+	}
+	if tsigError == TSIGErrorBadTime {
+		var otherData bytes.Buffer
+		Write(&otherData, uint16(uint64(now.Unix())>>32))
+		Write(&otherData, uint32(now.Unix()))
+		response.OtherData = otherData.Bytes()
+	}
+	if context != nil {
+		response.MAC = tsigMAC(context.key, context.requestMAC, responseBytes, response)
+		context.requestMAC = response.MAC
+	}
+
+	return tsigResourceRecord(response)
+}
+
+// tsigContinuationRecord signs a message after the first of a zone transfer.
+// Its MAC covers the previous message's MAC, the message and only the timers
+// of the TSIG variables (RFC 8945 section 5.3.1).
+func tsigContinuationRecord(context *tsigContext, record TSIGRecord, responseBytes []byte, now time.Time) DNSResourceRecord {
+	response := TSIGRecord{
+		KeyName:    record.KeyName,
+		Algorithm:  record.Algorithm,
+		TimeSigned: uint64(now.Unix()),
+		Fudge:      record.Fudge,
+		OriginalID: record.OriginalID,
+	}
+
+	mac := hmac.New(tsigAlgorithms[context.key.algorithm], context.key.secret)
+	binary.Write(mac, binary.BigEndian, uint16(len(context.requestMAC)))
+	mac.Write(context.requestMAC)
+	mac.Write(responseBytes)
+	var timers bytes.Buffer
+	writeTSIGTimes(&timers, response)
+	mac.Write(timers.Bytes())
+	response.MAC = mac.Sum(nil)
+	context.requestMAC = response.MAC
+
+	return tsigResourceRecord(response)
+}
+
+// tsigResourceRecord encodes a TSIG record.
+func tsigResourceRecord(record TSIGRecord) DNSResourceRecord {
+	var resourceData bytes.Buffer
+	writeDomainName(&resourceData, record.Algorithm)
+	writeTSIGTimes(&resourceData, record)
+	Write(&resourceData, uint16(len(record.MAC)))
+	resourceData.Write(record.MAC)
+	Write(&resourceData, record.OriginalID)
+	Write(&resourceData, record.Error)
+	Write(&resourceData, uint16(len(record.OtherData)))
+	resourceData.Write(record.OtherData)
+
+	return DNSResourceRecord{
+		DomainName:         record.KeyName,
+		Type:               TypeTSIG,
+		Class:              ClassANY,
+		ResourceData:       resourceData.Bytes(),
+		ResourceDataLength: uint16(resourceData.Len()),
+	}
+}
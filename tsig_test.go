@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+var testKey = TSIGKeyConfig{Name: "transfer-key", Secret: "c2VjcmV0LXNlY3JldC1zZWNyZXQ="}
+
+// signRequest appends a TSIG record signed with key at the given time.
+func signRequest(t *testing.T, requestBytes []byte, key TSIGKeyConfig, signedAt time.Time) []byte {
+	t.Helper()
+
+	keys, err := LoadTSIGKeys([]TSIGKeyConfig{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := keys[canonicalTarget(key.Name)]
+
+	record := TSIGRecord{
+		KeyName:    loaded.name,
+		Algorithm:  loaded.algorithm,
+		TimeSigned: uint64(signedAt.Unix()),
+		Fudge:      300,
+		OriginalID: binary.BigEndian.Uint16(requestBytes),
+	}
+	record.MAC = tsigMAC(loaded, nil, requestBytes, record)
+
+	signed := bytes.NewBuffer(append([]byte(nil), requestBytes...))
+	binary.BigEndian.PutUint16(signed.Bytes()[10:], binary.BigEndian.Uint16(requestBytes[10:])+1)
+	writeResourceRecord(signed, tsigResourceRecord(record), make(nameCompression))
+	return signed.Bytes()
+}
+
+// requestMAC returns the MAC of a signed request.
+func requestMAC(t *testing.T, requestBytes []byte) []byte {
+	t.Helper()
+	_, record, err := splitTSIG(requestBytes)
+	if err != nil || record == nil {
+		t.Fatal("request isn't signed:", err)
+	}
+	return record.MAC
+}
+
+func TestLoadTSIGKeysRejectsBadKeys(t *testing.T) {
+	bad := []TSIGKeyConfig{
+		{Name: "", Secret: testKey.Secret},
+		{Name: "key", Algorithm: "hmac-md5", Secret: testKey.Secret},
+		{Name: "key", Secret: "not base64!"},
+	}
+	for _, key := range bad {
+		_, err := LoadTSIGKeys([]TSIGKeyConfig{key})
+		if err == nil {
+			t.Errorf("LoadTSIGKeys(%+v) succeeded, want an error", key)
+		}
+	}
+}
+
+func TestVerifyTSIG(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TSIGKeys = []TSIGKeyConfig{testKey}
+	useConfig(t, cfg)
+
+	now := time.Now()
+	request := signRequest(t, buildQuery(7, 0, "example.com", TypeSOA), testKey, now)
+
+	unsigned, record, err := splitTSIG(request)
+	if err != nil || record == nil {
+		t.Fatal("splitTSIG found no signature:", err)
+	}
+	if !bytes.Equal(unsigned, buildQuery(7, 0, "example.com", TypeSOA)) {
+		t.Error("splitTSIG didn't restore the unsigned message")
+	}
+	_, tsigError := verifyTSIG(unsigned, *record, now)
+	if tsigError != 0 {
+		t.Errorf("verifyTSIG of a good signature = error %d", tsigError)
+	}
+
+	tampered := append([]byte(nil), request...)
+	tampered[DNSHeaderSizeBytes+1] ^= 0x20
+	unsigned, record, _ = splitTSIG(tampered)
+	_, tsigError = verifyTSIG(unsigned, *record, now)
+	if tsigError != TSIGErrorBadSig {
+		t.Errorf("verifyTSIG of a tampered message = error %d, want BADSIG", tsigError)
+	}
+
+	unsigned, record, _ = splitTSIG(request)
+	_, tsigError = verifyTSIG(unsigned, *record, now.Add(time.Hour))
+	if tsigError != TSIGErrorBadTime {
+		t.Errorf("verifyTSIG an hour late = error %d, want BADTIME", tsigError)
+	}
+
+	unknown := signRequest(t, buildQuery(7, 0, "example.com", TypeSOA), TSIGKeyConfig{Name: "other-key", Secret: testKey.Secret}, now)
+	unsigned, record, _ = splitTSIG(unknown)
+	_, tsigError = verifyTSIG(unsigned, *record, now)
+	if tsigError != TSIGErrorBadKey {
+		t.Errorf("verifyTSIG with an unknown key = error %d, want BADKEY", tsigError)
+	}
+}
+
+func TestBadTimeResponseCarriesServerTime(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TSIGKeys = []TSIGKeyConfig{testKey}
+	useConfig(t, cfg)
+
+	now := time.Now()
+	request := signRequest(t, buildQuery(7, 0, "example.com", TypeSOA), testKey, now.Add(-time.Hour))
+	unsigned, record, _ := splitTSIG(request)
+	context, tsigError := verifyTSIG(unsigned, *record, now)
+	if tsigError != TSIGErrorBadTime || context == nil {
+		t.Fatalf("verifyTSIG = error %d, want BADTIME with a context", tsigError)
+	}
+
+	responseBytes := buildQuery(7, FlagResponse|RcodeNotAuth, "example.com", TypeSOA)
+	resourceRecord := tsigResponseRecord(context, *record, responseBytes, tsigError, now)
+	response, err := parseTSIG(resourceRecord.ResourceData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.OtherData) != 6 {
+		t.Fatalf("BADTIME other data is %d bytes, want 6", len(response.OtherData))
+	}
+	serverTime := uint64(binary.BigEndian.Uint16(response.OtherData))<<32 | uint64(binary.BigEndian.Uint32(response.OtherData[2:]))
+	if serverTime != uint64(now.Unix()) {
+		t.Errorf("BADTIME other data = %d, want the server time %d", serverTime, now.Unix())
+	}
+
+	keys, _ := LoadTSIGKeys([]TSIGKeyConfig{testKey})
+	response.KeyName = canonicalTarget(testKey.Name)
+	expected := tsigMAC(keys[response.KeyName], record.MAC, responseBytes, response)
+	if !hmac.Equal(expected, response.MAC) {
+		t.Error("the BADTIME response MAC doesn't cover its other data")
+	}
+}
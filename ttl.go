@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+)
+
+// clampTTL applies the configured TTL floor and cap. A limit of 0 is not
+// applied.
+func clampTTL(ttl uint32) uint32 {
+	if currentConfig().MinTTL > 0 && ttl < currentConfig().MinTTL {
+		ttl = currentConfig().MinTTL
+	}
+	if currentConfig().MaxTTL > 0 && ttl > currentConfig().MaxTTL {
+		ttl = currentConfig().MaxTTL
+	}
+	return ttl
+}
+
+// ttlIn returns an entry's own TTL, falling back to its zone's default.
+// Entries of different types under one name each keep their own TTL.
+func (name Name) ttlIn(zone *ZoneConfig) uint32 {
+	if name.TTL > 0 {
+		return name.TTL
+	}
+	return zone.TTL()
+}
+
+// uniformRRsetTTLs gives every record of an RRset the lowest TTL among them,
+// as the records of one RRset must share a TTL (RFC 2181 section 5.2).
+func uniformRRsetTTLs(resourceRecords []DNSResourceRecord) {
+	type rrset struct {
+		name       string
+		recordType uint16
+	}
+	lowest := make(map[rrset]uint32)
+	for _, resourceRecord := range resourceRecords {
+		key := rrset{strings.ToLower(resourceRecord.DomainName), resourceRecord.Type}
+		if ttl, ok := lowest[key]; !ok || resourceRecord.TimeToLive < ttl {
+			lowest[key] = resourceRecord.TimeToLive
+		}
+	}
+	for i := range resourceRecords {
+		resourceRecords[i].TimeToLive = lowest[rrset{strings.ToLower(resourceRecords[i].DomainName), resourceRecords[i].Type}]
+	}
+}
+
+// clampTTLs finalizes the TTL of every record, whatever TTL it was stored or
+// built with: it jitters them when configured and then bounds them.
+func clampTTLs(resourceRecords []DNSResourceRecord) {
+	jitterTTLs(resourceRecords)
+	for i := range resourceRecords {
+		resourceRecords[i].TimeToLive = clampTTL(resourceRecords[i].TimeToLive)
+	}
+}
+
+// jitterTTLs moves each TTL by a random amount within TTLJitterPercent of
+// it, so caches that fetched a record together don't all expire it at once.
+// Every record of an RRset moves by the same amount to keep their TTLs equal.
+func jitterTTLs(resourceRecords []DNSResourceRecord) {
+	percent := min(currentConfig().TTLJitterPercent, 100)
+	if percent == 0 {
+		return
+	}
+
+	type rrset struct {
+		name       string
+		recordType uint16
+	}
+	jittered := make(map[rrset]uint32)
+	for i, resourceRecord := range resourceRecords {
+		key := rrset{strings.ToLower(resourceRecord.DomainName), resourceRecord.Type}
+		ttl, ok := jittered[key]
+		if !ok {
+			spread := int64(resourceRecord.TimeToLive) * int64(percent) / 100
+			ttl = uint32(int64(resourceRecord.TimeToLive) + rand.Int63n(2*spread+1) - spread)
+			jittered[key] = ttl
+		}
+		resourceRecords[i].TimeToLive = ttl
+	}
+}
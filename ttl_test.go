@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestServedTTLsAreBounded(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MinTTL = 30
+	cfg.MaxTTL = 3600
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	useConfig(t, cfg,
+		NameModel{Name: "long.example.com", Address: "192.0.2.10", TTL: 604800},
+		NameModel{Name: "short.example.com", Address: "192.0.2.20", TTL: 5},
+		NameModel{Name: "www.example.com", Address: "192.0.2.30", TTL: 300},
+	)
+
+	tests := map[string]uint32{
+		"long.example.com":  3600,
+		"short.example.com": 30,
+		"www.example.com":   300,
+	}
+	for name, want := range tests {
+		response := query(t, name, TypeA)
+		if len(response.Answers) != 1 || response.Answers[0].TimeToLive != want {
+			t.Errorf("%s: answers %+v, want one with TTL %d", name, response.Answers, want)
+		}
+	}
+}
+
+func TestForwardedTTLsAreBounded(t *testing.T) {
+	upstream := startUpstream(t, func(requestBytes []byte) []byte {
+		return upstreamResponse(requestBytes, RcodeNoError, DNSResourceRecord{
+			DomainName: "www.example.net", Type: TypeA, Class: ClassINET, TimeToLive: 86400,
+			ResourceData: net.IPv4(192, 0, 2, 40).To4(), ResourceDataLength: 4,
+		})
+	})
+	cfg := DefaultConfig()
+	cfg.MaxTTL = 3600
+	useForwarding(t, cfg, upstream.address)
+
+	response := query(t, "www.example.net", TypeA)
+	if len(response.Answers) != 1 || response.Answers[0].TimeToLive != 3600 {
+		t.Errorf("forwarded answers %+v, want one capped to TTL 3600", response.Answers)
+	}
+}
+
+func TestJitteredTTLsStayInBand(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TTLJitterPercent = 10
+	cfg.MaxTTL = 1050
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	useConfig(t, cfg,
+		NameModel{Name: "www.example.com", Address: "192.0.2.10", TTL: 1000},
+		NameModel{Name: "www.example.com", Address: "192.0.2.11", TTL: 1000},
+	)
+
+	served := make(map[uint32]bool)
+	for i := 0; i < 200; i++ {
+		response := query(t, "www.example.com", TypeA)
+		if len(response.Answers) != 2 {
+			t.Fatalf("got %d answers, want 2", len(response.Answers))
+		}
+		ttl := response.Answers[0].TimeToLive
+		if response.Answers[1].TimeToLive != ttl {
+			t.Fatalf("TTLs %d and %d within one RRset", ttl, response.Answers[1].TimeToLive)
+		}
+		// Jitter is applied before the bounds, so MaxTTL still caps it
+		if ttl < 900 || ttl > 1050 {
+			t.Fatalf("TTL %d outside 900 to 1050", ttl)
+		}
+		served[ttl] = true
+	}
+	if len(served) < 10 {
+		t.Errorf("only %d distinct TTLs in 200 responses", len(served))
+	}
+
+	// Off by default
+	cfg.TTLJitterPercent = DefaultConfig().TTLJitterPercent
+	useConfig(t, cfg, NameModel{Name: "www.example.com", Address: "192.0.2.10", TTL: 1000})
+	for i := 0; i < 20; i++ {
+		if response := query(t, "www.example.com", TypeA); response.Answers[0].TimeToLive != 1000 {
+			t.Fatalf("TTL %d without jitter, want 1000", response.Answers[0].TimeToLive)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpcodeUpdate marks a dynamic update message (RFC 2136).
+const OpcodeUpdate uint16 = 5
+
+// Classes with special meaning in the prerequisite and update sections
+const (
+	ClassNONE uint16 = 254
+	ClassANY  uint16 = 255
+)
+
+// Response codes added by RFC 2136
+const (
+	RcodeYXDomain uint16 = 6  // a name that should not exist does
+	RcodeYXRRSet  uint16 = 7  // an RRset that should not exist does
+	RcodeNXRRSet  uint16 = 8  // an RRset that should exist doesn't
+	RcodeNotAuth  uint16 = 9  // the server isn't authoritative for the zone
+	RcodeNotZone  uint16 = 10 // a name is outside the zone
+)
+
+// updateLock serializes updates, so the prerequisites of one update still
+// hold while its changes are applied.
+var updateLock sync.Mutex
+
+// handleUpdate answers an UPDATE message. Only zones listing the client in
+// allowUpdate, or the TSIG key that signed the update in updateKeys, accept
+// updates. Signed updates get signed responses.
+func handleUpdate(ctx context.Context, queryHeader DNSHeader, requestBytes []byte, responseWriter DNSResponseWriter) {
+	rcode := RcodeFormatError
+	var zoneSection []DNSResourceRecord
+
+	now := time.Now()
+	var signature *tsigContext
+	var tsigError uint16
+
+	unsigned, tsigRecord, err := splitTSIG(requestBytes)
+	if err == nil && tsigRecord != nil {
+		signature, tsigError = verifyTSIG(unsigned, *tsigRecord, now)
+	}
+
+	var message DNSResponse
+	if err == nil {
+		message, err = parseResponse(unsigned)
+	}
+	switch {
+	case err != nil:
+		logDebug("Error decoding update message:", err)
+		rcode = rcodeForError(err)
+	case tsigError != 0:
+		logWarn("Refused update from", responseWriter.RemoteAddr(), "with bad TSIG for key", tsigRecord.KeyName, ": error", tsigError)
+		zoneSection = message.Questions
+		rcode = RcodeNotAuth
+	default:
+		keyName := ""
+		if signature != nil {
+			keyName = signature.key.name
+		}
+		zoneSection = message.Questions
+		rcode = applyUpdate(ctx, message, clientIP(responseWriter.RemoteAddr()), keyName)
+	}
+	if len(zoneSection) > 1 {
+		zoneSection = zoneSection[:1]
+	}
+
+	responseFlags := FlagResponse | OpcodeUpdate<<11 | rcode
+	responseBuffer := zoneResponse(queryHeader.TransactionID, responseFlags, zoneSection)
+
+	// Failed verifications other than BADTIME are answered unsigned
+	if tsigRecord != nil {
+		if tsigError != 0 && tsigError != TSIGErrorBadTime {
+			signature = nil
+		}
+		tsigResourceRecord := tsigResponseRecord(signature, *tsigRecord, responseBuffer.Bytes(), tsigError, now)
+		binary.BigEndian.PutUint16(responseBuffer.Bytes()[10:], 1)
+		writeResourceRecord(responseBuffer, tsigResourceRecord, make(nameCompression))
+	}
+
+	logQuery(zoneSection, responseWriter.RemoteAddr(), responseFlags, SourceLocal)
+
+	captureExchange(requestBytes, responseBuffer.Bytes(), responseWriter)
+
+	err = responseWriter.WriteResponse(responseBuffer.Bytes())
+	if err != nil {
+		logWarn("Error sending response to", responseWriter.RemoteAddr(), ":", err)
+	}
+}
+
+// zoneResponse starts the response to an UPDATE or NOTIFY, echoing the zone
+// section.
+func zoneResponse(transactionID uint16, responseFlags uint16, zoneSection []DNSResourceRecord) *bytes.Buffer {
+	var responseBuffer bytes.Buffer
+	Write(&responseBuffer, DNSHeader{TransactionID: transactionID, Flags: responseFlags, NumQuestions: uint16(len(zoneSection))})
+	for _, zone := range zoneSection {
+		writeDomainName(&responseBuffer, zone.DomainName)
+		Write(&responseBuffer, zone.Type)
+		Write(&responseBuffer, zone.Class)
+	}
+	return &responseBuffer
+}
+
+// applyUpdate checks the zone, the client and the prerequisites of an
+// update and then applies its changes, returning the response code. Records
+// added by an update keep the TTL given in the message.
+func applyUpdate(ctx context.Context, message DNSResponse, clientIP net.IP, keyName string) uint16 {
+	if len(message.Questions) != 1 || message.Questions[0].Type != TypeSOA {
+		return RcodeFormatError
+	}
+
+	zoneName := canonicalTarget(message.Questions[0].DomainName)
+	zone := exactZone(zoneName)
+	if zone == nil {
+		return RcodeNotAuth
+	}
+	if !zone.AllowsUpdate(clientIP, keyName) {
+		logWarn("Refused update of zone", zoneName, "from", clientIP)
+		return RcodeRefused
+	}
+
+	updateLock.Lock()
+	defer updateLock.Unlock()
+
+	rcode := checkPrerequisites(ctx, zoneName, message.Answers)
+	if rcode != RcodeNoError {
+		return rcode
+	}
+
+	rcode = checkUpdates(zoneName, message.Authorities)
+	if rcode != RcodeNoError {
+		return rcode
+	}
+
+	// Records deleted by the same update aren't credited against the
+	// records it adds
+	models, err := currentConfig().store.All(ctx)
+	if err != nil {
+		logError("Error loading entries:", err)
+		return RcodeServerFailure
+	}
+	models = slices.Clone(models)
+	for _, update := range message.Authorities {
+		if update.Class == ClassINET {
+			model, _ := updateModel(update)
+			models = putEntry(models, model, false)
+		}
+	}
+	err = checkRecordLimits(currentConfig(), models)
+	if err != nil {
+		logWarn("Refused update of zone", zoneName, "from", clientIP, ":", err)
+		return rcodeForError(err)
+	}
+
+	for _, update := range message.Authorities {
+		err := applyUpdateRecord(ctx, zoneName, update)
+		if err != nil {
+			logError("Error applying update to zone", zoneName, ":", err)
+			return RcodeServerFailure
+		}
+	}
+	if len(message.Authorities) > 0 {
+		zoneChanged(zoneName)
+	}
+
+	logInfo("Applied", len(message.Authorities), "update(s) to zone", zoneName, "from", clientIP)
+	return RcodeNoError
+}
+
+// checkPrerequisites evaluates the prerequisite section (RFC 2136 section
+// 3.2). Value-dependent prerequisites must match a stored RRset exactly.
+func checkPrerequisites(ctx context.Context, zoneName string, prerequisites []DNSResourceRecord) uint16 {
+	expected := make(map[string][][]byte)
+
+	for _, prerequisite := range prerequisites {
+		name := canonicalTarget(prerequisite.DomainName)
+		if prerequisite.TimeToLive != 0 {
+			return RcodeFormatError
+		}
+		if !inZone(name, zoneName) {
+			return RcodeNotZone
+		}
+
+		switch prerequisite.Class {
+		case ClassANY, ClassNONE:
+			if len(prerequisite.ResourceData) != 0 {
+				return RcodeFormatError
+			}
+			exists, err := rrsetExists(ctx, name, zoneName, prerequisite.Type)
+			if err != nil {
+				return RcodeServerFailure
+			}
+			switch {
+			case prerequisite.Class == ClassANY && prerequisite.Type == TypeANY && !exists:
+				return RcodeNameError
+			case prerequisite.Class == ClassANY && !exists:
+				return RcodeNXRRSet
+			case prerequisite.Class == ClassNONE && prerequisite.Type == TypeANY && exists:
+				return RcodeYXDomain
+			case prerequisite.Class == ClassNONE && exists:
+				return RcodeYXRRSet
+			}
+		case ClassINET:
+			key := name + "/" + typeName(prerequisite.Type)
+			expected[key] = append(expected[key], prerequisite.ResourceData)
+		default:
+			return RcodeFormatError
+		}
+	}
+
+	for key, wanted := range expected {
+		name, recordType, _ := strings.Cut(key, "/")
+		stored, err := storedResourceData(ctx, name, recordType)
+		if err != nil {
+			return RcodeServerFailure
+		}
+		if !sameResourceDataSet(wanted, stored) {
+			return RcodeNXRRSet
+		}
+	}
+
+	return RcodeNoError
+}
+
+// checkUpdates prescans the update section (RFC 2136 section 3.4.1) so a
+// bad record is refused before anything is changed.
+func checkUpdates(zoneName string, updates []DNSResourceRecord) uint16 {
+	for _, update := range updates {
+		if !inZone(canonicalTarget(update.DomainName), zoneName) {
+			return RcodeNotZone
+		}
+
+		switch update.Class {
+		case ClassINET:
+			if update.Type == TypeANY {
+				return RcodeFormatError
+			}
+			_, err := updateModel(update)
+			if err != nil {
+				logDebug("Refusing update of", update.DomainName, ":", err)
+				return RcodeNotImplemented
+			}
+		case ClassANY:
+			if update.TimeToLive != 0 || len(update.ResourceData) != 0 {
+				return RcodeFormatError
+			}
+		case ClassNONE:
+			if update.TimeToLive != 0 || update.Type == TypeANY {
+				return RcodeFormatError
+			}
+		default:
+			return RcodeFormatError
+		}
+	}
+	return RcodeNoError
+}
+
+// applyUpdateRecord makes the change of one checked update record: class IN
+// adds a record, or changes the TTL of an existing one, class ANY deletes an
+// RRset or every record of the name and class NONE deletes one record. The
+// SOA and NS RRsets at the zone apex are never deleted (RFC 2136 section
+// 3.4.2.3), so deleting every RRset of the apex leaves them.
+func applyUpdateRecord(ctx context.Context, zoneName string, update DNSResourceRecord) error {
+	name := canonicalTarget(update.DomainName)
+	if name == zoneName && update.Class != ClassINET && (update.Type == TypeSOA || update.Type == TypeNS) {
+		logDebug("Ignoring deletion of the", typeName(update.Type), "records of zone", zoneName)
+		return nil
+	}
+
+	switch update.Class {
+	case ClassINET:
+		model, _ := updateModel(update)
+		entries, err := currentConfig().store.Lookup(ctx, name, model.Type)
+		if err != nil {
+			return err
+		}
+		for i, entry := range entries {
+			stored, err := ToName(entry)
+			if err != nil || !bytes.Equal(stored.ResourceData, update.ResourceData) {
+				continue
+			}
+			if entry.TTL == model.TTL {
+				return nil
+			}
+			entries[i].TTL = model.TTL
+			return rewriteRRset(ctx, name, model.Type, entries)
+		}
+		return currentConfig().store.Put(ctx, model, false)
+	case ClassANY:
+		if update.Type != TypeANY {
+			_, err := currentConfig().store.Delete(ctx, name, typeName(update.Type))
+			return err
+		}
+		if name != zoneName {
+			_, err := currentConfig().store.Delete(ctx, name, "")
+			return err
+		}
+		entries, err := currentConfig().store.Lookup(ctx, name, "")
+		if err != nil {
+			return err
+		}
+		deleted := make(map[string]bool)
+		for _, entry := range entries {
+			recordType := recordTypeName(entry)
+			if recordType == "SOA" || recordType == "NS" || deleted[recordType] {
+				continue
+			}
+			_, err = currentConfig().store.Delete(ctx, name, recordType)
+			if err != nil {
+				return err
+			}
+			deleted[recordType] = true
+		}
+		return nil
+	}
+
+	// Deleting one record rewrites the RRset without it
+	recordType := typeName(update.Type)
+	entries, err := currentConfig().store.Lookup(ctx, name, recordType)
+	if err != nil {
+		return err
+	}
+	kept := slices.DeleteFunc(entries, func(entry NameModel) bool {
+		stored, err := ToName(entry)
+		return err == nil && bytes.Equal(stored.ResourceData, update.ResourceData)
+	})
+	if len(kept) == len(entries) {
+		return nil
+	}
+	return rewriteRRset(ctx, name, recordType, kept)
+}
+
+// rewriteRRset replaces the entries stored under a name and type.
+func rewriteRRset(ctx context.Context, name string, recordType string, entries []NameModel) error {
+	return currentConfig().store.Replace(ctx, name, recordType, entries)
+}
+
+// updateModel converts an added record into a store entry. Only address
+// records can be added by an update.
+func updateModel(update DNSResourceRecord) (NameModel, error) {
+	model := NameModel{Name: canonicalTarget(update.DomainName), Type: typeName(update.Type), TTL: update.TimeToLive}
+	switch {
+	case update.Type == TypeA && len(update.ResourceData) == net.IPv4len,
+		update.Type == TypeAAAA && len(update.ResourceData) == net.IPv6len:
+		model.Address = net.IP(update.ResourceData).String()
+	default:
+		return model, fmt.Errorf("only A and AAAA records can be added by an update, not %s", typeName(update.Type))
+	}
+	_, err := ToName(model)
+	return model, err
+}
+
+// rrsetExists reports whether records of the type are stored under the
+// name, with TypeANY asking whether the name has any records. The zone's
+// SOA exists at its apex without being stored.
+func rrsetExists(ctx context.Context, name string, zoneName string, recordType uint16) (bool, error) {
+	if name == zoneName && (recordType == TypeSOA || recordType == TypeANY) {
+		return true, nil
+	}
+	storeType := ""
+	if recordType != TypeANY {
+		storeType = typeName(recordType)
+	}
+	entries, err := currentConfig().store.Lookup(ctx, name, storeType)
+	return len(entries) > 0, err
+}
+
+// storedResourceData returns the wire rdata of the stored RRset.
+func storedResourceData(ctx context.Context, name string, recordType string) ([][]byte, error) {
+	entries, err := currentConfig().store.Lookup(ctx, name, recordType)
+	if err != nil {
+		return nil, err
+	}
+	resourceData := make([][]byte, 0, len(entries))
+	for _, entry := range entries {
+		stored, err := ToName(entry)
+		if err == nil {
+			resourceData = append(resourceData, stored.ResourceData)
+		}
+	}
+	return resourceData, nil
+}
+
+// sameResourceDataSet compares two RRsets as sets of rdata.
+func sameResourceDataSet(a [][]byte, b [][]byte) bool {
+	contains := func(set [][]byte, resourceData []byte) bool {
+		return slices.ContainsFunc(set, func(other []byte) bool { return bytes.Equal(other, resourceData) })
+	}
+	for _, resourceData := range a {
+		if !contains(b, resourceData) {
+			return false
+		}
+	}
+	for _, resourceData := range b {
+		if !contains(a, resourceData) {
+			return false
+		}
+	}
+	return true
+}
+
+// inZone reports whether a canonical name is at or below the zone apex.
+func inZone(name string, zoneName string) bool {
+	return name == zoneName || strings.HasSuffix(name, "."+zoneName)
+}
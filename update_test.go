@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func updateConfig(t *testing.T, entries ...NameModel) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.TSIGKeys = []TSIGKeyConfig{testKey}
+	cfg.Zones = []ZoneConfig{{Name: "example.com", AllowUpdate: []string{"198.51.100.0/24"}, UpdateKeys: []string{testKey.Name}}}
+	useConfig(t, cfg, entries...)
+}
+
+// updateMessage builds an update of example.com with the given changes.
+func updateMessage(prerequisites []DNSResourceRecord, updates ...DNSResourceRecord) DNSResponse {
+	return DNSResponse{
+		Questions:   []DNSResourceRecord{{DomainName: "example.com", Type: TypeSOA, Class: ClassINET}},
+		Answers:     prerequisites,
+		Authorities: updates,
+	}
+}
+
+func addRecord(name string, address string, ttl uint32) DNSResourceRecord {
+	ip := net.ParseIP(address).To4()
+	return DNSResourceRecord{DomainName: name, Type: TypeA, Class: ClassINET, TimeToLive: ttl, ResourceData: ip, ResourceDataLength: uint16(len(ip))}
+}
+
+var updateClient = net.ParseIP("198.51.100.7")
+
+func TestUpdateKeepsMessageTTL(t *testing.T) {
+	updateConfig(t)
+	ctx := context.Background()
+
+	rcode := applyUpdate(ctx, updateMessage(nil, addRecord("www.example.com", "192.0.2.10", 42)), updateClient, "")
+	if rcode != RcodeNoError {
+		t.Fatalf("rcode = %d, want NOERROR", rcode)
+	}
+	response := query(t, "www.example.com", TypeA)
+	if len(response.Answers) != 1 || response.Answers[0].TimeToLive != 42 {
+		t.Fatalf("answers = %+v, want one record with TTL 42", response.Answers)
+	}
+
+	rcode = applyUpdate(ctx, updateMessage(nil, addRecord("www.example.com", "192.0.2.10", 600)), updateClient, "")
+	if rcode != RcodeNoError {
+		t.Fatalf("rcode = %d, want NOERROR", rcode)
+	}
+	response = query(t, "www.example.com", TypeA)
+	if len(response.Answers) != 1 || response.Answers[0].TimeToLive != 600 {
+		t.Errorf("answers = %+v, want the same record with its TTL changed to 600", response.Answers)
+	}
+}
+
+// encodeUpdate encodes an UPDATE message with the sections of message.
+func encodeUpdate(transactionID uint16, message DNSResponse) []byte {
+	var requestBuffer bytes.Buffer
+	Write(&requestBuffer, DNSHeader{
+		TransactionID:  transactionID,
+		Flags:          OpcodeUpdate << 11,
+		NumQuestions:   uint16(len(message.Questions)),
+		NumAnswers:     uint16(len(message.Answers)),
+		NumAuthorities: uint16(len(message.Authorities)),
+	})
+	for _, zone := range message.Questions {
+		writeDomainName(&requestBuffer, zone.DomainName)
+		Write(&requestBuffer, zone.Type)
+		Write(&requestBuffer, zone.Class)
+	}
+	compression := make(nameCompression)
+	for _, record := range append(slices.Clone(message.Answers), message.Authorities...) {
+		record.ResourceDataLength = uint16(len(record.ResourceData))
+		writeResourceRecord(&requestBuffer, record, compression)
+	}
+	return requestBuffer.Bytes()
+}
+
+// rrsetRecord is a prerequisite or deletion naming an RRset by its class.
+func rrsetRecord(name string, recordType uint16, class uint16) DNSResourceRecord {
+	return DNSResourceRecord{DomainName: name, Type: recordType, Class: class}
+}
+
+func TestUpdateAddsRecord(t *testing.T) {
+	updateConfig(t)
+
+	request := encodeUpdate(5, updateMessage(nil, addRecord("new.example.com", "192.0.2.50", 300)))
+	response := serve(t, newWriter("198.51.100.7", true), request)
+	if responseCode(response) != RcodeNoError || response.Header.Flags>>11&0x0f != OpcodeUpdate {
+		t.Fatalf("flags = %#x, want an UPDATE response with NOERROR", response.Header.Flags)
+	}
+	if len(response.Questions) != 1 || response.Questions[0].DomainName != "example.com" {
+		t.Errorf("zone section = %+v, want example.com echoed", response.Questions)
+	}
+
+	answer := query(t, "new.example.com", TypeA)
+	if answerAddress(answer) != "192.0.2.50" {
+		t.Errorf("the added record isn't served: %+v", answer.Answers)
+	}
+}
+
+func TestUpdatePrerequisiteFailures(t *testing.T) {
+	updateConfig(t, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+	ctx := context.Background()
+
+	tests := []struct {
+		name         string
+		prerequisite DNSResourceRecord
+		rcode        uint16
+	}{
+		{"RRset exists", rrsetRecord("www.example.com", TypeAAAA, ClassANY), RcodeNXRRSet},
+		{"name is in use", rrsetRecord("missing.example.com", TypeANY, ClassANY), RcodeNameError},
+		{"RRset doesn't exist", rrsetRecord("www.example.com", TypeA, ClassNONE), RcodeYXRRSet},
+		{"name isn't in use", rrsetRecord("www.example.com", TypeANY, ClassNONE), RcodeYXDomain},
+		{"RRset matches", addRecord("www.example.com", "192.0.2.99", 0), RcodeNXRRSet},
+		{"outside the zone", rrsetRecord("www.example.org", TypeA, ClassANY), RcodeNotZone},
+	}
+	for _, test := range tests {
+		message := updateMessage([]DNSResourceRecord{test.prerequisite}, addRecord("added.example.com", "192.0.2.60", 60))
+		rcode := applyUpdate(ctx, message, updateClient, "")
+		if rcode != test.rcode {
+			t.Errorf("%s: rcode = %d, want %d", test.name, rcode, test.rcode)
+		}
+	}
+
+	if response := query(t, "added.example.com", TypeA); len(response.Answers) != 0 {
+		t.Error("an update was applied although its prerequisites failed")
+	}
+
+	message := updateMessage([]DNSResourceRecord{addRecord("www.example.com", "192.0.2.10", 0)}, addRecord("added.example.com", "192.0.2.60", 60))
+	if rcode := applyUpdate(ctx, message, updateClient, ""); rcode != RcodeNoError {
+		t.Errorf("update with a matching RRset prerequisite: rcode = %d, want NOERROR", rcode)
+	}
+}
+
+func TestUpdateDeletes(t *testing.T) {
+	updateConfig(t,
+		NameModel{Name: "www.example.com", Address: "192.0.2.10"},
+		NameModel{Name: "www.example.com", Address: "192.0.2.11"},
+		NameModel{Name: "mail.example.com", Address: "192.0.2.20"},
+		NameModel{Name: "mail.example.com", Type: "TXT", TXT: "v=spf1 -all"},
+	)
+	ctx := context.Background()
+
+	deleteOne := addRecord("www.example.com", "192.0.2.10", 0)
+	deleteOne.Class = ClassNONE
+	rcode := applyUpdate(ctx, updateMessage(nil, deleteOne, rrsetRecord("mail.example.com", TypeANY, ClassANY)), updateClient, "")
+	if rcode != RcodeNoError {
+		t.Fatalf("rcode = %d, want NOERROR", rcode)
+	}
+
+	if response := query(t, "www.example.com", TypeA); len(response.Answers) != 1 || answerAddress(response) != "192.0.2.11" {
+		t.Errorf("www.example.com answers %+v, want only 192.0.2.11 left", response.Answers)
+	}
+	if response := query(t, "mail.example.com", TypeTXT); len(response.Answers) != 0 {
+		t.Error("deleting every RRset of mail.example.com left its TXT record")
+	}
+}
+
+func TestUpdateKeepsApexSOAAndNS(t *testing.T) {
+	updateConfig(t,
+		NameModel{Name: "example.com", Address: "192.0.2.1"},
+		NameModel{Name: "example.com", Type: "TXT", TXT: "v=spf1 -all"},
+		NameModel{Name: "example.com", Type: "NS", Target: "ns1.example.net"},
+	)
+	ctx := context.Background()
+
+	updates := []DNSResourceRecord{
+		rrsetRecord("example.com", TypeSOA, ClassANY),
+		rrsetRecord("example.com", TypeNS, ClassANY),
+		rrsetRecord("example.com", TypeANY, ClassANY),
+	}
+	for _, update := range updates {
+		if rcode := applyUpdate(ctx, updateMessage(nil, update), updateClient, ""); rcode != RcodeNoError {
+			t.Fatalf("deleting type %d at the apex: rcode %d, want NOERROR", update.Type, rcode)
+		}
+	}
+
+	// Everything else at the apex is gone, but not the NS RRset
+	stored := storedEntries(t, currentConfig(), "example.com")
+	if len(stored) != 1 || recordTypeName(stored[0]) != "NS" {
+		t.Errorf("the apex holds %+v after the deletes, want only the NS entry", stored)
+	}
+	for _, qtype := range []uint16{TypeSOA, TypeNS} {
+		if response := query(t, "example.com", qtype); len(response.Answers) == 0 {
+			t.Errorf("the apex lost its type %d records", qtype)
+		}
+	}
+}
+
+func TestUpdateAccess(t *testing.T) {
+	updateConfig(t)
+	add := updateMessage(nil, addRecord("new.example.com", "192.0.2.50", 300))
+
+	response := serve(t, newWriter("203.0.113.5", true), encodeUpdate(6, add))
+	if responseCode(response) != RcodeRefused {
+		t.Errorf("unsigned update from elsewhere: rcode = %d, want REFUSED", responseCode(response))
+	}
+
+	signed := signRequest(t, encodeUpdate(7, add), testKey, time.Now())
+	w := newWriter("203.0.113.5", true)
+	response = serve(t, w, signed)
+	if responseCode(response) != RcodeNoError {
+		t.Errorf("signed update: rcode = %d, want NOERROR", responseCode(response))
+	}
+	if _, record, err := splitTSIG(w.responses[0]); err != nil || record == nil {
+		t.Error("the response to a signed update isn't signed")
+	}
+
+	other := updateMessage(nil, addRecord("new.example.org", "192.0.2.50", 300))
+	other.Questions[0].DomainName = "example.org"
+	if rcode := applyUpdate(context.Background(), other, updateClient, ""); rcode != RcodeNotAuth {
+		t.Errorf("update of another zone: rcode = %d, want NOTAUTH", rcode)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upstream selection strategies for ForwardingConfig.Strategy
+const (
+	StrategyOrdered    = "ordered" // config order, the default
+	StrategyRoundRobin = "round-robin"
+	StrategyRandom     = "random"
+	StrategyFastest    = "fastest" // lowest recent latency first
+)
+
+type upstreamState struct {
+	// latency is a moving average of successful exchanges, 0 until one succeeds
+	latency   time.Duration
+	skipUntil time.Time
+}
+
+// upstreamPool tracks the health of each upstream and orders them for a
+// query according to the configured strategy.
+type upstreamPool struct {
+	sync.Mutex
+	states map[string]*upstreamState
+	next   int
+}
+
+var upstreamHealth = &upstreamPool{states: make(map[string]*upstreamState)}
+
+// state returns the upstream's state. Callers hold the lock.
+func (p *upstreamPool) state(upstream string) *upstreamState {
+	state, ok := p.states[upstream]
+	if !ok {
+		state = &upstreamState{}
+		p.states[upstream] = state
+	}
+	return state
+}
+
+// Order returns the upstreams in the order to try them. Upstreams that
+// failed recently go last, so they are only used when every other one fails.
+func (p *upstreamPool) Order(upstreams []string, strategy string, now time.Time) []string {
+	p.Lock()
+	defer p.Unlock()
+
+	ordered := slices.Clone(upstreams)
+
+	switch strings.ToLower(strategy) {
+	case StrategyRoundRobin:
+		if len(ordered) > 0 {
+			start := p.next % len(ordered)
+			ordered = append(ordered[start:], ordered[:start]...)
+			p.next++
+		}
+	case StrategyRandom:
+		rand.Shuffle(len(ordered), func(i, j int) { ordered[i], ordered[j] = ordered[j], ordered[i] })
+	case StrategyFastest:
+		// Untried upstreams have no latency yet and are tried first
+		slices.SortStableFunc(ordered, func(a, b string) int {
+			return int(p.state(a).latency - p.state(b).latency)
+		})
+	}
+
+	slices.SortStableFunc(ordered, func(a, b string) int {
+		aSkipped := now.Before(p.state(a).skipUntil)
+		bSkipped := now.Before(p.state(b).skipUntil)
+		switch {
+		case aSkipped && !bSkipped:
+			return 1
+		case !aSkipped && bSkipped:
+			return -1
+		}
+		return 0
+	})
+
+	return ordered
+}
+
+func (p *upstreamPool) RecordSuccess(upstream string, latency time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+
+	state := p.state(upstream)
+	if state.latency == 0 {
+		state.latency = latency
+	} else {
+		state.latency = (state.latency*7 + latency) / 8
+	}
+	state.skipUntil = time.Time{}
+}
+
+func (p *upstreamPool) RecordFailure(upstream string, now time.Time, holdoff time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.state(upstream).skipUntil = now.Add(holdoff)
+}
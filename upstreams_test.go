@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestUpstreamOrder(t *testing.T) {
+	upstreams := []string{"a", "b", "c"}
+	now := time.Now()
+
+	pool := &upstreamPool{states: make(map[string]*upstreamState)}
+	var rotations []string
+	for i := 0; i < 4; i++ {
+		rotations = append(rotations, fmt.Sprint(pool.Order(upstreams, StrategyRoundRobin, now)))
+	}
+	if got := fmt.Sprint(rotations); got != "[[a b c] [b c a] [c a b] [a b c]]" {
+		t.Errorf("round-robin orders = %s", got)
+	}
+
+	pool = &upstreamPool{states: make(map[string]*upstreamState)}
+	pool.RecordSuccess("a", 30*time.Millisecond)
+	pool.RecordSuccess("b", 10*time.Millisecond)
+	pool.RecordSuccess("c", 20*time.Millisecond)
+	if got := pool.Order(upstreams, StrategyFastest, now); !slices.Equal(got, []string{"b", "c", "a"}) {
+		t.Errorf("fastest order = %v, want b c a", got)
+	}
+
+	// A failed upstream goes last until its holdoff ends
+	pool.RecordFailure("b", now, time.Minute)
+	if got := pool.Order(upstreams, StrategyFastest, now); !slices.Equal(got, []string{"c", "a", "b"}) {
+		t.Errorf("fastest order after b failed = %v, want c a b", got)
+	}
+	if got := pool.Order(upstreams, StrategyOrdered, now.Add(2*time.Minute)); !slices.Equal(got, upstreams) {
+		t.Errorf("ordered after the holdoff = %v, want the config order", got)
+	}
+
+	got := pool.Order(upstreams, StrategyRandom, now.Add(2*time.Minute))
+	slices.Sort(got)
+	if !slices.Equal(got, upstreams) {
+		t.Errorf("random order %v doesn't hold each upstream once", got)
+	}
+}
+
+func TestForwardingFailsOver(t *testing.T) {
+	broken := startUpstream(t, func(requestBytes []byte) []byte { return requestBytes[:4] })
+	working := startUpstream(t, upstreamAddress(300))
+	cfg := DefaultConfig()
+	cfg.Forwarding.Strategy = StrategyOrdered
+	useForwarding(t, cfg, broken.address, working.address)
+
+	for _, name := range []string{"one.example.net", "two.example.net"} {
+		response := query(t, name, TypeA)
+		if responseCode(response) != RcodeNoError || len(response.Answers) != 1 {
+			t.Errorf("%s: rcode %d with %d answers, want the working upstream's answer", name, responseCode(response), len(response.Answers))
+		}
+	}
+
+	// The broken upstream is skipped once it has failed
+	if queries := broken.queries.Load(); queries != 1 {
+		t.Errorf("the broken upstream got %d queries, want 1", queries)
+	}
+	if queries := working.queries.Load(); queries != 2 {
+		t.Errorf("the working upstream got %d queries, want 2", queries)
+	}
+}
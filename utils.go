@@ -3,8 +3,48 @@ package main
 import (
 	"encoding/binary"
 	"io"
+	"strings"
+
+	"golang.org/x/net/idna"
 )
 
+// idnaProfile maps names the way resolvers do on lookup, but still accepts
+// underscore labels such as _443._tcp used by service records.
+var idnaProfile = idna.New(idna.MapForLookup(), idna.Transitional(false), idna.StrictDomainName(false))
+
 func Write(w io.Writer, data interface{}) error {
 	return binary.Write(w, binary.BigEndian, data)
 }
+
+// ToASCIIName converts a possibly internationalized domain name into its
+// A-label (punycode) form, which is how names are stored and compared.
+func ToASCIIName(name string) (string, error) {
+	return idnaProfile.ToASCII(name)
+}
+
+// CanonicalName converts a name into the single form used for storage and
+// matching: A-labels, lowercase, without a trailing dot. This makes
+// "Example.COM." from the API match a query for "example.com".
+func CanonicalName(name string) (string, error) {
+	asciiName, err := ToASCIIName(strings.TrimSuffix(name, "."))
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(strings.TrimSuffix(asciiName, ".")), nil
+}
+
+// ToUnicodeName converts an A-label domain name back into its Unicode form
+// for display. Names that fail to convert are returned unchanged.
+func ToUnicodeName(name string) string {
+	unicodeName, err := idnaProfile.ToUnicode(name)
+	if err != nil {
+		return name
+	}
+	return unicodeName
+}
+
+// pointerTo returns a pointer to a copy of value, for optional fields such
+// as NameModel.Enabled.
+func pointerTo[T any](value T) *T {
+	return &value
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestCanonicalName(t *testing.T) {
+	tests := map[string]string{
+		"Example.COM.":              "example.com",
+		"bücher.example":            "xn--bcher-kva.example",
+		"BÜCHER.example.":           "xn--bcher-kva.example",
+		"xn--bcher-kva.example":     "xn--bcher-kva.example",
+		"_443._tcp.www.example.com": "_443._tcp.www.example.com",
+	}
+	for name, want := range tests {
+		got, err := CanonicalName(name)
+		if err != nil || got != want {
+			t.Errorf("CanonicalName(%q) = %q, %v; want %q", name, got, err, want)
+		}
+	}
+
+	if ToUnicodeName("xn--bcher-kva.example") != "bücher.example" {
+		t.Error("ToUnicodeName didn't restore the U-label")
+	}
+}
+
+func TestAddAndResolveUnicodeName(t *testing.T) {
+	apiConfig(t)
+
+	w := apiRequest(t, http.MethodPost, "/add-entry", `{"name":"München.example.com","address":"192.0.2.10"}`, testToken)
+	if w.Code != http.StatusOK {
+		t.Fatalf("adding a Unicode name: %d %s", w.Code, w.Body)
+	}
+
+	for _, name := range []string{"xn--mnchen-3ya.example.com", "münchen.example.com"} {
+		response := query(t, name, TypeA)
+		if len(response.Answers) != 1 || response.Answers[0].DomainName != "xn--mnchen-3ya.example.com" {
+			t.Errorf("query for %s answered %+v, want the A-label name's address", name, response.Answers)
+		}
+	}
+
+	var entries []NameModel
+	json.NewDecoder(apiRequest(t, http.MethodGet, "/entries?unicode=true", "", "").Body).Decode(&entries)
+	if len(entries) != 1 || entries[0].Name != "münchen.example.com" {
+		t.Errorf("/entries?unicode=true listed %+v, want münchen.example.com", entries)
+	}
+}
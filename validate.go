@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ValidateDomainName checks that a stored name is a well formed A-label
+// domain name: at most 253 characters in labels of 1 to 63 letters, digits,
+// hyphens or underscores.
+func ValidateDomainName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty domain name")
+	}
+	if len(name) > 253 {
+		return fmt.Errorf("domain name %q longer than 253 characters", name)
+	}
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return fmt.Errorf("domain name %q has a label that is empty or longer than 63 characters", name)
+		}
+		for _, c := range label {
+			isAlphanumeric := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+			if !isAlphanumeric && c != '-' && c != '_' {
+				return fmt.Errorf("domain name %q contains invalid character %q", name, c)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ValidateStoreFile loads a store file and runs every entry through the same
+// validation as the loader, additionally reporting duplicate entries. It
+// returns one error per problem found.
+func ValidateStoreFile(path string) []error {
+	// The loader treats a missing file as empty, but validating one is a mistake
+	_, err := os.Stat(path)
+	if err != nil {
+		return []error{err}
+	}
+
+	models, err := GetNameModelsFrom(path)
+	if err != nil {
+		return []error{err}
+	}
+
+	var problems []error
+	for i, model := range models {
+		_, err := ToName(model)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("entry %d (%s): %v", i+1, model.Name, err))
+		}
+	}
+
+	_, duplicates := removeDuplicateEntries(models)
+
+	return append(problems, duplicates...)
+}
+
+// removeDuplicateEntries drops entries that repeat an earlier entry's name,
+// type and rdata, returning the remaining entries and one error per dropped
+// duplicate. Distinct records sharing a name are all kept. Invalid entries
+// are left in place for the loader to report.
+func removeDuplicateEntries(models []NameModel) ([]NameModel, []error) {
+	var duplicates []error
+	unique := make([]NameModel, 0, len(models))
+	seen := make(map[string]int)
+
+	for i, model := range models {
+		name, err := ToName(model)
+		if err != nil {
+			unique = append(unique, model)
+			continue
+		}
+
+		key := fmt.Sprintf("%s/%d/%s", strings.ToLower(name.Name), name.Type, hex.EncodeToString(name.ResourceData))
+		if first, ok := seen[key]; ok {
+			duplicates = append(duplicates, fmt.Errorf("entry %d (%s): duplicate of entry %d", i+1, model.Name, first))
+			continue
+		}
+
+		seen[key] = i + 1
+		unique = append(unique, model)
+	}
+
+	return unique, duplicates
+}
+
+// runValidate implements the -validate command-line mode and returns the
+// process exit code.
+func runValidate(path string) int {
+	problems := ValidateStoreFile(path)
+	if len(problems) == 0 {
+		fmt.Println(path, "is valid")
+		return 0
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	fmt.Println(path, "has", len(problems), "problem(s)")
+	return 1
+}
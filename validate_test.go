@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeRawStoreFile writes a store file as given, valid or not.
+func writeRawStoreFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "names.json")
+	err := os.WriteFile(path, []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidateStoreFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		problems int
+	}{
+		{"clean", `[{"name": "www.example.com", "address": "192.0.2.1"}, {"name": "www.example.com", "type": "TXT", "txt": "hi"}]`, 0},
+		{"invalid address", `[{"name": "www.example.com", "address": "192.0.2.300"}]`, 1},
+		{"bad name", `[{"name": "bad..example.com", "address": "192.0.2.1"}]`, 1},
+		{"unknown type", `[{"name": "www.example.com", "type": "WKS", "address": "192.0.2.1"}]`, 1},
+		{"duplicates", `[{"name": "www.example.com", "address": "192.0.2.1"}, {"name": "WWW.example.com.", "address": "192.0.2.1"}]`, 1},
+		{"several problems", `[{"name": "a.example.com", "address": "x"}, {"name": "b.example.com", "type": "TXT", "txt": "hi"}, {"name": "b.example.com", "type": "TXT", "txt": "hi"}]`, 2},
+		{"not JSON", `[{"name": `, 1},
+	}
+	for _, test := range tests {
+		problems := ValidateStoreFile(writeRawStoreFile(t, test.contents))
+		if len(problems) != test.problems {
+			t.Errorf("%s: got problems %v, want %d", test.name, problems, test.problems)
+		}
+	}
+
+	if problems := ValidateStoreFile(filepath.Join(t.TempDir(), "missing.json")); len(problems) != 1 {
+		t.Errorf("a missing file gave %v, want an error", problems)
+	}
+}
+
+func TestRunValidateExitCode(t *testing.T) {
+	if code := runValidate(writeRawStoreFile(t, `[{"name": "www.example.com", "address": "192.0.2.1"}]`)); code != 0 {
+		t.Errorf("a clean file exited %d, want 0", code)
+	}
+	if code := runValidate(writeRawStoreFile(t, `[{"name": "www.example.com", "address": "x"}]`)); code == 0 {
+		t.Error("an invalid file exited 0")
+	}
+}
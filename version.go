@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Build information, set at build time with e.g.
+//
+//	go build -ldflags "-X main.Version=1.2.0 -X main.Commit=$(git rev-parse --short HEAD) -X main.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// versionString describes the running build. When the commit wasn't set with
+// -ldflags, the VCS revision recorded by the Go toolchain is used instead.
+func versionString() string {
+	commit := Commit
+	if commit == "unknown" {
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range info.Settings {
+				if setting.Key == "vcs.revision" && len(setting.Value) >= 7 {
+					commit = setting.Value[:7]
+				}
+			}
+		}
+	}
+	return fmt.Sprintf("LightDNS %s (commit %s, built %s)", Version, commit, BuildDate)
+}
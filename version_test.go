@@ -0,0 +1,30 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestVersionString(t *testing.T) {
+	previous := []string{Version, Commit, BuildDate}
+	t.Cleanup(func() { Version, Commit, BuildDate = previous[0], previous[1], previous[2] })
+
+	Version, Commit, BuildDate = "1.2.0", "abc1234", "2024-05-01T10:00:00Z"
+	if got := versionString(); got != "LightDNS 1.2.0 (commit abc1234, built 2024-05-01T10:00:00Z)" {
+		t.Errorf("versionString() = %q", got)
+	}
+
+	Version, Commit, BuildDate = "dev", "unknown", "unknown"
+	format := regexp.MustCompile(`^LightDNS dev \(commit ([0-9a-f]{7}|unknown), built unknown\)$`)
+	if got := versionString(); !format.MatchString(got) {
+		t.Errorf("versionString() without ldflags = %q", got)
+	}
+}
+
+func TestVersionFlag(t *testing.T) {
+	cfg, err := ParseConfig([]string{"-config", filepath.Join(t.TempDir(), "missing.json"), "-version"})
+	if err != nil || !cfg.ShowVersion {
+		t.Errorf("-version gave ShowVersion %v, %v", cfg.ShowVersion, err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// ViewConfig maps client networks to their own store file, giving them a
+// separate set of answers (split-horizon DNS).
+type ViewConfig struct {
+	Name      string   `json:"name"`
+	Networks  []string `json:"networks"`
+	StoreFile string   `json:"storeFile"`
+}
+
+type View struct {
+	Name     string
+	Networks []*net.IPNet
+	Store    Store
+}
+
+// LoadViews parses the configured views. They are matched in config order.
+func LoadViews(viewConfigs []ViewConfig) ([]View, error) {
+	loadedViews := make([]View, 0, len(viewConfigs))
+
+	for _, viewConfig := range viewConfigs {
+		if viewConfig.StoreFile == "" {
+			return nil, fmt.Errorf("view %q has no storeFile", viewConfig.Name)
+		}
+
+		view := View{Name: viewConfig.Name, Store: &FileStore{Path: viewConfig.StoreFile}}
+		for _, network := range viewConfig.Networks {
+			_, ipNet, err := net.ParseCIDR(network)
+			if err != nil {
+				return nil, fmt.Errorf("view %q: invalid network %q", viewConfig.Name, network)
+			}
+			view.Networks = append(view.Networks, ipNet)
+		}
+
+		loadedViews = append(loadedViews, view)
+	}
+
+	return loadedViews, nil
+}
+
+// modelsForClient returns the entries answering a client: those of the
+// first view containing the address the query came from, or else those of
+// the configured store. With GeoIP the names the country specific store file
+// for geoIP defines are answered from it instead; every other name falls
+// back to the configured store.
+func modelsForClient(ctx context.Context, sourceIP net.IP, geoIP net.IP) ([]NameModel, error) {
+	cfg := currentConfig()
+	for _, view := range cfg.views {
+		for _, network := range view.Networks {
+			if sourceIP != nil && network.Contains(sourceIP) {
+				return view.Store.All(ctx)
+			}
+		}
+	}
+
+	models, err := cfg.store.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	storeFile := storeFileForCountry(geoIP)
+	if storeFile == "" {
+		return models, nil
+	}
+	countryModels, err := (&FileStore{Path: storeFile}).All(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	countryNames := make(map[string]bool, len(countryModels))
+	for _, model := range countryModels {
+		countryNames[canonicalTarget(model.Name)] = true
+	}
+	for _, model := range models {
+		if !countryNames[canonicalTarget(model.Name)] {
+			countryModels = append(countryModels, model)
+		}
+	}
+	return countryModels, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// writeStoreFile saves entries to a store file in a temp directory.
+func writeStoreFile(t *testing.T, entries ...NameModel) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "names.json")
+	err := SaveNameModels(path, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// answerAddress returns the address in a single A answer.
+func answerAddress(response DNSResponse) string {
+	if len(response.Answers) != 1 {
+		return ""
+	}
+	return net.IP(response.Answers[0].ResourceData).String()
+}
+
+func TestViewsAnswerByClientNetwork(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	cfg.Views = []ViewConfig{{
+		Name:      "internal",
+		Networks:  []string{"10.0.0.0/8"},
+		StoreFile: writeStoreFile(t, NameModel{Name: "www.example.com", Address: "10.0.0.10"}),
+	}}
+	useConfig(t, cfg, NameModel{Name: "www.example.com", Address: "192.0.2.10"})
+
+	tests := map[string]string{
+		"10.1.2.3":     "10.0.0.10",
+		"192.0.2.1":    "192.0.2.10",
+		"2001:db8::53": "192.0.2.10",
+	}
+	for client, want := range tests {
+		response := serve(t, newWriter(client, true), buildQuery(1, 0, "www.example.com", TypeA))
+		if got := answerAddress(response); got != want {
+			t.Errorf("client %s got %q, want %s", client, got, want)
+		}
+	}
+}
+
+func TestLoadViewsRejectsBadViews(t *testing.T) {
+	bad := []ViewConfig{
+		{Name: "no store", Networks: []string{"10.0.0.0/8"}},
+		{Name: "bad network", Networks: []string{"10.0.0.0"}, StoreFile: "internal.json"},
+	}
+	for _, view := range bad {
+		_, err := LoadViews([]ViewConfig{view})
+		if err == nil {
+			t.Errorf("LoadViews accepted the %s view", view.Name)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// Answer orderings for Config.RRsetOrder
+const (
+	RRsetOrderFixed  = "fixed"  // store order, the default
+	RRsetOrderCyclic = "cyclic" // rotated by one on every response
+	RRsetOrderRandom = "random" // shuffled on every response
+)
+
+// rrsetRotations counts the responses per RRset for cyclic ordering.
+var rrsetRotations = struct {
+	sync.Mutex
+	counts map[cacheKey]uint64
+}{counts: make(map[cacheKey]uint64)}
+
+// orderRRset reorders the records of one RRset as configured.
+func orderRRset(records []DNSResourceRecord, key cacheKey, order string) []DNSResourceRecord {
+	if len(records) < 2 {
+		return records
+	}
+
+	switch order {
+	case RRsetOrderRandom:
+		rand.Shuffle(len(records), func(i, j int) { records[i], records[j] = records[j], records[i] })
+	case RRsetOrderCyclic:
+		rrsetRotations.Lock()
+		rotation := rrsetRotations.counts[key]
+		rrsetRotations.counts[key] = rotation + 1
+		rrsetRotations.Unlock()
+
+		shift := int(rotation % uint64(len(records)))
+		records = append(append(make([]DNSResourceRecord, 0, len(records)), records[shift:]...), records[:shift]...)
+	}
+	return records
+}
+
+// weightedOrder reorders records by a weighted random draw without
+// replacement, so each record is first with probability proportional to its
+// weight. Records without a weight count as weight 1. The top-level math/rand
+// functions are safe for concurrent use, so concurrent queries need no lock.
+func weightedOrder(records []DNSResourceRecord, weights []uint32) []DNSResourceRecord {
+	keys := make([]float64, len(records))
+	for i := range records {
+		weight := float64(weights[i])
+		if weight == 0 {
+			weight = 1
+		}
+		// Efraimidis-Spirakis: sorting by u^(1/w) descending is a weighted draw
+		keys[i] = math.Pow(rand.Float64(), 1/weight)
+	}
+
+	order := make([]int, len(records))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return keys[order[i]] > keys[order[j]] })
+
+	ordered := make([]DNSResourceRecord, 0, len(records))
+	for _, i := range order {
+		ordered = append(ordered, records[i])
+	}
+	return ordered
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestWeightedOrderFollowsWeights(t *testing.T) {
+	records := []DNSResourceRecord{addressRecord("www.example.com", 60), addressRecord("www.example.com", 60)}
+	records[1].ResourceData = []byte{192, 0, 2, 2}
+
+	const draws = 4000
+	heavyFirst := 0
+	for i := 0; i < draws; i++ {
+		ordered := weightedOrder(append([]DNSResourceRecord(nil), records...), []uint32{1, 9})
+		if len(ordered) != 2 {
+			t.Fatalf("weightedOrder returned %d records, want 2", len(ordered))
+		}
+		if ordered[0].ResourceData[3] == 2 {
+			heavyFirst++
+		}
+	}
+	share := float64(heavyFirst) / draws
+	if share < 0.85 || share > 0.95 {
+		t.Errorf("the weight 9 record came first %.1f%% of the time, want about 90%%", share*100)
+	}
+}
+
+func TestWeightedAnswersKeepEveryRecord(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com"}}
+	useConfig(t, cfg,
+		NameModel{Name: "www.example.com", Address: "192.0.2.1", Weight: 1},
+		NameModel{Name: "www.example.com", Address: "192.0.2.2", Weight: 3},
+		NameModel{Name: "www.example.com", Address: "192.0.2.3"},
+	)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		response := query(t, "www.example.com", TypeA)
+		if len(response.Answers) != 3 {
+			t.Fatalf("got %d answers, want all 3 records", len(response.Answers))
+		}
+		seen[net.IP(response.Answers[0].ResourceData).String()] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("50 weighted answers always started with %v", seen)
+	}
+}
+
+// answerOrder returns the addresses of the A answers in order.
+func answerOrder(response DNSResponse) string {
+	var addresses []string
+	for _, answer := range response.Answers {
+		addresses = append(addresses, net.IP(answer.ResourceData).String())
+	}
+	return strings.Join(addresses, ",")
+}
+
+func orderConfig(t *testing.T, order string) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.RRsetOrder = order
+	useConfig(t, cfg,
+		NameModel{Name: "www.example.com", Address: "192.0.2.1"},
+		NameModel{Name: "www.example.com", Address: "192.0.2.2"},
+		NameModel{Name: "www.example.com", Address: "192.0.2.3"},
+	)
+}
+
+func TestCyclicOrderRotates(t *testing.T) {
+	orderConfig(t, RRsetOrderCyclic)
+
+	rotations := []string{"192.0.2.1,192.0.2.2,192.0.2.3", "192.0.2.2,192.0.2.3,192.0.2.1", "192.0.2.3,192.0.2.1,192.0.2.2"}
+	first := slices.Index(rotations, answerOrder(query(t, "www.example.com", TypeA)))
+	if first < 0 {
+		t.Fatal("the first cyclic answer isn't a rotation of the RRset")
+	}
+	for i := 1; i <= 6; i++ {
+		got := answerOrder(query(t, "www.example.com", TypeA))
+		if want := rotations[(first+i)%3]; got != want {
+			t.Fatalf("response %d ordered %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestRandomOrderVaries(t *testing.T) {
+	orderConfig(t, RRsetOrderRandom)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 60; i++ {
+		order := answerOrder(query(t, "www.example.com", TypeA))
+		if strings.Count(order, ",") != 2 {
+			t.Fatalf("random order dropped records: %s", order)
+		}
+		seen[order] = true
+	}
+	if len(seen) < 3 {
+		t.Errorf("60 random answers used only %d orderings", len(seen))
+	}
+}
+
+func TestFixedOrderKeepsStoreOrder(t *testing.T) {
+	orderConfig(t, RRsetOrderFixed)
+
+	for i := 0; i < 5; i++ {
+		if got := answerOrder(query(t, "www.example.com", TypeA)); got != "192.0.2.1,192.0.2.2,192.0.2.3" {
+			t.Fatalf("fixed order answered %s", got)
+		}
+	}
+}
+
+func TestWeightedRecordsAtTheApex(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com", NameServers: []string{"ns1.example.com", "ns2.example.com"}}}
+	useConfig(t, cfg,
+		NameModel{Name: "example.com", Address: "192.0.2.1", Weight: 1},
+		NameModel{Name: "example.com", Address: "192.0.2.2", Weight: 3},
+	)
+
+	// ANY at the apex mixes the zone's SOA and NS records into the draw
+	for i := 0; i < 20; i++ {
+		response := query(t, "example.com", TypeANY)
+		counts := make(map[uint16]int)
+		for _, answer := range response.Answers {
+			counts[answer.Type]++
+		}
+		if counts[TypeA] != 2 || counts[TypeSOA] != 1 || counts[TypeNS] != 2 {
+			t.Fatalf("ANY answers %+v, want both A records, the SOA and both NS", response.Answers)
+		}
+
+		response = query(t, "example.com", TypeNS)
+		if len(response.Answers) != 2 || response.Answers[0].Type != TypeNS || response.Answers[1].Type != TypeNS {
+			t.Fatalf("NS answers %+v, want the zone's two NS records", response.Answers)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ExportZoneFile writes the entries at or below origin in BIND master file
+// syntax. An empty origin exports every entry relative to the root. The SOA
+// is included when origin is a configured zone.
+func ExportZoneFile(w io.Writer, models []NameModel, origin string) error {
+	fmt.Fprintf(w, "$ORIGIN %s\n", absoluteName(origin))
+	zone := findZone(origin)
+	fmt.Fprintf(w, "$TTL %d\n", zone.TTL())
+
+	if origin != "" && zone != nil && canonicalTarget(zone.Name) == origin {
+		primaryNS, mailbox := zone.soaNames()
+		fmt.Fprintf(w, "@\t%d\tIN\tSOA\t%s %s %d %d %d %d %d\n", valueOr(zone.Minimum, 300),
+			absoluteName(primaryNS), absoluteName(mailbox), zone.CurrentSerial(), valueOr(zone.Refresh, 3600),
+			valueOr(zone.Retry, 600), valueOr(zone.Expire, 604800), valueOr(zone.Minimum, 300))
+		for _, nsResourceRecord := range zone.NSRecords() {
+			fmt.Fprintf(w, "@\tIN\tNS\t%s\n", formatWireResourceData(nsResourceRecord))
+		}
+	}
+
+	for _, model := range models {
+		name := canonicalTarget(model.Name)
+		if origin != "" && name != origin && !strings.HasSuffix(name, "."+origin) {
+			continue
+		}
+
+		resourceData, err := formatResourceData(model)
+		if err != nil {
+			return fmt.Errorf("error exporting %s: %v", model.Name, err)
+		}
+
+		// Entries without their own TTL use the $TTL default
+		ttl := ""
+		if model.TTL > 0 {
+			ttl = fmt.Sprintf("%d\t", model.TTL)
+		}
+		_, err = fmt.Fprintf(w, "%s\t%sIN\t%s\t%s\n", relativeName(name, origin), ttl, recordTypeName(model), resourceData)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// relativeName writes an owner name relative to the origin where possible.
+func relativeName(name string, origin string) string {
+	switch {
+	case origin != "" && name == origin:
+		return "@"
+	case origin != "" && strings.HasSuffix(name, "."+origin):
+		return strings.TrimSuffix(name, "."+origin)
+	}
+	return absoluteName(name)
+}
+
+// absoluteName writes a canonical name fully qualified, with a trailing dot.
+func absoluteName(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+// quoteCharacterString quotes a string for the master file, escaping quotes,
+// backslashes and unprintable bytes as \DDD.
+func quoteCharacterString(value string) string {
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '"' || c == '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+		case c < 0x20 || c > 0x7e:
+			fmt.Fprintf(&quoted, "\\%03d", c)
+		default:
+			quoted.WriteByte(c)
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
+
+// formatResourceData renders an entry's rdata in presentation format.
+func formatResourceData(model NameModel) (string, error) {
+	_, resourceData, err := encodeResourceData(model)
+	if err != nil {
+		return "", err
+	}
+
+	switch recordTypeName(model) {
+	case "HINFO":
+		return quoteCharacterString(model.HINFO.CPU) + " " + quoteCharacterString(model.HINFO.OS), nil
+	case "TXT":
+		var quoted []string
+		for _, chunk := range txtChunks(model.TXT) {
+			quoted = append(quoted, quoteCharacterString(chunk))
+		}
+		return strings.Join(quoted, " "), nil
+	case "NAPTR":
+		replacement, _ := naptrReplacement(*model.NAPTR)
+		return fmt.Sprintf("%d %d %s %s %s %s", model.NAPTR.Order, model.NAPTR.Preference, quoteCharacterString(model.NAPTR.Flags),
+			quoteCharacterString(model.NAPTR.Service), quoteCharacterString(model.NAPTR.Regexp), absoluteName(replacement)), nil
+	case "LOC":
+		return formatLOC(resourceData), nil
+	case "DNAME":
+		return absoluteName(canonicalTarget(model.Target)), nil
+	case "SSHFP":
+		return fmt.Sprintf("%d %d %s", model.SSHFP.Algorithm, model.SSHFP.FingerprintType, strings.ToUpper(model.SSHFP.Fingerprint)), nil
+	case "TLSA":
+		return fmt.Sprintf("%d %d %d %s", model.TLSA.Usage, model.TLSA.Selector, model.TLSA.MatchingType, strings.ToUpper(model.TLSA.Certificate)), nil
+	case "SVCB", "HTTPS":
+		return formatSVCB(*model.SVCB), nil
+	case "URI":
+		return fmt.Sprintf("%d %d %s", model.URI.Priority, model.URI.Weight, quoteCharacterString(model.URI.Target)), nil
+	case "CAA":
+		return fmt.Sprintf("%d %s %s", model.CAA.Flags, model.CAA.Tag, quoteCharacterString(model.CAA.Value)), nil
+	}
+
+	return model.Address, nil
+}
+
+func formatSVCB(svcb SVCBRecord) string {
+	target := canonicalTarget(svcb.Target)
+
+	fields := []string{strconv.Itoa(int(svcb.Priority)), absoluteName(target)}
+	if len(svcb.ALPN) > 0 {
+		fields = append(fields, "alpn="+strings.Join(svcb.ALPN, ","))
+	}
+	if svcb.Port != nil {
+		fields = append(fields, fmt.Sprintf("port=%d", *svcb.Port))
+	}
+	if len(svcb.IPv4Hint) > 0 {
+		fields = append(fields, "ipv4hint="+strings.Join(svcb.IPv4Hint, ","))
+	}
+	if svcb.ECH != "" {
+		// Normalize the base64 form the same way it is encoded on the wire
+		ech, _ := base64.StdEncoding.DecodeString(svcb.ECH)
+		fields = append(fields, "ech="+base64.StdEncoding.EncodeToString(ech))
+	}
+	if len(svcb.IPv6Hint) > 0 {
+		fields = append(fields, "ipv6hint="+strings.Join(svcb.IPv6Hint, ","))
+	}
+
+	return strings.Join(fields, " ")
+}
+
+// formatLOC renders LOC rdata as in RFC 1876 section 3:
+// "d m s.sss N d m s.sss E alt size hp vp", with sizes in meters.
+func formatLOC(resourceData []byte) string {
+	coordinate := func(value uint32, positive string, negative string) string {
+		offset := int64(value) - int64(locEquator)
+		hemisphere := positive
+		if offset < 0 {
+			hemisphere = negative
+			offset = -offset
+		}
+		degrees := offset / 3600000
+		minutes := offset % 3600000 / 60000
+		seconds := float64(offset%60000) / 1000
+		return fmt.Sprintf("%d %d %.3f %s", degrees, minutes, seconds, hemisphere)
+	}
+
+	precision := func(encoded byte) string {
+		centimeters := float64(encoded>>4) * math.Pow(10, float64(encoded&0x0f))
+		return strconv.FormatFloat(centimeters/100, 'f', -1, 64) + "m"
+	}
+
+	latitude := binary.BigEndian.Uint32(resourceData[4:8])
+	longitude := binary.BigEndian.Uint32(resourceData[8:12])
+	altitude := (float64(binary.BigEndian.Uint32(resourceData[12:16])) - locAltitudeOffset) / 100
+
+	return fmt.Sprintf("%s %s %.2fm %s %s %s", coordinate(latitude, "N", "S"), coordinate(longitude, "E", "W"),
+		altitude, precision(resourceData[1]), precision(resourceData[2]), precision(resourceData[3]))
+}
+
+// exportOrigin picks the origin to export: the given name, or the only
+// configured zone, or the root to export everything.
+func exportOrigin(origin string) string {
+	if origin == "" && len(currentConfig().Zones) == 1 {
+		origin = currentConfig().Zones[0].Name
+	}
+	return canonicalTarget(origin)
+}
+
+// handleExport serves the store as a BIND zone file, for the zone given with
+// the 'origin' query parameter.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	models, err := currentConfig().store.All(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error loading entries: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/dns")
+	err = ExportZoneFile(w, models, exportOrigin(r.URL.Query().Get("origin")))
+	if err != nil {
+		logError("Error exporting zone file:", err)
+	}
+}
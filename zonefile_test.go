@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func exportConfig(t *testing.T, entries ...NameModel) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.DefaultTTL = 3600
+	cfg.Zones = []ZoneConfig{{Name: "example.com", PrimaryNS: "ns1.example.com", Mailbox: "hostmaster.example.com", Serial: 2024010101}}
+	useConfig(t, cfg, entries...)
+}
+
+func TestExportZoneFile(t *testing.T) {
+	exportConfig(t)
+
+	models := []NameModel{
+		{Name: "example.com", Type: "TXT", TXT: `say "hi"`},
+		{Name: "www.example.com", Address: "192.0.2.10", TTL: 60},
+		{Name: "www.example.com", Type: "AAAA", Address: "2001:db8::10"},
+		{Name: "old.example.com", Type: "DNAME", Target: "example.net"},
+		{Name: "example.com", Type: "CAA", CAA: &CAARecord{Tag: "issue", Value: "ca.example.net"}},
+		{Name: "box.example.com", Type: "HINFO", HINFO: &HINFORecord{CPU: "x86", OS: "Linux"}},
+		{Name: "www.example.org", Address: "192.0.2.99"},
+	}
+
+	var exported strings.Builder
+	err := ExportZoneFile(&exported, models, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `$ORIGIN example.com.
+$TTL 3600
+@	300	IN	SOA	ns1.example.com. hostmaster.example.com. 2024010101 3600 600 604800 300
+@	IN	NS	ns1.example.com.
+@	IN	TXT	"say \"hi\""
+www	60	IN	A	192.0.2.10
+www	IN	AAAA	2001:db8::10
+old	IN	DNAME	example.net.
+@	IN	CAA	0 issue "ca.example.net"
+box	IN	HINFO	"x86" "Linux"
+`
+	if exported.String() != want {
+		t.Errorf("exported\n%s\nwant\n%s", exported.String(), want)
+	}
+}
+
+func TestExportEndpoint(t *testing.T) {
+	exportConfig(t,
+		NameModel{Name: "www.example.com", Address: "192.0.2.10"},
+		NameModel{Name: "www.example.org", Address: "192.0.2.99"},
+	)
+
+	// The only configured zone is exported by default
+	w := apiRequest(t, http.MethodGet, "/export", "", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/dns" {
+		t.Fatalf("/export = %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.HasPrefix(w.Body.String(), "$ORIGIN example.com.\n") || !strings.Contains(w.Body.String(), "www\tIN\tA\t192.0.2.10\n") ||
+		strings.Contains(w.Body.String(), "192.0.2.99") {
+		t.Errorf("/export =\n%s", w.Body)
+	}
+
+	// Any origin can be asked for, only configured zones get an SOA
+	w = apiRequest(t, http.MethodGet, "/export?origin=example.org", "", "")
+	if !strings.Contains(w.Body.String(), "www\tIN\tA\t192.0.2.99\n") || strings.Contains(w.Body.String(), "SOA") {
+		t.Errorf("/export?origin=example.org =\n%s", w.Body)
+	}
+}
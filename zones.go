@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+const TypeSOA uint16 = 6 // start of a zone of authority
+
+// ZoneConfig describes a zone the server is authoritative for. The SOA fields
+// fall back to common defaults when left out.
+type ZoneConfig struct {
+	Name      string `json:"name"`
+	PrimaryNS string `json:"primaryNS"`
+	Mailbox   string `json:"mailbox"`
+	Serial    uint32 `json:"serial"`
+	Refresh   uint32 `json:"refresh"`
+	Retry     uint32 `json:"retry"`
+	Expire    uint32 `json:"expire"`
+	Minimum   uint32 `json:"minimum"`
+
+	// NameServers are the zone's NS records at the apex, defaulting to the
+	// SOA's primary nameserver
+	NameServers []string `json:"nameServers"`
+
+	// Serial is bumped whenever the zone's records change. SerialFormat
+	// "date" keeps it in the YYYYMMDDnn form; by default it just counts up.
+	SerialFormat string `json:"serialFormat"`
+
+	// DefaultTTL overrides the global default TTL for records in the zone
+	DefaultTTL uint32 `json:"defaultTTL"`
+
+	// MaxRecords caps the number of entries stored in the zone, 0 for no
+	// limit. Names in a more specific zone count against that zone only.
+	MaxRecords int `json:"maxRecords"`
+
+	// Forward sends queries for names in the zone without local data to the
+	// upstreams instead of answering NXDOMAIN
+	Forward bool `json:"forward"`
+
+	// NXDomainRedirect answers queries for names in the zone that don't
+	// exist with fixed addresses instead of NXDOMAIN, e.g. for a search
+	// page; other query types get an empty answer. Off unless an address
+	// is set.
+	NXDomainRedirect CatchAllConfig `json:"nxdomainRedirect"`
+
+	// AllowQuery lists the client networks allowed to query the zone; other
+	// clients are REFUSED. Everyone may query it when empty.
+	AllowQuery []string `json:"allowQuery"`
+
+	// AllowUpdate lists the client networks allowed to change the zone with
+	// DNS UPDATE messages, and UpdateKeys the TSIG keys whose signed updates
+	// are accepted from anywhere. Updates are refused when both are empty.
+	AllowUpdate []string `json:"allowUpdate"`
+	UpdateKeys  []string `json:"updateKeys"`
+
+	// Notify lists the secondaries (host:port) sent a NOTIFY when the
+	// zone's serial changes. AllowNotify lists the networks of primaries
+	// whose NOTIFY messages are accepted; none are when empty.
+	Notify      []string `json:"notify"`
+	AllowNotify []string `json:"allowNotify"`
+
+	// AllowTransfer lists the client networks allowed to transfer the zone
+	// with AXFR, and TransferKeys the TSIG keys whose signed transfer
+	// requests are accepted from anywhere. Transfers are refused when both
+	// are empty.
+	AllowTransfer []string `json:"allowTransfer"`
+	TransferKeys  []string `json:"transferKeys"`
+
+	allowNetworks         []*net.IPNet
+	allowUpdateNetworks   []*net.IPNet
+	allowNotifyNetworks   []*net.IPNet
+	allowTransferNetworks []*net.IPNet
+}
+
+// LoadZones parses the per-zone settings that need it, such as the query and
+// update ACLs.
+func LoadZones(zones []ZoneConfig) error {
+	for i := range zones {
+		var err error
+		zones[i].allowNetworks, err = parseNetworks(zones[i].Name, zones[i].AllowQuery)
+		if err != nil {
+			return err
+		}
+		zones[i].allowUpdateNetworks, err = parseNetworks(zones[i].Name, zones[i].AllowUpdate)
+		if err != nil {
+			return err
+		}
+		zones[i].allowNotifyNetworks, err = parseNetworks(zones[i].Name, zones[i].AllowNotify)
+		if err != nil {
+			return err
+		}
+		zones[i].allowTransferNetworks, err = parseNetworks(zones[i].Name, zones[i].AllowTransfer)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseNetworks(zoneName string, networks []string) ([]*net.IPNet, error) {
+	var parsed []*net.IPNet
+	for _, network := range networks {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("zone %q: invalid network %q", zoneName, network)
+		}
+		parsed = append(parsed, ipNet)
+	}
+	return parsed, nil
+}
+
+// findZone returns the most specific configured zone containing the name.
+func findZone(name string) *ZoneConfig {
+	return currentConfig().findZone(name)
+}
+
+// findZone returns the most specific of the config's zones holding a name.
+func (cfg *Config) findZone(name string) *ZoneConfig {
+	var bestZone *ZoneConfig
+	bestLength := -1
+
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	for i := range cfg.Zones {
+		zoneName := canonicalTarget(cfg.Zones[i].Name)
+		if zoneName == "" {
+			continue
+		}
+		if inDomain(name, zoneName) && len(zoneName) > bestLength {
+			bestZone = &cfg.Zones[i]
+			bestLength = len(zoneName)
+		}
+	}
+
+	return bestZone
+}
+
+// exactZone returns the configured zone with the given apex.
+func exactZone(zoneName string) *ZoneConfig {
+	for i := range currentConfig().Zones {
+		if canonicalTarget(currentConfig().Zones[i].Name) == zoneName {
+			return &currentConfig().Zones[i]
+		}
+	}
+	return nil
+}
+
+// TTL returns the default TTL of records in the zone. Names outside every
+// zone, a nil zone, use the global default.
+func (zone *ZoneConfig) TTL() uint32 {
+	if zone == nil || zone.DefaultTTL == 0 {
+		return currentConfig().DefaultTTL
+	}
+	return zone.DefaultTTL
+}
+
+// AllowsClient reports whether the zone's ACL lets the client query it.
+func (zone *ZoneConfig) AllowsClient(clientIP net.IP) bool {
+	if len(zone.allowNetworks) == 0 {
+		return true
+	}
+	for _, network := range zone.allowNetworks {
+		if network.Contains(clientIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsUpdate reports whether the zone accepts updates from the client,
+// keyName being the TSIG key that signed the update or "" when unsigned.
+func (zone *ZoneConfig) AllowsUpdate(clientIP net.IP, keyName string) bool {
+	if keyName != "" && slices.ContainsFunc(zone.UpdateKeys, func(name string) bool { return canonicalTarget(name) == keyName }) {
+		return true
+	}
+	for _, network := range zone.allowUpdateNetworks {
+		if network.Contains(clientIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsTransfer reports whether the zone may be transferred to the client,
+// keyName being the TSIG key that signed the request or "" when unsigned.
+func (zone *ZoneConfig) AllowsTransfer(clientIP net.IP, keyName string) bool {
+	if keyName != "" && slices.ContainsFunc(zone.TransferKeys, func(name string) bool { return canonicalTarget(name) == keyName }) {
+		return true
+	}
+	for _, network := range zone.allowTransferNetworks {
+		if network.Contains(clientIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsNotify reports whether the zone accepts NOTIFY messages from the
+// client.
+func (zone *ZoneConfig) AllowsNotify(clientIP net.IP) bool {
+	for _, network := range zone.allowNotifyNetworks {
+		if network.Contains(clientIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// SOARecord builds the zone's SOA record. Its TTL is the negative caching TTL
+// (the minimum field) so it can be used directly in negative answers.
+func (zone *ZoneConfig) SOARecord() DNSResourceRecord {
+	zoneName := canonicalTarget(zone.Name)
+	primaryNS, mailbox := zone.soaNames()
+
+	var buffer bytes.Buffer
+	writeDomainName(&buffer, primaryNS)
+	writeDomainName(&buffer, mailbox)
+	Write(&buffer, zone.CurrentSerial())
+	Write(&buffer, valueOr(zone.Refresh, 3600))
+	Write(&buffer, valueOr(zone.Retry, 600))
+	Write(&buffer, valueOr(zone.Expire, 604800))
+	Write(&buffer, valueOr(zone.Minimum, 300))
+
+	return DNSResourceRecord{
+		DomainName:         zoneName,
+		Type:               TypeSOA,
+		Class:              ClassINET,
+		TimeToLive:         valueOr(zone.Minimum, 300),
+		ResourceData:       buffer.Bytes(),
+		ResourceDataLength: uint16(buffer.Len()),
+	}
+}
+
+// NSRecords builds the zone's NS RRset for its apex.
+func (zone *ZoneConfig) NSRecords() []DNSResourceRecord {
+	nameServers := zone.NameServers
+	if len(nameServers) == 0 {
+		primaryNS, _ := zone.soaNames()
+		nameServers = []string{primaryNS}
+	}
+
+	var records []DNSResourceRecord
+	for _, nameServer := range nameServers {
+		var buffer bytes.Buffer
+		writeDomainName(&buffer, canonicalTarget(nameServer))
+		records = append(records, DNSResourceRecord{
+			DomainName:         canonicalTarget(zone.Name),
+			Type:               TypeNS,
+			Class:              ClassINET,
+			TimeToLive:         zone.TTL(),
+			ResourceData:       buffer.Bytes(),
+			ResourceDataLength: uint16(buffer.Len()),
+		})
+	}
+	return records
+}
+
+// soaNames returns the canonical primary nameserver and mailbox of the SOA,
+// defaulting to ns1 and hostmaster in the zone.
+func (zone *ZoneConfig) soaNames() (string, string) {
+	zoneName := canonicalTarget(zone.Name)
+
+	primaryNS := zone.PrimaryNS
+	if primaryNS == "" {
+		primaryNS = "ns1." + zoneName
+	}
+	mailbox := zone.Mailbox
+	if mailbox == "" {
+		mailbox = "hostmaster." + zoneName
+	}
+
+	return canonicalTarget(primaryNS), canonicalTarget(mailbox)
+}
+
+// nameExists reports whether the store holds any record at or below the name,
+// which makes an empty answer NODATA rather than NXDOMAIN. Names with records
+// only below them are empty non-terminals, which exist too.
+func nameExists(queryName string, names []Name) bool {
+	for _, name := range names {
+		if inDomain(name.Name, queryName) {
+			return true
+		}
+	}
+	return false
+}
+
+// inDomain reports whether a canonical name is the domain itself or a name
+// below it. Whole labels are compared, so "badexample.com" is not in
+// "example.com".
+func inDomain(name string, domain string) bool {
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+func valueOr(value uint32, defaultValue uint32) uint32 {
+	if value == 0 {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestZonesHaveTheirOwnSettings(t *testing.T) {
+	upstream := startUpstream(t, upstreamAddress(300))
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{
+		{Name: "example.com", DefaultTTL: 600, Minimum: 60, Mailbox: "hostmaster.example.com"},
+		{Name: "example.org", DefaultTTL: 120, Minimum: 30, Forward: true, AllowQuery: []string{"192.0.2.0/24"}},
+	}
+	loaded := useForwarding(t, cfg, upstream.address)
+	err := loaded.store.(*MemoryStore).Seed([]NameModel{
+		{Name: "www.example.com", Address: "192.0.2.10"},
+		{Name: "www.example.org", Address: "192.0.2.20"},
+		{Name: "own.example.org", Address: "192.0.2.30", TTL: 45},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]uint32{
+		"www.example.com": 600,
+		"www.example.org": 120,
+		"own.example.org": 45,
+	}
+	for name, want := range tests {
+		response := query(t, name, TypeA)
+		if len(response.Answers) != 1 || response.Answers[0].TimeToLive != want {
+			t.Errorf("%s: answers %+v, want one with TTL %d", name, response.Answers, want)
+		}
+	}
+
+	// Each zone's SOA goes with its own negative answers
+	response := query(t, "missing.example.com", TypeA)
+	if responseCode(response) != RcodeNameError || len(response.Authorities) != 1 {
+		t.Fatalf("missing.example.com: rcode %d with %d authorities, want NXDOMAIN with the SOA", responseCode(response), len(response.Authorities))
+	}
+	soa := response.Authorities[0]
+	if soa.DomainName != "example.com" || binary.BigEndian.Uint32(soa.ResourceData[len(soa.ResourceData)-4:]) != 60 {
+		t.Errorf("NXDOMAIN authority %+v, want the example.com SOA with minimum 60", soa)
+	}
+
+	// Only example.org forwards names it has no data for
+	response = query(t, "other.example.org", TypeA)
+	if answerAddress(response) != "192.0.2.40" {
+		t.Errorf("other.example.org answered %+v, want the forwarded answer", response.Answers)
+	}
+	if queries := upstream.queries.Load(); queries != 1 {
+		t.Errorf("the upstream got %d queries, want only the example.org one", queries)
+	}
+
+	// The example.org ACL leaves example.com open to everyone
+	response = serve(t, newWriter("203.0.113.5", true), buildQuery(1, FlagRecursionDesired, "www.example.org", TypeA))
+	if responseCode(response) != RcodeRefused {
+		t.Errorf("www.example.org from outside the ACL: rcode %d, want REFUSED", responseCode(response))
+	}
+	response = serve(t, newWriter("203.0.113.5", true), buildQuery(1, FlagRecursionDesired, "www.example.com", TypeA))
+	if answerAddress(response) != "192.0.2.10" {
+		t.Errorf("www.example.com from outside the example.org ACL got %+v", response.Answers)
+	}
+}
+
+func TestRootAndApexQueries(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Zones = []ZoneConfig{{Name: "example.com", PrimaryNS: "ns1.example.com"}}
+	cfg.MinimalResponses = true
+	useConfig(t, cfg, NameModel{Name: "www.example.com", Address: "192.0.2.10"}, NameModel{Name: "www.example.org", Address: "192.0.2.20"})
+
+	refused := []struct {
+		name      string
+		queryType uint16
+	}{
+		{".", TypeNS},
+		{"", TypeSOA},
+		{"com", TypeNS},
+		{"example.org", TypeNS},
+		{"example.org", TypeSOA},
+		{"example.net", TypeNS},
+	}
+	for _, test := range refused {
+		response := query(t, test.name, test.queryType)
+		if responseCode(response) != RcodeRefused || len(response.Answers) != 0 {
+			t.Errorf("%q %s: rcode %d with %d answers, want REFUSED", test.name, typeName(test.queryType), responseCode(response), len(response.Answers))
+		}
+	}
+
+	response := query(t, "example.com", TypeNS)
+	if responseCode(response) != RcodeNoError || len(response.Answers) == 0 || response.Answers[0].Type != TypeNS {
+		t.Fatalf("example.com NS: rcode %d with answers %+v, want the zone's NS records", responseCode(response), response.Answers)
+	}
+	if got := formatWireResourceData(response.Answers[0]); got != "ns1.example.com." {
+		t.Errorf("example.com NS = %s, want ns1.example.com.", got)
+	}
+
+	response = query(t, "EXAMPLE.com.", TypeSOA)
+	if responseCode(response) != RcodeNoError || len(response.Answers) != 1 || response.Answers[0].Type != TypeSOA {
+		t.Errorf("example.com SOA: rcode %d with answers %+v, want the zone's SOA", responseCode(response), response.Answers)
+	}
+
+	// Other types at the apex are authoritative NODATA with the SOA
+	response = query(t, "example.com", TypeA)
+	if responseCode(response) != RcodeNoError || response.Header.Flags&FlagAuthoritative == 0 || len(response.Answers) != 0 || len(response.Authorities) != 1 || response.Authorities[0].Type != TypeSOA {
+		t.Errorf("example.com A: rcode %d, %d answers, authorities %+v, want NODATA with the SOA", responseCode(response), len(response.Answers), response.Authorities)
+	}
+}